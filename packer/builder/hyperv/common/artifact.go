@@ -5,48 +5,256 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/convert"
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/vhdx"
 	"github.com/mitchellh/packer/packer"
 )
 
 // This is the common builder ID to all of these artifacts.
 const BuilderId = "MSOpenTech.hyperv"
 
-// Artifact is the result of running the VirtualBox builder, namely a set
-// of files associated with the resulting machine.
+// The name of the manifest describing an artifact, written into its
+// output directory.
+const ArtifactManifestName = "artifact.json"
+
+// The names of the state an artifact returns from State.
+const (
+	// The output directory, holding the exported VM in the VmDir and
+	// VhdDir directories. A string.
+	ArtifactStateDir = "dir"
+	// The name of the VM. A string.
+	ArtifactStateVMName = "vm_name"
+	// The generation of the VM. A uint.
+	ArtifactStateGeneration = "generation"
+	// The path of the configuration of the VM. A string.
+	ArtifactStateConfig = "vm_config"
+	// The paths of the hard disks of the VM. A []string.
+	ArtifactStateDisks = "disks"
+	// The sizes in bytes of the hard disks by their path. A map[string]int64.
+	ArtifactStateDiskSizes = "disk_sizes"
+	// The virtual sizes in bytes of the VHDX hard disks by their path, the
+	// sizes the VM sees. A map[string]int64.
+	ArtifactStateDiskVirtualSizes = "disk_virtual_sizes"
+	// The sizes of the hard disks before and after they were compacted by
+	// their path, when they were. A map[string]DiskCompaction.
+	ArtifactStateDiskCompaction = "disk_compaction"
+	// The formats of the hard disks converted by output_disk_formats by
+	// their path. A map[string]string.
+	ArtifactStateConvertedDisks = "converted_disks"
+	// The path of the OVF descriptor or OVA file written by output_ovf or
+	// output_ova, or an empty string. A string.
+	ArtifactStateOVF = "ovf"
+	// The SHA-256 checksums of the files by their path. A map[string]string.
+	ArtifactStateChecksums = "checksums"
+	// When the build started and finished. A time.Time.
+	ArtifactStateBuildStarted  = "build_started"
+	ArtifactStateBuildFinished = "build_finished"
+	// The path of the manifest. A string.
+	ArtifactStateManifest = "manifest"
+)
+
+// The hard disk file extensions of an exported VM.
+var diskExtensions = []string{".vhd", ".vhdx", ".avhd", ".avhdx"}
+
+// The configuration file extensions of an exported VM.
+var configExtensions = []string{".xml", ".vmcx"}
+
+// ArtifactManifest describes an artifact, for tools reading the
+// artifact.json of an output directory. The paths are relative to the
+// output directory and separated by slashes.
+type ArtifactManifest struct {
+	BuilderId      string                          `json:"builder_id"`
+	VMName         string                          `json:"vm_name"`
+	Generation     uint                            `json:"generation"`
+	Config         string                          `json:"vm_config"`
+	Disks          []ArtifactManifestDisk          `json:"disks"`
+	ConvertedDisks []ArtifactManifestConvertedDisk `json:"converted_disks,omitempty"`
+	OVF            string                          `json:"ovf,omitempty"`
+	Files          []ArtifactManifestFile          `json:"files"`
+	BuildStarted   time.Time                       `json:"build_started"`
+	BuildFinished  time.Time                       `json:"build_finished"`
+}
+
+type ArtifactManifestDisk struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// The virtual size of a VHDX disk, and the size of its allocated
+	// blocks, read from the disk.
+	VirtualSize   int64 `json:"virtual_size,omitempty"`
+	AllocatedSize int64 `json:"allocated_size,omitempty"`
+	// The sizes of the disk before and after it was compacted.
+	Compaction *DiskCompaction `json:"compaction,omitempty"`
+}
+
+// ArtifactManifestConvertedDisk is a hard disk converted to one of the
+// formats of the convert package.
+type ArtifactManifestConvertedDisk struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Size   int64  `json:"size"`
+}
+
+type ArtifactManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Artifact is the result of running the Hyper-V builder, namely a set
+// of files associated with the exported VM.
 type artifact struct {
-	dir string
-	f   []string
+	dir        string
+	files      []string
+	manifest   ArtifactManifest
+	compaction map[string]DiskCompaction
 }
 
-// NewArtifact returns a VirtualBox artifact containing the files
-// in the given directory.
-func NewArtifact(dir string) (packer.Artifact, error) {
-	files := make([]string, 0, 5)
+// NewArtifact returns a Hyper-V artifact containing the files of the VM
+// exported to the given directory, and writes the manifest describing
+// it into the directory. The compaction of the disks, keyed by file name
+// as StepCompactDisk leaves it, is nil when they were not compacted.
+func NewArtifact(dir string, vmName string, generation uint, buildStarted time.Time, compaction map[string]DiskCompaction) (packer.Artifact, error) {
+	a := &artifact{
+		dir:        dir,
+		compaction: compaction,
+		manifest: ArtifactManifest{
+			BuilderId:     BuilderId,
+			VMName:        vmName,
+			Generation:    generation,
+			BuildStarted:  buildStarted,
+			BuildFinished: time.Now(),
+		},
+	}
 
-	// we need to store output dir path to get rel path to keep dir tree :)
-	// to not modify interface - put it as the first array element
-	files = append(files, dir)
+	manifestPath := filepath.Join(dir, ArtifactManifestName)
 
 	visit := func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			files = append(files, path)
+		if err != nil {
+			return err
 		}
 
-		return err
+		if info.IsDir() || path == manifestPath {
+			return nil
+		}
+
+		return a.addFile(path, info)
 	}
 
 	if err := filepath.Walk(dir, visit); err != nil {
 		return nil, err
 	}
 
-	return &artifact { 
-		dir: dir, 
-		f: files,
-	}, nil
+	if err := a.writeManifest(manifestPath); err != nil {
+		return nil, err
+	}
+
+	a.files = append(a.files, manifestPath)
+
+	return a, nil
+}
+
+func (a *artifact) addFile(path string, info os.FileInfo) error {
+	rel, err := filepath.Rel(a.dir, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	a.files = append(a.files, path)
+	a.manifest.Files = append(a.manifest.Files, ArtifactManifestFile{
+		Path:   rel,
+		Size:   info.Size(),
+		SHA256: checksum,
+	})
+
+	parent := filepath.Base(filepath.Dir(path))
+	ext := strings.ToLower(filepath.Ext(path))
+
+	switch {
+	case parent == VhdDir && hasExtension(diskExtensions, ext):
+		disk := ArtifactManifestDisk{
+			Path: rel,
+			Size: info.Size(),
+		}
+
+		if ext == ".vhdx" || ext == ".avhdx" {
+			if d, err := vhdx.Open(path); err == nil {
+				disk.VirtualSize = d.Size()
+				disk.AllocatedSize = d.AllocatedSize()
+				d.Close()
+			} else {
+				log.Printf("Error reading disk %s: %s", path, err)
+			}
+		}
+
+		if compaction, ok := a.compaction[filepath.Base(path)]; ok {
+			disk.Compaction = &compaction
+		}
+
+		a.manifest.Disks = append(a.manifest.Disks, disk)
+	case parent == ConvertedDiskDir && convert.FormatOf(path) != "":
+		a.manifest.ConvertedDisks = append(a.manifest.ConvertedDisks, ArtifactManifestConvertedDisk{
+			Path:   rel,
+			Format: convert.FormatOf(path),
+			Size:   info.Size(),
+		})
+	case parent == OvfDir && (ext == ".ovf" || ext == ".ova"):
+		a.manifest.OVF = rel
+	case parent == VmDir && hasExtension(configExtensions, ext) && a.manifest.Config == "":
+		a.manifest.Config = rel
+	}
+
+	return nil
+}
+
+func (a *artifact) writeManifest(path string) error {
+	contents, err := json.MarshalIndent(&a.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+func hasExtension(extensions []string, ext string) bool {
+	for _, extension := range extensions {
+		if extension == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func (*artifact) BuilderId() string {
@@ -54,21 +262,91 @@ func (*artifact) BuilderId() string {
 }
 
 func (a *artifact) Files() []string {
-	return a.f
+	return a.files
 }
 
-func (*artifact) Id() string {
-	return "VM"
+func (a *artifact) Id() string {
+	return a.manifest.VMName
 }
 
 func (a *artifact) String() string {
-	return fmt.Sprintf("VM files in directory: %s", a.dir)
+	return fmt.Sprintf("VM %s exported to directory: %s", a.manifest.VMName, a.dir)
 }
 
 func (a *artifact) State(name string) interface{} {
+	switch name {
+	case ArtifactStateDir:
+		return a.dir
+	case ArtifactStateVMName:
+		return a.manifest.VMName
+	case ArtifactStateGeneration:
+		return a.manifest.Generation
+	case ArtifactStateConfig:
+		if a.manifest.Config == "" {
+			return ""
+		}
+		return a.path(a.manifest.Config)
+	case ArtifactStateDisks:
+		disks := make([]string, 0, len(a.manifest.Disks))
+		for _, disk := range a.manifest.Disks {
+			disks = append(disks, a.path(disk.Path))
+		}
+		return disks
+	case ArtifactStateDiskSizes:
+		sizes := make(map[string]int64)
+		for _, disk := range a.manifest.Disks {
+			sizes[a.path(disk.Path)] = disk.Size
+		}
+		return sizes
+	case ArtifactStateDiskVirtualSizes:
+		sizes := make(map[string]int64)
+		for _, disk := range a.manifest.Disks {
+			if disk.VirtualSize > 0 {
+				sizes[a.path(disk.Path)] = disk.VirtualSize
+			}
+		}
+		return sizes
+	case ArtifactStateDiskCompaction:
+		compaction := make(map[string]DiskCompaction)
+		for _, disk := range a.manifest.Disks {
+			if disk.Compaction != nil {
+				compaction[a.path(disk.Path)] = *disk.Compaction
+			}
+		}
+		return compaction
+	case ArtifactStateConvertedDisks:
+		formats := make(map[string]string)
+		for _, disk := range a.manifest.ConvertedDisks {
+			formats[a.path(disk.Path)] = disk.Format
+		}
+		return formats
+	case ArtifactStateOVF:
+		if a.manifest.OVF == "" {
+			return ""
+		}
+		return a.path(a.manifest.OVF)
+	case ArtifactStateChecksums:
+		checksums := make(map[string]string)
+		for _, file := range a.manifest.Files {
+			checksums[a.path(file.Path)] = file.SHA256
+		}
+		return checksums
+	case ArtifactStateBuildStarted:
+		return a.manifest.BuildStarted
+	case ArtifactStateBuildFinished:
+		return a.manifest.BuildFinished
+	case ArtifactStateManifest:
+		return filepath.Join(a.dir, ArtifactManifestName)
+	}
+
 	return nil
 }
 
+// path returns the path of a file named in the manifest.
+func (a *artifact) path(rel string) string {
+	return filepath.Join(a.dir, filepath.FromSlash(rel))
+}
+
 func (a *artifact) Destroy() error {
 	return os.RemoveAll(a.dir)
 }
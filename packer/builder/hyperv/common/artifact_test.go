@@ -0,0 +1,283 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/vhdx"
+	"github.com/mitchellh/packer/packer"
+)
+
+func TestArtifact_impl(t *testing.T) {
+	var _ packer.Artifact = new(artifact)
+}
+
+// testExportedVM creates an output directory as StepExportVm leaves it.
+func testExportedVM(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := map[string]string{
+		filepath.Join(VmDir, "vm.xml"):   "<configuration/>",
+		filepath.Join(VhdDir, "vm.vhdx"): "vhdx",
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	return dir
+}
+
+func TestNewArtifact(t *testing.T) {
+	dir := testExportedVM(t)
+	defer os.RemoveAll(dir)
+
+	started := time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+	compaction := map[string]DiskCompaction{"vm.vhdx": {SizeBefore: 8, SizeAfter: 4}}
+	a, err := NewArtifact(dir, "packer-test", 2, started, compaction)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if a.BuilderId() != BuilderId || a.Id() != "packer-test" {
+		t.Fatalf("bad: %s %s", a.BuilderId(), a.Id())
+	}
+
+	config := filepath.Join(dir, VmDir, "vm.xml")
+	disk := filepath.Join(dir, VhdDir, "vm.vhdx")
+	manifest := filepath.Join(dir, ArtifactManifestName)
+
+	if files := a.Files(); !reflect.DeepEqual(files, []string{disk, config, manifest}) {
+		t.Fatalf("bad files: %#v", files)
+	}
+
+	state := map[string]interface{}{
+		ArtifactStateDir:        dir,
+		ArtifactStateVMName:     "packer-test",
+		ArtifactStateGeneration: uint(2),
+		ArtifactStateConfig:     config,
+		ArtifactStateDisks:      []string{disk},
+		ArtifactStateDiskSizes:  map[string]int64{disk: 4},
+		ArtifactStateDiskCompaction: map[string]DiskCompaction{
+			disk: {SizeBefore: 8, SizeAfter: 4},
+		},
+		ArtifactStateBuildStarted: started,
+		ArtifactStateManifest:     manifest,
+		ArtifactStateChecksums: map[string]string{
+			// the SHA-256 checksums of "<configuration/>" and "vhdx"
+			config: "d8dd707326ed7b20067da559fc086da3b86ae9730c3b4ffb56c245c17eb5aeaa",
+			disk:   "9e913e127bce25e42f8ab2877eb8a480a34877b5bae008261c6e4ba59f9a7e00",
+		},
+	}
+
+	for name, expected := range state {
+		if actual := a.State(name); !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("bad %s: %#v", name, actual)
+		}
+	}
+
+	finished := a.State(ArtifactStateBuildFinished).(time.Time)
+	if finished.Before(started) {
+		t.Fatalf("bad build_finished: %s", finished)
+	}
+
+	if a.State("unknown") != nil {
+		t.Fatal("unknown state should be nil")
+	}
+}
+
+func TestNewArtifact_manifest(t *testing.T) {
+	dir := testExportedVM(t)
+	defer os.RemoveAll(dir)
+
+	started := time.Date(2014, 7, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := NewArtifact(dir, "packer-test", 1, started, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// making the artifact again leaves the manifest out of itself
+	if _, err := NewArtifact(dir, "packer-test", 1, started, nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, ArtifactManifestName))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var manifest ArtifactManifest
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if manifest.BuilderId != BuilderId || manifest.VMName != "packer-test" || manifest.Generation != 1 {
+		t.Fatalf("bad: %#v", manifest)
+	}
+
+	if manifest.Config != "Virtual Machines/vm.xml" {
+		t.Fatalf("bad vm_config: %s", manifest.Config)
+	}
+
+	if !reflect.DeepEqual(manifest.Disks, []ArtifactManifestDisk{{Path: "Virtual Hard Disks/vm.vhdx", Size: 4}}) {
+		t.Fatalf("bad disks: %#v", manifest.Disks)
+	}
+
+	if len(manifest.Files) != 2 || manifest.Files[1].Path != "Virtual Machines/vm.xml" || manifest.Files[1].Size != 16 {
+		t.Fatalf("bad files: %#v", manifest.Files)
+	}
+
+	if !manifest.BuildStarted.Equal(started) || manifest.BuildFinished.Before(started) {
+		t.Fatalf("bad build times: %s %s", manifest.BuildStarted, manifest.BuildFinished)
+	}
+}
+
+func TestNewArtifact_vhdx(t *testing.T) {
+	dir := testExportedVM(t)
+	defer os.RemoveAll(dir)
+
+	disk := filepath.Join(dir, VhdDir, "data.vhdx")
+	d, err := vhdx.Create(disk, vhdx.CreateOptions{VirtualSize: 64 * vhdx.MB, BlockSize: vhdx.MB})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := d.WriteAt([]byte("data"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	d.Close()
+
+	a, err := NewArtifact(dir, "packer-test", 1, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// the virtual size is only known for the disk that is a VHDX file
+	sizes := a.State(ArtifactStateDiskVirtualSizes).(map[string]int64)
+	if !reflect.DeepEqual(sizes, map[string]int64{disk: 64 * vhdx.MB}) {
+		t.Fatalf("bad disk_virtual_sizes: %#v", sizes)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, ArtifactManifestName))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var manifest ArtifactManifest
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := ArtifactManifestDisk{Path: "Virtual Hard Disks/data.vhdx", Size: 5 * vhdx.MB, VirtualSize: 64 * vhdx.MB, AllocatedSize: vhdx.MB}
+	if len(manifest.Disks) != 2 || manifest.Disks[0] != expected {
+		t.Fatalf("bad disks: %#v", manifest.Disks)
+	}
+}
+
+func TestNewArtifact_convertedDisks(t *testing.T) {
+	dir := testExportedVM(t)
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, ConvertedDiskDir), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	vmdk := filepath.Join(dir, ConvertedDiskDir, "vm.vmdk")
+	fixed := filepath.Join(dir, ConvertedDiskDir, "vm-fixed.vhd")
+	for _, path := range []string{vmdk, fixed} {
+		if err := ioutil.WriteFile(path, []byte("disk"), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	a, err := NewArtifact(dir, "packer-test", 1, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	formats := a.State(ArtifactStateConvertedDisks).(map[string]string)
+	if !reflect.DeepEqual(formats, map[string]string{vmdk: "vmdk", fixed: "vhd-fixed"}) {
+		t.Fatalf("bad converted_disks: %#v", formats)
+	}
+
+	// the converted disks are not disks of the VM
+	if disks := a.State(ArtifactStateDisks).([]string); len(disks) != 1 {
+		t.Fatalf("bad disks: %#v", disks)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, ArtifactManifestName))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var manifest ArtifactManifest
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []ArtifactManifestConvertedDisk{
+		{Path: "Converted Disks/vm-fixed.vhd", Format: "vhd-fixed", Size: 4},
+		{Path: "Converted Disks/vm.vmdk", Format: "vmdk", Size: 4},
+	}
+	if !reflect.DeepEqual(manifest.ConvertedDisks, expected) {
+		t.Fatalf("bad converted disks: %#v", manifest.ConvertedDisks)
+	}
+}
+
+func TestNewArtifact_ova(t *testing.T) {
+	dir := testExportedVM(t)
+	defer os.RemoveAll(dir)
+
+	a, err := NewArtifact(dir, "packer-test", 1, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if path := a.State(ArtifactStateOVF); path != "" {
+		t.Fatalf("bad ovf: %#v", path)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, OvfDir), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	ova := filepath.Join(dir, OvfDir, "packer-test.ova")
+	if err := ioutil.WriteFile(ova, []byte("ova"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	a, err = NewArtifact(dir, "packer-test", 1, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if path := a.State(ArtifactStateOVF); path != ova {
+		t.Fatalf("bad ovf: %#v", path)
+	}
+}
+
+func TestArtifactDestroy(t *testing.T) {
+	dir := testExportedVM(t)
+	defer os.RemoveAll(dir)
+
+	a, err := NewArtifact(dir, "packer-test", 1, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := a.Destroy(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatal("should remove the output directory")
+	}
+}
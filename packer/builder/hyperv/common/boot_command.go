@@ -0,0 +1,212 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The scancodes typed are those of scancode set 1, which the keyboard of
+// a VM takes. A key sends its make code when pressed and its break code,
+// the make code with the high bit set, when released. The extended keys
+// prefix both with 0xe0.
+const (
+	scancodeExtended  = 0xe0
+	scancodeBreak     = 0x80
+	scancodeLeftShift = 0x2a
+)
+
+// The make codes of the keys of boot_command, by lower case name.
+var specialKeys = map[string][]byte{
+	"bs":         {0x0e},
+	"del":        {scancodeExtended, 0x53},
+	"enter":      {0x1c},
+	"return":     {0x1c},
+	"esc":        {0x01},
+	"tab":        {0x0f},
+	"spacebar":   {0x39},
+	"insert":     {scancodeExtended, 0x52},
+	"home":       {scancodeExtended, 0x47},
+	"end":        {scancodeExtended, 0x4f},
+	"pageup":     {scancodeExtended, 0x49},
+	"pagedown":   {scancodeExtended, 0x51},
+	"up":         {scancodeExtended, 0x48},
+	"down":       {scancodeExtended, 0x50},
+	"left":       {scancodeExtended, 0x4b},
+	"right":      {scancodeExtended, 0x4d},
+	"leftalt":    {0x38},
+	"leftctrl":   {0x1d},
+	"leftshift":  {scancodeLeftShift},
+	"leftsuper":  {scancodeExtended, 0x5b},
+	"rightalt":   {scancodeExtended, 0x38},
+	"rightctrl":  {scancodeExtended, 0x1d},
+	"rightshift": {0x36},
+	"rightsuper": {scancodeExtended, 0x5c},
+	"f1":         {0x3b},
+	"f2":         {0x3c},
+	"f3":         {0x3d},
+	"f4":         {0x3e},
+	"f5":         {0x3f},
+	"f6":         {0x40},
+	"f7":         {0x41},
+	"f8":         {0x42},
+	"f9":         {0x43},
+	"f10":        {0x44},
+	"f11":        {0x57},
+	"f12":        {0x58},
+}
+
+// A characterKey is the key typing a character of a US keyboard layout,
+// and whether shift is held for it.
+type characterKey struct {
+	scancode byte
+	shift    bool
+}
+
+var characterKeys = make(map[rune]characterKey)
+
+func init() {
+	// the rows of the keyboard, whose keys have consecutive make codes
+	rows := []struct {
+		first     byte
+		unshifted string
+		shifted   string
+	}{
+		{0x02, "1234567890-=", "!@#$%^&*()_+"},
+		{0x10, "qwertyuiop[]", "QWERTYUIOP{}"},
+		{0x1e, "asdfghjkl;'`", "ASDFGHJKL:\"~"},
+		{0x2b, "\\zxcvbnm,./", "|ZXCVBNM<>?"},
+	}
+
+	for _, row := range rows {
+		for i, c := range row.unshifted {
+			characterKeys[c] = characterKey{scancode: row.first + byte(i)}
+		}
+		for i, c := range row.shifted {
+			characterKeys[c] = characterKey{scancode: row.first + byte(i), shift: true}
+		}
+	}
+
+	characterKeys[' '] = characterKey{scancode: 0x39}
+	characterKeys['\t'] = characterKey{scancode: 0x0f}
+	characterKeys['\n'] = characterKey{scancode: 0x1c}
+}
+
+// A BootCommandAction is either scancodes typed on the keyboard of the VM
+// or a pause.
+type BootCommandAction struct {
+	Scancodes []byte
+	Wait      time.Duration
+}
+
+// ParseBootCommand parses an entry of boot_command into the scancodes
+// typing it, split by its pauses. Besides characters, the entry holds
+// special keys such as <enter> or <f6>, which are pressed and released, or
+// held down by <leftCtrlOn> and released by <leftCtrlOff>, and pauses of a
+// second, <wait>, or of a number of seconds or a duration, such as <wait5>
+// or <wait1m30s>. A < not starting any of these is typed as it is.
+func ParseBootCommand(command string) ([]BootCommandAction, error) {
+	var actions []BootCommandAction
+	var scancodes []byte
+
+	for i := 0; i < len(command); {
+		if command[i] == '<' {
+			if end := strings.IndexByte(command[i:], '>'); end > 0 {
+				name := strings.ToLower(command[i+1 : i+end])
+
+				if wait, ok, err := parseWait(name); ok {
+					if err != nil {
+						return nil, fmt.Errorf("<%s>: %s", command[i+1:i+end], err)
+					}
+					if len(scancodes) > 0 {
+						actions = append(actions, BootCommandAction{Scancodes: scancodes})
+						scancodes = nil
+					}
+					actions = append(actions, BootCommandAction{Wait: wait})
+					i += end + 1
+					continue
+				}
+
+				if codes, ok := specialKeyScancodes(name); ok {
+					scancodes = append(scancodes, codes...)
+					i += end + 1
+					continue
+				}
+			}
+		}
+
+		// the characters are bytes of ASCII, which is all a key types
+		c := rune(command[i])
+		key, ok := characterKeys[c]
+		if !ok {
+			return nil, fmt.Errorf("The character %q at %d cannot be typed, only ASCII characters can.", c, i)
+		}
+
+		if key.shift {
+			scancodes = append(scancodes, scancodeLeftShift)
+		}
+		scancodes = append(scancodes, key.scancode, key.scancode|scancodeBreak)
+		if key.shift {
+			scancodes = append(scancodes, scancodeLeftShift|scancodeBreak)
+		}
+		i++
+	}
+
+	if len(scancodes) > 0 {
+		actions = append(actions, BootCommandAction{Scancodes: scancodes})
+	}
+	return actions, nil
+}
+
+// parseWait returns the pause of a wait key, and whether the key is one.
+func parseWait(name string) (time.Duration, bool, error) {
+	if !strings.HasPrefix(name, "wait") {
+		return 0, false, nil
+	}
+
+	s := strings.TrimPrefix(name, "wait")
+	if s == "" {
+		return time.Second, true, nil
+	}
+
+	if seconds, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true, nil
+	}
+
+	wait, err := time.ParseDuration(s)
+	if err != nil {
+		// such as <waiting>, which is typed
+		if s[0] < '0' || s[0] > '9' {
+			return 0, false, nil
+		}
+		return 0, true, err
+	}
+	return wait, true, nil
+}
+
+// specialKeyScancodes returns the scancodes of a special key pressed and
+// released, or only pressed or released with the On and Off suffixes.
+func specialKeyScancodes(name string) ([]byte, bool) {
+	if codes, ok := specialKeys[name]; ok {
+		return append(append([]byte(nil), codes...), breakCode(codes)...), true
+	}
+	if codes, ok := specialKeys[strings.TrimSuffix(name, "on")]; ok && strings.HasSuffix(name, "on") {
+		return append([]byte(nil), codes...), true
+	}
+	if codes, ok := specialKeys[strings.TrimSuffix(name, "off")]; ok && strings.HasSuffix(name, "off") {
+		return breakCode(codes), true
+	}
+	return nil, false
+}
+
+// breakCode returns the break code of the make code of a key.
+func breakCode(makeCode []byte) []byte {
+	codes := append([]byte(nil), makeCode...)
+	codes[len(codes)-1] |= scancodeBreak
+	return codes
+}
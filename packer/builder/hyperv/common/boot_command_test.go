@@ -0,0 +1,74 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBootCommand(t *testing.T) {
+	cases := []struct {
+		command string
+		actions []BootCommandAction
+	}{
+		{"", nil},
+		{"a1", []BootCommandAction{
+			{Scancodes: []byte{0x1e, 0x9e, 0x02, 0x82}},
+		}},
+		// shifted characters are typed holding left shift
+		{"A:", []BootCommandAction{
+			{Scancodes: []byte{0x2a, 0x1e, 0x9e, 0xaa, 0x2a, 0x27, 0xa7, 0xaa}},
+		}},
+		{"<enter><f6><esc>", []BootCommandAction{
+			{Scancodes: []byte{0x1c, 0x9c, 0x40, 0xc0, 0x01, 0x81}},
+		}},
+		{"<Up><del>", []BootCommandAction{
+			{Scancodes: []byte{0xe0, 0x48, 0xe0, 0xc8, 0xe0, 0x53, 0xe0, 0xd3}},
+		}},
+		{"<leftCtrlOn>c<leftCtrlOff>", []BootCommandAction{
+			{Scancodes: []byte{0x1d, 0x2e, 0xae, 0x9d}},
+		}},
+		{"<rightAltOn><rightAltOff>", []BootCommandAction{
+			{Scancodes: []byte{0xe0, 0x38, 0xe0, 0xb8}},
+		}},
+		{"a<wait>b<wait5><wait1m30s>", []BootCommandAction{
+			{Scancodes: []byte{0x1e, 0x9e}},
+			{Wait: time.Second},
+			{Scancodes: []byte{0x30, 0xb0}},
+			{Wait: 5 * time.Second},
+			{Wait: 90 * time.Second},
+		}},
+		// a < starting no key is typed
+		{"<a", []BootCommandAction{
+			{Scancodes: []byte{0x2a, 0x33, 0xb3, 0xaa, 0x1e, 0x9e}},
+		}},
+		{"<waiting>", []BootCommandAction{
+			{Scancodes: []byte{
+				0x2a, 0x33, 0xb3, 0xaa,
+				0x11, 0x91, 0x1e, 0x9e, 0x17, 0x97, 0x14, 0x94, 0x17, 0x97, 0x31, 0xb1, 0x22, 0xa2,
+				0x2a, 0x34, 0xb4, 0xaa,
+			}},
+		}},
+		{" \n", []BootCommandAction{
+			{Scancodes: []byte{0x39, 0xb9, 0x1c, 0x9c}},
+		}},
+	}
+
+	for _, tc := range cases {
+		actions, err := ParseBootCommand(tc.command)
+		if err != nil {
+			t.Fatalf("%q: err: %s", tc.command, err)
+		}
+		if !reflect.DeepEqual(actions, tc.actions) {
+			t.Fatalf("%q: bad actions: %#v", tc.command, actions)
+		}
+	}
+}
+
+func TestParseBootCommand_bad(t *testing.T) {
+	for _, command := range []string{"é", "<wait5x>"} {
+		if _, err := ParseBootCommand(command); err == nil {
+			t.Fatalf("%q: should have error", command)
+		}
+	}
+}
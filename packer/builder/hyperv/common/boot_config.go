@@ -0,0 +1,57 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// The time waited for the VM to boot before typing the boot_command when
+// none is set.
+const DefaultBootWait = "10s"
+
+type BootConfig struct {
+	// The keys typed on the keyboard of the VM once it boots, such as the
+	// kernel options of a Linux installer. They are templates of the HTTP
+	// server, {{ .HTTPIP }} and {{ .HTTPPort }}, and of the VM, {{ .Name }}.
+	BootCommand []string `mapstructure:"boot_command"`
+	// The time waited for the VM to boot before typing the boot_command.
+	RawBootWait string `mapstructure:"boot_wait"`
+
+	BootWait time.Duration
+}
+
+func (c *BootConfig) Prepare(t *packer.ConfigTemplate) []error {
+	errs := make([]error, 0)
+
+	if c.RawBootWait == "" {
+		c.RawBootWait = DefaultBootWait
+	}
+
+	var err error
+	c.RawBootWait, err = t.Process(c.RawBootWait, nil)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Error processing boot_wait: %s", err))
+	}
+
+	c.BootWait, err = time.ParseDuration(c.RawBootWait)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing boot_wait: %s", err))
+	}
+
+	// the boot_command is processed once the VM runs
+	for i, command := range c.BootCommand {
+		if err := t.Validate(command); err != nil {
+			errs = append(errs, fmt.Errorf("Error processing boot_command[%d]: %s", i, err))
+		} else if _, err := ParseBootCommand(command); err != nil {
+			errs = append(errs, fmt.Errorf("boot_command[%d]: %s", i, err))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBootConfigPrepare(t *testing.T) {
+	c := new(BootConfig)
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	if c.BootWait != 10*time.Second {
+		t.Fatalf("bad boot_wait: %s", c.BootWait)
+	}
+
+	c = &BootConfig{
+		BootCommand: []string{"<esc><wait>linux ks=http://{{ .HTTPIP }}:{{ .HTTPPort }}/ks.cfg<enter>"},
+		RawBootWait: "1m",
+	}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	if c.BootWait != time.Minute {
+		t.Fatalf("bad boot_wait: %s", c.BootWait)
+	}
+}
+
+func TestBootConfigPrepare_bad(t *testing.T) {
+	c := &BootConfig{RawBootWait: "soon"}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	c = &BootConfig{BootCommand: []string{"{{ .HTTPIP", "é"}}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) != 2 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+// The free memory of the host, in megabytes, below which creating the VM
+// may fail.
+const LowRam = 512
+
+// BuilderConfig is the configuration the builders share, everything but
+// what the VM is built from.
+type BuilderConfig struct {
+	common.PackerConfig `mapstructure:",squash"`
+	OutputConfig        `mapstructure:",squash"`
+	SSHConfig           `mapstructure:",squash"`
+	WinRMConfig         `mapstructure:",squash"`
+	ShutdownConfig      `mapstructure:",squash"`
+	CompactionConfig    `mapstructure:",squash"`
+	HardwareConfig      `mapstructure:",squash"`
+	GuestOSConfig       `mapstructure:",squash"`
+	NetworkConfig       `mapstructure:",squash"`
+	HTTPConfig          `mapstructure:",squash"`
+	BootConfig          `mapstructure:",squash"`
+
+	// This is the name of the new virtual machine.
+	// By default this is "pvm_" followed by a UUID.
+	VMName string `mapstructure:"vm_name"`
+
+	// The communicator of the build, "ssh" or "winrm". By default, this
+	// is "ssh".
+	Communicator string `mapstructure:"communicator"`
+}
+
+// Prepare prepares the settings that do not depend on the VM the build
+// starts from.
+func (c *BuilderConfig) Prepare(t *packer.ConfigTemplate) []error {
+	errs := make([]error, 0)
+	errs = append(errs, c.OutputConfig.Prepare(t, &c.PackerConfig)...)
+	errs = append(errs, c.ShutdownConfig.Prepare(t)...)
+	errs = append(errs, c.CompactionConfig.Prepare(t)...)
+	errs = append(errs, c.GuestOSConfig.Prepare(t)...)
+	errs = append(errs, c.HTTPConfig.Prepare(t)...)
+	errs = append(errs, c.BootConfig.Prepare(t)...)
+
+	if c.Communicator == "" {
+		c.Communicator = "ssh"
+	}
+
+	switch c.Communicator {
+	case "ssh":
+		errs = append(errs, c.SSHConfig.Prepare(t)...)
+	case "winrm":
+		errs = append(errs, c.WinRMConfig.Prepare(t)...)
+	default:
+		errs = append(errs, errors.New("communicator must be either ssh or winrm"))
+	}
+
+	var err error
+	c.VMName, err = t.Process(c.VMName, nil)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Error processing vm_name: %s", err))
+	}
+
+	if c.VMName == "" {
+		c.VMName = fmt.Sprintf("pvm_%s", uuid.New())
+	}
+
+	return errs
+}
+
+// PrepareVM prepares the hardware and the network of a VM with the memory
+// and generation given, either of which is 0 when the VM keeps its own.
+// When the build runs on a Hyper-V host, driver is not nil and they are
+// checked against the host.
+func (c *BuilderConfig) PrepareVM(t *packer.ConfigTemplate, driver Driver, ramSizeMB uint, generation uint) ([]string, []error) {
+	warnings := make([]string, 0)
+	errs := make([]error, 0)
+
+	if ramSizeMB != 0 {
+		log.Println(fmt.Sprintf("%s: %v", "RamSize", ramSizeMB))
+
+		ramWarnings, ramErrs := c.GuestOSConfig.CheckRamSize(ramSizeMB)
+		warnings = append(warnings, ramWarnings...)
+		errs = append(errs, ramErrs...)
+	}
+
+	errs = append(errs, c.HardwareConfig.Prepare(ramSizeMB)...)
+
+	if c.SwitchName == "" && c.NewSwitch() {
+		// a switch of the type given is created for the build
+		c.SwitchName = fmt.Sprintf("pis_%s", uuid.New())
+	} else if c.SwitchName == "" {
+		// no switch name, try to get one attached to a online network adapter
+		var onlineSwitchName string
+		if driver != nil {
+			onlineSwitchName, _ = driver.GetExternalOnlineVirtualSwitch()
+		}
+		if onlineSwitchName == "" {
+			c.SwitchName = fmt.Sprintf("pis_%s", uuid.New())
+		} else {
+			c.SwitchName = onlineSwitchName
+		}
+	}
+
+	errs = append(errs, c.NetworkConfig.Prepare(t)...)
+
+	if driver != nil {
+		if ramSizeMB != 0 {
+			hostWarnings, hostErrs := CheckHostRamSize(driver, ramSizeMB, generation)
+			warnings = append(warnings, hostWarnings...)
+			errs = append(errs, hostErrs...)
+		}
+		errs = append(errs, c.CheckHostNetAdapter(driver)...)
+
+		availableMemory, err := driver.GetHostAvailableMemory()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error getting the free memory of the host: %s", err))
+		} else if availableMemory-float64(ramSizeMB) < LowRam {
+			warnings = append(warnings, "Hyper-V might fail to create a VM if there is not enough free memory in the system.")
+		}
+	}
+
+	log.Println(fmt.Sprintf("%s: %v", "VMName", c.VMName))
+	log.Println(fmt.Sprintf("%s: %v", "SwitchName", c.SwitchName))
+	log.Println(fmt.Sprintf("%s: %v", "Communicator", c.Communicator))
+
+	if c.ShutdownCommand == "" {
+		warnings = append(warnings,
+			"A shutdown_command was not specified. Without a shutdown command, Packer\n"+
+				"will forcibly halt the virtual machine, which may result in data loss.")
+	}
+
+	return warnings, errs
+}
+
+// HostDriver returns the driver of the Hyper-V host the build runs on,
+// or nil when it does not run on one.
+func HostDriver() Driver {
+	driver, err := NewHypervPS4Driver()
+	if err != nil {
+		log.Println(fmt.Sprintf("Not checking the host: %s", err))
+		return nil
+	}
+
+	return driver
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testBuilderConfig(t *testing.T) *BuilderConfig {
+	c := &BuilderConfig{}
+	c.SSHUser = "foo"
+	c.ShutdownCommand = "foo"
+	c.SwitchName = "switch"
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	return c
+}
+
+func hasLowMemoryWarning(warnings []string) bool {
+	for _, warning := range warnings {
+		if strings.Contains(warning, "not enough free memory") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBuilderConfigPrepareVM_availableMemory(t *testing.T) {
+	c := testBuilderConfig(t)
+	driver := NewFakeDriver()
+	driver.HostAvailableMemory = 4096
+
+	warnings, errs := c.PrepareVM(testConfigTemplate(t), driver, 1024, 1)
+	if len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if hasLowMemoryWarning(warnings) {
+		t.Fatalf("should not warn: %#v", warnings)
+	}
+	if !driver.Called("GetHostAvailableMemory") {
+		t.Fatal("should get the free memory of the host")
+	}
+
+	// less than LowRam would be left once the VM starts
+	driver.HostAvailableMemory = 1024 + LowRam - 1
+	warnings, errs = c.PrepareVM(testConfigTemplate(t), driver, 1024, 1)
+	if len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if !hasLowMemoryWarning(warnings) {
+		t.Fatalf("should warn: %#v", warnings)
+	}
+}
+
+func TestBuilderConfigPrepareVM_availableMemoryError(t *testing.T) {
+	c := testBuilderConfig(t)
+	driver := NewFakeDriver()
+	driver.FailOn("GetHostAvailableMemory", errors.New("Get-WmiObject : Access denied"))
+
+	warnings, errs := c.PrepareVM(testConfigTemplate(t), driver, 1024, 1)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Access denied") {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if hasLowMemoryWarning(warnings) {
+		t.Fatalf("should not warn: %#v", warnings)
+	}
+}
+
+func TestBuilderConfigPrepareVM_noHost(t *testing.T) {
+	c := testBuilderConfig(t)
+
+	warnings, errs := c.PrepareVM(testConfigTemplate(t), nil, 1024, 1)
+	if len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if hasLowMemoryWarning(warnings) {
+		t.Fatalf("should not warn: %#v", warnings)
+	}
+}
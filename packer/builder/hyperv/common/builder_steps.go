@@ -0,0 +1,180 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"errors"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+// CreateSwitchStep returns the step creating the switch of the first
+// network adapter, unless it exists.
+func (c *BuilderConfig) CreateSwitchStep() multistep.Step {
+	adapter := c.NetworkAdapters[0]
+	netAdapterName, netAdapterDescription := c.SwitchNetAdapter(adapter.SwitchName)
+
+	return &StepCreateSwitch{
+		SwitchName:                     adapter.SwitchName,
+		SwitchType:                     adapter.SwitchType,
+		NetAdapterName:                 netAdapterName,
+		NetAdapterInterfaceDescription: netAdapterDescription,
+	}
+}
+
+// ConfigureVMSteps returns the steps configuring the network and the
+// hardware of the VM once it is created. The adapters are added first, as
+// MAC address spoofing is turned on for the adapters the VM has.
+func (c *BuilderConfig) ConfigureVMSteps() []multistep.Step {
+	return []multistep.Step{
+		&StepConfigureNetworkAdapters{
+			NetworkAdapters:                c.NetworkAdapters,
+			SwitchName:                     c.SwitchName,
+			NetAdapterName:                 c.SwitchNetAdapterName,
+			NetAdapterInterfaceDescription: c.SwitchNetAdapterDescription,
+		},
+		&StepConfigureHardware{
+			CPUs:                           c.CPUs,
+			EnableDynamicMemory:            c.EnableDynamicMemory,
+			DynamicMemoryMinMB:             c.DynamicMemoryMinMB,
+			DynamicMemoryMaxMB:             c.DynamicMemoryMaxMB,
+			DynamicMemoryBuffer:            c.DynamicMemoryBuffer,
+			EnableVirtualizationExtensions: c.EnableVirtualizationExtensions,
+			EnableMacSpoofing:              c.EnableMacSpoofing,
+		},
+		&StepCreateNat{
+			SwitchName: c.SwitchName,
+			Prefix:     c.NatPrefix,
+			DnsServers: c.NatDnsServers,
+		},
+		&StepEnableIntegrationService{},
+	}
+}
+
+// HTTPServerStep returns the step serving the http_directory. It runs
+// once the network of the VM is configured, as the server is reached at
+// the address of the host on the switch of the communicator.
+func (c *BuilderConfig) HTTPServerStep() multistep.Step {
+	return &StepHTTPServer{
+		HTTPDir:     c.HTTPDir,
+		HTTPPortMin: c.HTTPPortMin,
+		HTTPPortMax: c.HTTPPortMax,
+		HTTPAddress: c.HTTPAddress,
+		SwitchName:  c.CommunicatorSwitchName(),
+	}
+}
+
+// BootSteps returns the steps starting the VM, for the reason given, and
+// typing the boot_command. The HTTPServerStep has to run before.
+func (c *BuilderConfig) BootSteps(reason string, tpl *packer.ConfigTemplate) []multistep.Step {
+	return []multistep.Step{
+		&StepStartVm{
+			Reason: reason,
+		},
+		&StepTypeBootCommand{
+			BootCommand: c.BootCommand,
+			BootWait:    c.BootWait,
+			Tpl:         tpl,
+		},
+	}
+}
+
+// HTTPEnvironmentStep returns the step giving the commands run by the
+// provisioners the address of the HTTP server, once the communicator is
+// connected.
+func (c *BuilderConfig) HTTPEnvironmentStep() multistep.Step {
+	return &StepHTTPEnvironment{
+		Communicator: c.Communicator,
+	}
+}
+
+// CommunicatorStep returns the step connecting the communicator, ssh or
+// winrm, to the VM.
+func (c *BuilderConfig) CommunicatorStep() multistep.Step {
+	if c.Communicator == "winrm" {
+		return &StepConnectWinRM{
+			WinRMAddress:     WinRMAddress(c.WinRMConfig),
+			WinRMConfig:      WinRMConfigFunc(c.WinRMConfig),
+			WinRMWaitTimeout: c.WinRMWaitTimeout,
+		}
+	}
+
+	return &common.StepConnectSSH{
+		SSHAddress:     SSHAddress,
+		SSHConfig:      SSHConfigFunc(c.SSHConfig),
+		SSHWaitTimeout: c.SSHWaitTimeout,
+	}
+}
+
+// ExportSteps returns the steps shutting the provisioned VM down and
+// exporting it with the memory and generation given, either of which is 0
+// when it is read from the VM.
+func (c *BuilderConfig) ExportSteps(ramSizeMB uint, generation uint) []multistep.Step {
+	return []multistep.Step{
+		c.ZeroFreeSpaceStep(c.Communicator),
+
+		&StepShutdown{
+			Command: c.ShutdownCommand,
+			Timeout: c.ShutdownTimeout,
+		},
+
+		&StepCompactDisk{
+			SkipCompaction: c.SkipCompaction,
+		},
+
+		&StepExportVm{
+			OutputDir: c.OutputDir,
+		},
+
+		&StepConvertDisks{
+			Formats:   c.OutputDiskFormats,
+			OutputDir: c.OutputDir,
+		},
+
+		&StepExportOvf{
+			OVF:         c.OutputOVF,
+			OVA:         c.OutputOVA,
+			OutputDir:   c.OutputDir,
+			MemoryMB:    ramSizeMB,
+			Generation:  generation,
+			SwitchNames: c.SwitchNames(),
+		},
+	}
+}
+
+// NewRunner returns the runner of the steps of a build, which pauses
+// between the steps in debug mode.
+func NewRunner(steps []multistep.Step, config common.PackerConfig, ui packer.Ui) multistep.Runner {
+	if config.PackerDebug {
+		return &multistep.DebugRunner{
+			Steps:   steps,
+			PauseFn: common.MultistepDebugFn(ui),
+		}
+	}
+
+	return &multistep.BasicRunner{Steps: steps}
+}
+
+// BuildError returns why the steps of a build did not complete, or nil
+// when they did.
+func BuildError(state multistep.StateBag) error {
+	// Report any errors.
+	if rawErr, ok := state.GetOk("error"); ok {
+		return rawErr.(error)
+	}
+
+	// If we were interrupted or cancelled, then just exit.
+	if _, ok := state.GetOk(multistep.StateCancelled); ok {
+		return errors.New("Build was cancelled.")
+	}
+
+	if _, ok := state.GetOk(multistep.StateHalted); ok {
+		return errors.New("Build was halted.")
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestBuilderConfig_ConfigureVMSteps(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	var c BuilderConfig
+	c.SwitchName = "switch"
+	c.EnableMacSpoofing = true
+	c.NetworkAdapters = []NetworkAdapterConfig{
+		{SwitchName: "switch", SwitchType: SwitchTypeInternal},
+		{SwitchName: "private", SwitchType: SwitchTypePrivate},
+	}
+
+	for _, step := range c.ConfigureVMSteps() {
+		if action := step.Run(state); action != multistep.ActionContinue {
+			t.Fatalf("bad action of %T: %#v", step, action)
+		}
+	}
+
+	// spoofing reaches the adapters added after the one of New-VM
+	adapters := driver.VMs["vm"].NetworkAdapters
+	if len(adapters) != 2 {
+		t.Fatalf("bad adapters: %#v", adapters)
+	}
+	for _, adapter := range adapters {
+		if !adapter.MacSpoofing {
+			t.Fatalf("bad adapter: %#v", adapter)
+		}
+	}
+}
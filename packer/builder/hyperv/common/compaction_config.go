@@ -0,0 +1,96 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// The path the script zeroing the free space of a Windows guest is
+// uploaded to.
+const zeroFreeSpaceScriptPath = `C:\Windows\Temp\packer-zero-free-space.ps1`
+
+// zeroFreeSpaceScript fills the free space of the system drive of a
+// Windows guest with a file of zeros, and removes it.
+const zeroFreeSpaceScript = `$ErrorActionPreference = 'Stop'
+$path = Join-Path $env:SystemDrive 'packer-zero-free-space.tmp'
+$disk = Get-WmiObject Win32_LogicalDisk -Filter "DeviceID='$env:SystemDrive'"
+$buffer = New-Object byte[] (1MB)
+$left = $disk.FreeSpace - 64MB
+$stream = [System.IO.File]::OpenWrite($path)
+try {
+  while ($left -gt 0) {
+    $count = [Math]::Min($left, $buffer.Length)
+    $stream.Write($buffer, 0, $count)
+    $left -= $count
+  }
+} finally {
+  $stream.Close()
+  Remove-Item -Path $path -Force
+}
+`
+
+// The commands zeroing the free space of a guest by communicator. The
+// file of zeros of a Linux guest is written until the file system is
+// full, which dd reports as an error.
+var defaultZeroFreeSpaceCommands = map[string]string{
+	"winrm": `powershell -NoProfile -ExecutionPolicy Bypass -File ` + zeroFreeSpaceScriptPath,
+	"ssh":   "dd if=/dev/zero of=/var/tmp/packer-zero-free-space.tmp bs=1M; rm -f /var/tmp/packer-zero-free-space.tmp; sync",
+}
+
+type CompactionConfig struct {
+	// Leaves the hard disks as they are instead of compacting them after
+	// the VM is shut down. By default, they are compacted.
+	SkipCompaction bool `mapstructure:"skip_compaction"`
+	// Fills the free space of the guest with zeros before the VM is shut
+	// down, so that compaction reclaims it. By default, it is not zeroed.
+	ZeroFreeSpace bool `mapstructure:"zero_free_space"`
+	// The command zeroing the free space, run through the communicator.
+	// By default, a PowerShell script for winrm or dd for ssh.
+	ZeroFreeSpaceCommand string `mapstructure:"zero_free_space_command"`
+}
+
+func (c *CompactionConfig) Prepare(t *packer.ConfigTemplate) []error {
+	templates := map[string]*string{
+		"zero_free_space_command": &c.ZeroFreeSpaceCommand,
+	}
+
+	errs := make([]error, 0)
+	for n, ptr := range templates {
+		var err error
+		*ptr, err = t.Process(*ptr, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing %s: %s", n, err))
+		}
+	}
+
+	if c.ZeroFreeSpaceCommand != "" && !c.ZeroFreeSpace {
+		errs = append(errs, fmt.Errorf("zero_free_space_command: The command requires zero_free_space."))
+	}
+
+	return errs
+}
+
+// ZeroFreeSpaceStep returns the step zeroing the free space of the guest
+// through the communicator given, "ssh" or "winrm", which does nothing
+// unless zero_free_space is set.
+func (c *CompactionConfig) ZeroFreeSpaceStep(communicator string) *StepZeroFreeSpace {
+	if !c.ZeroFreeSpace {
+		return &StepZeroFreeSpace{}
+	}
+
+	if c.ZeroFreeSpaceCommand != "" {
+		return &StepZeroFreeSpace{Command: c.ZeroFreeSpaceCommand}
+	}
+
+	step := &StepZeroFreeSpace{Command: defaultZeroFreeSpaceCommands[communicator]}
+	if communicator == "winrm" {
+		step.Script = zeroFreeSpaceScript
+		step.ScriptPath = zeroFreeSpaceScriptPath
+	}
+	return step
+}
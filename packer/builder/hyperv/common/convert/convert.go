@@ -0,0 +1,198 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package convert writes virtual disks in the formats of other
+// hypervisors and clouds: raw images, dynamic and fixed VHD, stream
+// optimized VMDK and QCOW2.
+//
+// A disk is read through the Source interface, which a *vhdx.Disk
+// implements, and the parts of it that read as zeros are left out of the
+// formats that allow it.
+package convert
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	KB = 1024
+	MB = 1024 * KB
+	GB = 1024 * MB
+
+	sectorSize = 512
+)
+
+// The formats a disk can be converted to.
+const (
+	// A raw image, a sparse file where the file system allows it.
+	FormatRaw = "raw"
+	// A dynamic VHD, for Virtual PC, Hyper-V and XenServer.
+	FormatVHD = "vhd"
+	// A fixed VHD, as Azure requires.
+	FormatVHDFixed = "vhd-fixed"
+	// A stream optimized VMDK, for VMware and OVF packages.
+	FormatVMDK = "vmdk"
+	// A QCOW2 image, for QEMU and KVM.
+	FormatQCOW2 = "qcow2"
+)
+
+// Formats lists the formats a disk can be converted to.
+var Formats = []string{FormatRaw, FormatVHD, FormatVHDFixed, FormatVMDK, FormatQCOW2}
+
+// The suffixes of the files of each format.
+var suffixes = map[string]string{
+	FormatRaw:      ".raw",
+	FormatVHD:      ".vhd",
+	FormatVHDFixed: "-fixed.vhd",
+	FormatVMDK:     ".vmdk",
+	FormatQCOW2:    ".qcow2",
+}
+
+// Source is a virtual disk to convert, such as a *vhdx.Disk.
+type Source interface {
+	io.ReaderAt
+	// The virtual size of the disk in bytes.
+	Size() int64
+}
+
+// allocator is a Source that knows which parts of it may hold data. The
+// other parts are taken as zeros without being read.
+type allocator interface {
+	Allocated(off int64, n int64) bool
+}
+
+// IsFormat reports whether the format given is one of Formats.
+func IsFormat(format string) bool {
+	_, ok := suffixes[format]
+	return ok
+}
+
+// FileName returns the name of the file of the disk named, without its
+// extension, converted to the format given.
+func FileName(name string, format string) string {
+	return name + suffixes[format]
+}
+
+// FormatOf returns the format of a file named by FileName, or an empty
+// string.
+func FormatOf(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+
+	// -fixed.vhd before .vhd
+	format := ""
+	for f, suffix := range suffixes {
+		if strings.HasSuffix(name, suffix) && len(suffix) > len(suffixes[format]) {
+			format = f
+		}
+	}
+	return format
+}
+
+// Convert writes the disk read from src to a new file at path, in the
+// format given.
+func Convert(path string, src Source, format string) error {
+	var write func(*os.File, Source) error
+	switch format {
+	case FormatRaw:
+		write = writeRaw
+	case FormatVHD:
+		write = writeDynamicVHD
+	case FormatVHDFixed:
+		write = writeFixedVHD
+	case FormatVMDK:
+		write = writeVMDK
+	case FormatQCOW2:
+		write = writeQCOW2
+	default:
+		return fmt.Errorf("convert: unknown format %s", format)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f, src); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("convert: %s: %s", path, err)
+	}
+
+	return f.Close()
+}
+
+// forEachChunk calls fn with the offset and the contents of every chunk
+// of the size given of src that holds data, in order. The last chunk is
+// padded with zeros, and the buffer is reused from one call to the next.
+func forEachChunk(src Source, chunkSize int64, fn func(off int64, b []byte) error) error {
+	alloc, _ := src.(allocator)
+	b := make([]byte, chunkSize)
+
+	for off := int64(0); off < src.Size(); off += chunkSize {
+		if alloc != nil && !alloc.Allocated(off, chunkSize) {
+			continue
+		}
+
+		n := chunkSize
+		if rest := src.Size() - off; n > rest {
+			n = rest
+			for i := n; i < chunkSize; i++ {
+				b[i] = 0
+			}
+		}
+
+		if _, err := src.ReadAt(b[:n], off); err != nil && err != io.EOF {
+			return err
+		}
+
+		if isZero(b) {
+			continue
+		}
+
+		if err := fn(off, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func divUp(n int64, d int64) int64 {
+	return (n + d - 1) / d
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	return b, err
+}
+
+func writeRaw(f *os.File, src Source) error {
+	if err := f.Truncate(src.Size()); err != nil {
+		return err
+	}
+
+	return forEachChunk(src, 64*KB, func(off int64, b []byte) error {
+		if rest := src.Size() - off; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+		_, err := f.WriteAt(b, off)
+		return err
+	})
+}
@@ -0,0 +1,366 @@
+package convert
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testChunkSize = 64 * KB
+
+// testSource is a sparse disk in memory, made of chunks of 64 KB.
+type testSource struct {
+	size   int64
+	chunks map[int64][]byte
+}
+
+func newTestSource(size int64, offsets ...int64) *testSource {
+	s := &testSource{size: size, chunks: make(map[int64][]byte)}
+	for _, off := range offsets {
+		b := make([]byte, testChunkSize)
+		for i := range b {
+			b[i] = byte(off/testChunkSize + int64(i)%251 + 1)
+		}
+		if rest := size - off; rest < testChunkSize {
+			for i := rest; i < testChunkSize; i++ {
+				b[i] = 0
+			}
+		}
+		s.chunks[off] = b
+	}
+	return s
+}
+
+func (s *testSource) Size() int64 {
+	return s.size
+}
+
+func (s *testSource) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		pos := off + int64(i)
+		p[i] = 0
+		if chunk, ok := s.chunks[pos-pos%testChunkSize]; ok {
+			p[i] = chunk[pos%testChunkSize]
+		}
+	}
+	return len(p), nil
+}
+
+func (s *testSource) Allocated(off int64, n int64) bool {
+	for chunk := range s.chunks {
+		if chunk < off+n && off < chunk+testChunkSize {
+			return true
+		}
+	}
+	return false
+}
+
+// testChunks returns the chunks of 64 KB of b holding data, by offset.
+func testChunks(t *testing.T, chunks map[int64][]byte, b []byte, off int64) {
+	for i := int64(0); i < int64(len(b)); i += testChunkSize {
+		chunk := make([]byte, testChunkSize)
+		copy(chunk, b[i:])
+		if !isZero(chunk) {
+			if _, ok := chunks[off+i]; ok {
+				t.Fatalf("chunk at %d read twice", off+i)
+			}
+			chunks[off+i] = chunk
+		}
+	}
+}
+
+func readRaw(t *testing.T, b []byte) (int64, map[int64][]byte) {
+	chunks := make(map[int64][]byte)
+	testChunks(t, chunks, b, 0)
+	return int64(len(b)), chunks
+}
+
+func readVHDFooter(t *testing.T, b []byte, diskType uint32) int64 {
+	footer := make([]byte, vhdFooterSize)
+	copy(footer, b)
+
+	if string(footer[0:8]) != "conectix" {
+		t.Fatalf("bad footer cookie: %q", footer[0:8])
+	}
+	if binary.BigEndian.Uint32(footer[60:64]) != diskType {
+		t.Fatalf("bad disk type: %d", binary.BigEndian.Uint32(footer[60:64]))
+	}
+
+	checksum := binary.BigEndian.Uint32(footer[64:68])
+	binary.BigEndian.PutUint32(footer[64:68], 0)
+	if vhdChecksum(footer) != checksum {
+		t.Fatal("bad footer checksum")
+	}
+
+	return int64(binary.BigEndian.Uint64(footer[48:56]))
+}
+
+func readFixedVHD(t *testing.T, b []byte) (int64, map[int64][]byte) {
+	size := readVHDFooter(t, b[len(b)-vhdFooterSize:], vhdTypeFixed)
+	if size != int64(len(b)-vhdFooterSize) {
+		t.Fatalf("bad size: %d", size)
+	}
+
+	chunks := make(map[int64][]byte)
+	testChunks(t, chunks, b[:size], 0)
+	return size, chunks
+}
+
+func readDynamicVHD(t *testing.T, b []byte) (int64, map[int64][]byte) {
+	size := readVHDFooter(t, b[len(b)-vhdFooterSize:], vhdTypeDynamic)
+	if !bytes.Equal(b[:vhdFooterSize], b[len(b)-vhdFooterSize:]) {
+		t.Fatal("the footer and its copy differ")
+	}
+
+	header := make([]byte, vhdHeaderSize)
+	copy(header, b[vhdFooterSize:])
+	if string(header[0:8]) != "cxsparse" {
+		t.Fatalf("bad header cookie: %q", header[0:8])
+	}
+	checksum := binary.BigEndian.Uint32(header[36:40])
+	binary.BigEndian.PutUint32(header[36:40], 0)
+	if vhdChecksum(header) != checksum {
+		t.Fatal("bad header checksum")
+	}
+
+	batOffset := binary.BigEndian.Uint64(header[16:24])
+	entries := binary.BigEndian.Uint32(header[28:32])
+	blockSize := int64(binary.BigEndian.Uint32(header[32:36]))
+	if int64(entries) != divUp(size, blockSize) {
+		t.Fatalf("bad entries: %d", entries)
+	}
+
+	chunks := make(map[int64][]byte)
+	for i := int64(0); i < int64(entries); i++ {
+		sector := binary.BigEndian.Uint32(b[int64(batOffset)+i*4:])
+		if sector == vhdUnused {
+			continue
+		}
+		data := int64(sector)*sectorSize + vhdBitmapSize
+		testChunks(t, chunks, b[data:data+blockSize], i*blockSize)
+	}
+	return size, chunks
+}
+
+func readQCOW2(t *testing.T, b []byte) (int64, map[int64][]byte) {
+	if string(b[0:4]) != "QFI\xfb" || binary.BigEndian.Uint32(b[4:8]) != 2 {
+		t.Fatalf("bad header: %q", b[0:8])
+	}
+
+	size := int64(binary.BigEndian.Uint64(b[24:32]))
+	l1Size := int64(binary.BigEndian.Uint32(b[36:40]))
+	l1Offset := int64(binary.BigEndian.Uint64(b[40:48]))
+	tableOffset := int64(binary.BigEndian.Uint64(b[48:56]))
+	tableClusters := int64(binary.BigEndian.Uint32(b[56:60]))
+
+	// Every cluster of the file is used once.
+	if int64(len(b))%qcow2ClusterSize != 0 {
+		t.Fatalf("bad file size: %d", len(b))
+	}
+	for i := int64(0); i < int64(len(b))/qcow2ClusterSize; i++ {
+		block := int64(binary.BigEndian.Uint64(b[tableOffset+i/qcow2RefcountEntries*8:]))
+		if block == 0 || i/qcow2RefcountEntries*8 >= tableClusters*qcow2ClusterSize {
+			t.Fatalf("no refcount block for cluster %d", i)
+		}
+		if n := binary.BigEndian.Uint16(b[block+i%qcow2RefcountEntries*2:]); n != 1 {
+			t.Fatalf("bad refcount of cluster %d: %d", i, n)
+		}
+	}
+
+	chunks := make(map[int64][]byte)
+	for i := int64(0); i < l1Size; i++ {
+		l2 := binary.BigEndian.Uint64(b[l1Offset+i*8:])
+		if l2 == 0 {
+			continue
+		}
+		if l2&qcow2Copied == 0 {
+			t.Fatalf("L1 entry %d is not copied", i)
+		}
+		for j := int64(0); j < qcow2L2Entries; j++ {
+			entry := binary.BigEndian.Uint64(b[int64(l2&^qcow2Copied)+j*8:])
+			if entry == 0 {
+				continue
+			}
+			data := int64(entry &^ qcow2Copied)
+			testChunks(t, chunks, b[data:data+qcow2ClusterSize], (i*qcow2L2Entries+j)*qcow2ClusterSize)
+		}
+	}
+	return size, chunks
+}
+
+func readVMDK(t *testing.T, b []byte) (int64, map[int64][]byte) {
+	if binary.LittleEndian.Uint32(b[0:4]) != vmdkMagic {
+		t.Fatalf("bad magic: %x", b[0:4])
+	}
+	if binary.LittleEndian.Uint64(b[56:64]) != vmdkGDAtEnd {
+		t.Fatal("the grain directory should be at the end")
+	}
+	if !strings.Contains(string(b[sectorSize:2*sectorSize]), `createType="streamOptimized"`) {
+		t.Fatalf("bad descriptor: %s", b[sectorSize:2*sectorSize])
+	}
+
+	if !isZero(b[len(b)-sectorSize:]) {
+		t.Fatal("no end of stream marker")
+	}
+	footer := b[len(b)-2*sectorSize : len(b)-sectorSize]
+	if binary.LittleEndian.Uint32(b[len(b)-3*sectorSize+12:]) != vmdkMarkerFooter {
+		t.Fatal("no footer marker")
+	}
+
+	capacity := int64(binary.LittleEndian.Uint64(footer[12:20]))
+	gdOffset := int64(binary.LittleEndian.Uint64(footer[56:64]))
+	if binary.LittleEndian.Uint32(b[(gdOffset-1)*sectorSize+12:]) != vmdkMarkerGD {
+		t.Fatal("no grain directory marker")
+	}
+
+	chunks := make(map[int64][]byte)
+	gdEntries := divUp(divUp(capacity, vmdkGrainSectors), vmdkGTEntries)
+	for i := int64(0); i < gdEntries; i++ {
+		gt := int64(binary.LittleEndian.Uint32(b[gdOffset*sectorSize+i*4:]))
+		if gt == 0 {
+			continue
+		}
+		if binary.LittleEndian.Uint32(b[(gt-1)*sectorSize+12:]) != vmdkMarkerGT {
+			t.Fatalf("no grain table marker at %d", gt-1)
+		}
+		for j := int64(0); j < vmdkGTEntries; j++ {
+			grain := int64(binary.LittleEndian.Uint32(b[gt*sectorSize+j*4:]))
+			if grain == 0 {
+				continue
+			}
+
+			marker := b[grain*sectorSize:]
+			lba := int64(binary.LittleEndian.Uint64(marker[0:8]))
+			if lba != (i*vmdkGTEntries+j)*vmdkGrainSectors {
+				t.Fatalf("bad grain sector: %d", lba)
+			}
+			n := binary.LittleEndian.Uint32(marker[8:12])
+			r, err := zlib.NewReader(bytes.NewReader(marker[vmdkGrainMarkerSize : vmdkGrainMarkerSize+n]))
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			testChunks(t, chunks, data, lba*sectorSize)
+		}
+	}
+	return capacity * sectorSize, chunks
+}
+
+var testReaders = map[string]func(*testing.T, []byte) (int64, map[int64][]byte){
+	FormatRaw:      readRaw,
+	FormatVHD:      readDynamicVHD,
+	FormatVHDFixed: readFixedVHD,
+	FormatQCOW2:    readQCOW2,
+	FormatVMDK:     readVMDK,
+}
+
+func testConvert(t *testing.T, src *testSource, formats ...string) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, format := range formats {
+		path := filepath.Join(dir, FileName("disk", format))
+		if err := Convert(path, src, format); err != nil {
+			t.Fatalf("%s: err: %s", format, err)
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		size, chunks := testReaders[format](t, b)
+		if size != src.size {
+			t.Fatalf("%s: bad size: %d", format, size)
+		}
+		if !reflect.DeepEqual(chunks, src.chunks) {
+			t.Fatalf("%s: the data differ", format)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	size := int64(5*MB + 3*sectorSize)
+	testConvert(t, newTestSource(size, 0, 3*testChunkSize, 2*MB+testChunkSize, size-size%testChunkSize), Formats...)
+}
+
+func TestConvert_empty(t *testing.T) {
+	testConvert(t, newTestSource(4*MB), Formats...)
+}
+
+func TestConvert_large(t *testing.T) {
+	// Several L2 tables of QCOW2 and grain tables of VMDK.
+	size := int64(1200 * MB)
+	testConvert(t, newTestSource(size, 0, 40*MB, 600*MB, size-testChunkSize), FormatQCOW2, FormatVMDK)
+}
+
+func TestConvert_vhdTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := newTestSource(2041 * GB)
+	for _, format := range []string{FormatVHD, FormatVHDFixed} {
+		path := filepath.Join(dir, FileName("disk", format))
+		if err := Convert(path, src, format); err == nil {
+			t.Fatalf("%s: should have error", format)
+		}
+		if _, err := os.Stat(path); err == nil {
+			t.Fatalf("%s: the file should be removed", format)
+		}
+	}
+}
+
+func TestConvert_badFormat(t *testing.T) {
+	if err := Convert("disk.img", newTestSource(MB), "img"); err == nil {
+		t.Fatal("should have error")
+	}
+	if IsFormat("img") {
+		t.Fatal("img should not be a format")
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for _, format := range Formats {
+		name := FileName("disk", format)
+		if FormatOf(filepath.Join("output", name)) != format {
+			t.Fatalf("bad format of %s: %s", name, FormatOf(name))
+		}
+	}
+
+	if FormatOf("disk.vhdx") != "" {
+		t.Fatal("vhdx should not be a format")
+	}
+}
+
+func TestVHDGeometry(t *testing.T) {
+	cases := []struct {
+		size                      int64
+		cylinders, heads, sectors int
+	}{
+		{127 * GB, 65278, 16, 255},
+		{GB, 2080, 16, 63},
+		{20 * MB, 602, 4, 17},
+	}
+
+	for _, tc := range cases {
+		c, h, s := vhdGeometry(tc.size)
+		if int(c) != tc.cylinders || int(h) != tc.heads || int(s) != tc.sectors {
+			t.Fatalf("bad geometry of %d: %d/%d/%d", tc.size, c, h, s)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package convert
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+const (
+	qcow2ClusterBits = 16
+	qcow2ClusterSize = 1 << qcow2ClusterBits
+	// The entries of an L2 table, the entries of the refcount table in a
+	// cluster, and the 16 bit refcounts of a refcount block.
+	qcow2L2Entries       = qcow2ClusterSize / 8
+	qcow2RefcountEntries = qcow2ClusterSize / 2
+	qcow2HeaderSize      = 72
+	// Set on the L1 and L2 entries of clusters whose refcount is 1.
+	qcow2Copied = 1 << 63
+)
+
+// A QCOW2 image is written in a single pass: the header cluster, the
+// clusters holding data in the order of the disk, the L2 tables mapping
+// them, the L1 table, and the refcount table and blocks counting every
+// cluster once. The header is written last.
+func writeQCOW2(f *os.File, src Source) error {
+	// The L2 tables holding data, by L1 index.
+	l2 := make(map[int64][]uint64)
+
+	next := int64(qcow2ClusterSize)
+	err := forEachChunk(src, qcow2ClusterSize, func(off int64, b []byte) error {
+		cluster := off / qcow2ClusterSize
+		table := l2[cluster/qcow2L2Entries]
+		if table == nil {
+			table = make([]uint64, qcow2L2Entries)
+			l2[cluster/qcow2L2Entries] = table
+		}
+		table[cluster%qcow2L2Entries] = uint64(next) | qcow2Copied
+
+		if _, err := f.WriteAt(b, next); err != nil {
+			return err
+		}
+		next += qcow2ClusterSize
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	l1Size := divUp(divUp(src.Size(), qcow2ClusterSize), qcow2L2Entries)
+	l1 := make([]byte, divUp(l1Size*8, qcow2ClusterSize)*qcow2ClusterSize)
+	for i := int64(0); i < l1Size; i++ {
+		table := l2[i]
+		if table == nil {
+			continue
+		}
+
+		b := make([]byte, qcow2ClusterSize)
+		for j, entry := range table {
+			binary.BigEndian.PutUint64(b[j*8:], entry)
+		}
+		if _, err := f.WriteAt(b, next); err != nil {
+			return err
+		}
+
+		binary.BigEndian.PutUint64(l1[i*8:], uint64(next)|qcow2Copied)
+		next += qcow2ClusterSize
+	}
+
+	l1Offset := next
+	if _, err := f.WriteAt(l1, l1Offset); err != nil {
+		return err
+	}
+	next += int64(len(l1))
+
+	// The refcount table and blocks count themselves, so their sizes are
+	// grown until they cover every cluster.
+	clusters := next / qcow2ClusterSize
+	var tableClusters, blocks int64
+	for {
+		total := clusters + tableClusters + blocks
+		b := divUp(total, qcow2RefcountEntries)
+		t := divUp(b*8, qcow2ClusterSize)
+		if b == blocks && t == tableClusters {
+			break
+		}
+		blocks, tableClusters = b, t
+	}
+	total := clusters + tableClusters + blocks
+
+	tableOffset := next
+	table := make([]byte, tableClusters*qcow2ClusterSize)
+	for i := int64(0); i < blocks; i++ {
+		binary.BigEndian.PutUint64(table[i*8:], uint64(tableOffset+(tableClusters+i)*qcow2ClusterSize))
+	}
+	if _, err := f.WriteAt(table, tableOffset); err != nil {
+		return err
+	}
+	next += int64(len(table))
+
+	for i := int64(0); i < blocks; i++ {
+		b := make([]byte, qcow2ClusterSize)
+		for j := int64(0); j < qcow2RefcountEntries && i*qcow2RefcountEntries+j < total; j++ {
+			binary.BigEndian.PutUint16(b[j*2:], 1)
+		}
+		if _, err := f.WriteAt(b, next); err != nil {
+			return err
+		}
+		next += qcow2ClusterSize
+	}
+
+	header := make([]byte, qcow2HeaderSize)
+	copy(header[0:4], "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:8], 2)
+	binary.BigEndian.PutUint32(header[20:24], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:32], uint64(src.Size()))
+	binary.BigEndian.PutUint32(header[36:40], uint32(l1Size))
+	binary.BigEndian.PutUint64(header[40:48], uint64(l1Offset))
+	binary.BigEndian.PutUint64(header[48:56], uint64(tableOffset))
+	binary.BigEndian.PutUint32(header[56:60], uint32(tableClusters))
+	_, err = f.WriteAt(header, 0)
+	return err
+}
@@ -0,0 +1,212 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package convert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// The largest disk a VHD can hold.
+	vhdMaxSize = 2040 * GB
+	// The size of the blocks of a dynamic VHD.
+	vhdBlockSize = 2 * MB
+
+	vhdFooterSize  = 512
+	vhdHeaderSize  = 1024
+	vhdBitmapSize  = vhdBlockSize / sectorSize / 8
+	vhdTypeFixed   = 2
+	vhdTypeDynamic = 3
+	vhdUnused      = 0xFFFFFFFF
+)
+
+// VHD timestamps count the seconds since January 1st, 2000.
+var vhdEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// vhdFooter returns the footer of a VHD of the type given holding a disk
+// of the size given, with its dynamic header at dataOffset if it has one.
+func vhdFooter(size int64, diskType uint32, dataOffset uint64) ([]byte, error) {
+	id, err := randomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, vhdFooterSize)
+	copy(b[0:8], "conectix")
+	binary.BigEndian.PutUint32(b[8:12], 2)
+	binary.BigEndian.PutUint32(b[12:16], 0x00010000)
+	binary.BigEndian.PutUint64(b[16:24], dataOffset)
+	binary.BigEndian.PutUint32(b[24:28], uint32(time.Now().Sub(vhdEpoch)/time.Second))
+	copy(b[28:32], "pckr")
+	binary.BigEndian.PutUint32(b[32:36], 0x00010000)
+	copy(b[36:40], "Wi2k")
+	binary.BigEndian.PutUint64(b[40:48], uint64(size))
+	binary.BigEndian.PutUint64(b[48:56], uint64(size))
+	cylinders, heads, sectors := vhdGeometry(size)
+	binary.BigEndian.PutUint16(b[56:58], cylinders)
+	b[58] = heads
+	b[59] = sectors
+	binary.BigEndian.PutUint32(b[60:64], diskType)
+	copy(b[68:84], id)
+	binary.BigEndian.PutUint32(b[64:68], vhdChecksum(b))
+	return b, nil
+}
+
+// vhdGeometry returns the CHS geometry of a disk of the size given, as
+// computed in the VHD specification.
+func vhdGeometry(size int64) (cylinders uint16, heads uint8, sectors uint8) {
+	total := size / sectorSize
+	if total > 65535*16*255 {
+		total = 65535 * 16 * 255
+	}
+
+	var perTrack, h, cylinderTimesHeads int64
+	if total >= 65535*16*63 {
+		perTrack = 255
+		h = 16
+		cylinderTimesHeads = total / perTrack
+	} else {
+		perTrack = 17
+		cylinderTimesHeads = total / perTrack
+		h = (cylinderTimesHeads + 1023) / 1024
+		if h < 4 {
+			h = 4
+		}
+		if cylinderTimesHeads >= h*1024 || h > 16 {
+			perTrack = 31
+			h = 16
+			cylinderTimesHeads = total / perTrack
+		}
+		if cylinderTimesHeads >= h*1024 {
+			perTrack = 63
+			h = 16
+			cylinderTimesHeads = total / perTrack
+		}
+	}
+
+	return uint16(cylinderTimesHeads / h), uint8(h), uint8(perTrack)
+}
+
+// vhdChecksum returns the one's complement of the sum of the bytes of a
+// footer or dynamic header, whose checksum field is zero.
+func vhdChecksum(b []byte) uint32 {
+	var sum uint32
+	for _, c := range b {
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+func vhdSize(src Source) (int64, error) {
+	size := divUp(src.Size(), sectorSize) * sectorSize
+	if size > vhdMaxSize {
+		return 0, fmt.Errorf("the disk is %d GB, larger than the %d GB a VHD can hold", size/GB, vhdMaxSize/GB)
+	}
+	return size, nil
+}
+
+// A fixed VHD is the disk followed by a footer.
+func writeFixedVHD(f *os.File, src Source) error {
+	size, err := vhdSize(src)
+	if err != nil {
+		return err
+	}
+
+	footer, err := vhdFooter(size, vhdTypeFixed, 0xFFFFFFFFFFFFFFFF)
+	if err != nil {
+		return err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	err = forEachChunk(src, 64*KB, func(off int64, b []byte) error {
+		if rest := size - off; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+		_, err := f.WriteAt(b, off)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(footer, size)
+	return err
+}
+
+// A dynamic VHD is a copy of the footer, the dynamic header, the block
+// allocation table and the blocks holding data, each a sector bitmap and
+// the data, followed by the footer.
+func writeDynamicVHD(f *os.File, src Source) error {
+	size, err := vhdSize(src)
+	if err != nil {
+		return err
+	}
+
+	footer, err := vhdFooter(size, vhdTypeDynamic, vhdFooterSize)
+	if err != nil {
+		return err
+	}
+
+	entries := divUp(size, vhdBlockSize)
+	batOffset := int64(vhdFooterSize + vhdHeaderSize)
+	batSize := divUp(entries*4, sectorSize) * sectorSize
+
+	header := make([]byte, vhdHeaderSize)
+	copy(header[0:8], "cxsparse")
+	binary.BigEndian.PutUint64(header[8:16], 0xFFFFFFFFFFFFFFFF)
+	binary.BigEndian.PutUint64(header[16:24], uint64(batOffset))
+	binary.BigEndian.PutUint32(header[24:28], 0x00010000)
+	binary.BigEndian.PutUint32(header[28:32], uint32(entries))
+	binary.BigEndian.PutUint32(header[32:36], vhdBlockSize)
+	binary.BigEndian.PutUint32(header[36:40], vhdChecksum(header))
+
+	bat := make([]byte, batSize)
+	for i := range bat {
+		bat[i] = 0xFF
+	}
+
+	bitmap := make([]byte, vhdBitmapSize)
+	for i := range bitmap {
+		bitmap[i] = 0xFF
+	}
+
+	next := batOffset + batSize
+	err = forEachChunk(src, vhdBlockSize, func(off int64, b []byte) error {
+		binary.BigEndian.PutUint32(bat[off/vhdBlockSize*4:], uint32(next/sectorSize))
+		if _, err := f.WriteAt(bitmap, next); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(b, next+vhdBitmapSize); err != nil {
+			return err
+		}
+		next += vhdBitmapSize + vhdBlockSize
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, part := range []struct {
+		b   []byte
+		off int64
+	}{
+		{footer, 0},
+		{header, vhdFooterSize},
+		{bat, batOffset},
+		{footer, next},
+	} {
+		if _, err := f.WriteAt(part.b, part.off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
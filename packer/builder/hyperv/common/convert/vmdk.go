@@ -0,0 +1,207 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package convert
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// The grains of a VMDK are 128 sectors of 64 KB, 512 to a grain table.
+	vmdkGrainSectors = 128
+	vmdkGrainSize    = vmdkGrainSectors * sectorSize
+	vmdkGTEntries    = 512
+
+	vmdkMagic = 0x564d444b
+	// Valid newline test, compressed grains and markers.
+	vmdkFlags           = 0x30001
+	vmdkDescriptorSize  = 20
+	vmdkGDAtEnd         = 0xFFFFFFFFFFFFFFFF
+	vmdkCompressionZlib = 1
+	vmdkMarkerEOS       = 0
+	vmdkMarkerGT        = 1
+	vmdkMarkerGD        = 2
+	vmdkMarkerFooter    = 3
+	vmdkGrainMarkerSize = 12
+	vmdkMaxCylinders    = 65535
+	vmdkHeads           = 255
+	vmdkSectorsPerTrack = 63
+)
+
+// vmdkHeader returns the sparse extent header of a stream optimized VMDK
+// of the capacity given in sectors, with its grain directory at gdOffset.
+func vmdkHeader(capacity int64, gdOffset uint64) []byte {
+	b := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(b[0:4], vmdkMagic)
+	binary.LittleEndian.PutUint32(b[4:8], 3)
+	binary.LittleEndian.PutUint32(b[8:12], vmdkFlags)
+	binary.LittleEndian.PutUint64(b[12:20], uint64(capacity))
+	binary.LittleEndian.PutUint64(b[20:28], vmdkGrainSectors)
+	binary.LittleEndian.PutUint64(b[28:36], 1)
+	binary.LittleEndian.PutUint64(b[36:44], vmdkDescriptorSize)
+	binary.LittleEndian.PutUint32(b[44:48], vmdkGTEntries)
+	binary.LittleEndian.PutUint64(b[56:64], gdOffset)
+	binary.LittleEndian.PutUint64(b[64:72], vmdkGrainSectors)
+	copy(b[73:77], "\n \r\n")
+	binary.LittleEndian.PutUint16(b[77:79], vmdkCompressionZlib)
+	return b
+}
+
+// vmdkMarker returns the marker of the metadata of the type given, which
+// takes the number of sectors given after it.
+func vmdkMarker(sectors int64, markerType uint32) []byte {
+	b := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint64(b[0:8], uint64(sectors))
+	binary.LittleEndian.PutUint32(b[12:16], markerType)
+	return b
+}
+
+func vmdkDescriptor(name string, capacity int64) ([]byte, error) {
+	cid, err := randomBytes(4)
+	if err != nil {
+		return nil, err
+	}
+
+	cylinders := capacity / (vmdkHeads * vmdkSectorsPerTrack)
+	if cylinders > vmdkMaxCylinders {
+		cylinders = vmdkMaxCylinders
+	}
+
+	text := fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.adapterType = "lsilogic"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "%d"
+ddb.geometry.sectors = "%d"
+`, binary.BigEndian.Uint32(cid), capacity, name, cylinders, vmdkHeads, vmdkSectorsPerTrack)
+
+	b := make([]byte, vmdkDescriptorSize*sectorSize)
+	if len(text) > len(b) {
+		return nil, fmt.Errorf("the VMDK descriptor is too long")
+	}
+	copy(b, text)
+	return b, nil
+}
+
+// A stream optimized VMDK is the header, the descriptor and the grains
+// holding data, each compressed after a marker giving its sector. The
+// grain tables, the grain directory and a footer holding the header
+// again with the offset of the directory follow them, with an end of
+// stream marker last.
+func writeVMDK(f *os.File, src Source) error {
+	capacity := divUp(src.Size(), sectorSize)
+
+	descriptor, err := vmdkDescriptor(filepath.Base(f.Name()), capacity)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteAt(vmdkHeader(capacity, vmdkGDAtEnd), 0); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(descriptor, sectorSize); err != nil {
+		return err
+	}
+
+	// The grain tables holding grains, by grain directory index.
+	gts := make(map[int64][]uint32)
+
+	var compressed bytes.Buffer
+	next := int64(vmdkGrainSectors)
+	err = forEachChunk(src, vmdkGrainSize, func(off int64, b []byte) error {
+		if rest := capacity*sectorSize - off; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+
+		compressed.Reset()
+		compressed.Write(make([]byte, vmdkGrainMarkerSize))
+		w := zlib.NewWriter(&compressed)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		grain := compressed.Bytes()
+		binary.LittleEndian.PutUint64(grain[0:8], uint64(off/sectorSize))
+		binary.LittleEndian.PutUint32(grain[8:12], uint32(len(grain)-vmdkGrainMarkerSize))
+		grain = append(grain, make([]byte, divUp(int64(len(grain)), sectorSize)*sectorSize-int64(len(grain)))...)
+
+		index := off / vmdkGrainSize
+		gt := gts[index/vmdkGTEntries]
+		if gt == nil {
+			gt = make([]uint32, vmdkGTEntries)
+			gts[index/vmdkGTEntries] = gt
+		}
+		gt[index%vmdkGTEntries] = uint32(next)
+
+		if _, err := f.WriteAt(grain, next*sectorSize); err != nil {
+			return err
+		}
+		next += int64(len(grain)) / sectorSize
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	gtSectors := int64(vmdkGTEntries * 4 / sectorSize)
+	gdEntries := divUp(divUp(capacity, vmdkGrainSectors), vmdkGTEntries)
+	gd := make([]byte, divUp(gdEntries*4, sectorSize)*sectorSize)
+	for i := int64(0); i < gdEntries; i++ {
+		gt := gts[i]
+		if gt == nil {
+			continue
+		}
+
+		b := make([]byte, gtSectors*sectorSize)
+		for j, entry := range gt {
+			binary.LittleEndian.PutUint32(b[j*4:], entry)
+		}
+		if _, err := f.WriteAt(vmdkMarker(gtSectors, vmdkMarkerGT), next*sectorSize); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(b, (next+1)*sectorSize); err != nil {
+			return err
+		}
+
+		binary.LittleEndian.PutUint32(gd[i*4:], uint32(next+1))
+		next += 1 + gtSectors
+	}
+
+	gdOffset := next + 1
+	tail := [][]byte{
+		vmdkMarker(int64(len(gd))/sectorSize, vmdkMarkerGD),
+		gd,
+		vmdkMarker(1, vmdkMarkerFooter),
+		vmdkHeader(capacity, uint64(gdOffset)),
+		vmdkMarker(0, vmdkMarkerEOS),
+	}
+	for _, b := range tail {
+		if _, err := f.WriteAt(b, next*sectorSize); err != nil {
+			return err
+		}
+		next += int64(len(b)) / sectorSize
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package dhcp is a minimal DHCP server, as described by RFC 2131 and RFC
+// 2132, which leases the addresses of the NAT network of a build to its
+// VM, so that the guest gets an address and a route out without a DHCP
+// server on the host.
+package dhcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// The operations of a packet.
+const (
+	BootRequest = 1
+	BootReply   = 2
+)
+
+// The DHCP message types of option 53.
+const (
+	Discover = 1
+	Offer    = 2
+	Request  = 3
+	Decline  = 4
+	Ack      = 5
+	Nak      = 6
+	Release  = 7
+	Inform   = 8
+)
+
+// The options the server reads or writes.
+const (
+	OptionSubnetMask       = 1
+	OptionRouter           = 3
+	OptionDomainNameServer = 6
+	OptionRequestedIP      = 50
+	OptionLeaseTime        = 51
+	OptionMessageType      = 53
+	OptionServerIdentifier = 54
+	OptionRenewalTime      = 58
+	OptionRebindingTime    = 59
+	OptionPad              = 0
+	OptionEnd              = 255
+)
+
+// The layout of a packet: the fixed BOOTP fields, then the magic cookie
+// and the options. A packet is padded to the size of a BOOTP packet.
+const (
+	headerSize    = 236
+	minPacketSize = 300
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// The hardware type of Ethernet, the only one the server leases to.
+const hardwareTypeEthernet = 1
+
+// A Packet is a DHCP message.
+type Packet struct {
+	Op     byte
+	XID    uint32
+	Secs   uint16
+	Flags  uint16
+	CIAddr net.IP
+	YIAddr net.IP
+	SIAddr net.IP
+	GIAddr net.IP
+	CHAddr net.HardwareAddr
+
+	// The options, keyed by code, other than the pad and end options.
+	Options map[byte][]byte
+}
+
+// ParsePacket parses the DHCP message of an Ethernet client.
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < headerSize+len(magicCookie) {
+		return nil, fmt.Errorf("packet of %d bytes is too short", len(b))
+	}
+	if !bytes.Equal(b[headerSize:headerSize+len(magicCookie)], magicCookie) {
+		return nil, errors.New("packet has no DHCP magic cookie")
+	}
+	if b[1] != hardwareTypeEthernet || b[2] != 6 {
+		return nil, fmt.Errorf("packet has hardware type %d of length %d, not Ethernet", b[1], b[2])
+	}
+
+	p := &Packet{
+		Op:      b[0],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(append([]byte(nil), b[12:16]...)),
+		YIAddr:  net.IP(append([]byte(nil), b[16:20]...)),
+		SIAddr:  net.IP(append([]byte(nil), b[20:24]...)),
+		GIAddr:  net.IP(append([]byte(nil), b[24:28]...)),
+		CHAddr:  net.HardwareAddr(append([]byte(nil), b[28:34]...)),
+		Options: make(map[byte][]byte),
+	}
+
+	options := b[headerSize+len(magicCookie):]
+	for i := 0; i < len(options); {
+		code := options[i]
+		if code == OptionEnd {
+			break
+		}
+		if code == OptionPad {
+			i++
+			continue
+		}
+		if i+1 >= len(options) || i+2+int(options[i+1]) > len(options) {
+			return nil, fmt.Errorf("option %d overruns the packet", code)
+		}
+		n := int(options[i+1])
+		p.Options[code] = append(p.Options[code], options[i+2:i+2+n]...)
+		i += 2 + n
+	}
+
+	return p, nil
+}
+
+// MessageType returns the DHCP message type of option 53, or 0 for a
+// BOOTP packet.
+func (p *Packet) MessageType() byte {
+	if v := p.Options[OptionMessageType]; len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// IPOption returns the IPv4 address of the option given, or nil.
+func (p *Packet) IPOption(code byte) net.IP {
+	if v := p.Options[code]; len(v) == net.IPv4len {
+		return net.IP(v)
+	}
+	return nil
+}
+
+// Marshal returns the packet as it is sent, with the options in the order
+// of their codes.
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, headerSize, minPacketSize)
+	b[0] = p.Op
+	b[1] = hardwareTypeEthernet
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+
+	b = append(b, magicCookie...)
+	for code := 1; code < OptionEnd; code++ {
+		v, ok := p.Options[byte(code)]
+		if !ok {
+			continue
+		}
+		// an option longer than 255 bytes is split, as RFC 3396 allows
+		for len(v) > 255 {
+			b = append(b, byte(code), 255)
+			b = append(b, v[:255]...)
+			v = v[255:]
+		}
+		b = append(b, byte(code), byte(len(v)))
+		b = append(b, v...)
+	}
+	b = append(b, OptionEnd)
+
+	for len(b) < minPacketSize {
+		b = append(b, OptionPad)
+	}
+	return b
+}
@@ -0,0 +1,84 @@
+package dhcp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func testPacket(messageType byte) *Packet {
+	return &Packet{
+		Op:     BootRequest,
+		XID:    0x12345678,
+		Flags:  0x8000,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: net.HardwareAddr{0x00, 0x15, 0x5d, 0x01, 0x02, 0x03},
+		Options: map[byte][]byte{
+			OptionMessageType: {messageType},
+		},
+	}
+}
+
+func TestPacket(t *testing.T) {
+	p := testPacket(Request)
+	p.Options[OptionRequestedIP] = []byte{192, 168, 250, 2}
+
+	b := p.Marshal()
+	if len(b) != minPacketSize {
+		t.Fatalf("bad size: %d", len(b))
+	}
+
+	parsed, err := ParsePacket(b)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if parsed.Op != BootRequest || parsed.XID != p.XID || parsed.Flags != p.Flags {
+		t.Fatalf("bad packet: %#v", parsed)
+	}
+	if !bytes.Equal(parsed.CHAddr, p.CHAddr) {
+		t.Fatalf("bad hardware address: %s", parsed.CHAddr)
+	}
+	if parsed.MessageType() != Request {
+		t.Fatalf("bad message type: %d", parsed.MessageType())
+	}
+	if ip := parsed.IPOption(OptionRequestedIP); !ip.Equal(net.IPv4(192, 168, 250, 2)) {
+		t.Fatalf("bad requested address: %s", ip)
+	}
+}
+
+func TestPacket_longOption(t *testing.T) {
+	p := testPacket(Ack)
+	p.Options[OptionDomainNameServer] = bytes.Repeat([]byte{8, 8, 8, 8}, 100)
+
+	parsed, err := ParsePacket(p.Marshal())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(parsed.Options[OptionDomainNameServer], p.Options[OptionDomainNameServer]) {
+		t.Fatalf("bad option of %d bytes", len(parsed.Options[OptionDomainNameServer]))
+	}
+}
+
+func TestParsePacket_bad(t *testing.T) {
+	good := testPacket(Discover).Marshal()
+
+	short := good[:headerSize]
+
+	cookie := append([]byte(nil), good...)
+	cookie[headerSize] = 0
+
+	hardware := append([]byte(nil), good...)
+	hardware[1] = 6
+
+	overrun := append([]byte(nil), good[:headerSize+len(magicCookie)]...)
+	overrun = append(overrun, OptionRequestedIP, 4, 192, 168)
+
+	for _, b := range [][]byte{short, cookie, hardware, overrun} {
+		if _, err := ParsePacket(b); err == nil {
+			t.Fatalf("should have error: %v", b)
+		}
+	}
+}
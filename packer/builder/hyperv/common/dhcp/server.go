@@ -0,0 +1,290 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package dhcp
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// The ports of the server and of its clients.
+const (
+	ServerPort = 67
+	ClientPort = 68
+)
+
+// The lease time a server gives when none is set. Leases last as long as
+// the server anyway, which is the length of a build.
+const DefaultLeaseTime = 24 * time.Hour
+
+// A Server leases the addresses of a subnet to the clients asking for
+// one, each client keeping its address for as long as the server runs.
+// The server is the router of its clients.
+type Server struct {
+	// The address of the server, in the subnet.
+	ServerIP net.IP
+	Subnet   *net.IPNet
+
+	// The DNS servers of the clients, if any.
+	DNSServers []net.IP
+
+	LeaseTime time.Duration
+
+	l        sync.Mutex
+	conn     net.PacketConn
+	closed   bool
+	leases   map[string]net.IP
+	declined map[string]bool
+}
+
+// NewServer returns a server leasing the addresses of the subnet other
+// than its own.
+func NewServer(serverIP net.IP, subnet *net.IPNet) *Server {
+	return &Server{
+		ServerIP:  serverIP.To4(),
+		Subnet:    subnet,
+		LeaseTime: DefaultLeaseTime,
+		leases:    make(map[string]net.IP),
+		declined:  make(map[string]bool),
+	}
+}
+
+// Serve answers the requests read from conn, which is normally bound to
+// the server port of ServerIP, until Close is called or reading fails.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.l.Lock()
+	s.conn = conn
+	closed := s.closed
+	s.l.Unlock()
+	if closed {
+		return conn.Close()
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.l.Lock()
+			closed := s.closed
+			s.l.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		request, err := ParsePacket(buf[:n])
+		if err != nil {
+			log.Printf("dhcp: Ignoring a packet from %s: %s", addr, err)
+			continue
+		}
+
+		reply := s.Handle(request)
+		if reply == nil {
+			continue
+		}
+
+		if _, err := conn.WriteTo(reply.Marshal(), replyAddr(request, addr)); err != nil {
+			log.Printf("dhcp: Error replying to %s: %s", request.CHAddr, err)
+		}
+	}
+}
+
+// Close stops Serve.
+func (s *Server) Close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.closed = true
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// Leases returns the addresses leased, keyed by the hardware address of
+// their clients.
+func (s *Server) Leases() map[string]net.IP {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	leases := make(map[string]net.IP)
+	for client, ip := range s.leases {
+		leases[client] = ip
+	}
+	return leases
+}
+
+// Handle returns the reply to a request, or nil when there is none.
+func (s *Server) Handle(request *Packet) *Packet {
+	if request.Op != BootRequest {
+		return nil
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	client := request.CHAddr.String()
+	switch request.MessageType() {
+	case Discover:
+		ip := s.lease(client, request.IPOption(OptionRequestedIP))
+		if ip == nil {
+			log.Printf("dhcp: No address left to offer %s.", client)
+			return nil
+		}
+		return s.reply(request, Offer, ip)
+
+	case Request:
+		if id := request.IPOption(OptionServerIdentifier); id != nil && !id.Equal(s.ServerIP) {
+			// the client took the offer of another server
+			delete(s.leases, client)
+			return nil
+		}
+
+		// a renewing client has no requested address, but its own
+		ip := request.IPOption(OptionRequestedIP)
+		if ip == nil {
+			ip = request.CIAddr
+		}
+
+		if leased, ok := s.leases[client]; ok && leased.Equal(ip) || !ok && s.available(ip) {
+			s.leases[client] = ip.To4()
+			log.Printf("dhcp: Leased %s to %s.", ip, client)
+			return s.reply(request, Ack, ip)
+		}
+		return s.reply(request, Nak, nil)
+
+	case Decline:
+		// the address is used by a host the server does not know of
+		if ip, ok := s.leases[client]; ok {
+			s.declined[ip.String()] = true
+			delete(s.leases, client)
+		}
+
+	case Release:
+		delete(s.leases, client)
+
+	case Inform:
+		return s.reply(request, Ack, nil)
+	}
+
+	return nil
+}
+
+// lease returns the address of the client, preferring the one it asks
+// for, or nil when the subnet has no address left.
+func (s *Server) lease(client string, requested net.IP) net.IP {
+	if ip, ok := s.leases[client]; ok {
+		return ip
+	}
+
+	if requested != nil && s.available(requested) {
+		s.leases[client] = requested.To4()
+		return s.leases[client]
+	}
+
+	first, last := s.hosts()
+	for n := first; n <= last; n++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, n)
+		if s.available(ip) {
+			s.leases[client] = ip
+			return ip
+		}
+	}
+	return nil
+}
+
+// available reports whether the address is a host of the subnet that is
+// neither the server nor leased nor declined.
+func (s *Server) available(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil || !s.Subnet.Contains(ip) || ip.Equal(s.ServerIP) || s.declined[ip.String()] {
+		return false
+	}
+
+	first, last := s.hosts()
+	if n := binary.BigEndian.Uint32(ip); n < first || n > last {
+		return false
+	}
+
+	for _, leased := range s.leases {
+		if leased.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// hosts returns the first and last host addresses of the subnet, between
+// the network and broadcast addresses.
+func (s *Server) hosts() (uint32, uint32) {
+	network := binary.BigEndian.Uint32(s.Subnet.IP.To4())
+	mask := binary.BigEndian.Uint32(net.IP(s.Subnet.Mask).To4())
+	return network + 1, (network | ^mask) - 1
+}
+
+func (s *Server) reply(request *Packet, messageType byte, ip net.IP) *Packet {
+	reply := &Packet{
+		Op:      BootReply,
+		XID:     request.XID,
+		Flags:   request.Flags,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  request.GIAddr,
+		CHAddr:  request.CHAddr,
+		Options: make(map[byte][]byte),
+	}
+
+	reply.Options[OptionMessageType] = []byte{messageType}
+	reply.Options[OptionServerIdentifier] = s.ServerIP.To4()
+	if messageType == Nak {
+		return reply
+	}
+
+	if messageType == Ack {
+		reply.CIAddr = request.CIAddr
+	}
+
+	reply.Options[OptionSubnetMask] = net.IP(s.Subnet.Mask).To4()
+	reply.Options[OptionRouter] = s.ServerIP.To4()
+	for _, dns := range s.DNSServers {
+		reply.Options[OptionDomainNameServer] = append(reply.Options[OptionDomainNameServer], dns.To4()...)
+	}
+
+	// an informing client has an address already
+	if ip != nil {
+		reply.YIAddr = ip
+		seconds := uint32(s.LeaseTime / time.Second)
+		reply.Options[OptionLeaseTime] = uint32Option(seconds)
+		reply.Options[OptionRenewalTime] = uint32Option(seconds / 2)
+		reply.Options[OptionRebindingTime] = uint32Option(seconds / 8 * 7)
+	}
+
+	return reply
+}
+
+// replyAddr returns where the reply to a request goes: to the relay agent
+// it came through, to the address it came from, or else broadcast, since
+// a client without an address cannot be reached otherwise.
+func replyAddr(request *Packet, addr net.Addr) net.Addr {
+	if !request.GIAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: request.GIAddr, Port: ServerPort}
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok && !udpAddr.IP.IsUnspecified() {
+		return udpAddr
+	}
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: ClientPort}
+}
+
+func uint32Option(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
@@ -0,0 +1,222 @@
+package dhcp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T) *Server {
+	_, subnet, err := net.ParseCIDR("192.168.250.0/29")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	s := NewServer(net.IPv4(192, 168, 250, 1), subnet)
+	s.DNSServers = []net.IP{net.IPv4(8, 8, 8, 8), net.IPv4(8, 8, 4, 4)}
+	return s
+}
+
+// testServe serves on a loopback socket, returning the socket of a client
+// sending to it.
+func testServe(t *testing.T, s *Server) (net.PacketConn, net.Addr) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	go s.Serve(conn)
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return client, conn.LocalAddr()
+}
+
+// testExchange sends a request from the client and returns the reply.
+func testExchange(t *testing.T, client net.PacketConn, addr net.Addr, request *Packet) *Packet {
+	if _, err := client.WriteTo(request.Marshal(), addr); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	reply, err := ParsePacket(buf[:n])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if reply.Op != BootReply || reply.XID != request.XID {
+		t.Fatalf("bad reply: %#v", reply)
+	}
+	return reply
+}
+
+func TestServer(t *testing.T) {
+	s := testServer(t)
+	client, addr := testServe(t, s)
+	defer client.Close()
+	defer s.Close()
+
+	offer := testExchange(t, client, addr, testPacket(Discover))
+	if offer.MessageType() != Offer {
+		t.Fatalf("bad message type: %d", offer.MessageType())
+	}
+	if !offer.YIAddr.Equal(net.IPv4(192, 168, 250, 2)) {
+		t.Fatalf("bad offered address: %s", offer.YIAddr)
+	}
+	if ip := offer.IPOption(OptionServerIdentifier); !ip.Equal(s.ServerIP) {
+		t.Fatalf("bad server identifier: %s", ip)
+	}
+	if ip := offer.IPOption(OptionRouter); !ip.Equal(s.ServerIP) {
+		t.Fatalf("bad router: %s", ip)
+	}
+	if mask := offer.IPOption(OptionSubnetMask); !mask.Equal(net.IPv4(255, 255, 255, 248)) {
+		t.Fatalf("bad subnet mask: %s", mask)
+	}
+	if dns := offer.Options[OptionDomainNameServer]; len(dns) != 8 || dns[0] != 8 || dns[6] != 4 {
+		t.Fatalf("bad DNS servers: %v", dns)
+	}
+
+	request := testPacket(Request)
+	request.Options[OptionRequestedIP] = offer.YIAddr
+	request.Options[OptionServerIdentifier] = s.ServerIP
+	ack := testExchange(t, client, addr, request)
+	if ack.MessageType() != Ack || !ack.YIAddr.Equal(offer.YIAddr) {
+		t.Fatalf("bad ack: %#v", ack)
+	}
+
+	leases := s.Leases()
+	if ip := leases["00:15:5d:01:02:03"]; !ip.Equal(offer.YIAddr) {
+		t.Fatalf("bad leases: %#v", leases)
+	}
+
+	// a renewing client asks for its own address
+	renew := testPacket(Request)
+	renew.CIAddr = offer.YIAddr
+	ack = testExchange(t, client, addr, renew)
+	if ack.MessageType() != Ack || !ack.CIAddr.Equal(offer.YIAddr) {
+		t.Fatalf("bad ack: %#v", ack)
+	}
+}
+
+func TestServer_clients(t *testing.T) {
+	s := testServer(t)
+	client, addr := testServe(t, s)
+	defer client.Close()
+	defer s.Close()
+
+	// a /29 has 6 hosts, the server then 5 clients
+	var offers []net.IP
+	for i := 0; i < 5; i++ {
+		discover := testPacket(Discover)
+		discover.XID = uint32(i)
+		discover.CHAddr = net.HardwareAddr{0x00, 0x15, 0x5d, 0x01, 0x02, byte(i)}
+		offer := testExchange(t, client, addr, discover)
+		offers = append(offers, offer.YIAddr)
+	}
+	if !offers[0].Equal(net.IPv4(192, 168, 250, 2)) || !offers[4].Equal(net.IPv4(192, 168, 250, 6)) {
+		t.Fatalf("bad offers: %v", offers)
+	}
+
+	discover := testPacket(Discover)
+	discover.CHAddr = net.HardwareAddr{0x00, 0x15, 0x5d, 0x01, 0x02, 0xff}
+	if reply := s.Handle(discover); reply != nil {
+		t.Fatalf("should not offer an address: %#v", reply)
+	}
+
+	// the address of another client is refused
+	request := testPacket(Request)
+	request.CHAddr = discover.CHAddr
+	request.Options[OptionRequestedIP] = offers[1]
+	nak := testExchange(t, client, addr, request)
+	if nak.MessageType() != Nak {
+		t.Fatalf("bad message type: %d", nak.MessageType())
+	}
+
+	// until it is released
+	release := testPacket(Release)
+	release.CHAddr = net.HardwareAddr{0x00, 0x15, 0x5d, 0x01, 0x02, 0x01}
+	if reply := s.Handle(release); reply != nil {
+		t.Fatalf("should not reply to a release: %#v", reply)
+	}
+	ack := testExchange(t, client, addr, request)
+	if ack.MessageType() != Ack || !ack.YIAddr.Equal(offers[1]) {
+		t.Fatalf("bad ack: %#v", ack)
+	}
+}
+
+func TestServer_decline(t *testing.T) {
+	s := testServer(t)
+
+	offer := s.Handle(testPacket(Discover))
+	if offer == nil || !offer.YIAddr.Equal(net.IPv4(192, 168, 250, 2)) {
+		t.Fatalf("bad offer: %#v", offer)
+	}
+
+	s.Handle(testPacket(Decline))
+	offer = s.Handle(testPacket(Discover))
+	if offer == nil || !offer.YIAddr.Equal(net.IPv4(192, 168, 250, 3)) {
+		t.Fatalf("should not offer a declined address: %#v", offer)
+	}
+}
+
+func TestServer_otherServer(t *testing.T) {
+	s := testServer(t)
+	s.Handle(testPacket(Discover))
+
+	request := testPacket(Request)
+	request.Options[OptionRequestedIP] = []byte{192, 168, 1, 10}
+	request.Options[OptionServerIdentifier] = []byte{192, 168, 1, 1}
+	if reply := s.Handle(request); reply != nil {
+		t.Fatalf("should not reply to a request for another server: %#v", reply)
+	}
+	if leases := s.Leases(); len(leases) != 0 {
+		t.Fatalf("should drop the offer: %#v", leases)
+	}
+}
+
+func TestServer_close(t *testing.T) {
+	s := testServer(t)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Serve(conn) }()
+
+	// Serve may not have started yet, which it then finds out
+	time.Sleep(10 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("should stop serving")
+	}
+}
+
+func TestReplyAddr(t *testing.T) {
+	request := testPacket(Discover)
+
+	addr := replyAddr(request, &net.UDPAddr{IP: net.IPv4zero, Port: ClientPort})
+	if addr.String() != "255.255.255.255:68" {
+		t.Fatalf("bad address: %s", addr)
+	}
+
+	request.GIAddr = net.IPv4(10, 0, 0, 1)
+	addr = replyAddr(request, &net.UDPAddr{IP: net.IPv4zero, Port: ClientPort})
+	if addr.String() != "10.0.0.1:67" {
+		t.Fatalf("bad address: %s", addr)
+	}
+}
@@ -15,6 +15,12 @@ type Driver interface {
 	// Checks if the VM named is running.
 	IsRunning(string) (bool, error)
 
+	// Checks if the VM named is off.
+	IsOff(string) (bool, error)
+
+	// Uptime returns the number of seconds the VM named has been running.
+	Uptime(string) (uint64, error)
+
 	// Start starts a VM specified by the name given.
 	Start(string) error
 
@@ -24,5 +30,213 @@ type Driver interface {
 	// Verify checks to make sure that this driver should function
 	// properly. If there is any indication the driver can't function,
 	// this will return an error.
-	Verify() error	
+	Verify() error
+
+	// Finds the IP address of the network adapter named of the VM named,
+	// or of any of its network adapters when the name is empty.
+	GetVirtualMachineNetworkAdapterAddress(string, string) (string, error)
+
+	// Finds the name of an external switch bound to an online physical
+	// network adapter. Returns an empty string if none can be found.
+	GetExternalOnlineVirtualSwitch() (string, error)
+
+	// Creates a switch of the given name and type unless it already
+	// exists. Returns true if the switch was created.
+	CreateVirtualSwitch(string, string) (bool, error)
+
+	// Creates an external switch of the given name unless it already
+	// exists, bound to the physical network adapter of the given name or,
+	// when the name is empty, interface description. Returns true if the
+	// switch was created.
+	CreateExternalVirtualSwitchOnNetAdapter(string, string, string) (bool, error)
+
+	// Returns the type of the switch of the given name, Internal, Private
+	// or External. Returns an empty string if there is no such switch.
+	GetVirtualSwitchType(string) (string, error)
+
+	// Returns the status of the physical network adapter of the given name
+	// or, when the name is empty, interface description, such as Up or
+	// Disconnected. Returns an empty string if there is no such adapter.
+	GetNetAdapterStatus(string, string) (string, error)
+
+	// Gives the host adapter of the internal switch named the gateway
+	// address given of the prefix, such as 192.168.250.0/24, and creates a
+	// NAT network of the name and prefix given.
+	CreateNetNat(string, string, string, string) error
+
+	// Deletes the NAT network named and the gateway address given, if they
+	// exist.
+	DeleteNetNat(string, string) error
+
+	// Returns the IPv4 addresses of the DNS servers of the host.
+	GetHostDnsServers() ([]string, error)
+
+	// Returns the IPv4 address of the host on the switch named, or an
+	// empty string if it has none.
+	GetHostAdapterIpAddressForSwitch(string) (string, error)
+
+	// Creates an external switch bound to an online physical network
+	// adapter and connects the VM named to it.
+	CreateExternalVirtualSwitch(string, string) error
+
+	// Deletes the switch named, if it exists.
+	DeleteVirtualSwitch(string) error
+
+	// Finds the name of the switch the VM named is connected to.
+	GetVirtualMachineSwitchName(string) (string, error)
+
+	// Connects the network adapter of the VM named to a switch.
+	ConnectVirtualMachineNetworkAdapterToSwitch(string, string) error
+
+	// Sets the VLAN ID of a management OS network adapter.
+	SetNetworkAdapterVlanId(string, string) error
+
+	// Sets the VLAN ID of the network adapter of the VM named.
+	SetVirtualMachineVlanId(string, string) error
+
+	// Connects the network adapter named of the VM named to a switch,
+	// adding it to the VM, which is off, unless it has one of that name.
+	AddVirtualMachineNetworkAdapter(string, string, string) error
+
+	// Sets the VLAN ID of the network adapter named of the VM named.
+	SetVirtualMachineNetworkAdapterVlanId(string, string, string) error
+
+	// Sets the static MAC address of the network adapter named of the VM
+	// named, which is off.
+	SetVirtualMachineNetworkAdapterMacAddress(string, string, string) error
+
+	// Disconnects the network adapter named of the VM named from its
+	// switch.
+	DisconnectVirtualMachineNetworkAdapter(string, string) error
+
+	// Removes the VLAN ID from the VM named and the management OS
+	// network adapter of the given switch.
+	UntagVirtualMachineNetworkAdapterVlan(string, string) error
+
+	// Creates a VM with the name, path, memory in bytes, switch name and
+	// generation given, without any hard disk.
+	CreateVirtualMachine(string, string, int64, string, uint) error
+
+	// Creates a virtual hard disk at the path given, with the disk type,
+	// size in bytes and block size in bytes given. A differencing disk
+	// takes its size from the parent disk at the last path given. A block
+	// size of 0 leaves the default of Hyper-V.
+	CreateVirtualHardDisk(string, string, int64, int64, string) error
+
+	// Deletes the virtual hard disk at the path given, if it exists.
+	DeleteVirtualHardDisk(string) error
+
+	// Attaches the virtual hard disk at the path given to the first free
+	// location of the IDE or SCSI controllers of the VM named. A SCSI
+	// controller is added to the VM if it has none.
+	AddVirtualMachineHardDiskDrive(string, string, string) error
+
+	// Turns secure boot of the generation 2 VM named on or off, using the
+	// secure boot template named if it is not empty.
+	SetVirtualMachineSecureBoot(string, bool, string) error
+
+	// Sets the number of virtual processors of the VM named, which is off.
+	SetVirtualMachineProcessorCount(string, uint) error
+
+	// Turns dynamic memory of the VM named, which is off, on or off. The
+	// minimum and maximum memory in bytes and the memory buffer in percent
+	// are set unless they are 0.
+	SetVirtualMachineDynamicMemory(string, bool, int64, int64, uint) error
+
+	// Exposes the virtualization extensions of the processor to the VM
+	// named, which is off and has static memory, or hides them.
+	SetVirtualMachineVirtualizationExtensions(string, bool) error
+
+	// Turns MAC address spoofing of the network adapters of the VM named
+	// on or off.
+	SetVirtualMachineMacSpoofing(string, bool) error
+
+	// Deletes the VM named.
+	DeleteVirtualMachine(string) error
+
+	// Starts the VM named.
+	StartVirtualMachine(string) error
+
+	// Types scancodes of scancode set 1 on the keyboard of the running VM
+	// named.
+	TypeScancodes(string, []byte) error
+
+	// Gracefully stops the VM named, if it is running.
+	StopVirtualMachine(string) error
+
+	// Restarts the VM named.
+	RestartVirtualMachine(string) error
+
+	// Enables an integration service on the VM named.
+	EnableVirtualMachineIntegrationService(string, string) error
+
+	// Exports the VM named to the path given.
+	ExportVirtualMachine(string, string) error
+
+	// Exports the checkpoint named of the VM named to the path given.
+	ExportVirtualMachineSnapshot(string, string, string) error
+
+	// Imports a copy of the VM exported to the first path given, with a
+	// new ID, as a VM with the name given whose files are kept under the
+	// second path. Its memory in bytes is set unless it is 0, and its
+	// network adapters are connected to the switch named.
+	ImportVirtualMachine(string, string, string, int64, string) error
+
+	// Returns the generation of the VM named.
+	GetVirtualMachineGeneration(string) (uint, error)
+
+	// Returns the number of virtual processors of the VM named.
+	GetVirtualMachineProcessorCount(string) (uint, error)
+
+	// Returns the startup memory of the VM named in bytes.
+	GetVirtualMachineMemory(string) (int64, error)
+
+	// Returns the physical memory of the host in bytes.
+	GetHostMemoryCapacity() (int64, error)
+
+	// Returns the free physical memory of the host in megabytes.
+	GetHostAvailableMemory() (float64, error)
+
+	// Returns the configuration versions of the VMs the host can create,
+	// such as 5.0 or 8.0.
+	GetHostSupportedVersions() ([]string, error)
+
+	// Copies the virtual hard disk at the first path given to the second.
+	CopyVirtualHardDisk(string, string) error
+
+	// Returns the paths of the hard disks attached to the VM named.
+	GetVirtualMachineHardDiskPaths(string) ([]string, error)
+
+	// Compacts the virtual hard disk at the path given, reclaiming the
+	// blocks holding only zeros or unused by its file system, and returns
+	// the size of its file before and after. A fixed disk is left as it is.
+	// The disk must not be in use.
+	CompactVirtualHardDisk(string) (int64, int64, error)
+
+	// Copies the disks and configuration of an exported VM to the
+	// output directory.
+	CopyExportedVirtualMachine(string, string, string, string) error
+
+	// Mounts an ISO image on the DVD drive of the VM named.
+	MountDvdDrive(string, string) error
+
+	// Ejects the image from the DVD drive of the VM named.
+	UnmountDvdDrive(string) error
+
+	// Adds a DVD drive with the ISO image mounted to the VM named and
+	// returns its controller number and location.
+	CreateDvdDrive(string, string) (uint, uint, error)
+
+	// Removes the DVD drive at the controller number and location given.
+	DeleteDvdDrive(string, uint, uint) error
+
+	// Makes the generation 2 VM named boot from the DVD drive at the
+	// controller number and location given.
+	SetBootDvdDrive(string, uint, uint) error
+
+	// Mounts a virtual floppy disk on the floppy drive of the VM named.
+	MountFloppyDrive(string, string) error
+
+	// Ejects the disk from the floppy drive of the VM named.
+	UnmountFloppyDrive(string) error
 }
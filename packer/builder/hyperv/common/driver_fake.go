@@ -0,0 +1,1849 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The power states a FakeVM can be in.
+type FakeVMState int
+
+const (
+	FakeVMStateOff FakeVMState = iota
+	FakeVMStateRunning
+	FakeVMStateSaved
+)
+
+func (s FakeVMState) String() string {
+	switch s {
+	case FakeVMStateOff:
+		return "Off"
+	case FakeVMStateRunning:
+		return "Running"
+	case FakeVMStateSaved:
+		return "Saved"
+	}
+	return fmt.Sprintf("FakeVMState(%d)", int(s))
+}
+
+const (
+	// Each IDE controller of a generation 1 VM has two locations, and
+	// the SCSI controller of a generation 2 VM has 64.
+	fakeIdeControllerLocations  = 2
+	fakeScsiControllerLocations = 64
+
+	// The number of seconds a running VM's uptime advances each time it
+	// is polled.
+	fakeUptimeStep = SleepSeconds
+)
+
+// FakeDvdDrive is a DVD drive attached to a FakeVM.
+type FakeDvdDrive struct {
+	ControllerNumber   uint
+	ControllerLocation uint
+	Path               string
+}
+
+// FakeHardDiskDrive is a hard disk drive attached to a FakeVM.
+type FakeHardDiskDrive struct {
+	ControllerType     string
+	ControllerNumber   uint
+	ControllerLocation uint
+	Path               string
+}
+
+// FakeDisk is a virtual hard disk created by a FakeDriver.
+type FakeDisk struct {
+	Path           string
+	Type           string
+	SizeBytes      int64
+	BlockSizeBytes int64
+	ParentPath     string
+
+	// The size of the file of the disk, and how much of it compaction
+	// reclaims, as blocks the guest zeroed or no longer uses.
+	FileSizeBytes    int64
+	ReclaimableBytes int64
+}
+
+// The size of the file of a new dynamic or differencing FakeDisk.
+const fakeEmptyDiskFileSize = 4 * 1024 * 1024
+
+// FakeVM is the in-memory state of a VM managed by a FakeDriver.
+type FakeVM struct {
+	Name           string
+	Path           string
+	Generation     uint
+	ProcessorCount uint
+	MemoryBytes    int64
+	State          FakeVMState
+	Uptime         uint64
+	DvdDrives      []*FakeDvdDrive
+	HardDiskDrives []*FakeHardDiskDrive
+	FloppyPath     string
+
+	// The number of SCSI controllers of the VM.
+	ScsiControllers uint
+
+	// The network adapters of the VM, the one New-VM adds first.
+	NetworkAdapters []*FakeNetworkAdapter
+
+	// The dynamic memory settings of the VM, with the memory in bytes and
+	// the buffer in percent.
+	DynamicMemory      bool
+	MinimumMemoryBytes int64
+	MaximumMemoryBytes int64
+	MemoryBuffer       uint
+
+	// Whether nested virtualization is on.
+	VirtualizationExtensions bool
+
+	// The firmware settings of a generation 2 VM.
+	SecureBoot         bool
+	SecureBootTemplate string
+	BootDvdDrive       *FakeDvdDrive
+
+	// The integration services of the VM, and whether they are enabled.
+	IntegrationServices map[string]bool
+
+	// The names of the checkpoints of the VM.
+	Snapshots []string
+
+	// The scancodes typed on the keyboard of the VM.
+	TypedScancodes []byte
+}
+
+// FakeNetworkAdapter is a network adapter of a FakeVM, with the address
+// it reports once the VM is running.
+type FakeNetworkAdapter struct {
+	Name       string
+	SwitchName string
+	VlanID     string
+	MacAddress string
+	IPAddress  string
+
+	// Whether the adapter may send frames from other MAC addresses.
+	MacSpoofing bool
+}
+
+// NetworkAdapter returns the network adapter named, or nil.
+func (vm *FakeVM) NetworkAdapter(adapterName string) *FakeNetworkAdapter {
+	for _, adapter := range vm.NetworkAdapters {
+		if adapter.Name == adapterName {
+			return adapter
+		}
+	}
+	return nil
+}
+
+// FakeSwitch is the in-memory state of a switch managed by a FakeDriver.
+type FakeSwitch struct {
+	Name   string
+	Type   string
+	VlanID string
+
+	// The physical network adapter an external switch is bound to.
+	NetAdapterName string
+}
+
+// FakeNetNat is a NAT network of the simulated host.
+type FakeNetNat struct {
+	Name       string
+	SwitchName string
+	Prefix     string
+	GatewayIP  string
+}
+
+// FakeNetAdapter is a physical network adapter of the simulated host.
+type FakeNetAdapter struct {
+	Name                 string
+	InterfaceDescription string
+	Status               string
+}
+
+type fakeTransition struct {
+	vmName string
+	poll   int
+	apply  func(*FakeVM)
+}
+
+// FakeDriver is an in-memory Driver that simulates a Hyper-V host. It
+// lets the builder steps be run without Hyper-V, records every call made
+// to it and can be told to fail calls or to change the state of a VM
+// after it has been polled a number of times.
+type FakeDriver struct {
+	// The VMs and switches on the simulated host, keyed by name.
+	VMs      map[string]*FakeVM
+	Switches map[string]*FakeSwitch
+
+	// The virtual hard disks on the simulated host, keyed by path.
+	Disks map[string]*FakeDisk
+
+	// The name of the switch reported by GetExternalOnlineVirtualSwitch.
+	ExternalOnlineSwitchName string
+
+	// The physical network adapters of the simulated host.
+	NetAdapters []*FakeNetAdapter
+
+	// The NAT networks of the simulated host, keyed by name, and the DNS
+	// servers it reports.
+	NetNats        map[string]*FakeNetNat
+	HostDnsServers []string
+
+	// The address of the host on each switch, keyed by switch name. The
+	// gateway of a NAT network is the address on its switch.
+	HostIPAddresses map[string]string
+
+	// The physical memory in bytes, the free memory in megabytes and the
+	// VM configuration versions of the simulated host.
+	HostMemoryCapacity    int64
+	HostAvailableMemory   float64
+	HostSupportedVersions []string
+
+	// The address the first network adapter of each VM reports once it is
+	// running, keyed by VM name.
+	IPAddresses map[string]string
+
+	// Errors to return from driver methods, keyed by method name.
+	Errors map[string]error
+
+	// The names of the driver methods called, in order.
+	Calls []string
+
+	polls       map[string]int
+	transitions []*fakeTransition
+	exports     map[string]*fakeExport
+	l           sync.Mutex
+}
+
+// fakeExport is what a FakeDriver remembers of a VM it exported, to
+// import it again like Hyper-V would from the configuration.
+type fakeExport struct {
+	vm    FakeVM
+	disks map[string]FakeDisk
+}
+
+// NewFakeDriver returns a FakeDriver for an empty host.
+func NewFakeDriver() *FakeDriver {
+	return &FakeDriver{
+		VMs:         make(map[string]*FakeVM),
+		Switches:    make(map[string]*FakeSwitch),
+		Disks:       make(map[string]*FakeDisk),
+		IPAddresses: make(map[string]string),
+		Errors:      make(map[string]error),
+		polls:       make(map[string]int),
+		exports:     make(map[string]*fakeExport),
+
+		HostMemoryCapacity:    16 * 1024 * 1024 * 1024,
+		HostAvailableMemory:   8 * 1024,
+		HostSupportedVersions: []string{"5.0", "8.0"},
+
+		NetAdapters: []*FakeNetAdapter{
+			{Name: "Ethernet", InterfaceDescription: "Fake Ethernet Adapter", Status: "Up"},
+		},
+		NetNats:         make(map[string]*FakeNetNat),
+		HostDnsServers:  []string{"10.0.0.53"},
+		HostIPAddresses: make(map[string]string),
+	}
+}
+
+// FailOn makes every subsequent call of the driver method named return err.
+func (d *FakeDriver) FailOn(method string, err error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.Errors[method] = err
+}
+
+// AfterPolls applies a change to the VM named once its state has been
+// polled, through IsRunning, IsOff or Uptime, the given number of times
+// from now.
+func (d *FakeDriver) AfterPolls(vmName string, polls int, apply func(*FakeVM)) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.transitions = append(d.transitions, &fakeTransition{
+		vmName: vmName,
+		poll:   d.polls[vmName] + polls,
+		apply:  apply,
+	})
+}
+
+// PowerOffAfterPolls powers off the VM named once it has been polled the
+// given number of times, as a guest shutting itself down would.
+func (d *FakeDriver) PowerOffAfterPolls(vmName string, polls int) {
+	d.AfterPolls(vmName, polls, func(vm *FakeVM) {
+		vm.State = FakeVMStateOff
+		vm.Uptime = 0
+	})
+}
+
+// RebootAfterPolls reboots the VM named once for each poll count given,
+// as a guest restarting during installation would.
+func (d *FakeDriver) RebootAfterPolls(vmName string, polls ...int) {
+	for _, p := range polls {
+		d.AfterPolls(vmName, p, func(vm *FakeVM) {
+			if vm.State == FakeVMStateRunning {
+				vm.Uptime = 0
+			}
+		})
+	}
+}
+
+// Called reports whether the driver method named has been called.
+func (d *FakeDriver) Called(method string) bool {
+	d.l.Lock()
+	defer d.l.Unlock()
+	for _, c := range d.Calls {
+		if c == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *FakeDriver) call(method string) error {
+	d.Calls = append(d.Calls, method)
+	return d.Errors[method]
+}
+
+func (d *FakeDriver) vm(vmName string) (*FakeVM, error) {
+	vm, ok := d.VMs[vmName]
+	if !ok {
+		return nil, fmt.Errorf("Hyper-V was unable to find a virtual machine with name %s.", vmName)
+	}
+	return vm, nil
+}
+
+func (d *FakeDriver) poll(vmName string) {
+	d.polls[vmName]++
+	count := d.polls[vmName]
+
+	vm, ok := d.VMs[vmName]
+	if !ok {
+		return
+	}
+
+	if vm.State == FakeVMStateRunning {
+		vm.Uptime += fakeUptimeStep
+	}
+
+	pending := d.transitions[:0]
+	for _, t := range d.transitions {
+		if t.vmName == vmName && t.poll <= count {
+			t.apply(vm)
+			continue
+		}
+		pending = append(pending, t)
+	}
+	d.transitions = pending
+}
+
+func (d *FakeDriver) IsRunning(vmName string) (bool, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("IsRunning"); err != nil {
+		return false, err
+	}
+
+	d.poll(vmName)
+	vm, ok := d.VMs[vmName]
+	return ok && vm.State == FakeVMStateRunning, nil
+}
+
+func (d *FakeDriver) IsOff(vmName string) (bool, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("IsOff"); err != nil {
+		return false, err
+	}
+
+	d.poll(vmName)
+	vm, ok := d.VMs[vmName]
+	return ok && vm.State == FakeVMStateOff, nil
+}
+
+func (d *FakeDriver) Uptime(vmName string) (uint64, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("Uptime"); err != nil {
+		return 0, err
+	}
+
+	d.poll(vmName)
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return 0, err
+	}
+	return vm.Uptime, nil
+}
+
+func (d *FakeDriver) Start(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("Start"); err != nil {
+		return err
+	}
+
+	if vm, ok := d.VMs[vmName]; ok && vm.State == FakeVMStateOff {
+		vm.State = FakeVMStateRunning
+		vm.Uptime = 0
+	}
+	return nil
+}
+
+func (d *FakeDriver) Stop(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("Stop"); err != nil {
+		return err
+	}
+
+	if vm, ok := d.VMs[vmName]; ok && vm.State == FakeVMStateRunning {
+		vm.State = FakeVMStateOff
+		vm.Uptime = 0
+	}
+	return nil
+}
+
+func (d *FakeDriver) Verify() error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return d.call("Verify")
+}
+
+func (d *FakeDriver) GetVirtualMachineNetworkAdapterAddress(vmName string, adapterName string) (string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetVirtualMachineNetworkAdapterAddress"); err != nil {
+		return "", err
+	}
+
+	// like the PowerShell implementation, "False" means no address yet
+	vm, ok := d.VMs[vmName]
+	if !ok || vm.State != FakeVMStateRunning {
+		return "False", nil
+	}
+
+	for _, adapter := range vm.NetworkAdapters {
+		if (adapterName == "" || adapter.Name == adapterName) && adapter.IPAddress != "" {
+			return adapter.IPAddress, nil
+		}
+	}
+	return "False", nil
+}
+
+func (d *FakeDriver) GetExternalOnlineVirtualSwitch() (string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetExternalOnlineVirtualSwitch"); err != nil {
+		return "", err
+	}
+	return d.ExternalOnlineSwitchName, nil
+}
+
+func (d *FakeDriver) CreateVirtualSwitch(switchName string, switchType string) (bool, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CreateVirtualSwitch"); err != nil {
+		return false, err
+	}
+
+	if _, ok := d.Switches[switchName]; ok {
+		return false, nil
+	}
+
+	d.Switches[switchName] = &FakeSwitch{Name: switchName, Type: switchType}
+	return true, nil
+}
+
+// CreateExternalVirtualSwitchOnNetAdapter fails like Hyper-V when the
+// adapter does not exist or another switch is bound to it.
+func (d *FakeDriver) CreateExternalVirtualSwitchOnNetAdapter(switchName string, netAdapterName string, netAdapterInterfaceDescription string) (bool, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CreateExternalVirtualSwitchOnNetAdapter"); err != nil {
+		return false, err
+	}
+
+	adapter := d.netAdapter(netAdapterName, netAdapterInterfaceDescription)
+
+	if sw, ok := d.Switches[switchName]; ok {
+		if sw.Type != SwitchTypeExternal || adapter == nil || sw.NetAdapterName != adapter.Name {
+			return false, fmt.Errorf("The switch '%s' exists with type %s on '%s', expected an External switch on '%s%s'.", switchName, sw.Type, sw.NetAdapterName, netAdapterName, netAdapterInterfaceDescription)
+		}
+		return false, nil
+	}
+
+	if adapter == nil {
+		return false, fmt.Errorf("network adapter '%s%s' not found", netAdapterName, netAdapterInterfaceDescription)
+	}
+
+	for _, sw := range d.Switches {
+		if sw.NetAdapterName == adapter.Name {
+			return false, fmt.Errorf("network adapter '%s' is bound to switch '%s'", adapter.Name, sw.Name)
+		}
+	}
+
+	d.Switches[switchName] = &FakeSwitch{Name: switchName, Type: "External", NetAdapterName: adapter.Name}
+	return true, nil
+}
+
+func (d *FakeDriver) GetVirtualSwitchType(switchName string) (string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetVirtualSwitchType"); err != nil {
+		return "", err
+	}
+
+	sw, ok := d.Switches[switchName]
+	if !ok {
+		return "", nil
+	}
+	return sw.Type, nil
+}
+
+func (d *FakeDriver) GetNetAdapterStatus(netAdapterName string, netAdapterInterfaceDescription string) (string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetNetAdapterStatus"); err != nil {
+		return "", err
+	}
+
+	adapter := d.netAdapter(netAdapterName, netAdapterInterfaceDescription)
+	if adapter == nil {
+		return "", nil
+	}
+	return adapter.Status, nil
+}
+
+// netAdapter returns the physical network adapter of the name or, when
+// the name is empty, interface description given, or nil.
+func (d *FakeDriver) netAdapter(name string, interfaceDescription string) *FakeNetAdapter {
+	for _, adapter := range d.NetAdapters {
+		if name != "" && adapter.Name == name || name == "" && adapter.InterfaceDescription == interfaceDescription {
+			return adapter
+		}
+	}
+	return nil
+}
+
+// CreateNetNat fails like Windows when the switch is not internal or
+// the host has a NAT network already, since it only has one.
+func (d *FakeDriver) CreateNetNat(natName string, switchName string, prefix string, gatewayIP string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CreateNetNat"); err != nil {
+		return err
+	}
+
+	if sw, ok := d.Switches[switchName]; !ok || sw.Type != "Internal" {
+		return fmt.Errorf("no host adapter for switch '%s'", switchName)
+	}
+	for _, nat := range d.NetNats {
+		return fmt.Errorf("the host has NAT network '%s' already", nat.Name)
+	}
+
+	d.NetNats[natName] = &FakeNetNat{Name: natName, SwitchName: switchName, Prefix: prefix, GatewayIP: gatewayIP}
+	return nil
+}
+
+func (d *FakeDriver) DeleteNetNat(natName string, gatewayIP string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("DeleteNetNat"); err != nil {
+		return err
+	}
+
+	delete(d.NetNats, natName)
+	return nil
+}
+
+func (d *FakeDriver) GetHostDnsServers() ([]string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetHostDnsServers"); err != nil {
+		return nil, err
+	}
+	return d.HostDnsServers, nil
+}
+
+func (d *FakeDriver) GetHostAdapterIpAddressForSwitch(switchName string) (string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetHostAdapterIpAddressForSwitch"); err != nil {
+		return "", err
+	}
+
+	for _, nat := range d.NetNats {
+		if nat.SwitchName == switchName {
+			return nat.GatewayIP, nil
+		}
+	}
+	return d.HostIPAddresses[switchName], nil
+}
+
+func (d *FakeDriver) CreateExternalVirtualSwitch(vmName string, switchName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CreateExternalVirtualSwitch"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	// an existing external switch is reused rather than created
+	for _, sw := range d.Switches {
+		if sw.Type == "External" {
+			vm.connect(sw.Name)
+			return nil
+		}
+	}
+
+	d.Switches[switchName] = &FakeSwitch{Name: switchName, Type: "External"}
+	vm.connect(switchName)
+	return nil
+}
+
+func (d *FakeDriver) DeleteVirtualSwitch(switchName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("DeleteVirtualSwitch"); err != nil {
+		return err
+	}
+
+	for _, vm := range d.VMs {
+		for _, adapter := range vm.NetworkAdapters {
+			if adapter.SwitchName == switchName {
+				adapter.SwitchName = ""
+			}
+		}
+	}
+
+	delete(d.Switches, switchName)
+	return nil
+}
+
+func (d *FakeDriver) GetVirtualMachineSwitchName(vmName string) (string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetVirtualMachineSwitchName"); err != nil {
+		return "", err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return "", err
+	}
+	if len(vm.NetworkAdapters) == 0 {
+		return "", nil
+	}
+	return vm.NetworkAdapters[0].SwitchName, nil
+}
+
+func (d *FakeDriver) ConnectVirtualMachineNetworkAdapterToSwitch(vmName string, switchName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("ConnectVirtualMachineNetworkAdapterToSwitch"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := d.Switches[switchName]; !ok {
+		return fmt.Errorf("Hyper-V was unable to find a virtual switch with name %s.", switchName)
+	}
+
+	vm.connect(switchName)
+	return nil
+}
+
+// connect connects all the network adapters of the VM to the switch
+// named, as Connect-VMNetworkAdapter -VMName does.
+func (vm *FakeVM) connect(switchName string) {
+	for _, adapter := range vm.NetworkAdapters {
+		adapter.SwitchName = switchName
+	}
+}
+
+func (d *FakeDriver) SetNetworkAdapterVlanId(switchName string, vlanId string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetNetworkAdapterVlanId"); err != nil {
+		return err
+	}
+
+	sw, ok := d.Switches[switchName]
+	if !ok {
+		return fmt.Errorf("Hyper-V was unable to find a network adapter with name %s.", switchName)
+	}
+
+	sw.VlanID = vlanId
+	return nil
+}
+
+func (d *FakeDriver) SetVirtualMachineVlanId(vmName string, vlanId string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineVlanId"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	for _, adapter := range vm.NetworkAdapters {
+		adapter.VlanID = vlanId
+	}
+	return nil
+}
+
+func (d *FakeDriver) AddVirtualMachineNetworkAdapter(vmName string, adapterName string, switchName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("AddVirtualMachineNetworkAdapter"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := d.Switches[switchName]; !ok {
+		return fmt.Errorf("Hyper-V was unable to find a virtual switch with name %s.", switchName)
+	}
+
+	if adapter := vm.NetworkAdapter(adapterName); adapter != nil {
+		adapter.SwitchName = switchName
+		return nil
+	}
+
+	if _, err := d.offVM(vmName); err != nil {
+		return err
+	}
+	if len(vm.NetworkAdapters) >= MaxNetworkAdapters {
+		return fmt.Errorf("Virtual machine '%s' already has %d network adapters.", vmName, MaxNetworkAdapters)
+	}
+
+	vm.NetworkAdapters = append(vm.NetworkAdapters, &FakeNetworkAdapter{Name: adapterName, SwitchName: switchName})
+	return nil
+}
+
+func (d *FakeDriver) SetVirtualMachineNetworkAdapterVlanId(vmName string, adapterName string, vlanId string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineNetworkAdapterVlanId"); err != nil {
+		return err
+	}
+
+	adapter, err := d.networkAdapter(vmName, adapterName)
+	if err != nil {
+		return err
+	}
+
+	adapter.VlanID = vlanId
+	return nil
+}
+
+func (d *FakeDriver) SetVirtualMachineNetworkAdapterMacAddress(vmName string, adapterName string, macAddress string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineNetworkAdapterMacAddress"); err != nil {
+		return err
+	}
+
+	if _, err := d.offVM(vmName); err != nil {
+		return err
+	}
+
+	adapter, err := d.networkAdapter(vmName, adapterName)
+	if err != nil {
+		return err
+	}
+
+	adapter.MacAddress = macAddress
+	return nil
+}
+
+func (d *FakeDriver) DisconnectVirtualMachineNetworkAdapter(vmName string, adapterName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("DisconnectVirtualMachineNetworkAdapter"); err != nil {
+		return err
+	}
+
+	adapter, err := d.networkAdapter(vmName, adapterName)
+	if err != nil {
+		return err
+	}
+
+	adapter.SwitchName = ""
+	return nil
+}
+
+func (d *FakeDriver) networkAdapter(vmName string, adapterName string) (*FakeNetworkAdapter, error) {
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	adapter := vm.NetworkAdapter(adapterName)
+	if adapter == nil {
+		return nil, fmt.Errorf("No network adapter named '%s' was found for virtual machine '%s'.", adapterName, vmName)
+	}
+	return adapter, nil
+}
+
+func (d *FakeDriver) UntagVirtualMachineNetworkAdapterVlan(vmName string, switchName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("UntagVirtualMachineNetworkAdapterVlan"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	for _, adapter := range vm.NetworkAdapters {
+		adapter.VlanID = ""
+	}
+	if sw, ok := d.Switches[switchName]; ok {
+		sw.VlanID = ""
+	}
+	return nil
+}
+
+func (d *FakeDriver) CreateVirtualMachine(vmName string, path string, ram int64, switchName string, generation uint) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CreateVirtualMachine"); err != nil {
+		return err
+	}
+
+	if _, ok := d.VMs[vmName]; ok {
+		return fmt.Errorf("A virtual machine with name %s already exists.", vmName)
+	}
+
+	if _, ok := d.Switches[switchName]; !ok {
+		return fmt.Errorf("Hyper-V was unable to find a virtual switch with name %s.", switchName)
+	}
+
+	if generation != 1 && generation != 2 {
+		return fmt.Errorf("Cannot validate argument on parameter 'Generation'. The argument \"%d\" does not belong to the set \"1,2\".", generation)
+	}
+
+	d.VMs[vmName] = d.newVM(vmName, path, ram, switchName, generation)
+	return nil
+}
+
+// newVM returns a VM as New-VM creates it: generation 1 VMs with a DVD
+// drive on IDE 1:0, and generation 2 VMs with secure boot on, a SCSI
+// controller and no DVD drive at all.
+func (d *FakeDriver) newVM(vmName string, path string, ram int64, switchName string, generation uint) *FakeVM {
+	var dvdDrives []*FakeDvdDrive
+	var scsiControllers uint
+	if generation == 1 {
+		dvdDrives = append(dvdDrives, &FakeDvdDrive{ControllerNumber: 1, ControllerLocation: 0})
+	} else {
+		scsiControllers = 1
+	}
+
+	return &FakeVM{
+		Name:            vmName,
+		Path:            path,
+		Generation:      generation,
+		ProcessorCount:  1,
+		MemoryBytes:     ram,
+		State:           FakeVMStateOff,
+		DvdDrives:       dvdDrives,
+		ScsiControllers: scsiControllers,
+		NetworkAdapters: []*FakeNetworkAdapter{{
+			Name:       DefaultNetworkAdapterName,
+			SwitchName: switchName,
+			IPAddress:  d.IPAddresses[vmName],
+		}},
+		SecureBoot: generation == 2,
+		IntegrationServices: map[string]bool{
+			"Time Synchronization":    true,
+			"Heartbeat":               true,
+			"Key-Value Pair Exchange": true,
+			"Shutdown":                true,
+			"VSS":                     true,
+			"Guest Service Interface": false,
+		},
+	}
+}
+
+func (d *FakeDriver) CreateVirtualHardDisk(path string, diskType string, sizeBytes int64, blockSizeBytes int64, parentPath string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CreateVirtualHardDisk"); err != nil {
+		return err
+	}
+
+	if _, ok := d.Disks[path]; ok {
+		return fmt.Errorf("The file '%s' already exists.", path)
+	}
+
+	if blockSizeBytes < 0 || blockSizeBytes&(blockSizeBytes-1) != 0 || blockSizeBytes > 256*1024*1024 {
+		return fmt.Errorf("The block size %d is not supported.", blockSizeBytes)
+	}
+
+	switch diskType {
+	case DiskTypeDifferencing:
+		parent, ok := d.Disks[parentPath]
+		if !ok {
+			return fmt.Errorf("The parent virtual hard disk '%s' was not found.", parentPath)
+		}
+		sizeBytes = parent.SizeBytes
+	case DiskTypeFixed, DiskTypeDynamic:
+		if sizeBytes <= 0 {
+			return fmt.Errorf("The size %d of the virtual hard disk is not valid.", sizeBytes)
+		}
+		parentPath = ""
+	default:
+		return fmt.Errorf("The virtual hard disk type '%s' is not supported.", diskType)
+	}
+
+	fileSizeBytes := int64(fakeEmptyDiskFileSize)
+	if diskType == DiskTypeFixed {
+		fileSizeBytes = sizeBytes
+	}
+
+	d.Disks[path] = &FakeDisk{
+		Path:           path,
+		Type:           diskType,
+		SizeBytes:      sizeBytes,
+		BlockSizeBytes: blockSizeBytes,
+		ParentPath:     parentPath,
+		FileSizeBytes:  fileSizeBytes,
+	}
+	return nil
+}
+
+func (d *FakeDriver) DeleteVirtualHardDisk(path string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("DeleteVirtualHardDisk"); err != nil {
+		return err
+	}
+
+	// like a file, a disk cannot be removed while a VM holds it open
+	for _, vm := range d.VMs {
+		for _, drive := range vm.HardDiskDrives {
+			if drive.Path == path {
+				return fmt.Errorf("The process cannot access the file '%s' because it is being used by another process.", path)
+			}
+		}
+	}
+
+	for _, disk := range d.Disks {
+		if disk.ParentPath == path {
+			return fmt.Errorf("The virtual hard disk '%s' is the parent of '%s'.", path, disk.Path)
+		}
+	}
+
+	delete(d.Disks, path)
+	return nil
+}
+
+func (d *FakeDriver) AddVirtualMachineHardDiskDrive(vmName string, path string, controllerType string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("AddVirtualMachineHardDiskDrive"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := d.Disks[path]; !ok {
+		return fmt.Errorf("The virtual hard disk '%s' was not found.", path)
+	}
+
+	var controllers, locations uint
+	switch controllerType {
+	case ControllerTypeIDE:
+		if vm.Generation == 2 {
+			return fmt.Errorf("Generation 2 virtual machines have no IDE controller.")
+		}
+		if vm.State != FakeVMStateOff {
+			return fmt.Errorf("Cannot add an IDE hard disk drive to '%s' while it is %s.", vmName, vm.State)
+		}
+		controllers, locations = 2, fakeIdeControllerLocations
+	case ControllerTypeSCSI:
+		if vm.ScsiControllers == 0 {
+			if vm.State != FakeVMStateOff {
+				return fmt.Errorf("Cannot add a SCSI controller to '%s' while it is %s.", vmName, vm.State)
+			}
+			vm.ScsiControllers = 1
+		}
+		controllers, locations = vm.ScsiControllers, fakeScsiControllerLocations
+	default:
+		return fmt.Errorf("The controller type '%s' is not supported.", controllerType)
+	}
+
+	for controllerNumber := uint(0); controllerNumber < controllers; controllerNumber++ {
+		for location := uint(0); location < locations; location++ {
+			if vm.inUse(controllerType, controllerNumber, location) {
+				continue
+			}
+
+			vm.HardDiskDrives = append(vm.HardDiskDrives, &FakeHardDiskDrive{
+				ControllerType:     controllerType,
+				ControllerNumber:   controllerNumber,
+				ControllerLocation: location,
+				Path:               path,
+			})
+			return nil
+		}
+	}
+
+	return fmt.Errorf("There is no free location for a hard disk drive on '%s'.", vmName)
+}
+
+func (d *FakeDriver) SetVirtualMachineSecureBoot(vmName string, enable bool, templateName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineSecureBoot"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.Generation != 2 {
+		return fmt.Errorf("The virtual machine '%s' does not have UEFI firmware.", vmName)
+	}
+
+	vm.SecureBoot = enable
+	if templateName != "" {
+		vm.SecureBootTemplate = templateName
+	}
+	return nil
+}
+
+// offVM returns the VM named, or an error unless it is off, as Hyper-V
+// requires for changing its processors and memory.
+func (d *FakeDriver) offVM(vmName string) (*FakeVM, error) {
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.State != FakeVMStateOff {
+		return nil, fmt.Errorf("The virtual machine '%s' must be turned off.", vmName)
+	}
+	return vm, nil
+}
+
+func (d *FakeDriver) SetVirtualMachineProcessorCount(vmName string, count uint) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineProcessorCount"); err != nil {
+		return err
+	}
+
+	vm, err := d.offVM(vmName)
+	if err != nil {
+		return err
+	}
+
+	vm.ProcessorCount = count
+	return nil
+}
+
+func (d *FakeDriver) SetVirtualMachineDynamicMemory(vmName string, enable bool, minimumBytes int64, maximumBytes int64, buffer uint) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineDynamicMemory"); err != nil {
+		return err
+	}
+
+	vm, err := d.offVM(vmName)
+	if err != nil {
+		return err
+	}
+
+	if enable && vm.VirtualizationExtensions {
+		return fmt.Errorf("Cannot enable dynamic memory on virtual machine '%s' while nested virtualization is enabled.", vmName)
+	}
+
+	vm.DynamicMemory = enable
+	if minimumBytes > 0 {
+		vm.MinimumMemoryBytes = minimumBytes
+	}
+	if maximumBytes > 0 {
+		vm.MaximumMemoryBytes = maximumBytes
+	}
+	if buffer > 0 {
+		vm.MemoryBuffer = buffer
+	}
+	return nil
+}
+
+func (d *FakeDriver) SetVirtualMachineVirtualizationExtensions(vmName string, enable bool) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineVirtualizationExtensions"); err != nil {
+		return err
+	}
+
+	vm, err := d.offVM(vmName)
+	if err != nil {
+		return err
+	}
+
+	if enable && vm.DynamicMemory {
+		return fmt.Errorf("Cannot enable nested virtualization on virtual machine '%s' while dynamic memory is enabled.", vmName)
+	}
+
+	vm.VirtualizationExtensions = enable
+	return nil
+}
+
+func (d *FakeDriver) SetVirtualMachineMacSpoofing(vmName string, enable bool) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetVirtualMachineMacSpoofing"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	// Set-VMNetworkAdapter -VMName changes the adapters the VM has now
+	for _, adapter := range vm.NetworkAdapters {
+		adapter.MacSpoofing = enable
+	}
+	return nil
+}
+
+func (d *FakeDriver) DeleteVirtualMachine(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("DeleteVirtualMachine"); err != nil {
+		return err
+	}
+
+	if _, err := d.vm(vmName); err != nil {
+		return err
+	}
+
+	delete(d.VMs, vmName)
+	return nil
+}
+
+func (d *FakeDriver) StartVirtualMachine(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("StartVirtualMachine"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	switch vm.State {
+	case FakeVMStateRunning:
+		return fmt.Errorf("'%s' failed to change state. The operation cannot be performed while the object is in its current state.", vmName)
+	case FakeVMStateOff:
+		vm.Uptime = 0
+	}
+
+	vm.State = FakeVMStateRunning
+	return nil
+}
+
+func (d *FakeDriver) TypeScancodes(vmName string, scancodes []byte) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("TypeScancodes"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.State != FakeVMStateRunning {
+		return fmt.Errorf("The keyboard of '%s' cannot be typed on, the VM is not running.", vmName)
+	}
+
+	vm.TypedScancodes = append(vm.TypedScancodes, scancodes...)
+	return nil
+}
+
+func (d *FakeDriver) StopVirtualMachine(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("StopVirtualMachine"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.State == FakeVMStateRunning {
+		vm.State = FakeVMStateOff
+		vm.Uptime = 0
+	}
+	return nil
+}
+
+func (d *FakeDriver) RestartVirtualMachine(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("RestartVirtualMachine"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.State != FakeVMStateRunning {
+		return fmt.Errorf("'%s' failed to change state. The operation cannot be performed while the object is in its current state.", vmName)
+	}
+
+	vm.Uptime = 0
+	return nil
+}
+
+func (d *FakeDriver) EnableVirtualMachineIntegrationService(vmName string, integrationServiceName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("EnableVirtualMachineIntegrationService"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := vm.IntegrationServices[integrationServiceName]; !ok {
+		return fmt.Errorf("No integration service named '%s' was found for '%s'.", integrationServiceName, vmName)
+	}
+
+	vm.IntegrationServices[integrationServiceName] = true
+	return nil
+}
+
+// ExportVirtualMachine writes the layout of a Hyper-V export to disk:
+// a directory named after the VM holding the "Virtual Hard Disks" and
+// "Virtual Machines" directories, with an empty file for each hard disk
+// attached to the VM.
+func (d *FakeDriver) ExportVirtualMachine(vmName string, path string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("ExportVirtualMachine"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	return d.export(vm, path)
+}
+
+func (d *FakeDriver) ExportVirtualMachineSnapshot(vmName string, snapshotName string, path string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("ExportVirtualMachineSnapshot"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range vm.Snapshots {
+		if name == snapshotName {
+			return d.export(vm, path)
+		}
+	}
+
+	return fmt.Errorf("Hyper-V was unable to find a checkpoint with name %s for '%s'.", snapshotName, vmName)
+}
+
+func (d *FakeDriver) export(vm *FakeVM, path string) error {
+	exportPath := filepath.Join(path, vm.Name)
+	files := map[string]string{
+		filepath.Join(exportPath, VmDir, vm.Name+".xml"): "<configuration/>",
+	}
+
+	export := &fakeExport{vm: *vm, disks: make(map[string]FakeDisk)}
+	for _, drive := range vm.HardDiskDrives {
+		name := filepath.Base(drive.Path)
+		files[filepath.Join(exportPath, VhdDir, name)] = ""
+		if disk, ok := d.Disks[drive.Path]; ok {
+			export.disks[name] = *disk
+		}
+	}
+	d.exports[exportPath] = export
+
+	for name, contents := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.WriteString(f, contents)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ImportVirtualMachine registers a copy of a VM exported to exportPath.
+// A VM the FakeDriver exported itself is imported with its settings and
+// drives, any other export as a VM of generation 1 with its disks on the
+// IDE controllers.
+func (d *FakeDriver) ImportVirtualMachine(exportPath string, vmName string, path string, ram int64, switchName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("ImportVirtualMachine"); err != nil {
+		return err
+	}
+
+	if _, ok := d.VMs[vmName]; ok {
+		return fmt.Errorf("A virtual machine with name %s already exists.", vmName)
+	}
+
+	if _, ok := d.Switches[switchName]; !ok {
+		return fmt.Errorf("Hyper-V was unable to find a virtual switch with name %s.", switchName)
+	}
+
+	var configs []string
+	for _, pattern := range []string{"*.xml", "*.vmcx"} {
+		matches, err := filepath.Glob(filepath.Join(exportPath, VmDir, pattern))
+		if err != nil {
+			return err
+		}
+		configs = append(configs, matches...)
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("No virtual machine configuration was found in '%s'.", filepath.Join(exportPath, VmDir))
+	}
+
+	vhdPath := filepath.Join(path, VhdDir)
+
+	var vm *FakeVM
+	if export, ok := d.exports[exportPath]; ok {
+		source := export.vm
+		vm = d.newVM(vmName, path, source.MemoryBytes, switchName, source.Generation)
+		vm.ProcessorCount = source.ProcessorCount
+		vm.DynamicMemory = source.DynamicMemory
+		vm.MinimumMemoryBytes = source.MinimumMemoryBytes
+		vm.MaximumMemoryBytes = source.MaximumMemoryBytes
+		vm.MemoryBuffer = source.MemoryBuffer
+		vm.VirtualizationExtensions = source.VirtualizationExtensions
+		vm.SecureBoot = source.SecureBoot
+		vm.SecureBootTemplate = source.SecureBootTemplate
+		vm.ScsiControllers = source.ScsiControllers
+
+		// the adapters keep their settings, connected to the switch
+		vm.NetworkAdapters = nil
+		for i, adapter := range source.NetworkAdapters {
+			networkAdapter := *adapter
+			networkAdapter.SwitchName = switchName
+			networkAdapter.IPAddress = ""
+			if i == 0 {
+				networkAdapter.IPAddress = d.IPAddresses[vmName]
+			}
+			vm.NetworkAdapters = append(vm.NetworkAdapters, &networkAdapter)
+		}
+
+		vm.DvdDrives = nil
+		for _, drive := range source.DvdDrives {
+			dvdDrive := *drive
+			vm.DvdDrives = append(vm.DvdDrives, &dvdDrive)
+		}
+
+		for service, enabled := range source.IntegrationServices {
+			vm.IntegrationServices[service] = enabled
+		}
+
+		for _, drive := range source.HardDiskDrives {
+			name := filepath.Base(drive.Path)
+			disk, ok := export.disks[name]
+			if !ok {
+				disk = FakeDisk{Type: DiskTypeDynamic}
+			}
+			disk.Path = filepath.Join(vhdPath, name)
+			d.Disks[disk.Path] = &disk
+
+			hardDiskDrive := *drive
+			hardDiskDrive.Path = disk.Path
+			vm.HardDiskDrives = append(vm.HardDiskDrives, &hardDiskDrive)
+		}
+	} else {
+		vm = d.newVM(vmName, path, 0, switchName, 1)
+
+		infos, err := ioutil.ReadDir(filepath.Join(exportPath, VhdDir))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		for i, info := range infos {
+			if i == 2*fakeIdeControllerLocations-1 {
+				return fmt.Errorf("There is no free location for a hard disk drive on '%s'.", vmName)
+			}
+
+			disk := &FakeDisk{
+				Path:          filepath.Join(vhdPath, info.Name()),
+				Type:          DiskTypeDynamic,
+				SizeBytes:     info.Size(),
+				FileSizeBytes: info.Size(),
+			}
+			d.Disks[disk.Path] = disk
+
+			// the DVD drive of the new VM takes IDE 1:0
+			location := uint(i)
+			if location >= 2 {
+				location++
+			}
+			vm.HardDiskDrives = append(vm.HardDiskDrives, &FakeHardDiskDrive{
+				ControllerType:     ControllerTypeIDE,
+				ControllerNumber:   location / fakeIdeControllerLocations,
+				ControllerLocation: location % fakeIdeControllerLocations,
+				Path:               disk.Path,
+			})
+		}
+	}
+
+	if ram > 0 {
+		vm.MemoryBytes = ram
+	}
+
+	d.VMs[vmName] = vm
+	return nil
+}
+
+func (d *FakeDriver) GetVirtualMachineGeneration(vmName string) (uint, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetVirtualMachineGeneration"); err != nil {
+		return 0, err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return 0, err
+	}
+	return vm.Generation, nil
+}
+
+func (d *FakeDriver) GetVirtualMachineProcessorCount(vmName string) (uint, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetVirtualMachineProcessorCount"); err != nil {
+		return 0, err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return 0, err
+	}
+	return vm.ProcessorCount, nil
+}
+
+func (d *FakeDriver) GetVirtualMachineMemory(vmName string) (int64, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetVirtualMachineMemory"); err != nil {
+		return 0, err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return 0, err
+	}
+	return vm.MemoryBytes, nil
+}
+
+func (d *FakeDriver) GetHostMemoryCapacity() (int64, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetHostMemoryCapacity"); err != nil {
+		return 0, err
+	}
+	return d.HostMemoryCapacity, nil
+}
+
+func (d *FakeDriver) GetHostAvailableMemory() (float64, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetHostAvailableMemory"); err != nil {
+		return 0, err
+	}
+	return d.HostAvailableMemory, nil
+}
+
+func (d *FakeDriver) GetHostSupportedVersions() ([]string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetHostSupportedVersions"); err != nil {
+		return nil, err
+	}
+	return d.HostSupportedVersions, nil
+}
+
+// CopyVirtualHardDisk copies a disk the FakeDriver created, or registers
+// a copy of a disk file that exists on the host as a dynamic disk.
+func (d *FakeDriver) CopyVirtualHardDisk(sourcePath string, path string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CopyVirtualHardDisk"); err != nil {
+		return err
+	}
+
+	if _, ok := d.Disks[path]; ok {
+		return fmt.Errorf("The file '%s' already exists.", path)
+	}
+
+	disk, ok := d.Disks[sourcePath]
+	if !ok {
+		info, err := os.Stat(sourcePath)
+		if err != nil {
+			return fmt.Errorf("Cannot find path '%s' because it does not exist.", sourcePath)
+		}
+		disk = &FakeDisk{Type: DiskTypeDynamic, SizeBytes: info.Size(), FileSizeBytes: info.Size()}
+	}
+
+	clone := *disk
+	clone.Path = path
+	d.Disks[path] = &clone
+	return nil
+}
+
+func (d *FakeDriver) GetVirtualMachineHardDiskPaths(vmName string) ([]string, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("GetVirtualMachineHardDiskPaths"); err != nil {
+		return nil, err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(vm.HardDiskDrives))
+	for _, drive := range vm.HardDiskDrives {
+		paths = append(paths, drive.Path)
+	}
+	return paths, nil
+}
+
+// CompactVirtualHardDisk shrinks the file of a dynamic or differencing
+// disk by its ReclaimableBytes.
+func (d *FakeDriver) CompactVirtualHardDisk(path string) (int64, int64, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CompactVirtualHardDisk"); err != nil {
+		return 0, 0, err
+	}
+
+	disk, ok := d.Disks[path]
+	if !ok {
+		return 0, 0, fmt.Errorf("The virtual hard disk '%s' was not found.", path)
+	}
+
+	// the disk of a running VM cannot be mounted to be compacted
+	for _, vm := range d.VMs {
+		for _, drive := range vm.HardDiskDrives {
+			if drive.Path == path && vm.State != FakeVMStateOff {
+				return 0, 0, fmt.Errorf("The process cannot access the file '%s' because it is being used by another process.", path)
+			}
+		}
+	}
+
+	before := disk.FileSizeBytes
+	if disk.Type != DiskTypeFixed {
+		disk.FileSizeBytes -= disk.ReclaimableBytes
+		disk.ReclaimableBytes = 0
+	}
+	return before, disk.FileSizeBytes, nil
+}
+
+func (d *FakeDriver) CopyExportedVirtualMachine(expPath string, outputPath string, vhdDir string, vmDir string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CopyExportedVirtualMachine"); err != nil {
+		return err
+	}
+
+	if err := fakeCopyTree(filepath.Join(expPath, vhdDir), filepath.Join(outputPath, vhdDir)); err != nil {
+		return err
+	}
+
+	return fakeCopyTree(filepath.Join(expPath, vmDir), filepath.Join(outputPath, vmDir))
+}
+
+func (d *FakeDriver) MountDvdDrive(vmName string, path string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("MountDvdDrive"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if len(vm.DvdDrives) == 0 {
+		return fmt.Errorf("No DVD drive was found for '%s'.", vmName)
+	}
+
+	// without a controller, Set-VMDvdDrive applies to every DVD drive
+	for _, drive := range vm.DvdDrives {
+		drive.Path = path
+	}
+	return nil
+}
+
+func (d *FakeDriver) UnmountDvdDrive(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("UnmountDvdDrive"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	for _, drive := range vm.DvdDrives {
+		drive.Path = ""
+	}
+	return nil
+}
+
+func (d *FakeDriver) CreateDvdDrive(vmName string, isoPath string) (uint, uint, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("CreateDvdDrive"); err != nil {
+		return 0, 0, err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if vm.State != FakeVMStateOff {
+		return 0, 0, fmt.Errorf("Cannot add a DVD drive to '%s' while it is %s.", vmName, vm.State)
+	}
+
+	// generation 1 VMs have two IDE controllers and generation 2 VMs one
+	// SCSI controller, shared with the hard disks
+	controllerType, controllers, locations := ControllerTypeIDE, uint(2), uint(fakeIdeControllerLocations)
+	if vm.Generation == 2 {
+		controllerType, controllers, locations = ControllerTypeSCSI, 1, fakeScsiControllerLocations
+	}
+
+	for controllerNumber := uint(0); controllerNumber < controllers; controllerNumber++ {
+		for location := uint(0); location < locations; location++ {
+			if vm.inUse(controllerType, controllerNumber, location) {
+				continue
+			}
+
+			vm.DvdDrives = append(vm.DvdDrives, &FakeDvdDrive{
+				ControllerNumber:   controllerNumber,
+				ControllerLocation: location,
+				Path:               isoPath,
+			})
+			return controllerNumber, location, nil
+		}
+	}
+
+	return 0, 0, fmt.Errorf("There is no free location for a DVD drive on '%s'.", vmName)
+}
+
+func (d *FakeDriver) DeleteDvdDrive(vmName string, controllerNumber uint, controllerLocation uint) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("DeleteDvdDrive"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	for i, drive := range vm.DvdDrives {
+		if drive.ControllerNumber == controllerNumber && drive.ControllerLocation == controllerLocation {
+			vm.DvdDrives = append(vm.DvdDrives[:i], vm.DvdDrives[i+1:]...)
+			if vm.BootDvdDrive == drive {
+				vm.BootDvdDrive = nil
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("No DVD drive was found at %d:%d for '%s'.", controllerNumber, controllerLocation, vmName)
+}
+
+func (d *FakeDriver) SetBootDvdDrive(vmName string, controllerNumber uint, controllerLocation uint) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("SetBootDvdDrive"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.Generation != 2 {
+		return fmt.Errorf("The virtual machine '%s' does not have UEFI firmware.", vmName)
+	}
+
+	drive := vm.dvdDrive(controllerNumber, controllerLocation)
+	if drive == nil {
+		return fmt.Errorf("No DVD drive was found at %d:%d for '%s'.", controllerNumber, controllerLocation, vmName)
+	}
+
+	vm.BootDvdDrive = drive
+	return nil
+}
+
+func (d *FakeDriver) MountFloppyDrive(vmName string, path string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("MountFloppyDrive"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	if vm.Generation == 2 {
+		return fmt.Errorf("Generation 2 virtual machines have no floppy drive.")
+	}
+
+	vm.FloppyPath = path
+	return nil
+}
+
+func (d *FakeDriver) UnmountFloppyDrive(vmName string) error {
+	d.l.Lock()
+	defer d.l.Unlock()
+	if err := d.call("UnmountFloppyDrive"); err != nil {
+		return err
+	}
+
+	vm, err := d.vm(vmName)
+	if err != nil {
+		return err
+	}
+
+	vm.FloppyPath = ""
+	return nil
+}
+
+func (vm *FakeVM) dvdDrive(controllerNumber uint, controllerLocation uint) *FakeDvdDrive {
+	for _, drive := range vm.DvdDrives {
+		if drive.ControllerNumber == controllerNumber && drive.ControllerLocation == controllerLocation {
+			return drive
+		}
+	}
+	return nil
+}
+
+// inUse reports whether a drive is attached at the location of the
+// controller given. The DVD drives of a VM are on its IDE controllers for
+// generation 1 and on its SCSI controller for generation 2.
+func (vm *FakeVM) inUse(controllerType string, controllerNumber uint, controllerLocation uint) bool {
+	for _, drive := range vm.HardDiskDrives {
+		if drive.ControllerType == controllerType && drive.ControllerNumber == controllerNumber && drive.ControllerLocation == controllerLocation {
+			return true
+		}
+	}
+
+	dvdControllerType := ControllerTypeIDE
+	if vm.Generation == 2 {
+		dvdControllerType = ControllerTypeSCSI
+	}
+	return controllerType == dvdControllerType && vm.dvdDrive(controllerNumber, controllerLocation) != nil
+}
+
+func fakeCopyTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
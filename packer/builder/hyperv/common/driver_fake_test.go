@@ -0,0 +1,251 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFakeDriver_impl(t *testing.T) {
+	var _ Driver = new(FakeDriver)
+}
+
+func TestFakeDriver_powerState(t *testing.T) {
+	d := NewFakeDriver()
+	d.CreateVirtualSwitch("switch", SwitchTypeInternal)
+
+	if err := d.CreateVirtualMachine("vm", "path", 1024, "missing", 1); err == nil {
+		t.Fatal("should error when the switch does not exist")
+	}
+	if err := d.CreateVirtualMachine("vm", "path", 1024, "switch", 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if off, _ := d.IsOff("vm"); !off {
+		t.Fatal("new VM should be off")
+	}
+
+	if err := d.StartVirtualMachine("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := d.StartVirtualMachine("vm"); err == nil {
+		t.Fatal("starting a running VM should error")
+	}
+	if running, _ := d.IsRunning("vm"); !running {
+		t.Fatal("VM should be running")
+	}
+
+	d.VMs["vm"].State = FakeVMStateSaved
+	if running, _ := d.IsRunning("vm"); running {
+		t.Fatal("saved VM should not be running")
+	}
+	if off, _ := d.IsOff("vm"); off {
+		t.Fatal("saved VM should not be off")
+	}
+
+	if err := d.Stop("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.VMs["vm"].State != FakeVMStateSaved {
+		t.Fatal("turning off should leave a saved VM alone")
+	}
+}
+
+func TestFakeDriver_transitions(t *testing.T) {
+	d := NewFakeDriver()
+	d.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	d.CreateVirtualMachine("vm", "path", 1024, "switch", 1)
+	d.StartVirtualMachine("vm")
+
+	d.RebootAfterPolls("vm", 3)
+	d.PowerOffAfterPolls("vm", 5)
+
+	var uptimes []uint64
+	for i := 0; i < 4; i++ {
+		uptime, err := d.Uptime("vm")
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		uptimes = append(uptimes, uptime)
+	}
+
+	expected := []uint64{fakeUptimeStep, 2 * fakeUptimeStep, 0, fakeUptimeStep}
+	for i := range expected {
+		if uptimes[i] != expected[i] {
+			t.Fatalf("bad uptimes: %v", uptimes)
+		}
+	}
+
+	if off, _ := d.IsOff("vm"); !off {
+		t.Fatal("VM should be off after 5 polls")
+	}
+}
+
+func TestFakeDriver_dvdDrives(t *testing.T) {
+	d := NewFakeDriver()
+	d.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	d.CreateVirtualMachine("vm", "path", 1024, "switch", 1)
+	d.CreateVirtualHardDisk("vm.vhdx", DiskTypeDynamic, 1024, 0, "")
+	d.AddVirtualMachineHardDiskDrive("vm", "vm.vhdx", ControllerTypeIDE)
+
+	number, location, err := d.CreateDvdDrive("vm", "a.iso")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if number != 0 || location != 1 {
+		t.Fatalf("bad controller: %d:%d", number, location)
+	}
+
+	number, location, err = d.CreateDvdDrive("vm", "b.iso")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if number != 1 || location != 1 {
+		t.Fatalf("bad controller: %d:%d", number, location)
+	}
+
+	if _, _, err := d.CreateDvdDrive("vm", "c.iso"); err == nil {
+		t.Fatal("should error when the IDE controllers are full")
+	}
+
+	if err := d.DeleteDvdDrive("vm", number, location); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := d.DeleteDvdDrive("vm", number, location); err == nil {
+		t.Fatal("should error deleting a missing drive")
+	}
+}
+
+func TestFakeDriver_hardDisks(t *testing.T) {
+	d := NewFakeDriver()
+	d.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	d.CreateVirtualMachine("vm", "path", 1024, "switch", 1)
+
+	if err := d.CreateVirtualHardDisk("a.vhdx", DiskTypeDynamic, 0, 0, ""); err == nil {
+		t.Fatal("should error without a size")
+	}
+	if err := d.CreateVirtualHardDisk("a.vhdx", DiskTypeFixed, 1024, 3*1024*1024, ""); err == nil {
+		t.Fatal("should error on a block size not a power of 2")
+	}
+	if err := d.CreateVirtualHardDisk("a.vhdx", DiskTypeDifferencing, 0, 0, "missing.vhdx"); err == nil {
+		t.Fatal("should error without the parent disk")
+	}
+	if err := d.CreateVirtualHardDisk("a.vhdx", DiskTypeFixed, 1024, 0, ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := d.CreateVirtualHardDisk("a.vhdx", DiskTypeFixed, 1024, 0, ""); err == nil {
+		t.Fatal("should error when the disk exists")
+	}
+	if err := d.CreateVirtualHardDisk("b.vhdx", DiskTypeDifferencing, 0, 0, "a.vhdx"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Disks["b.vhdx"].SizeBytes != 1024 {
+		t.Fatalf("bad disk: %#v", d.Disks["b.vhdx"])
+	}
+
+	if err := d.AddVirtualMachineHardDiskDrive("vm", "missing.vhdx", ControllerTypeIDE); err == nil {
+		t.Fatal("should error on a missing disk")
+	}
+	if err := d.AddVirtualMachineHardDiskDrive("vm", "b.vhdx", ControllerTypeIDE); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := d.AddVirtualMachineHardDiskDrive("vm", "b.vhdx", ControllerTypeSCSI); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	vm := d.VMs["vm"]
+	if vm.ScsiControllers != 1 || len(vm.HardDiskDrives) != 2 {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+
+	// the IDE disk takes 0:0, so the next DVD drive goes to 0:1
+	if number, location, _ := d.CreateDvdDrive("vm", "a.iso"); number != 0 || location != 1 {
+		t.Fatalf("bad controller: %d:%d", number, location)
+	}
+
+	if err := d.DeleteVirtualHardDisk("a.vhdx"); err == nil {
+		t.Fatal("should error deleting the parent of a disk")
+	}
+	if err := d.DeleteVirtualHardDisk("b.vhdx"); err == nil {
+		t.Fatal("should error deleting an attached disk")
+	}
+
+	d.DeleteVirtualMachine("vm")
+	for _, path := range []string{"b.vhdx", "a.vhdx", "missing.vhdx"} {
+		if err := d.DeleteVirtualHardDisk(path); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if len(d.Disks) != 0 {
+		t.Fatalf("bad disks: %#v", d.Disks)
+	}
+}
+
+func TestFakeDriver_generation2(t *testing.T) {
+	d := NewFakeDriver()
+	d.CreateVirtualSwitch("switch", SwitchTypeInternal)
+
+	if err := d.CreateVirtualMachine("vm", "path", 1024, "switch", 3); err == nil {
+		t.Fatal("should error on a bad generation")
+	}
+	if err := d.CreateVirtualMachine("vm", "path", 1024, "switch", 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	vm := d.VMs["vm"]
+	if len(vm.DvdDrives) != 0 || !vm.SecureBoot || vm.ScsiControllers != 1 {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+
+	if err := d.CreateVirtualHardDisk("vm.vhdx", DiskTypeDynamic, 1024, 0, ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := d.AddVirtualMachineHardDiskDrive("vm", "vm.vhdx", ControllerTypeIDE); err == nil {
+		t.Fatal("should error without an IDE controller")
+	}
+	if err := d.AddVirtualMachineHardDiskDrive("vm", "vm.vhdx", ControllerTypeSCSI); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := d.MountDvdDrive("vm", "a.iso"); err == nil {
+		t.Fatal("should error without a DVD drive")
+	}
+	if err := d.MountFloppyDrive("vm", "a.vfd"); err == nil {
+		t.Fatal("should error without a floppy drive")
+	}
+
+	number, location, err := d.CreateDvdDrive("vm", "a.iso")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if number != 0 || location != 1 {
+		t.Fatalf("bad controller: %d:%d", number, location)
+	}
+
+	if err := d.SetBootDvdDrive("vm", 0, 2); err == nil {
+		t.Fatal("should error on a missing drive")
+	}
+	if err := d.SetBootDvdDrive("vm", number, location); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := d.SetVirtualMachineSecureBoot("vm", true, "MicrosoftUEFICertificateAuthority"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if vm.BootDvdDrive == nil || vm.BootDvdDrive.Path != "a.iso" || vm.SecureBootTemplate != "MicrosoftUEFICertificateAuthority" {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+}
+
+func TestFakeDriver_FailOn(t *testing.T) {
+	d := NewFakeDriver()
+	d.FailOn("CreateVirtualSwitch", errors.New("boom"))
+
+	if _, err := d.CreateVirtualSwitch("switch", SwitchTypeInternal); err == nil {
+		t.Fatal("should error")
+	}
+	if !d.Called("CreateVirtualSwitch") {
+		t.Fatal("call should be recorded")
+	}
+	if len(d.Switches) != 0 {
+		t.Fatal("failed call should not change state")
+	}
+}
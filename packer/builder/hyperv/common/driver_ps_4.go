@@ -7,6 +7,7 @@ package common
 import (
 	"fmt"
 	"log"
+	"os"
 	"strings"
 	"runtime"
 	"strconv"
@@ -50,6 +51,242 @@ func (d *HypervPS4Driver) Stop(vmName string) error {
 	return hyperv.TurnOff(vmName);
 }
 
+func (d *HypervPS4Driver) IsOff(vmName string) (bool, error) {
+	return hyperv.IsOff(vmName)
+}
+
+func (d *HypervPS4Driver) Uptime(vmName string) (uint64, error) {
+	return hyperv.Uptime(vmName)
+}
+
+func (d *HypervPS4Driver) GetVirtualMachineNetworkAdapterAddress(vmName string, adapterName string) (string, error) {
+	return hyperv.GetVirtualMachineNetworkAdapterAddress(vmName, adapterName)
+}
+
+func (d *HypervPS4Driver) GetExternalOnlineVirtualSwitch() (string, error) {
+	return hyperv.GetExternalOnlineVirtualSwitch()
+}
+
+func (d *HypervPS4Driver) CreateVirtualSwitch(switchName string, switchType string) (bool, error) {
+	return hyperv.CreateVirtualSwitch(switchName, switchType)
+}
+
+func (d *HypervPS4Driver) CreateExternalVirtualSwitchOnNetAdapter(switchName string, netAdapterName string, netAdapterInterfaceDescription string) (bool, error) {
+	return hyperv.CreateExternalVirtualSwitchOnNetAdapter(switchName, netAdapterName, netAdapterInterfaceDescription)
+}
+
+func (d *HypervPS4Driver) GetVirtualSwitchType(switchName string) (string, error) {
+	return hyperv.GetVirtualSwitchType(switchName)
+}
+
+func (d *HypervPS4Driver) GetNetAdapterStatus(netAdapterName string, netAdapterInterfaceDescription string) (string, error) {
+	return hyperv.GetNetAdapterStatus(netAdapterName, netAdapterInterfaceDescription)
+}
+
+func (d *HypervPS4Driver) CreateNetNat(natName string, switchName string, prefix string, gatewayIP string) error {
+	return hyperv.CreateNetNat(natName, switchName, prefix, gatewayIP)
+}
+
+func (d *HypervPS4Driver) DeleteNetNat(natName string, gatewayIP string) error {
+	return hyperv.DeleteNetNat(natName, gatewayIP)
+}
+
+func (d *HypervPS4Driver) GetHostDnsServers() ([]string, error) {
+	return hyperv.GetHostDnsServers()
+}
+
+func (d *HypervPS4Driver) GetHostAdapterIpAddressForSwitch(switchName string) (string, error) {
+	return hyperv.GetHostAdapterIpAddressForSwitch(switchName)
+}
+
+func (d *HypervPS4Driver) CreateExternalVirtualSwitch(vmName string, switchName string) error {
+	return hyperv.CreateExternalVirtualSwitch(vmName, switchName)
+}
+
+func (d *HypervPS4Driver) DeleteVirtualSwitch(switchName string) error {
+	return hyperv.DeleteVirtualSwitch(switchName)
+}
+
+func (d *HypervPS4Driver) GetVirtualMachineSwitchName(vmName string) (string, error) {
+	return hyperv.GetVirtualMachineSwitchName(vmName)
+}
+
+func (d *HypervPS4Driver) ConnectVirtualMachineNetworkAdapterToSwitch(vmName string, switchName string) error {
+	return hyperv.ConnectVirtualMachineNetworkAdapterToSwitch(vmName, switchName)
+}
+
+func (d *HypervPS4Driver) SetNetworkAdapterVlanId(switchName string, vlanId string) error {
+	return hyperv.SetNetworkAdapterVlanId(switchName, vlanId)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineVlanId(vmName string, vlanId string) error {
+	return hyperv.SetVirtualMachineVlanId(vmName, vlanId)
+}
+
+func (d *HypervPS4Driver) AddVirtualMachineNetworkAdapter(vmName string, adapterName string, switchName string) error {
+	return hyperv.AddVirtualMachineNetworkAdapter(vmName, adapterName, switchName)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineNetworkAdapterVlanId(vmName string, adapterName string, vlanId string) error {
+	return hyperv.SetVirtualMachineNetworkAdapterVlanId(vmName, adapterName, vlanId)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineNetworkAdapterMacAddress(vmName string, adapterName string, macAddress string) error {
+	return hyperv.SetVirtualMachineNetworkAdapterMacAddress(vmName, adapterName, macAddress)
+}
+
+func (d *HypervPS4Driver) DisconnectVirtualMachineNetworkAdapter(vmName string, adapterName string) error {
+	return hyperv.DisconnectVirtualMachineNetworkAdapter(vmName, adapterName)
+}
+
+func (d *HypervPS4Driver) UntagVirtualMachineNetworkAdapterVlan(vmName string, switchName string) error {
+	return hyperv.UntagVirtualMachineNetworkAdapterVlan(vmName, switchName)
+}
+
+func (d *HypervPS4Driver) CreateVirtualMachine(vmName string, path string, ram int64, switchName string, generation uint) error {
+	return hyperv.CreateVirtualMachine(vmName, path, ram, switchName, generation)
+}
+
+func (d *HypervPS4Driver) CreateVirtualHardDisk(path string, diskType string, sizeBytes int64, blockSizeBytes int64, parentPath string) error {
+	return hyperv.CreateVirtualHardDisk(path, diskType, sizeBytes, blockSizeBytes, parentPath)
+}
+
+func (d *HypervPS4Driver) DeleteVirtualHardDisk(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *HypervPS4Driver) AddVirtualMachineHardDiskDrive(vmName string, path string, controllerType string) error {
+	return hyperv.AddVirtualMachineHardDiskDrive(vmName, path, controllerType)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineSecureBoot(vmName string, enable bool, templateName string) error {
+	return hyperv.SetVirtualMachineSecureBoot(vmName, enable, templateName)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineProcessorCount(vmName string, count uint) error {
+	return hyperv.SetVirtualMachineProcessorCount(vmName, count)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineDynamicMemory(vmName string, enable bool, minimumBytes int64, maximumBytes int64, buffer uint) error {
+	return hyperv.SetVirtualMachineDynamicMemory(vmName, enable, minimumBytes, maximumBytes, buffer)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineVirtualizationExtensions(vmName string, enable bool) error {
+	return hyperv.SetVirtualMachineVirtualizationExtensions(vmName, enable)
+}
+
+func (d *HypervPS4Driver) SetVirtualMachineMacSpoofing(vmName string, enable bool) error {
+	return hyperv.SetVirtualMachineMacSpoofing(vmName, enable)
+}
+
+func (d *HypervPS4Driver) DeleteVirtualMachine(vmName string) error {
+	return hyperv.DeleteVirtualMachine(vmName)
+}
+
+func (d *HypervPS4Driver) StartVirtualMachine(vmName string) error {
+	return hyperv.StartVirtualMachine(vmName)
+}
+
+func (d *HypervPS4Driver) TypeScancodes(vmName string, scancodes []byte) error {
+	return hyperv.TypeScancodes(vmName, scancodes)
+}
+
+func (d *HypervPS4Driver) StopVirtualMachine(vmName string) error {
+	return hyperv.StopVirtualMachine(vmName)
+}
+
+func (d *HypervPS4Driver) RestartVirtualMachine(vmName string) error {
+	return hyperv.RestartVirtualMachine(vmName)
+}
+
+func (d *HypervPS4Driver) EnableVirtualMachineIntegrationService(vmName string, integrationServiceName string) error {
+	return hyperv.EnableVirtualMachineIntegrationService(vmName, integrationServiceName)
+}
+
+func (d *HypervPS4Driver) ExportVirtualMachine(vmName string, path string) error {
+	return hyperv.ExportVirtualMachine(vmName, path)
+}
+
+func (d *HypervPS4Driver) ExportVirtualMachineSnapshot(vmName string, snapshotName string, path string) error {
+	return hyperv.ExportVirtualMachineSnapshot(vmName, snapshotName, path)
+}
+
+func (d *HypervPS4Driver) ImportVirtualMachine(exportPath string, vmName string, path string, ram int64, switchName string) error {
+	return hyperv.ImportVirtualMachine(exportPath, vmName, path, ram, switchName)
+}
+
+func (d *HypervPS4Driver) GetVirtualMachineGeneration(vmName string) (uint, error) {
+	return hyperv.GetVirtualMachineGeneration(vmName)
+}
+
+func (d *HypervPS4Driver) GetVirtualMachineProcessorCount(vmName string) (uint, error) {
+	return hyperv.GetVirtualMachineProcessorCount(vmName)
+}
+
+func (d *HypervPS4Driver) GetVirtualMachineMemory(vmName string) (int64, error) {
+	return hyperv.GetVirtualMachineMemory(vmName)
+}
+
+func (d *HypervPS4Driver) GetHostMemoryCapacity() (int64, error) {
+	return hyperv.GetHostMemoryCapacity()
+}
+
+func (d *HypervPS4Driver) GetHostAvailableMemory() (float64, error) {
+	return hyperv.GetHostAvailableMemory()
+}
+
+func (d *HypervPS4Driver) GetHostSupportedVersions() ([]string, error) {
+	return hyperv.GetHostSupportedVersions()
+}
+
+func (d *HypervPS4Driver) CopyVirtualHardDisk(sourcePath string, path string) error {
+	return hyperv.CopyVirtualHardDisk(sourcePath, path)
+}
+
+func (d *HypervPS4Driver) GetVirtualMachineHardDiskPaths(vmName string) ([]string, error) {
+	return hyperv.GetVirtualMachineHardDiskPaths(vmName)
+}
+
+func (d *HypervPS4Driver) CompactVirtualHardDisk(path string) (int64, int64, error) {
+	return hyperv.CompactVirtualHardDisk(path)
+}
+
+func (d *HypervPS4Driver) CopyExportedVirtualMachine(expPath string, outputPath string, vhdDir string, vmDir string) error {
+	return hyperv.CopyExportedVirtualMachine(expPath, outputPath, vhdDir, vmDir)
+}
+
+func (d *HypervPS4Driver) MountDvdDrive(vmName string, path string) error {
+	return hyperv.MountDvdDrive(vmName, path)
+}
+
+func (d *HypervPS4Driver) UnmountDvdDrive(vmName string) error {
+	return hyperv.UnmountDvdDrive(vmName)
+}
+
+func (d *HypervPS4Driver) CreateDvdDrive(vmName string, isoPath string) (uint, uint, error) {
+	return hyperv.CreateDvdDrive(vmName, isoPath)
+}
+
+func (d *HypervPS4Driver) DeleteDvdDrive(vmName string, controllerNumber uint, controllerLocation uint) error {
+	return hyperv.DeleteDvdDrive(vmName, controllerNumber, controllerLocation)
+}
+
+func (d *HypervPS4Driver) SetBootDvdDrive(vmName string, controllerNumber uint, controllerLocation uint) error {
+	return hyperv.SetBootDvdDrive(vmName, controllerNumber, controllerLocation)
+}
+
+func (d *HypervPS4Driver) MountFloppyDrive(vmName string, path string) error {
+	return hyperv.MountFloppyDrive(vmName, path)
+}
+
+func (d *HypervPS4Driver) UnmountFloppyDrive(vmName string) error {
+	return hyperv.UnmountFloppyDrive(vmName)
+}
+
 
 func (d *HypervPS4Driver) Verify() error {
 
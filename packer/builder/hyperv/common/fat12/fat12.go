@@ -0,0 +1,611 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package fat12 writes 1.44 MB floppy images formatted with FAT12, such
+// as the floppies holding answer files that are attached to a VM.
+//
+// Names that are not upper case 8.3 names get VFAT long name entries, so
+// that Windows setup finds files such as Autounattend.xml, and files may
+// be placed in subdirectories.
+package fat12
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The geometry of a 1.44 MB floppy.
+const (
+	sectorSize        = 512
+	totalSectors      = 2880
+	sectorsPerTrack   = 18
+	heads             = 2
+	reservedSectors   = 1
+	fatCount          = 2
+	sectorsPerFAT     = 9
+	rootEntries       = 224
+	rootSectors       = rootEntries * entrySize / sectorSize
+	firstDataSector   = reservedSectors + fatCount*sectorsPerFAT + rootSectors
+	dataClusters      = totalSectors - firstDataSector
+	mediaDescriptor   = 0xf0
+	entrySize         = 32
+	entriesPerCluster = sectorSize / entrySize
+
+	// Size is the size in bytes of every image.
+	Size = totalSectors * sectorSize
+)
+
+const (
+	attrVolumeID = 0x08
+	attrDir      = 0x10
+	attrArchive  = 0x20
+	attrLongName = 0x0f
+
+	endOfChain = 0xfff
+
+	// The longest long name VFAT allows.
+	maxLongNameLength = 255
+)
+
+// An Image is a tree of files to be written as a floppy image.
+type Image struct {
+	// The volume label of the image, up to 11 characters.
+	Label string
+
+	// The time recorded for the directories and the volume label, which
+	// also determines the volume serial number.
+	ModTime time.Time
+
+	root *node
+}
+
+type node struct {
+	name     string
+	isDir    bool
+	children map[string]*node
+	parent   *node
+
+	// for files, the host file holding the content
+	source  string
+	size    int64
+	modTime time.Time
+
+	// the layout of the node in the image
+	shortName    [11]byte
+	needsLong    bool
+	order        []*node
+	firstCluster uint16
+	clusters     int
+}
+
+// NewImage returns an empty image with the label given.
+func NewImage(label string) *Image {
+	return &Image{
+		Label:   label,
+		ModTime: time.Now(),
+		root:    &node{isDir: true, children: make(map[string]*node)},
+	}
+}
+
+// AddFile adds the host file at source to the image under the slash
+// separated path name, creating the directories leading to it.
+func (i *Image) AddFile(name string, source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", source)
+	}
+
+	if info.Size() > Size {
+		return fmt.Errorf("%s is too large for a floppy", source)
+	}
+
+	parts, err := splitPath(name)
+	if err != nil {
+		return err
+	}
+
+	dir, err := i.mkdirAll(parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+
+	base := parts[len(parts)-1]
+	if _, ok := dir.children[strings.ToLower(base)]; ok {
+		return fmt.Errorf("%s is already in the image", name)
+	}
+
+	dir.children[strings.ToLower(base)] = &node{
+		name:    base,
+		source:  source,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		parent:  dir,
+	}
+
+	return nil
+}
+
+// AddDir adds an empty directory to the image under the slash separated
+// path name, creating the directories leading to it.
+func (i *Image) AddDir(name string) error {
+	parts, err := splitPath(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.mkdirAll(parts)
+	return err
+}
+
+func (i *Image) mkdirAll(parts []string) (*node, error) {
+	dir := i.root
+	for _, part := range parts {
+		child, ok := dir.children[strings.ToLower(part)]
+		if !ok {
+			child = &node{name: part, isDir: true, children: make(map[string]*node), parent: dir}
+			dir.children[strings.ToLower(part)] = child
+		}
+
+		if !child.isDir {
+			return nil, fmt.Errorf("%s is a file in the image", part)
+		}
+
+		dir = child
+	}
+
+	return dir, nil
+}
+
+func splitPath(name string) ([]string, error) {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+
+		if part == ".." || strings.ContainsAny(part, `\:*?"<>|`) {
+			return nil, fmt.Errorf("invalid path in the image: %s", name)
+		}
+
+		if len(utf16.Encode([]rune(part))) > maxLongNameLength {
+			return nil, fmt.Errorf("name is longer than %d characters: %s", maxLongNameLength, part)
+		}
+
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("invalid path in the image: %s", name)
+	}
+
+	return parts, nil
+}
+
+// WriteTo writes the image to w.
+func (i *Image) WriteTo(w io.Writer) (int64, error) {
+	dirs, files, err := i.layout()
+	if err != nil {
+		return 0, err
+	}
+
+	image := make([]byte, Size)
+	i.bootSector(image[:sectorSize])
+
+	fat := make([]uint16, dataClusters+2)
+	fat[0] = 0xf00 | mediaDescriptor
+	fat[1] = endOfChain
+
+	for _, n := range append(dirs[1:], files...) {
+		for c := 0; c < n.clusters; c++ {
+			cluster := int(n.firstCluster) + c
+			if c == n.clusters-1 {
+				fat[cluster] = endOfChain
+			} else {
+				fat[cluster] = uint16(cluster + 1)
+			}
+		}
+	}
+
+	packed := packFAT(fat)
+	for n := 0; n < fatCount; n++ {
+		copy(image[(reservedSectors+n*sectorsPerFAT)*sectorSize:], packed)
+	}
+
+	for _, dir := range dirs {
+		copy(image[dirOffset(dir):], i.directoryEntries(dir))
+	}
+
+	for _, file := range files {
+		if file.size == 0 {
+			continue
+		}
+
+		if err := readFile(image[clusterOffset(file.firstCluster):], file); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.Write(image)
+	return int64(n), err
+}
+
+// layout gives the nodes short names and places the directories and then
+// the files in consecutive clusters. The root directory comes first in
+// the list of directories returned.
+func (i *Image) layout() ([]*node, []*node, error) {
+	var dirs, files []*node
+
+	queue := []*node{i.root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		nameChildren(dir)
+		dirs = append(dirs, dir)
+
+		for _, child := range dir.order {
+			if child.isDir {
+				queue = append(queue, child)
+			} else {
+				files = append(files, child)
+			}
+		}
+	}
+
+	if entries := i.entryCount(i.root); entries > rootEntries {
+		return nil, nil, fmt.Errorf("the root directory of a floppy holds %d entries, but %d are needed", rootEntries, entries)
+	}
+
+	next := 2
+	allocate := func(n *node, clusters int) {
+		n.clusters = clusters
+		if clusters > 0 {
+			n.firstCluster = uint16(next)
+			next += clusters
+		}
+	}
+
+	for _, dir := range dirs[1:] {
+		allocate(dir, (i.entryCount(dir)+entriesPerCluster-1)/entriesPerCluster)
+	}
+
+	for _, file := range files {
+		allocate(file, int((file.size+sectorSize-1)/sectorSize))
+	}
+
+	if used := next - 2; used > dataClusters {
+		return nil, nil, fmt.Errorf("the files need %d bytes, but a floppy holds %d", used*sectorSize, dataClusters*sectorSize)
+	}
+
+	return dirs, files, nil
+}
+
+// entryCount returns the number of directory entries of dir.
+func (i *Image) entryCount(dir *node) int {
+	count := 0
+	if dir.parent == nil {
+		if i.Label != "" {
+			count++
+		}
+	} else {
+		// the . and .. entries
+		count += 2
+	}
+
+	for _, child := range dir.order {
+		count += 1 + len(longNameEntries(child))
+	}
+
+	return count
+}
+
+// nameChildren gives the children of a directory unique short names,
+// and sorts them by name.
+func nameChildren(dir *node) {
+	dir.order = make([]*node, 0, len(dir.children))
+	for _, child := range dir.children {
+		dir.order = append(dir.order, child)
+	}
+	sort.Sort(byName(dir.order))
+
+	used := make(map[[11]byte]bool)
+	for _, child := range dir.order {
+		child.shortName, child.needsLong = shortName(child.name, used)
+		used[child.shortName] = true
+	}
+}
+
+type byName []*node
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// shortName returns an 8.3 name for the name given that is not one of
+// the used names, and whether a long name entry is needed to keep the
+// name as it is.
+func shortName(name string, used map[[11]byte]bool) ([11]byte, bool) {
+	base, ext := name, ""
+	if dot := strings.LastIndex(name, "."); dot > 0 {
+		base, ext = name[:dot], name[dot+1:]
+	}
+
+	base, lossyBase := shortNameCharacters(base)
+	ext, lossyExt := shortNameCharacters(ext)
+	lossy := lossyBase || lossyExt || len(base) > 8 || len(ext) > 3 || base == ""
+
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+
+	var result [11]byte
+	fill := func(base string) {
+		for n := range result {
+			result[n] = ' '
+		}
+		copy(result[:8], base)
+		copy(result[8:], ext)
+	}
+
+	if !lossy {
+		fill(base)
+		if !used[result] {
+			display := base
+			if ext != "" {
+				display += "." + ext
+			}
+			return result, display != name
+		}
+	}
+
+	if base == "" {
+		base = "_"
+	}
+
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		prefix := base
+		if len(prefix) > 8-len(tail) {
+			prefix = prefix[:8-len(tail)]
+		}
+
+		fill(prefix + tail)
+		if !used[result] {
+			return result, true
+		}
+	}
+}
+
+// shortNameCharacters upper cases s and replaces the characters not
+// allowed in short names, reporting whether anything was lost.
+func shortNameCharacters(s string) (string, bool) {
+	lossy := false
+	result := make([]byte, 0, len(s))
+	for _, r := range strings.ToUpper(s) {
+		switch {
+		case r == ' ' || r == '.':
+			lossy = true
+		case (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("!#$%&'()-@^_`{}~", r):
+			result = append(result, byte(r))
+		default:
+			lossy = true
+			result = append(result, '_')
+		}
+	}
+
+	return string(result), lossy
+}
+
+func shortNameChecksum(name [11]byte) byte {
+	var sum byte
+	for _, c := range name {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// longNameEntries returns the VFAT long name entries of a node, in the
+// order they are stored before its short name entry.
+func longNameEntries(n *node) [][]byte {
+	if !n.needsLong {
+		return nil
+	}
+
+	units := utf16.Encode([]rune(n.name))
+	if len(units)%13 != 0 {
+		units = append(units, 0)
+		for len(units)%13 != 0 {
+			units = append(units, 0xffff)
+		}
+	}
+
+	count := len(units) / 13
+	checksum := shortNameChecksum(n.shortName)
+
+	entries := make([][]byte, count)
+	for e := 0; e < count; e++ {
+		entry := make([]byte, entrySize)
+		entry[0] = byte(e + 1)
+		if e == count-1 {
+			entry[0] |= 0x40
+		}
+		entry[11] = attrLongName
+		entry[13] = checksum
+
+		chars := units[e*13 : (e+1)*13]
+		for c, offset := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(entry[offset:], chars[c])
+		}
+
+		entries[count-1-e] = entry
+	}
+
+	return entries
+}
+
+func (i *Image) directoryEntries(dir *node) []byte {
+	var result []byte
+
+	if dir.parent == nil {
+		if i.Label != "" {
+			result = append(result, shortEntry(labelName(i.Label), attrVolumeID, 0, 0, i.ModTime)...)
+		}
+	} else {
+		parentCluster := uint16(0)
+		if dir.parent.parent != nil {
+			parentCluster = dir.parent.firstCluster
+		}
+
+		result = append(result, shortEntry(dotName("."), attrDir, dir.firstCluster, 0, i.ModTime)...)
+		result = append(result, shortEntry(dotName(".."), attrDir, parentCluster, 0, i.ModTime)...)
+	}
+
+	for _, child := range dir.order {
+		for _, entry := range longNameEntries(child) {
+			result = append(result, entry...)
+		}
+
+		if child.isDir {
+			result = append(result, shortEntry(child.shortName, attrDir, child.firstCluster, 0, i.ModTime)...)
+		} else {
+			result = append(result, shortEntry(child.shortName, attrArchive, child.firstCluster, uint32(child.size), child.modTime)...)
+		}
+	}
+
+	return result
+}
+
+func shortEntry(name [11]byte, attr byte, cluster uint16, size uint32, modTime time.Time) []byte {
+	entry := make([]byte, entrySize)
+	copy(entry, name[:])
+	entry[11] = attr
+
+	date, clock := dosTime(modTime)
+	binary.LittleEndian.PutUint16(entry[14:], clock)
+	binary.LittleEndian.PutUint16(entry[16:], date)
+	binary.LittleEndian.PutUint16(entry[18:], date)
+	binary.LittleEndian.PutUint16(entry[22:], clock)
+	binary.LittleEndian.PutUint16(entry[24:], date)
+	binary.LittleEndian.PutUint16(entry[26:], cluster)
+	binary.LittleEndian.PutUint32(entry[28:], size)
+	return entry
+}
+
+func dotName(name string) [11]byte {
+	var result [11]byte
+	copy(result[:], name+strings.Repeat(" ", 11-len(name)))
+	return result
+}
+
+// labelName returns the label as it is stored, upper case and padded
+// with spaces to 11 characters.
+func labelName(label string) [11]byte {
+	var result [11]byte
+	for n := range result {
+		result[n] = ' '
+	}
+
+	characters, _ := shortNameCharacters(strings.Replace(label, " ", "_", -1))
+	copy(result[:], characters)
+	return result
+}
+
+// dosTime returns the date and time of t in the format of directory
+// entries. Dates before 1980 cannot be represented and are clamped.
+func dosTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	clock := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, clock
+}
+
+func (i *Image) bootSector(b []byte) {
+	// a jump over the parameter block, to code asking the BIOS to boot
+	// from the next device
+	copy(b, []byte{0xeb, 0x3c, 0x90})
+	copy(b[3:], "MSDOS5.0")
+
+	binary.LittleEndian.PutUint16(b[11:], sectorSize)
+	b[13] = 1
+	binary.LittleEndian.PutUint16(b[14:], reservedSectors)
+	b[16] = fatCount
+	binary.LittleEndian.PutUint16(b[17:], rootEntries)
+	binary.LittleEndian.PutUint16(b[19:], totalSectors)
+	b[21] = mediaDescriptor
+	binary.LittleEndian.PutUint16(b[22:], sectorsPerFAT)
+	binary.LittleEndian.PutUint16(b[24:], sectorsPerTrack)
+	binary.LittleEndian.PutUint16(b[26:], heads)
+
+	// the extended parameter block
+	b[38] = 0x29
+	date, clock := dosTime(i.ModTime)
+	binary.LittleEndian.PutUint32(b[39:], uint32(date)<<16|uint32(clock))
+
+	label := labelName(i.Label)
+	if i.Label == "" {
+		label = dotName("NO NAME")
+	}
+	copy(b[43:], label[:])
+	copy(b[54:], "FAT12   ")
+
+	// int 18h, then halt
+	copy(b[62:], []byte{0xcd, 0x18, 0xf4, 0xeb, 0xfd})
+
+	b[510], b[511] = 0x55, 0xaa
+}
+
+// packFAT packs the 12 bit entries of the FAT, two to every three bytes.
+func packFAT(fat []uint16) []byte {
+	packed := make([]byte, sectorsPerFAT*sectorSize)
+	for n, entry := range fat {
+		offset := n * 3 / 2
+		if n%2 == 0 {
+			packed[offset] = byte(entry)
+			packed[offset+1] = packed[offset+1]&0xf0 | byte(entry>>8)&0x0f
+		} else {
+			packed[offset] = packed[offset]&0x0f | byte(entry<<4)
+			packed[offset+1] = byte(entry >> 4)
+		}
+	}
+	return packed
+}
+
+func dirOffset(dir *node) int {
+	if dir.parent == nil {
+		return (reservedSectors + fatCount*sectorsPerFAT) * sectorSize
+	}
+	return clusterOffset(dir.firstCluster)
+}
+
+func clusterOffset(cluster uint16) int {
+	return (firstDataSector + int(cluster) - 2) * sectorSize
+}
+
+func readFile(b []byte, file *node) error {
+	f, err := os.Open(file.source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.ReadFull(f, b[:file.size]); err != nil {
+		return fmt.Errorf("error reading %s: %s", file.source, err)
+	}
+
+	return nil
+}
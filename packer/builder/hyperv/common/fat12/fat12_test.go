@@ -0,0 +1,404 @@
+package fat12
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+var testModTime = time.Date(2014, 7, 1, 12, 30, 0, 0, time.UTC)
+
+// testImage writes the files given, by their path in the image, to a
+// temporary directory and returns an image holding them.
+func testImage(t *testing.T, files map[string]string) (*Image, string) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	image := NewImage("packer")
+	image.ModTime = testModTime
+
+	for name, content := range files {
+		source := filepath.Join(dir, strings.Replace(name, "/", "_", -1))
+		if err := ioutil.WriteFile(source, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := os.Chtimes(source, testModTime, testModTime); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := image.AddFile(name, source); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	return image, dir
+}
+
+func writeImage(t *testing.T, image *Image) []byte {
+	var buf bytes.Buffer
+	n, err := image.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if n != Size || buf.Len() != Size {
+		t.Fatalf("bad length: %d %d", n, buf.Len())
+	}
+
+	return buf.Bytes()
+}
+
+// fatReader reads images the way a driver does, from the parameters of
+// the boot sector.
+type fatReader struct {
+	t   *testing.T
+	b   []byte
+	fat []byte
+
+	rootOffset int
+	dataOffset int
+}
+
+func newFATReader(t *testing.T, b []byte) *fatReader {
+	bytesPerSector := int(binary.LittleEndian.Uint16(b[11:]))
+	reserved := int(binary.LittleEndian.Uint16(b[14:]))
+	fats := int(b[16])
+	entries := int(binary.LittleEndian.Uint16(b[17:]))
+	fatSectors := int(binary.LittleEndian.Uint16(b[22:]))
+
+	if b[13] != 1 {
+		t.Fatalf("bad sectors per cluster: %d", b[13])
+	}
+
+	fat := b[reserved*bytesPerSector : (reserved+fatSectors)*bytesPerSector]
+	for n := 1; n < fats; n++ {
+		other := b[(reserved+n*fatSectors)*bytesPerSector : (reserved+(n+1)*fatSectors)*bytesPerSector]
+		if !bytes.Equal(fat, other) {
+			t.Fatalf("FAT %d differs from the first", n)
+		}
+	}
+
+	rootOffset := (reserved + fats*fatSectors) * bytesPerSector
+	return &fatReader{
+		t:          t,
+		b:          b,
+		fat:        fat,
+		rootOffset: rootOffset,
+		dataOffset: rootOffset + entries*32,
+	}
+}
+
+func (r *fatReader) next(cluster int) int {
+	entry := int(binary.LittleEndian.Uint16(r.fat[cluster*3/2:]))
+	if cluster%2 == 0 {
+		return entry & 0xfff
+	}
+	return entry >> 4
+}
+
+// chain returns the content of the clusters starting at the one given.
+func (r *fatReader) chain(cluster int) []byte {
+	var result []byte
+	for ; cluster < 0xff8; cluster = r.next(cluster) {
+		if cluster < 2 {
+			r.t.Fatalf("bad cluster in chain: %d", cluster)
+		}
+
+		offset := r.dataOffset + (cluster-2)*512
+		result = append(result, r.b[offset:offset+512]...)
+	}
+	return result
+}
+
+// readTree returns the content of every file by its long path, and an
+// empty string for every directory. The short names of the entries are
+// returned by their long path too.
+func (r *fatReader) readTree() (map[string]string, map[string]string) {
+	tree := make(map[string]string)
+	shortNames := make(map[string]string)
+	r.readDir(r.b[r.rootOffset:r.dataOffset], "", tree, shortNames)
+	return tree, shortNames
+}
+
+func (r *fatReader) readDir(entries []byte, path string, tree map[string]string, shortNames map[string]string) {
+	var long []uint16
+	var checksum byte
+
+	for offset := 0; offset < len(entries); offset += 32 {
+		entry := entries[offset : offset+32]
+		if entry[0] == 0 {
+			return
+		}
+
+		if entry[11] == attrLongName {
+			if entry[0]&0x40 != 0 {
+				long = nil
+				checksum = entry[13]
+			} else if entry[13] != checksum {
+				r.t.Fatalf("bad long name checksum in %s", path)
+			}
+
+			var units []uint16
+			for _, o := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				units = append(units, binary.LittleEndian.Uint16(entry[o:]))
+			}
+			long = append(units, long...)
+			continue
+		}
+
+		if entry[11]&attrVolumeID != 0 || entry[0] == '.' {
+			continue
+		}
+
+		var name [11]byte
+		copy(name[:], entry)
+
+		short := strings.TrimRight(string(name[:8]), " ")
+		if ext := strings.TrimRight(string(name[8:]), " "); ext != "" {
+			short += "." + ext
+		}
+
+		display := short
+		if long != nil {
+			if shortNameChecksum(name) != checksum {
+				r.t.Fatalf("long name of %s does not match its checksum", short)
+			}
+
+			for n, unit := range long {
+				if unit == 0 {
+					long = long[:n]
+					break
+				}
+			}
+			display = string(utf16.Decode(long))
+			long = nil
+		}
+
+		childPath := path + "/" + display
+		shortNames[childPath] = short
+
+		cluster := int(binary.LittleEndian.Uint16(entry[26:]))
+		if entry[11]&attrDir != 0 {
+			tree[childPath] = ""
+
+			content := r.chain(cluster)
+			if string(content[:11]) != ".          " || string(content[32:43]) != "..         " {
+				r.t.Fatalf("bad dot entries in %s", childPath)
+			}
+			if int(binary.LittleEndian.Uint16(content[26:])) != cluster {
+				r.t.Fatalf("bad . entry in %s", childPath)
+			}
+
+			r.readDir(content, childPath, tree, shortNames)
+			continue
+		}
+
+		size := int(binary.LittleEndian.Uint32(entry[28:]))
+		if size == 0 {
+			tree[childPath] = ""
+			continue
+		}
+		tree[childPath] = string(r.chain(cluster)[:size])
+	}
+}
+
+func TestImage(t *testing.T) {
+	image, dir := testImage(t, map[string]string{
+		"Autounattend.xml":            "<unattend/>",
+		"README.TXT":                  "readme",
+		"scripts/install guest.ps1":   "Write-Host 'hello'",
+		"scripts/openssh/sshd_config": strings.Repeat("x", 3*512+17),
+		"empty.txt":                   "",
+	})
+	defer os.RemoveAll(dir)
+
+	if err := image.AddDir("empty"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b := writeImage(t, image)
+
+	if !bytes.Equal(b[:3], []byte{0xeb, 0x3c, 0x90}) || b[510] != 0x55 || b[511] != 0xaa {
+		t.Fatal("bad boot sector")
+	}
+
+	if b[21] != 0xf0 || binary.LittleEndian.Uint16(b[19:]) != 2880 {
+		t.Fatalf("bad media: %x %d", b[21], binary.LittleEndian.Uint16(b[19:]))
+	}
+
+	if label := string(b[43:54]); label != "PACKER     " {
+		t.Fatalf("bad label: %q", label)
+	}
+
+	if fs := string(b[54:62]); fs != "FAT12   " {
+		t.Fatalf("bad file system: %q", fs)
+	}
+
+	r := newFATReader(t, b)
+
+	if label := string(b[r.rootOffset : r.rootOffset+11]); label != "PACKER     " || b[r.rootOffset+11] != attrVolumeID {
+		t.Fatalf("bad volume label entry: %q", label)
+	}
+
+	tree, shortNames := r.readTree()
+
+	expected := map[string]string{
+		"/Autounattend.xml":            "<unattend/>",
+		"/README.TXT":                  "readme",
+		"/empty":                       "",
+		"/empty.txt":                   "",
+		"/scripts":                     "",
+		"/scripts/install guest.ps1":   "Write-Host 'hello'",
+		"/scripts/openssh":             "",
+		"/scripts/openssh/sshd_config": strings.Repeat("x", 3*512+17),
+	}
+
+	if !reflect.DeepEqual(tree, expected) {
+		t.Fatalf("bad tree: %#v", tree)
+	}
+
+	expected = map[string]string{
+		"/Autounattend.xml":            "AUTOUN~1.XML",
+		"/README.TXT":                  "README.TXT",
+		"/empty":                       "EMPTY",
+		"/empty.txt":                   "EMPTY.TXT",
+		"/scripts":                     "SCRIPTS",
+		"/scripts/install guest.ps1":   "INSTAL~1.PS1",
+		"/scripts/openssh":             "OPENSSH",
+		"/scripts/openssh/sshd_config": "SSHD_C~1",
+	}
+
+	if !reflect.DeepEqual(shortNames, expected) {
+		t.Fatalf("bad short names: %#v", shortNames)
+	}
+
+	// the modification time of the files is kept
+	found := false
+	for offset := r.rootOffset; offset < r.dataOffset; offset += 32 {
+		if string(b[offset:offset+11]) == "README  TXT" {
+			date, clock := dosTime(testModTime)
+			if binary.LittleEndian.Uint16(b[offset+24:]) != date || binary.LittleEndian.Uint16(b[offset+22:]) != clock {
+				t.Fatal("bad modification time")
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("README.TXT should be in the root directory")
+	}
+}
+
+func TestImage_shortNames(t *testing.T) {
+	image, dir := testImage(t, map[string]string{
+		"install-guest-1.ps1": "1",
+		"install-guest-2.ps1": "2",
+		"install-guest-3.ps1": "3",
+		".hidden":             "hidden",
+		"a.b.c":               "abc",
+	})
+	defer os.RemoveAll(dir)
+
+	tree, shortNames := newFATReader(t, writeImage(t, image)).readTree()
+
+	if tree["/install-guest-3.ps1"] != "3" || tree["/.hidden"] != "hidden" || tree["/a.b.c"] != "abc" {
+		t.Fatalf("bad tree: %#v", tree)
+	}
+
+	expected := map[string]string{
+		"/.hidden":             "HIDDEN~1",
+		"/a.b.c":               "AB~1.C",
+		"/install-guest-1.ps1": "INSTAL~1.PS1",
+		"/install-guest-2.ps1": "INSTAL~2.PS1",
+		"/install-guest-3.ps1": "INSTAL~3.PS1",
+	}
+
+	if !reflect.DeepEqual(shortNames, expected) {
+		t.Fatalf("bad short names: %#v", shortNames)
+	}
+}
+
+func TestImage_longDirectory(t *testing.T) {
+	// enough entries for the directory to span several clusters
+	files := make(map[string]string)
+	for n := 0; n < 40; n++ {
+		files["dir/a file with a long name "+string(rune('A'+n%26))+strings.Repeat("b", n/26)+".txt"] = string(rune('0' + n%10))
+	}
+
+	image, dir := testImage(t, files)
+	defer os.RemoveAll(dir)
+
+	tree, _ := newFATReader(t, writeImage(t, image)).readTree()
+	if len(tree) != len(files)+1 {
+		t.Fatalf("bad: %d", len(tree))
+	}
+
+	for name, content := range files {
+		if tree["/"+name] != content {
+			t.Fatalf("bad content of %s: %q", name, tree["/"+name])
+		}
+	}
+}
+
+func TestImage_full(t *testing.T) {
+	image, dir := testImage(t, map[string]string{
+		"a.bin": strings.Repeat("a", dataClusters*512/2),
+		"b.bin": strings.Repeat("b", dataClusters*512/2+512),
+	})
+	defer os.RemoveAll(dir)
+
+	if _, err := image.WriteTo(ioutil.Discard); err == nil {
+		t.Fatal("should have error writing more than fits")
+	}
+}
+
+func TestImage_rootEntries(t *testing.T) {
+	files := make(map[string]string)
+	for n := 0; n < rootEntries; n++ {
+		files[strings.Repeat("F", 4)+string(rune('A'+n%26))+string(rune('A'+n/26))+".TXT"] = ""
+	}
+
+	image, dir := testImage(t, files)
+	defer os.RemoveAll(dir)
+
+	if _, err := image.WriteTo(ioutil.Discard); err == nil {
+		t.Fatal("should have error writing more entries than the root directory holds")
+	}
+
+	image.Label = ""
+	if _, err := image.WriteTo(ioutil.Discard); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestImageAddFile(t *testing.T) {
+	image, dir := testImage(t, map[string]string{"a/b.txt": "b"})
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "a_b.txt")
+
+	if err := image.AddFile("A/B.TXT", source); err == nil {
+		t.Fatal("should have error adding a file twice")
+	}
+
+	if err := image.AddFile("a/b.txt/c.txt", source); err == nil {
+		t.Fatal("should have error adding a file below a file")
+	}
+
+	if err := image.AddFile("a/c?.txt", source); err == nil {
+		t.Fatal("should have error adding an invalid name")
+	}
+
+	if err := image.AddFile("c.txt", dir); err == nil {
+		t.Fatal("should have error adding a directory as a file")
+	}
+}
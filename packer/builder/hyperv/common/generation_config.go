@@ -0,0 +1,48 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+type GenerationConfig struct {
+	// The generation of the VM, 1 for BIOS firmware and IDE controllers or 2
+	// for UEFI firmware and SCSI controllers. By default, this is 1.
+	Generation uint `mapstructure:"generation"`
+	// Turns on secure boot for a generation 2 VM. By default, it is off.
+	EnableSecureBoot bool `mapstructure:"enable_secure_boot"`
+	// The secure boot template of a generation 2 VM, such as
+	// "MicrosoftWindows" or "MicrosoftUEFICertificateAuthority" for Linux.
+	SecureBootTemplate string `mapstructure:"secure_boot_template"`
+}
+
+func (c *GenerationConfig) Prepare() []error {
+	if c.Generation == 0 {
+		c.Generation = 1
+	}
+
+	log.Println(fmt.Sprintf("%s: %v", "Generation", c.Generation))
+
+	switch c.Generation {
+	case 1:
+		if c.EnableSecureBoot || c.SecureBootTemplate != "" {
+			return []error{errors.New("enable_secure_boot: Secure boot requires a generation 2 VM.")}
+		}
+	case 2:
+	default:
+		return []error{fmt.Errorf("generation: The generation must be 1 or 2, but defined: %v", c.Generation)}
+	}
+
+	return nil
+}
+
+// IsSet reports whether any of the generation and firmware settings is
+// set.
+func (c *GenerationConfig) IsSet() bool {
+	return c.Generation != 0 || c.EnableSecureBoot || c.SecureBootTemplate != ""
+}
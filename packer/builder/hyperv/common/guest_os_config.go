@@ -0,0 +1,128 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// The guest OS types of guest_os_type.
+const (
+	GuestOSWindowsServer = "windows-server"
+	GuestOSWindowsClient = "windows-client"
+	GuestOSLinux         = "linux"
+)
+
+// The memory limits of a VM on Hyper-V, in megabytes, whatever its guest.
+const (
+	MinRamSize = 32
+	MaxRamSize = 12 * 1024 * 1024 // 12TB
+)
+
+// A GuestOSProfile holds the memory and disk space in megabytes a guest
+// OS needs. Below the minimums it does not install, below the recommended
+// sizes it installs but may run out of memory or space. A size of 0 has
+// no limit.
+type GuestOSProfile struct {
+	MinRamSizeMB          uint
+	MinDiskSizeMB         uint
+	RecommendedRamSizeMB  uint
+	RecommendedDiskSizeMB uint
+}
+
+var guestOSProfiles = map[string]GuestOSProfile{
+	GuestOSWindowsServer: {
+		MinRamSizeMB:          512,
+		MinDiskSizeMB:         10 * 1024,
+		RecommendedDiskSizeMB: 32 * 1024,
+	},
+	GuestOSWindowsClient: {
+		MinRamSizeMB:          1024,
+		MinDiskSizeMB:         16 * 1024,
+		RecommendedRamSizeMB:  2048,
+		RecommendedDiskSizeMB: 32 * 1024,
+	},
+	GuestOSLinux: {
+		RecommendedRamSizeMB:  256,
+		RecommendedDiskSizeMB: 1024,
+	},
+}
+
+type GuestOSConfig struct {
+	// The family of the OS installed in the VM, windows-server,
+	// windows-client or linux, which the memory and disk size are checked
+	// against. By default, windows-server.
+	GuestOSType string `mapstructure:"guest_os_type"`
+}
+
+func (c *GuestOSConfig) Prepare(t *packer.ConfigTemplate) []error {
+	errs := make([]error, 0)
+
+	var err error
+	c.GuestOSType, err = t.Process(c.GuestOSType, nil)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Error processing guest_os_type: %s", err))
+	}
+
+	c.GuestOSType = strings.ToLower(c.GuestOSType)
+	if c.GuestOSType == "" {
+		c.GuestOSType = GuestOSWindowsServer
+	}
+
+	if _, ok := guestOSProfiles[c.GuestOSType]; !ok {
+		errs = append(errs, fmt.Errorf("guest_os_type: The guest OS type must be %s, %s or %s, but defined: %s",
+			GuestOSWindowsServer, GuestOSWindowsClient, GuestOSLinux, c.GuestOSType))
+	}
+
+	return errs
+}
+
+// Profile returns the profile of the guest OS type.
+func (c *GuestOSConfig) Profile() GuestOSProfile {
+	return guestOSProfiles[c.GuestOSType]
+}
+
+// CheckRamSize checks the memory of ram_size_mb against the limits of
+// Hyper-V and the profile of the guest OS.
+func (c *GuestOSConfig) CheckRamSize(ramSizeMB uint) ([]string, []error) {
+	warnings := make([]string, 0)
+	errs := make([]error, 0)
+	profile := c.Profile()
+
+	if ramSizeMB < MinRamSize {
+		errs = append(errs, fmt.Errorf("ram_size_mb: Hyper-V requires memory size >= %v MB, but defined: %v", MinRamSize, ramSizeMB))
+	} else if ramSizeMB > MaxRamSize {
+		errs = append(errs, fmt.Errorf("ram_size_mb: Hyper-V requires memory size <= %v GB, but defined: %v", MaxRamSize/1024, ramSizeMB/1024))
+	} else if ramSizeMB < profile.MinRamSizeMB {
+		errs = append(errs, fmt.Errorf("ram_size_mb: %s requires memory size >= %v MB, but defined: %v", c.GuestOSType, profile.MinRamSizeMB, ramSizeMB))
+	} else if ramSizeMB < profile.RecommendedRamSizeMB {
+		warnings = append(warnings, fmt.Sprintf(
+			"The ram_size_mb of %v MB is less than the %v MB recommended for %s, the\n"+
+				"installation may run out of memory.", ramSizeMB, profile.RecommendedRamSizeMB, c.GuestOSType))
+	}
+
+	return warnings, errs
+}
+
+// CheckDiskSize checks the hard disk of disk_size against the profile of
+// the guest OS.
+func (c *GuestOSConfig) CheckDiskSize(diskSizeMB uint) ([]string, []error) {
+	warnings := make([]string, 0)
+	errs := make([]error, 0)
+	profile := c.Profile()
+
+	if diskSizeMB < profile.MinDiskSizeMB {
+		errs = append(errs, fmt.Errorf("disk_size: %s requires disk space >= %v GB, but defined: %v MB", c.GuestOSType, profile.MinDiskSizeMB/1024, diskSizeMB))
+	} else if diskSizeMB < profile.RecommendedDiskSizeMB {
+		warnings = append(warnings, fmt.Sprintf(
+			"The disk_size of %v MB is less than the %v GB recommended for %s, the\n"+
+				"installation may run out of space.", diskSizeMB, profile.RecommendedDiskSizeMB/1024, c.GuestOSType))
+	}
+
+	return warnings, errs
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestGuestOSConfigPrepare(t *testing.T) {
+	c := new(GuestOSConfig)
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if c.GuestOSType != GuestOSWindowsServer {
+		t.Fatalf("bad guest_os_type: %s", c.GuestOSType)
+	}
+
+	c = &GuestOSConfig{GuestOSType: "Linux"}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if c.GuestOSType != GuestOSLinux {
+		t.Fatalf("bad guest_os_type: %s", c.GuestOSType)
+	}
+
+	c = &GuestOSConfig{GuestOSType: "freebsd"}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestGuestOSConfigCheckRamSize(t *testing.T) {
+	cases := []struct {
+		guestOSType string
+		ramSizeMB   uint
+		warnings    int
+		errs        int
+	}{
+		{GuestOSWindowsServer, 1024, 0, 0},
+		{GuestOSWindowsServer, 256, 0, 1},
+		{GuestOSWindowsServer, 65536, 0, 0},
+		{GuestOSWindowsClient, 1024, 1, 0},
+		{GuestOSWindowsClient, 512, 0, 1},
+		{GuestOSLinux, 128, 1, 0},
+		{GuestOSLinux, 512, 0, 0},
+		// the limits of Hyper-V
+		{GuestOSLinux, 16, 0, 1},
+		{GuestOSLinux, MaxRamSize + 1, 0, 1},
+	}
+
+	for _, tc := range cases {
+		c := &GuestOSConfig{GuestOSType: tc.guestOSType}
+		warnings, errs := c.CheckRamSize(tc.ramSizeMB)
+		if len(warnings) != tc.warnings || len(errs) != tc.errs {
+			t.Fatalf("bad: %s %d MB: %#v %#v", tc.guestOSType, tc.ramSizeMB, warnings, errs)
+		}
+	}
+}
+
+func TestGuestOSConfigCheckDiskSize(t *testing.T) {
+	cases := []struct {
+		guestOSType string
+		diskSizeMB  uint
+		warnings    int
+		errs        int
+	}{
+		{GuestOSWindowsServer, 127 * 1024, 0, 0},
+		{GuestOSWindowsServer, 20 * 1024, 1, 0},
+		{GuestOSWindowsServer, 8 * 1024, 0, 1},
+		{GuestOSWindowsClient, 8 * 1024, 0, 1},
+		{GuestOSLinux, 2048, 0, 0},
+		{GuestOSLinux, 512, 1, 0},
+	}
+
+	for _, tc := range cases {
+		c := &GuestOSConfig{GuestOSType: tc.guestOSType}
+		warnings, errs := c.CheckDiskSize(tc.diskSizeMB)
+		if len(warnings) != tc.warnings || len(errs) != tc.errs {
+			t.Fatalf("bad: %s %d MB: %#v %#v", tc.guestOSType, tc.diskSizeMB, warnings, errs)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+)
+
+// The range of the memory buffer of dynamic memory, in percent.
+const (
+	MinDynamicMemoryBuffer = 5
+	MaxDynamicMemoryBuffer = 2000
+)
+
+type HardwareConfig struct {
+	// The number of virtual processors of the VM. By default, a new VM has
+	// 1 and a clone keeps the processors of its VM.
+	CPUs uint `mapstructure:"cpus"`
+	// Turns dynamic memory on, with ram_size_mb as the startup memory. The
+	// minimum and maximum memory in megabytes and the memory buffer in
+	// percent keep the Hyper-V defaults unless they are set.
+	EnableDynamicMemory bool `mapstructure:"enable_dynamic_memory"`
+	DynamicMemoryMinMB  uint `mapstructure:"dynamic_memory_min_mb"`
+	DynamicMemoryMaxMB  uint `mapstructure:"dynamic_memory_max_mb"`
+	DynamicMemoryBuffer uint `mapstructure:"dynamic_memory_buffer"`
+	// Exposes the virtualization extensions of the processor to the VM, so
+	// that it can run Hyper-V and other hypervisors itself. It requires
+	// static memory, and MAC address spoofing for the nested VMs to reach
+	// the network.
+	EnableVirtualizationExtensions bool `mapstructure:"enable_virtualization_extensions"`
+	// Lets the VM send packets from MAC addresses other than the one of
+	// its network adapter.
+	EnableMacSpoofing bool `mapstructure:"enable_mac_spoofing"`
+}
+
+// Prepare validates the hardware settings of a VM whose startup memory
+// is ramSizeMB, or whose memory is kept when it is 0.
+func (c *HardwareConfig) Prepare(ramSizeMB uint) []error {
+	errs := make([]error, 0)
+
+	dynamic := c.DynamicMemoryMinMB != 0 || c.DynamicMemoryMaxMB != 0 || c.DynamicMemoryBuffer != 0
+	if dynamic && !c.EnableDynamicMemory {
+		errs = append(errs, fmt.Errorf("dynamic_memory_min_mb, dynamic_memory_max_mb and dynamic_memory_buffer require enable_dynamic_memory."))
+	}
+
+	if c.DynamicMemoryMinMB != 0 && ramSizeMB != 0 && c.DynamicMemoryMinMB > ramSizeMB {
+		errs = append(errs, fmt.Errorf("dynamic_memory_min_mb: %d MB is more than the %d MB of ram_size_mb.", c.DynamicMemoryMinMB, ramSizeMB))
+	}
+
+	if c.DynamicMemoryMaxMB != 0 && ramSizeMB != 0 && c.DynamicMemoryMaxMB < ramSizeMB {
+		errs = append(errs, fmt.Errorf("dynamic_memory_max_mb: %d MB is less than the %d MB of ram_size_mb.", c.DynamicMemoryMaxMB, ramSizeMB))
+	}
+
+	if c.DynamicMemoryMinMB != 0 && c.DynamicMemoryMaxMB != 0 && c.DynamicMemoryMinMB > c.DynamicMemoryMaxMB {
+		errs = append(errs, fmt.Errorf("dynamic_memory_min_mb: %d MB is more than the %d MB of dynamic_memory_max_mb.", c.DynamicMemoryMinMB, c.DynamicMemoryMaxMB))
+	}
+
+	if c.DynamicMemoryBuffer != 0 && (c.DynamicMemoryBuffer < MinDynamicMemoryBuffer || c.DynamicMemoryBuffer > MaxDynamicMemoryBuffer) {
+		errs = append(errs, fmt.Errorf("dynamic_memory_buffer: %d is not a percentage between %d and %d.", c.DynamicMemoryBuffer, MinDynamicMemoryBuffer, MaxDynamicMemoryBuffer))
+	}
+
+	if c.EnableVirtualizationExtensions {
+		if c.EnableDynamicMemory {
+			errs = append(errs, fmt.Errorf("enable_virtualization_extensions: Nested virtualization requires static memory. Remove enable_dynamic_memory."))
+		}
+		if !c.EnableMacSpoofing {
+			errs = append(errs, fmt.Errorf("enable_virtualization_extensions: Nested virtualization requires enable_mac_spoofing, for the nested VMs to reach the network."))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestHardwareConfigPrepare(t *testing.T) {
+	c := new(HardwareConfig)
+	if errs := c.Prepare(1024); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	c = &HardwareConfig{
+		CPUs:                2,
+		EnableDynamicMemory: true,
+		DynamicMemoryMinMB:  512,
+		DynamicMemoryMaxMB:  4096,
+		DynamicMemoryBuffer: 20,
+	}
+	if errs := c.Prepare(1024); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	c = &HardwareConfig{EnableVirtualizationExtensions: true, EnableMacSpoofing: true}
+	if errs := c.Prepare(1024); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestHardwareConfigPrepare_dynamicMemory(t *testing.T) {
+	cases := []struct {
+		config    HardwareConfig
+		ramSizeMB uint
+	}{
+		// without enable_dynamic_memory
+		{HardwareConfig{DynamicMemoryMaxMB: 4096}, 1024},
+		// around the startup memory
+		{HardwareConfig{EnableDynamicMemory: true, DynamicMemoryMinMB: 2048}, 1024},
+		{HardwareConfig{EnableDynamicMemory: true, DynamicMemoryMaxMB: 512}, 1024},
+		// around each other, for a clone keeping its memory
+		{HardwareConfig{EnableDynamicMemory: true, DynamicMemoryMinMB: 2048, DynamicMemoryMaxMB: 1024}, 0},
+		// out of range
+		{HardwareConfig{EnableDynamicMemory: true, DynamicMemoryBuffer: 2}, 1024},
+		{HardwareConfig{EnableDynamicMemory: true, DynamicMemoryBuffer: 3000}, 1024},
+	}
+
+	for _, tc := range cases {
+		if errs := tc.config.Prepare(tc.ramSizeMB); len(errs) != 1 {
+			t.Fatalf("bad: %#v: %#v", tc.config, errs)
+		}
+	}
+}
+
+func TestHardwareConfigPrepare_nested(t *testing.T) {
+	c := &HardwareConfig{EnableVirtualizationExtensions: true}
+	if errs := c.Prepare(1024); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	c = &HardwareConfig{EnableVirtualizationExtensions: true, EnableMacSpoofing: true, EnableDynamicMemory: true}
+	if errs := c.Prepare(1024); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The most memory of a generation 1 VM, or of any VM on a host creating
+// VMs of configuration versions before 8.0, such as Windows Server 2012
+// R2, in megabytes.
+const MaxRamSizeVersion5 = 1024 * 1024 // 1TB
+
+// CheckHostRamSize checks the memory of ram_size_mb of a VM of the
+// generation given, or of an unknown generation when it is 0, against
+// the memory of the host and the VMs it can create. A host that cannot be
+// queried is only warned about.
+func CheckHostRamSize(driver Driver, ramSizeMB uint, generation uint) ([]string, []error) {
+	warnings := make([]string, 0)
+	errs := make([]error, 0)
+
+	capacity, err := driver.GetHostMemoryCapacity()
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("The memory of the Hyper-V host could not be read: %s", err))
+	} else if int64(ramSizeMB)*1024*1024 > capacity {
+		errs = append(errs, fmt.Errorf("ram_size_mb: The host has %v MB of memory, but defined: %v", capacity/(1024*1024), ramSizeMB))
+	}
+
+	versions, err := driver.GetHostSupportedVersions()
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("The VM versions of the Hyper-V host could not be read: %s", err))
+		return warnings, errs
+	}
+
+	max := uint(MaxRamSize)
+	if generation == 1 || !supportsVersion(versions, 8) {
+		max = MaxRamSizeVersion5
+	}
+
+	if ramSizeMB > max {
+		vm := "A VM"
+		if generation != 0 {
+			vm = fmt.Sprintf("A generation %v VM", generation)
+		}
+		errs = append(errs, fmt.Errorf("ram_size_mb: %s on this host supports memory size <= %v GB, but defined: %v", vm, max/1024, ramSizeMB/1024))
+	}
+
+	return warnings, errs
+}
+
+// supportsVersion reports whether one of the configuration versions is
+// the major version given or a later one.
+func supportsVersion(versions []string, major int) bool {
+	for _, version := range versions {
+		n, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+		if err == nil && n >= major {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckHostRamSize(t *testing.T) {
+	driver := NewFakeDriver()
+	driver.HostMemoryCapacity = 256 * 1024 * 1024 * 1024
+
+	cases := []struct {
+		ramSizeMB  uint
+		generation uint
+		errs       int
+	}{
+		{64 * 1024, 1, 0},
+		{64 * 1024, 2, 0},
+		// more than the host has
+		{512 * 1024, 2, 1},
+	}
+
+	for _, tc := range cases {
+		warnings, errs := CheckHostRamSize(driver, tc.ramSizeMB, tc.generation)
+		if len(warnings) != 0 || len(errs) != tc.errs {
+			t.Fatalf("bad: %d MB: %#v %#v", tc.ramSizeMB, warnings, errs)
+		}
+	}
+}
+
+func TestCheckHostRamSize_versions(t *testing.T) {
+	driver := NewFakeDriver()
+	driver.HostMemoryCapacity = 4 * 1024 * 1024 * 1024 * 1024
+
+	// a generation 1 VM holds at most 1 TB
+	if _, errs := CheckHostRamSize(driver, 2*1024*1024, 1); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if _, errs := CheckHostRamSize(driver, 2*1024*1024, 2); len(errs) != 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if _, errs := CheckHostRamSize(driver, 2*1024*1024, 0); len(errs) != 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	// as do all VMs on Windows Server 2012 R2
+	driver.HostSupportedVersions = []string{"5.0"}
+	if _, errs := CheckHostRamSize(driver, 2*1024*1024, 2); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestCheckHostRamSize_unknown(t *testing.T) {
+	driver := NewFakeDriver()
+	driver.FailOn("GetHostMemoryCapacity", errors.New("Get-VMHost failed"))
+	driver.FailOn("GetHostSupportedVersions", errors.New("Get-VMHostSupportedVersion failed"))
+
+	warnings, errs := CheckHostRamSize(driver, 1024, 1)
+	if len(warnings) != 2 || len(errs) != 0 {
+		t.Fatalf("bad: %#v %#v", warnings, errs)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// The ports the HTTP server picks from when none are set.
+const (
+	DefaultHTTPPortMin = 8000
+	DefaultHTTPPortMax = 9000
+)
+
+type HTTPConfig struct {
+	// The directory served to the VM over HTTP while it runs, such as the
+	// kickstart or preseed files of a Linux installation. By default, there
+	// is no HTTP server.
+	HTTPDir string `mapstructure:"http_directory"`
+	// The range the port of the HTTP server is picked from at random.
+	HTTPPortMin uint `mapstructure:"http_port_min"`
+	HTTPPortMax uint `mapstructure:"http_port_max"`
+	// The address the HTTP server listens on. By default, all the addresses
+	// of the host.
+	HTTPAddress string `mapstructure:"http_bind_address"`
+}
+
+func (c *HTTPConfig) Prepare(t *packer.ConfigTemplate) []error {
+	errs := make([]error, 0)
+
+	templates := map[string]*string{
+		"http_directory":    &c.HTTPDir,
+		"http_bind_address": &c.HTTPAddress,
+	}
+
+	for n, ptr := range templates {
+		var err error
+		*ptr, err = t.Process(*ptr, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing %s: %s", n, err))
+		}
+	}
+
+	if c.HTTPPortMin == 0 {
+		c.HTTPPortMin = DefaultHTTPPortMin
+	}
+	if c.HTTPPortMax == 0 {
+		c.HTTPPortMax = DefaultHTTPPortMax
+	}
+	if c.HTTPAddress == "" {
+		c.HTTPAddress = "0.0.0.0"
+	}
+
+	if c.HTTPPortMin > c.HTTPPortMax {
+		errs = append(errs, fmt.Errorf("http_port_min: The minimum port must be at most http_port_max, but defined: %v", c.HTTPPortMin))
+	} else if c.HTTPPortMax > 65535 {
+		errs = append(errs, fmt.Errorf("http_port_max: The maximum port must be at most 65535, but defined: %v", c.HTTPPortMax))
+	}
+
+	if net.ParseIP(c.HTTPAddress) == nil {
+		errs = append(errs, fmt.Errorf("http_bind_address: '%s' is not an IP address.", c.HTTPAddress))
+	}
+
+	if c.HTTPDir != "" {
+		if fi, err := os.Stat(c.HTTPDir); err != nil {
+			errs = append(errs, fmt.Errorf("http_directory: %s", err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("http_directory: %s is not a directory.", c.HTTPDir))
+		}
+	}
+
+	return errs
+}
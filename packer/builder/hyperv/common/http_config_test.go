@@ -0,0 +1,57 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPConfigPrepare(t *testing.T) {
+	c := new(HTTPConfig)
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	if c.HTTPPortMin != DefaultHTTPPortMin || c.HTTPPortMax != DefaultHTTPPortMax || c.HTTPAddress != "0.0.0.0" {
+		t.Fatalf("bad config: %#v", c)
+	}
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c = &HTTPConfig{HTTPDir: dir, HTTPPortMin: 8080, HTTPPortMax: 8080, HTTPAddress: "192.168.250.1"}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestHTTPConfigPrepare_bad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "ks.cfg")
+	if err := ioutil.WriteFile(file, []byte("install"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []HTTPConfig{
+		{HTTPPortMin: 9000, HTTPPortMax: 8000},
+		{HTTPPortMax: 70000},
+		{HTTPAddress: "localhost"},
+		{HTTPDir: filepath.Join(dir, "missing")},
+		{HTTPDir: file},
+	}
+
+	for _, c := range cases {
+		if errs := c.Prepare(testConfigTemplate(t)); len(errs) != 1 {
+			t.Fatalf("bad: %#v: %#v", c, errs)
+		}
+	}
+}
@@ -0,0 +1,758 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package iso9660 writes ISO 9660 images with Joliet extensions, such as
+// the CDs holding answer files that are attached to a VM.
+//
+// The primary volume uses ISO 9660 level 1 names, 8.3 upper case, for the
+// readers that need them. Windows and Linux read the Joliet volume, which
+// keeps the names as given.
+package iso9660
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 2048
+
+	// The volume descriptors start after the 16 sectors of the system area.
+	systemAreaSectors = 16
+
+	// Joliet names are limited to 64 UCS-2 characters.
+	maxJolietNameLength = 64
+)
+
+// An Image is a tree of files to be written as an ISO image.
+type Image struct {
+	// The volume label of the image.
+	Label string
+
+	// The time recorded as the creation and modification time of the
+	// volume, and of its directories.
+	ModTime time.Time
+
+	root *node
+}
+
+type node struct {
+	name     string
+	isDir    bool
+	children map[string]*node
+
+	// for files, the host file holding the content
+	source  string
+	size    int64
+	modTime time.Time
+
+	// the layout of the node in the image, for directories one for the
+	// primary and one for the Joliet volume
+	primaryName  string
+	jolietName   []byte
+	primary      extent
+	joliet       extent
+	number       int
+	jolietNumber int
+	parent       *node
+	primaryOrder []*node
+	jolietOrder  []*node
+}
+
+type extent struct {
+	sector uint32
+	length uint32
+}
+
+// NewImage returns an empty image with the label given.
+func NewImage(label string) *Image {
+	return &Image{
+		Label:   label,
+		ModTime: time.Now(),
+		root:    &node{isDir: true, children: make(map[string]*node)},
+	}
+}
+
+// AddFile adds the host file at source to the image under the slash
+// separated path name, creating the directories leading to it.
+func (i *Image) AddFile(name string, source string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", source)
+	}
+
+	if info.Size() > math.MaxUint32 {
+		return fmt.Errorf("%s is too large for an ISO 9660 image", source)
+	}
+
+	parts, err := splitPath(name)
+	if err != nil {
+		return err
+	}
+
+	dir, err := i.mkdirAll(parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+
+	base := parts[len(parts)-1]
+	if _, ok := dir.children[strings.ToLower(base)]; ok {
+		return fmt.Errorf("%s is already in the image", name)
+	}
+
+	dir.children[strings.ToLower(base)] = &node{
+		name:    base,
+		source:  source,
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		parent:  dir,
+	}
+
+	return nil
+}
+
+// AddDir adds an empty directory to the image under the slash separated
+// path name, creating the directories leading to it.
+func (i *Image) AddDir(name string) error {
+	parts, err := splitPath(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.mkdirAll(parts)
+	return err
+}
+
+func (i *Image) mkdirAll(parts []string) (*node, error) {
+	dir := i.root
+	for _, part := range parts {
+		child, ok := dir.children[strings.ToLower(part)]
+		if !ok {
+			child = &node{name: part, isDir: true, children: make(map[string]*node), parent: dir}
+			dir.children[strings.ToLower(part)] = child
+		}
+
+		if !child.isDir {
+			return nil, fmt.Errorf("%s is a file in the image", part)
+		}
+
+		dir = child
+	}
+
+	return dir, nil
+}
+
+func splitPath(name string) ([]string, error) {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+
+		if part == ".." {
+			return nil, fmt.Errorf("invalid path in the image: %s", name)
+		}
+
+		if len(utf16.Encode([]rune(part))) > maxJolietNameLength {
+			return nil, fmt.Errorf("name is longer than %d characters: %s", maxJolietNameLength, part)
+		}
+
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("invalid path in the image: %s", name)
+	}
+
+	return parts, nil
+}
+
+// WriteTo writes the image to w.
+func (i *Image) WriteTo(w io.Writer) (int64, error) {
+	l := i.layout()
+
+	bw := &sectorWriter{w: bufio.NewWriter(w)}
+
+	bw.pad(systemAreaSectors * sectorSize)
+	bw.write(i.volumeDescriptor(l, false))
+	bw.write(i.volumeDescriptor(l, true))
+	bw.write(terminator())
+
+	bw.write(pathTable(l.primaryDirs, false, binary.LittleEndian))
+	bw.padSector()
+	bw.write(pathTable(l.primaryDirs, false, binary.BigEndian))
+	bw.padSector()
+	bw.write(pathTable(l.jolietDirs, true, binary.LittleEndian))
+	bw.padSector()
+	bw.write(pathTable(l.jolietDirs, true, binary.BigEndian))
+	bw.padSector()
+
+	for _, dir := range l.primaryDirs {
+		bw.write(i.directoryRecords(dir, false))
+	}
+
+	for _, dir := range l.jolietDirs {
+		bw.write(i.directoryRecords(dir, true))
+	}
+
+	for _, file := range l.files {
+		if bw.err != nil {
+			break
+		}
+
+		if err := bw.copyFile(file); err != nil {
+			return bw.n, err
+		}
+		bw.padSector()
+	}
+
+	if bw.err != nil {
+		return bw.n, bw.err
+	}
+
+	if bw.n != int64(l.sectors)*sectorSize {
+		return bw.n, errors.New("image size does not match its layout")
+	}
+
+	return bw.n, bw.w.Flush()
+}
+
+type layout struct {
+	primaryDirs []*node
+	jolietDirs  []*node
+	files       []*node
+
+	pathTableSize       uint32
+	jolietPathTableSize uint32
+	pathTableSectors    [4]uint32
+	sectors             uint32
+}
+
+// layout names the nodes and places every part of the image in sectors.
+func (i *Image) layout() *layout {
+	l := &layout{}
+
+	// directories in the breadth first order of the path tables
+	queue := []*node{i.root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		nameChildren(dir)
+		l.primaryDirs = append(l.primaryDirs, dir)
+		dir.number = len(l.primaryDirs)
+
+		for _, child := range dir.primaryOrder {
+			if child.isDir {
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	queue = []*node{i.root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+
+		l.jolietDirs = append(l.jolietDirs, dir)
+		dir.jolietNumber = len(l.jolietDirs)
+
+		for _, child := range dir.jolietOrder {
+			if child.isDir {
+				queue = append(queue, child)
+			} else {
+				l.files = append(l.files, child)
+			}
+		}
+	}
+
+	for _, dir := range l.primaryDirs {
+		l.pathTableSize += pathTableEntryLength(len(dir.primaryName))
+		l.jolietPathTableSize += pathTableEntryLength(len(dir.jolietName))
+	}
+
+	// system area, two volume descriptors and the terminator
+	sector := uint32(systemAreaSectors + 3)
+
+	for n := range l.pathTableSectors {
+		size := l.pathTableSize
+		if n >= 2 {
+			size = l.jolietPathTableSize
+		}
+
+		l.pathTableSectors[n] = sector
+		sector += sectors(int64(size))
+	}
+
+	for _, dir := range l.primaryDirs {
+		length := recordsLength(dir, false)
+		dir.primary = extent{sector: sector, length: uint32(length)}
+		sector += sectors(length)
+	}
+
+	for _, dir := range l.jolietDirs {
+		length := recordsLength(dir, true)
+		dir.joliet = extent{sector: sector, length: uint32(length)}
+		sector += sectors(length)
+	}
+
+	for _, file := range l.files {
+		file.primary = extent{length: uint32(file.size)}
+		if file.size > 0 {
+			file.primary.sector = sector
+		}
+		file.joliet = file.primary
+		sector += sectors(file.size)
+	}
+
+	l.sectors = sector
+	return l
+}
+
+// nameChildren gives the children of a directory their primary and
+// Joliet names, and sorts them by each.
+func nameChildren(dir *node) {
+	if dir.parent == nil {
+		dir.primaryName = "\x00"
+		dir.jolietName = []byte{0}
+	}
+
+	dir.primaryOrder = make([]*node, 0, len(dir.children))
+	for _, child := range dir.children {
+		dir.primaryOrder = append(dir.primaryOrder, child)
+	}
+
+	// names are given in the order of the original names so that the
+	// same tree always gets the same names
+	sort.Sort(byName(dir.primaryOrder))
+
+	used := make(map[string]bool)
+	for _, child := range dir.primaryOrder {
+		child.primaryName = primaryName(child.name, child.isDir, used)
+		child.jolietName = jolietName(child.name)
+	}
+
+	sort.Sort(byPrimaryName(dir.primaryOrder))
+
+	dir.jolietOrder = make([]*node, len(dir.primaryOrder))
+	copy(dir.jolietOrder, dir.primaryOrder)
+	sort.Sort(byJolietName(dir.jolietOrder))
+}
+
+// primaryName returns a level 1 name for the name given that is unique
+// among the used names: up to 8 d-characters, and for files up to 3 more
+// after a dot.
+func primaryName(name string, isDir bool, used map[string]bool) string {
+	base, ext := name, ""
+	if !isDir {
+		if dot := strings.LastIndex(name, "."); dot > 0 {
+			base, ext = name[:dot], name[dot+1:]
+		}
+	}
+
+	base = dCharacters(base, 8)
+	ext = dCharacters(ext, 3)
+	if base == "" {
+		base = "_"
+	}
+
+	result := ""
+	for n := 0; ; n++ {
+		candidate := base
+		if n > 0 {
+			suffix := fmt.Sprintf("~%d", n)
+			if len(candidate)+len(suffix) > 8 {
+				candidate = candidate[:8-len(suffix)]
+			}
+			candidate += suffix
+		}
+
+		if !isDir {
+			candidate += "." + ext
+		}
+
+		if !used[candidate] {
+			result = candidate
+			break
+		}
+	}
+
+	used[result] = true
+
+	if !isDir {
+		result += ";1"
+	}
+
+	return result
+}
+
+func dCharacters(s string, max int) string {
+	result := make([]byte, 0, max)
+	for _, r := range strings.ToUpper(s) {
+		if len(result) == max {
+			break
+		}
+
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			result = append(result, byte(r))
+		} else {
+			result = append(result, '_')
+		}
+	}
+
+	return string(result)
+}
+
+func jolietName(name string) []byte {
+	return ucs2(name)
+}
+
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	result := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.BigEndian.PutUint16(result[2*i:], unit)
+	}
+	return result
+}
+
+type byName []*node
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byPrimaryName []*node
+
+func (s byPrimaryName) Len() int           { return len(s) }
+func (s byPrimaryName) Less(i, j int) bool { return s[i].primaryName < s[j].primaryName }
+func (s byPrimaryName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+type byJolietName []*node
+
+func (s byJolietName) Len() int           { return len(s) }
+func (s byJolietName) Less(i, j int) bool { return string(s[i].jolietName) < string(s[j].jolietName) }
+func (s byJolietName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func sectors(length int64) uint32 {
+	return uint32((length + sectorSize - 1) / sectorSize)
+}
+
+func pathTableEntryLength(nameLength int) uint32 {
+	return uint32(8 + nameLength + nameLength%2)
+}
+
+func recordLength(nameLength int) int {
+	return 33 + nameLength + (nameLength+1)%2
+}
+
+// recordsLength returns the length of the directory records of dir,
+// which may not cross sector boundaries.
+func recordsLength(dir *node, joliet bool) int64 {
+	var length int64
+	add := func(recordLength int) {
+		if length%sectorSize+int64(recordLength) > sectorSize {
+			length += sectorSize - length%sectorSize
+		}
+		length += int64(recordLength)
+	}
+
+	// the . and .. entries
+	add(recordLength(1))
+	add(recordLength(1))
+
+	for _, child := range children(dir, joliet) {
+		add(recordLength(len(name(child, joliet))))
+	}
+
+	return int64(sectors(length)) * sectorSize
+}
+
+func children(dir *node, joliet bool) []*node {
+	if joliet {
+		return dir.jolietOrder
+	}
+	return dir.primaryOrder
+}
+
+func name(n *node, joliet bool) []byte {
+	if joliet {
+		return n.jolietName
+	}
+	return []byte(n.primaryName)
+}
+
+func location(n *node, joliet bool) extent {
+	if joliet {
+		return n.joliet
+	}
+	return n.primary
+}
+
+func (i *Image) directoryRecords(dir *node, joliet bool) []byte {
+	ext := location(dir, joliet)
+	result := make([]byte, 0, ext.length)
+
+	add := func(record []byte) {
+		if len(result)%sectorSize+len(record) > sectorSize {
+			result = append(result, make([]byte, sectorSize-len(result)%sectorSize)...)
+		}
+		result = append(result, record...)
+	}
+
+	parent := dir.parent
+	if parent == nil {
+		parent = dir
+	}
+
+	add(directoryRecord([]byte{0}, location(dir, joliet), true, i.ModTime))
+	add(directoryRecord([]byte{1}, location(parent, joliet), true, i.ModTime))
+
+	for _, child := range children(dir, joliet) {
+		modTime := child.modTime
+		if child.isDir {
+			modTime = i.ModTime
+		}
+
+		add(directoryRecord(name(child, joliet), location(child, joliet), child.isDir, modTime))
+	}
+
+	return append(result, make([]byte, int(ext.length)-len(result))...)
+}
+
+func directoryRecord(name []byte, ext extent, isDir bool, modTime time.Time) []byte {
+	record := make([]byte, recordLength(len(name)))
+	record[0] = byte(len(record))
+	putBothUint32(record[2:], ext.sector)
+	putBothUint32(record[10:], ext.length)
+
+	t := modTime.UTC()
+	record[18] = byte(t.Year() - 1900)
+	record[19] = byte(t.Month())
+	record[20] = byte(t.Day())
+	record[21] = byte(t.Hour())
+	record[22] = byte(t.Minute())
+	record[23] = byte(t.Second())
+
+	if isDir {
+		record[25] = 2
+	}
+
+	putBothUint16(record[28:], 1)
+	record[32] = byte(len(name))
+	copy(record[33:], name)
+	return record
+}
+
+func (i *Image) volumeDescriptor(l *layout, joliet bool) []byte {
+	d := make([]byte, sectorSize)
+
+	d[0] = 1
+	if joliet {
+		d[0] = 2
+	}
+	copy(d[1:], "CD001")
+	d[6] = 1
+
+	pathTableSize := l.pathTableSize
+	lPathTable, mPathTable := l.pathTableSectors[0], l.pathTableSectors[1]
+	root := i.root.primary
+	if joliet {
+		pathTableSize = l.jolietPathTableSize
+		lPathTable, mPathTable = l.pathTableSectors[2], l.pathTableSectors[3]
+		root = i.root.joliet
+
+		// UCS-2 level 3
+		copy(d[88:], "%/E")
+	}
+
+	putString(d[8:40], "", joliet)
+	putString(d[40:72], i.volumeLabel(joliet), joliet)
+	putBothUint32(d[80:], l.sectors)
+	putBothUint16(d[120:], 1)
+	putBothUint16(d[124:], 1)
+	putBothUint16(d[128:], sectorSize)
+	putBothUint32(d[132:], pathTableSize)
+	binary.LittleEndian.PutUint32(d[140:], lPathTable)
+	binary.BigEndian.PutUint32(d[148:], mPathTable)
+	copy(d[156:190], directoryRecord([]byte{0}, root, true, i.ModTime))
+
+	// volume set, publisher, data preparer and application identifiers,
+	// then the copyright, abstract and bibliographic file identifiers
+	for _, field := range [][2]int{{190, 318}, {318, 446}, {446, 574}, {574, 702}, {702, 739}, {739, 776}, {776, 813}} {
+		putString(d[field[0]:field[1]], "", joliet)
+	}
+
+	created := volumeTime(i.ModTime)
+	copy(d[813:], created)
+	copy(d[830:], created)
+	copy(d[847:], volumeTime(time.Time{}))
+	copy(d[864:], created)
+	d[881] = 1
+
+	return d
+}
+
+// volumeLabel returns the label in the characters allowed by the volume.
+func (i *Image) volumeLabel(joliet bool) string {
+	if joliet {
+		label := []rune(i.Label)
+		if len(label) > 16 {
+			label = label[:16]
+		}
+		return string(label)
+	}
+
+	// d-characters are upper case only, but labels such as cidata are
+	// looked for as they are given
+	label := make([]byte, 0, 32)
+	for _, r := range i.Label {
+		if len(label) == 32 {
+			break
+		}
+
+		if r > ' ' && r < 0x7f {
+			label = append(label, byte(r))
+		} else {
+			label = append(label, '_')
+		}
+	}
+	return string(label)
+}
+
+// volumeTime formats a time as a volume descriptor does, with the zero
+// time meaning no time at all.
+func volumeTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+
+	t = t.UTC()
+	s := fmt.Sprintf("%04d%02d%02d%02d%02d%02d%02d", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond()/10000000)
+	return append([]byte(s), 0)
+}
+
+func terminator() []byte {
+	d := make([]byte, sectorSize)
+	d[0] = 255
+	copy(d[1:], "CD001")
+	d[6] = 1
+	return d
+}
+
+func pathTable(dirs []*node, joliet bool, order binary.ByteOrder) []byte {
+	var result []byte
+	for _, dir := range dirs {
+		dirName := name(dir, joliet)
+		entry := make([]byte, pathTableEntryLength(len(dirName)))
+		entry[0] = byte(len(dirName))
+		order.PutUint32(entry[2:], location(dir, joliet).sector)
+
+		parent := dir.parent
+		if parent == nil {
+			parent = dir
+		}
+
+		number := parent.number
+		if joliet {
+			number = parent.jolietNumber
+		}
+
+		order.PutUint16(entry[6:], uint16(number))
+		copy(entry[8:], dirName)
+		result = append(result, entry...)
+	}
+
+	return result
+}
+
+// putString fills a field with the string given, padded with spaces, in
+// ASCII for the primary volume or UCS-2 for the Joliet volume.
+func putString(field []byte, s string, joliet bool) {
+	if !joliet {
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, s)
+		return
+	}
+
+	for i := 0; i+1 < len(field); i += 2 {
+		field[i], field[i+1] = 0, ' '
+	}
+	copy(field, ucs2(s))
+}
+
+func putBothUint16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBothUint32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// sectorWriter counts what is written, keeps the first error and pads
+// to sector boundaries.
+type sectorWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (w *sectorWriter) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+
+	n, err := w.w.Write(b)
+	w.n += int64(n)
+	w.err = err
+}
+
+func (w *sectorWriter) pad(n int64) {
+	w.write(make([]byte, n))
+}
+
+func (w *sectorWriter) padSector() {
+	if rest := w.n % sectorSize; rest != 0 {
+		w.pad(sectorSize - rest)
+	}
+}
+
+func (w *sectorWriter) copyFile(file *node) error {
+	f, err := os.Open(file.source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w.w, io.LimitReader(f, file.size))
+	w.n += n
+	if err != nil {
+		w.err = err
+		return err
+	}
+
+	if n != file.size {
+		return fmt.Errorf("%s changed size while the image was written", file.source)
+	}
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+var testModTime = time.Date(2014, 7, 1, 12, 30, 0, 0, time.UTC)
+
+// testImage writes the files given, by their path in the image, to a
+// temporary directory and returns an image holding them.
+func testImage(t *testing.T, files map[string]string) (*Image, string) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	image := NewImage("cidata")
+	image.ModTime = testModTime
+
+	for name, content := range files {
+		source := filepath.Join(dir, strings.Replace(name, "/", "_", -1))
+		if err := ioutil.WriteFile(source, []byte(content), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if err := image.AddFile(name, source); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	return image, dir
+}
+
+func writeImage(t *testing.T, image *Image) []byte {
+	var buf bytes.Buffer
+	n, err := image.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if n != int64(buf.Len()) || n%sectorSize != 0 {
+		t.Fatalf("bad length: %d %d", n, buf.Len())
+	}
+
+	return buf.Bytes()
+}
+
+// readTree reads the directory tree of the volume described at the
+// sector given, returning the content of every file by its path, and
+// an empty string for every directory.
+func readTree(t *testing.T, b []byte, descriptor int, joliet bool) map[string]string {
+	root := b[descriptor*sectorSize+156 : descriptor*sectorSize+190]
+	result := make(map[string]string)
+	readDir(t, b, root, "", joliet, result)
+	return result
+}
+
+func readDir(t *testing.T, b []byte, record []byte, path string, joliet bool, result map[string]string) {
+	sector := binary.LittleEndian.Uint32(record[2:])
+	length := binary.LittleEndian.Uint32(record[10:])
+	if binary.BigEndian.Uint32(record[6:]) != sector || binary.BigEndian.Uint32(record[14:]) != length {
+		t.Fatalf("bad both-endian fields in %s", path)
+	}
+
+	records := b[sector*sectorSize : sector*sectorSize+length]
+	for offset, n := 0, 0; offset < len(records); n++ {
+		size := int(records[offset])
+		if size == 0 {
+			// records do not span sectors
+			offset = (offset/sectorSize + 1) * sectorSize
+			continue
+		}
+
+		child := records[offset : offset+size]
+		offset += size
+
+		if n < 2 {
+			// the . and .. records
+			continue
+		}
+
+		name := decodeName(child[33:33+int(child[32])], joliet)
+		childPath := path + "/" + name
+
+		if child[25]&2 != 0 {
+			result[childPath] = ""
+			readDir(t, b, child, childPath, joliet, result)
+			continue
+		}
+
+		start := binary.LittleEndian.Uint32(child[2:])
+		size32 := binary.LittleEndian.Uint32(child[10:])
+		result[childPath] = string(b[start*sectorSize : start*sectorSize+size32])
+	}
+}
+
+func decodeName(b []byte, joliet bool) string {
+	if !joliet {
+		return string(b)
+	}
+
+	units := make([]uint16, len(b)/2)
+	for n := range units {
+		units[n] = binary.BigEndian.Uint16(b[2*n:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func TestImage(t *testing.T) {
+	image, dir := testImage(t, map[string]string{
+		"Autounattend.xml":            "<unattend/>",
+		"scripts/install guest.ps1":   "Write-Host 'hello'",
+		"scripts/openssh/sshd_config": strings.Repeat("x", 3*sectorSize+17),
+		"meta-data":                   "",
+	})
+	defer os.RemoveAll(dir)
+
+	if err := image.AddDir("empty"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b := writeImage(t, image)
+
+	// the primary volume descriptor, the Joliet supplementary volume
+	// descriptor and the terminator
+	for sector, kind := range map[int]byte{16: 1, 17: 2, 18: 255} {
+		d := b[sector*sectorSize:]
+		if d[0] != kind || string(d[1:6]) != "CD001" || d[6] != 1 {
+			t.Fatalf("bad descriptor at sector %d: % x", sector, d[:7])
+		}
+	}
+
+	if label := string(b[16*sectorSize+40 : 16*sectorSize+72]); label != "cidata"+strings.Repeat(" ", 26) {
+		t.Fatalf("bad label: %q", label)
+	}
+
+	if escape := string(b[17*sectorSize+88 : 17*sectorSize+91]); escape != "%/E" {
+		t.Fatalf("bad escape sequence: %q", escape)
+	}
+
+	if size := binary.LittleEndian.Uint32(b[16*sectorSize+80:]); int(size)*sectorSize != len(b) {
+		t.Fatalf("bad volume size: %d", size)
+	}
+
+	expected := map[string]string{
+		"/Autounattend.xml":            "<unattend/>",
+		"/empty":                       "",
+		"/meta-data":                   "",
+		"/scripts":                     "",
+		"/scripts/install guest.ps1":   "Write-Host 'hello'",
+		"/scripts/openssh":             "",
+		"/scripts/openssh/sshd_config": strings.Repeat("x", 3*sectorSize+17),
+	}
+
+	if tree := readTree(t, b, 17, true); !reflect.DeepEqual(tree, expected) {
+		t.Fatalf("bad Joliet tree: %#v", tree)
+	}
+
+	expected = map[string]string{
+		"/AUTOUNAT.XML;1":              "<unattend/>",
+		"/EMPTY":                       "",
+		"/META_DAT.;1":                 "",
+		"/SCRIPTS":                     "",
+		"/SCRIPTS/INSTALL_.PS1;1":      "Write-Host 'hello'",
+		"/SCRIPTS/OPENSSH":             "",
+		"/SCRIPTS/OPENSSH/SSHD_CON.;1": strings.Repeat("x", 3*sectorSize+17),
+	}
+
+	if tree := readTree(t, b, 16, false); !reflect.DeepEqual(tree, expected) {
+		t.Fatalf("bad primary tree: %#v", tree)
+	}
+}
+
+func TestImage_manyFiles(t *testing.T) {
+	// enough records for the directory to span several sectors, with
+	// names that are the same as level 1 names
+	files := make(map[string]string)
+	for n := 0; n < 80; n++ {
+		files[strings.Repeat("a", 20)+string(rune('A'+n%26))+strings.Repeat("b", n/26)+".txt"] = string(rune('0' + n%10))
+	}
+
+	image, dir := testImage(t, files)
+	defer os.RemoveAll(dir)
+
+	b := writeImage(t, image)
+
+	tree := readTree(t, b, 17, true)
+	if len(tree) != len(files) {
+		t.Fatalf("bad: %d", len(tree))
+	}
+	for name, content := range files {
+		if tree["/"+name] != content {
+			t.Fatalf("bad content of %s: %q", name, tree["/"+name])
+		}
+	}
+
+	primary := readTree(t, b, 16, false)
+	if len(primary) != len(files) {
+		t.Fatalf("primary names are not unique: %d", len(primary))
+	}
+	for name := range primary {
+		if len(name) > len("/AAAAA~80.TXT;1") {
+			t.Fatalf("bad primary name: %s", name)
+		}
+	}
+}
+
+func TestImage_deterministic(t *testing.T) {
+	image, dir := testImage(t, map[string]string{
+		"a.txt":     "a",
+		"b/c.txt":   "c",
+		"b/d/e.txt": "e",
+	})
+	defer os.RemoveAll(dir)
+
+	if !bytes.Equal(writeImage(t, image), writeImage(t, image)) {
+		t.Fatal("images should be the same")
+	}
+}
+
+func TestImageAddFile(t *testing.T) {
+	image, dir := testImage(t, map[string]string{"a/b.txt": "b"})
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "a_b.txt")
+
+	if err := image.AddFile("A/B.TXT", source); err == nil {
+		t.Fatal("should have error adding a file twice")
+	}
+
+	if err := image.AddFile("a/b.txt/c.txt", source); err == nil {
+		t.Fatal("should have error adding a file below a file")
+	}
+
+	if err := image.AddFile("../c.txt", source); err == nil {
+		t.Fatal("should have error adding a file outside the image")
+	}
+
+	if err := image.AddFile(strings.Repeat("c", maxJolietNameLength+1), source); err == nil {
+		t.Fatal("should have error adding a long name")
+	}
+
+	if err := image.AddFile("c.txt", dir); err == nil {
+		t.Fatal("should have error adding a directory as a file")
+	}
+
+	if err := image.AddFile("c.txt", filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("should have error adding a missing file")
+	}
+}
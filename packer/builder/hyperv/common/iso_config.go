@@ -0,0 +1,236 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+type ISOConfig struct {
+	// The checksum for the OS ISO file. Because ISO files are so large,
+	// this is required and Packer will verify it prior to booting a virtual
+	// machine with the ISO attached. The type of the checksum is specified
+	// with iso_checksum_type, documented below.
+	ISOChecksum string `mapstructure:"iso_checksum"`
+	// A URL to a checksum file listing the checksum of the ISO, such as a
+	// SHA256SUMS file. The entry for the file name of the ISO is used. This
+	// can be given instead of iso_checksum.
+	ISOChecksumURL string `mapstructure:"iso_checksum_url"`
+	// The type of the checksum specified in iso_checksum. Valid values are
+	// "none", "md5", "sha1", "sha256", or "sha512" currently. While "none"
+	// will skip checksumming, this is not recommended since ISO files are
+	// generally large and corruption does happen from time to time.
+	ISOChecksumType string `mapstructure:"iso_checksum_type"`
+	// A URL to the ISO containing the installation image. This URL can be
+	// either an HTTP URL or a file URL (or path to a file). If this is an
+	// HTTP URL, Packer will download it and cache it between runs.
+	RawSingleISOUrl string `mapstructure:"iso_url"`
+	// Multiple URLs for the ISO to download. Packer will try these in order.
+	// If anything goes wrong attempting to download or while downloading a
+	// single URL, it will move on to the next. All URLs must point to the
+	// same file (same checksum). By default this is empty and iso_url is
+	// used. Only one of iso_url or iso_urls can be specified.
+	ISOUrls []string `mapstructure:"iso_urls"`
+}
+
+func (c *ISOConfig) Prepare(t *packer.ConfigTemplate) ([]string, []error) {
+	templates := map[string]*string{
+		"iso_checksum":      &c.ISOChecksum,
+		"iso_checksum_url":  &c.ISOChecksumURL,
+		"iso_checksum_type": &c.ISOChecksumType,
+		"iso_url":           &c.RawSingleISOUrl,
+	}
+
+	errs := make([]error, 0)
+	for n, ptr := range templates {
+		var err error
+		*ptr, err = t.Process(*ptr, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing %s: %s", n, err))
+		}
+	}
+
+	for i, rawUrl := range c.ISOUrls {
+		var err error
+		c.ISOUrls[i], err = t.Process(rawUrl, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing iso_urls[%d]: %s", i, err))
+		}
+	}
+
+	if c.RawSingleISOUrl == "" && len(c.ISOUrls) == 0 {
+		errs = append(errs, errors.New("One of iso_url or iso_urls must be specified."))
+	} else if c.RawSingleISOUrl != "" && len(c.ISOUrls) > 0 {
+		errs = append(errs, errors.New("Only one of iso_url or iso_urls may be specified."))
+	} else if c.RawSingleISOUrl != "" {
+		c.ISOUrls = []string{c.RawSingleISOUrl}
+	}
+
+	for i, rawUrl := range c.ISOUrls {
+		var err error
+		c.ISOUrls[i], err = common.DownloadableURL(rawUrl)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Failed to parse iso_url %d: %s", i+1, err))
+		}
+	}
+
+	warnings := make([]string, 0)
+
+	c.ISOChecksumType = strings.ToLower(c.ISOChecksumType)
+	if c.ISOChecksumType == "" {
+		errs = append(errs, errors.New("The iso_checksum_type must be specified."))
+		return warnings, errs
+	}
+
+	if c.ISOChecksumType == "none" {
+		warnings = append(warnings,
+			"A checksum type of 'none' was specified. Since ISO files are so big,\n"+
+				"a checksum is highly recommended.")
+		return warnings, errs
+	}
+
+	if h := common.HashForType(c.ISOChecksumType); h == nil {
+		errs = append(errs, fmt.Errorf("Unsupported checksum type: %s", c.ISOChecksumType))
+		return warnings, errs
+	}
+
+	if c.ISOChecksum != "" && c.ISOChecksumURL != "" {
+		errs = append(errs, errors.New("Only one of iso_checksum or iso_checksum_url may be specified."))
+		return warnings, errs
+	}
+
+	if c.ISOChecksumURL != "" && len(c.ISOUrls) > 0 {
+		checksum, err := fetchISOChecksum(c.ISOChecksumURL, c.ISOUrls[0])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("iso_checksum_url: Error getting the checksum: %s", err))
+			return warnings, errs
+		}
+
+		c.ISOChecksum = checksum
+	}
+
+	c.ISOChecksum = strings.ToLower(c.ISOChecksum)
+	if c.ISOChecksum == "" && c.ISOChecksumURL == "" {
+		errs = append(errs, errors.New("Due to large file sizes, an iso_checksum is required."))
+	}
+
+	return warnings, errs
+}
+
+// The time allowed to download the checksum file of iso_checksum_url, so
+// that a server that stalls does not hang the validation of the template.
+var isoChecksumTimeout = 30 * time.Second
+
+// fetchISOChecksum reads the checksum file at checksumUrl and returns the
+// checksum listed for the file name of isoUrl. Both the GNU coreutils
+// format ("<checksum>  <file>") and the BSD format ("SHA256 (<file>) =
+// <checksum>") are understood, as is a file holding a single checksum.
+func fetchISOChecksum(checksumUrl string, isoUrl string) (string, error) {
+	u, err := url.Parse(checksumUrl)
+	if err != nil {
+		return "", err
+	}
+
+	// a Windows path such as C:\SHA256SUMS parses with a scheme of "c"
+	scheme := u.Scheme
+	if len(scheme) == 1 {
+		scheme = ""
+	}
+
+	var reader io.ReadCloser
+	switch scheme {
+	case "http", "https":
+		client := &http.Client{Timeout: isoChecksumTimeout}
+		resp, err := client.Get(checksumUrl)
+		if err != nil {
+			return "", err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("%s returned status %s", checksumUrl, resp.Status)
+		}
+
+		reader = resp.Body
+	case "file", "":
+		filename := u.Path
+		if scheme == "" {
+			filename = checksumUrl
+		}
+
+		// file:///C:/path gives a path of /C:/path
+		if len(filename) > 2 && filename[0] == '/' && filename[2] == ':' {
+			filename = filename[1:]
+		}
+
+		reader, err = os.Open(filepath.FromSlash(filename))
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+	}
+	defer reader.Close()
+
+	isoName := isoUrl
+	if u, err := url.Parse(isoUrl); err == nil && u.Path != "" {
+		isoName = u.Path
+	}
+	isoName = path.Base(filepath.ToSlash(isoName))
+
+	checksums := make([]string, 0)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// BSD format: SHA256 (file.iso) = checksum
+		if open := strings.Index(line, " ("); open > 0 {
+			if end := strings.LastIndex(line, ") = "); end > open {
+				if path.Base(line[open+2:end]) == isoName {
+					return strings.TrimSpace(line[end+4:]), nil
+				}
+				continue
+			}
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 1 {
+			checksums = append(checksums, fields[0])
+			continue
+		}
+
+		// GNU format: checksum  file.iso, with a * before binary files
+		name := strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+		if path.Base(filepath.ToSlash(name)) == isoName {
+			return fields[0], nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	if len(checksums) == 1 {
+		return checksums[0], nil
+	}
+
+	return "", fmt.Errorf("no checksum for %s found in %s", isoName, checksumUrl)
+}
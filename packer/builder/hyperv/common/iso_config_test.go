@@ -0,0 +1,211 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+func testISOConfig() *ISOConfig {
+	return &ISOConfig{
+		ISOChecksum:     "FOO",
+		ISOChecksumType: "MD5",
+		RawSingleISOUrl: "http://www.packer.io/install.iso",
+	}
+}
+
+func testConfigTemplate(t *testing.T) *packer.ConfigTemplate {
+	result, err := packer.NewConfigTemplate()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return result
+}
+
+func TestISOConfigPrepare(t *testing.T) {
+	c := testISOConfig()
+	warns, errs := c.Prepare(testConfigTemplate(t))
+	if len(warns) > 0 || len(errs) > 0 {
+		t.Fatalf("bad: %#v %#v", warns, errs)
+	}
+
+	if c.ISOChecksum != "foo" || c.ISOChecksumType != "md5" {
+		t.Fatalf("should be lowercased: %s %s", c.ISOChecksum, c.ISOChecksumType)
+	}
+
+	if !reflect.DeepEqual(c.ISOUrls, []string{"http://www.packer.io/install.iso"}) {
+		t.Fatalf("bad: %#v", c.ISOUrls)
+	}
+}
+
+func TestISOConfigPrepare_ISOUrls(t *testing.T) {
+	// iso_url and iso_urls are exclusive
+	c := testISOConfig()
+	c.ISOUrls = []string{"http://www.packer.io/install.iso"}
+	if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	// one of them is required
+	c = testISOConfig()
+	c.RawSingleISOUrl = ""
+	if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testISOConfig()
+	c.RawSingleISOUrl = ""
+	c.ISOUrls = []string{"http://mirror1/install.iso", "http://mirror2/install.iso"}
+	if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	if len(c.ISOUrls) != 2 {
+		t.Fatalf("bad: %#v", c.ISOUrls)
+	}
+}
+
+func TestISOConfigPrepare_ISOChecksumType(t *testing.T) {
+	c := testISOConfig()
+	c.ISOChecksumType = ""
+	if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testISOConfig()
+	c.ISOChecksumType = "crc32"
+	if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	// none needs no checksum, but is warned about
+	c = testISOConfig()
+	c.ISOChecksum = ""
+	c.ISOChecksumType = "none"
+	warns, errs := c.Prepare(testConfigTemplate(t))
+	if len(warns) == 0 || len(errs) > 0 {
+		t.Fatalf("bad: %#v %#v", warns, errs)
+	}
+}
+
+func TestISOConfigPrepare_ISOChecksum(t *testing.T) {
+	c := testISOConfig()
+	c.ISOChecksum = ""
+	if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) == 0 {
+		t.Fatal("should have error")
+	}
+
+	c = testISOConfig()
+	c.ISOChecksumURL = "http://www.packer.io/SHA256SUMS"
+	if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) == 0 {
+		t.Fatal("iso_checksum and iso_checksum_url should be exclusive")
+	}
+}
+
+func TestISOConfigPrepare_ISOChecksumURL(t *testing.T) {
+	files := map[string]string{
+		"/gnu": "# comment\n" +
+			"d41d8cd98f00b204e9800998ecf8427e  other.iso\n" +
+			"0BD6B6F0A39B6D8D0EF3E6F6F1F2E8DA *install.iso\n",
+		"/bsd": "MD5 (other.iso) = d41d8cd98f00b204e9800998ecf8427e\n" +
+			"MD5 (install.iso) = 0bd6b6f0a39b6d8d0ef3e6f6f1f2e8da\n",
+		"/single": "0bd6b6f0a39b6d8d0ef3e6f6f1f2e8da\n",
+		"/missing": "d41d8cd98f00b204e9800998ecf8427e  other.iso\n",
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, content)
+	}))
+	defer server.Close()
+
+	for _, name := range []string{"/gnu", "/bsd", "/single"} {
+		c := testISOConfig()
+		c.ISOChecksum = ""
+		c.ISOChecksumURL = server.URL + name
+		c.RawSingleISOUrl = "http://mirror/releases/install.iso?download=1"
+
+		if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+			t.Fatalf("%s: %#v", name, errs)
+		}
+
+		if c.ISOChecksum != "0bd6b6f0a39b6d8d0ef3e6f6f1f2e8da" {
+			t.Fatalf("%s: bad checksum %q", name, c.ISOChecksum)
+		}
+	}
+
+	for _, name := range []string{"/missing", "/notfound"} {
+		c := testISOConfig()
+		c.ISOChecksum = ""
+		c.ISOChecksumURL = server.URL + name
+
+		_, errs := c.Prepare(testConfigTemplate(t))
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), "iso_checksum_url") {
+			t.Fatalf("%s: bad: %#v", name, errs)
+		}
+	}
+}
+
+func TestISOConfigPrepare_ISOChecksumURLTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { isoChecksumTimeout = timeout }(isoChecksumTimeout)
+	isoChecksumTimeout = 50 * time.Millisecond
+
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	c := testISOConfig()
+	c.ISOChecksum = ""
+	c.ISOChecksumURL = server.URL + "/SHA256SUMS"
+
+	_, errs := c.Prepare(testConfigTemplate(t))
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "iso_checksum_url: ") {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestISOConfigPrepare_ISOChecksumURLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "SHA1SUMS")
+	err = ioutil.WriteFile(path, []byte("da39a3ee5e6b4b0d3255bfef95601890afd80709  install.iso\n"), 0644)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, checksumUrl := range []string{path, "file:///" + strings.TrimPrefix(filepath.ToSlash(path), "/")} {
+		c := testISOConfig()
+		c.ISOChecksum = ""
+		c.ISOChecksumType = "sha1"
+		c.ISOChecksumURL = checksumUrl
+
+		if _, errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+			t.Fatalf("%s: %#v", checksumUrl, errs)
+		}
+
+		if c.ISOChecksum != "da39a3ee5e6b4b0d3255bfef95601890afd80709" {
+			t.Fatalf("%s: bad checksum %q", checksumUrl, c.ISOChecksum)
+		}
+	}
+}
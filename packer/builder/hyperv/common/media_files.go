@@ -0,0 +1,173 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// mediaImage is an image files are added to, such as the floppy images of
+// the fat12 package or the ISO images of the iso9660 package.
+type mediaImage interface {
+	AddFile(name string, source string) error
+	AddDir(name string) error
+}
+
+// templateImage is a mediaImage the files are added to processed as
+// templates of the data given, from copies written to the directory given.
+type templateImage struct {
+	mediaImage
+	tpl  *packer.ConfigTemplate
+	data interface{}
+	dir  string
+}
+
+func (i *templateImage) AddFile(name string, source string) error {
+	contents, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+
+	processed, err := i.tpl.Process(string(contents), i.data)
+	if err != nil {
+		return fmt.Errorf("Error processing %s: %s", source, err)
+	}
+
+	f, err := ioutil.TempFile(i.dir, "template")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(processed)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return i.mediaImage.AddFile(name, f.Name())
+}
+
+// addFlatFiles adds the files matching the patterns to the root of the
+// image. Wildcard characters (*, ?, and []) are allowed, and every file
+// found in a matching directory is added to the root of the image too.
+func addFlatFiles(image mediaImage, patterns []string) error {
+	for _, pattern := range patterns {
+		matches, err := globFiles(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+
+				log.Printf("Adding file: %s", path)
+				return image.AddFile(filepath.Base(path), path)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// addTrees adds the files and directories matching the patterns to the
+// image, keeping the structure of the directories. A directory is added
+// under its own name, or when its path ends with a slash, its contents
+// are added to the root of the image.
+func addTrees(image mediaImage, patterns []string) error {
+	for _, pattern := range patterns {
+		contentsOnly := false
+		for len(pattern) > 1 && os.IsPathSeparator(pattern[len(pattern)-1]) {
+			pattern = pattern[:len(pattern)-1]
+			contentsOnly = true
+		}
+
+		matches, err := globFiles(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, match := range matches {
+			root := filepath.Dir(match)
+			if contentsOnly {
+				root = match
+			}
+
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				name, err := filepath.Rel(root, path)
+				if err != nil {
+					return err
+				}
+				name = filepath.ToSlash(name)
+
+				switch {
+				case name == ".":
+					return nil
+				case info.IsDir():
+					return image.AddDir(name)
+				case info.Mode().IsRegular():
+					log.Printf("Adding file: %s", path)
+					return image.AddFile(name, path)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func globFiles(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("No files found matching %s", pattern)
+	}
+
+	return matches, nil
+}
+
+// writeImage writes the image to a new file at path.
+func writeImage(path string, image io.WriterTo) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = image.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
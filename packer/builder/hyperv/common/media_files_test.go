@@ -0,0 +1,174 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testMediaImage records the files and directories added to it.
+type testMediaImage struct {
+	entries map[string]string
+}
+
+func (i *testMediaImage) AddFile(name string, source string) error {
+	i.entries[name] = source
+	return nil
+}
+
+func (i *testMediaImage) AddDir(name string) error {
+	i.entries[name] = ""
+	return nil
+}
+
+// testMediaFiles creates a temporary directory of files to put on media.
+func testMediaFiles(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, name := range []string{"Autounattend.xml", "a.ps1", "b.ps1", filepath.Join("drivers", "net.inf"), filepath.Join("drivers", "amd64", "net.sys")} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, "drivers", "empty"), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return dir
+}
+
+func TestAddFlatFiles(t *testing.T) {
+	dir := testMediaFiles(t)
+	defer os.RemoveAll(dir)
+
+	image := &testMediaImage{entries: make(map[string]string)}
+	err := addFlatFiles(image, []string{
+		filepath.Join(dir, "Autounattend.xml"),
+		filepath.Join(dir, "*.ps1"),
+		filepath.Join(dir, "drivers"),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{
+		"Autounattend.xml": filepath.Join(dir, "Autounattend.xml"),
+		"a.ps1":            filepath.Join(dir, "a.ps1"),
+		"b.ps1":            filepath.Join(dir, "b.ps1"),
+		"net.inf":          filepath.Join(dir, "drivers", "net.inf"),
+		"net.sys":          filepath.Join(dir, "drivers", "amd64", "net.sys"),
+	}
+
+	if !reflect.DeepEqual(image.entries, expected) {
+		t.Fatalf("bad: %#v", image.entries)
+	}
+
+	if err := addFlatFiles(image, []string{filepath.Join(dir, "*.bat")}); err == nil {
+		t.Fatal("should error when nothing matches")
+	}
+}
+
+func TestAddTrees(t *testing.T) {
+	dir := testMediaFiles(t)
+	defer os.RemoveAll(dir)
+
+	image := &testMediaImage{entries: make(map[string]string)}
+	err := addTrees(image, []string{
+		filepath.Join(dir, "Autounattend.xml"),
+		filepath.Join(dir, "drivers"),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := map[string]string{
+		"Autounattend.xml":      filepath.Join(dir, "Autounattend.xml"),
+		"drivers":               "",
+		"drivers/amd64":         "",
+		"drivers/amd64/net.sys": filepath.Join(dir, "drivers", "amd64", "net.sys"),
+		"drivers/empty":         "",
+		"drivers/net.inf":       filepath.Join(dir, "drivers", "net.inf"),
+	}
+
+	if !reflect.DeepEqual(image.entries, expected) {
+		t.Fatalf("bad: %#v", image.entries)
+	}
+
+	// a trailing slash puts the contents of the directory in the root
+	image = &testMediaImage{entries: make(map[string]string)}
+	if err := addTrees(image, []string{filepath.Join(dir, "drivers") + string(filepath.Separator)}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected = map[string]string{
+		"amd64":         "",
+		"amd64/net.sys": filepath.Join(dir, "drivers", "amd64", "net.sys"),
+		"empty":         "",
+		"net.inf":       filepath.Join(dir, "drivers", "net.inf"),
+	}
+
+	if !reflect.DeepEqual(image.entries, expected) {
+		t.Fatalf("bad: %#v", image.entries)
+	}
+
+	if err := addTrees(image, []string{filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("should error when nothing matches")
+	}
+}
+
+func TestTemplateImage(t *testing.T) {
+	dir := testMediaFiles(t)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "ks.cfg")
+	if err := ioutil.WriteFile(source, []byte("url --url=http://{{ .HTTPIP }}:{{ .HTTPPort }}/{{ .Name }}"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entries := make(map[string]string)
+	data := &bootTemplateData{HTTPIP: "192.168.0.1", HTTPPort: 8080, Name: "vm"}
+	image := &templateImage{&testMediaImage{entries: entries}, testConfigTemplate(t), data, dir}
+	if err := image.AddFile("ks.cfg", source); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if entries["ks.cfg"] == source || filepath.Dir(entries["ks.cfg"]) != dir {
+		t.Fatalf("should add a processed copy: %s", entries["ks.cfg"])
+	}
+
+	contents, err := ioutil.ReadFile(entries["ks.cfg"])
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(contents) != "url --url=http://192.168.0.1:8080/vm" {
+		t.Fatalf("bad contents: %s", contents)
+	}
+}
+
+func TestTemplateImage_error(t *testing.T) {
+	dir := testMediaFiles(t)
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "ks.cfg")
+	if err := ioutil.WriteFile(source, []byte("{{ .HTTPIP"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	entries := make(map[string]string)
+	image := &templateImage{&testMediaImage{entries: entries}, testConfigTemplate(t), &bootTemplateData{}, dir}
+	if err := image.AddFile("ks.cfg", source); err == nil {
+		t.Fatal("should error")
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("should not add the file: %#v", entries)
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+const (
+	// The name Hyper-V gives the network adapter of a new VM.
+	DefaultNetworkAdapterName = "Network Adapter"
+
+	// The most synthetic network adapters a VM can have.
+	MaxNetworkAdapters = 8
+)
+
+// The network modes of network_mode.
+const (
+	NetworkModeSwitch = "switch"
+	NetworkModeNat    = "nat"
+
+	// The prefix of the NAT network when none is set.
+	DefaultNatPrefix = "192.168.250.0/24"
+)
+
+// NetworkAdapterName returns the name of the network adapter at the index
+// given of network_adapters: the adapter of a new VM, then "Network
+// Adapter 2" and so on.
+func NetworkAdapterName(index int) string {
+	if index == 0 {
+		return DefaultNetworkAdapterName
+	}
+	return fmt.Sprintf("%s %d", DefaultNetworkAdapterName, index+1)
+}
+
+type NetworkAdapterConfig struct {
+	// The switch the adapter is connected to, created when it does not
+	// exist. By default, the switch of switch_name.
+	SwitchName string `mapstructure:"switch_name"`
+	// The type of the switch when it is created, Internal or Private. By
+	// default, Internal. The switch of switch_name has the switch_type.
+	SwitchType string `mapstructure:"switch_type"`
+	// The VLAN ID the traffic of the adapter is tagged with.
+	VlanID string `mapstructure:"vlan_id"`
+	// The static MAC address of the adapter, such as 00-15-5D-01-02-03.
+	// By default, Hyper-V assigns a dynamic one.
+	MacAddress string `mapstructure:"mac_address"`
+	// Whether the communicator connects to the address of this adapter.
+	// By default, the first adapter.
+	Communicator bool `mapstructure:"communicator"`
+}
+
+type NetworkConfig struct {
+	// The switch of the network adapter of the VM, or of the network
+	// adapters without a switch_name.
+	SwitchName string `mapstructure:"switch_name"`
+	// The type of the switch of switch_name when it is created, Internal,
+	// Private or External. By default, Internal, or External when a
+	// physical network adapter is given.
+	SwitchType string `mapstructure:"switch_type"`
+	// The physical network adapter an External switch is bound to, by name
+	// or by interface description.
+	SwitchNetAdapterName        string `mapstructure:"switch_net_adapter_name"`
+	SwitchNetAdapterDescription string `mapstructure:"switch_net_adapter_description"`
+	// How the VM reaches the network: through switch_name, or through a
+	// NAT network on the Internal switch of switch_name, whose addresses a
+	// DHCP server of the build leases to the VM. By default, switch.
+	NetworkMode string `mapstructure:"network_mode"`
+	// The prefix of the NAT network, and the DNS servers of the VM on it.
+	// By default, 192.168.250.0/24 and the DNS servers of the host.
+	NatPrefix     string   `mapstructure:"nat_prefix"`
+	NatDnsServers []string `mapstructure:"nat_dns_servers"`
+	// The VLAN ID of the network adapter of the VM.
+	VlanID string `mapstructure:"VlanID"`
+	// The network adapters of the VM, in order. By default, one adapter
+	// connected to switch_name with the VlanID.
+	NetworkAdapters []NetworkAdapterConfig `mapstructure:"network_adapters"`
+}
+
+// Prepare validates the network adapters and fills in their defaults, so
+// that NetworkAdapters lists all of them. It must be called once
+// SwitchName is set.
+func (c *NetworkConfig) Prepare(t *packer.ConfigTemplate) []error {
+	errs := make([]error, 0)
+
+	switchTemplates := map[string]*string{
+		"switch_net_adapter_name":        &c.SwitchNetAdapterName,
+		"switch_net_adapter_description": &c.SwitchNetAdapterDescription,
+		"nat_prefix":                     &c.NatPrefix,
+	}
+
+	for n, ptr := range switchTemplates {
+		var err error
+		*ptr, err = t.Process(*ptr, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing %s: %s", n, err))
+		}
+	}
+
+	netAdapter := c.SwitchNetAdapterName != "" || c.SwitchNetAdapterDescription != ""
+	if c.SwitchNetAdapterName != "" && c.SwitchNetAdapterDescription != "" {
+		errs = append(errs, fmt.Errorf("switch_net_adapter_name: Only one of switch_net_adapter_name or switch_net_adapter_description can be set."))
+	}
+
+	switch strings.ToLower(c.SwitchType) {
+	case "":
+		c.SwitchType = SwitchTypeInternal
+		if netAdapter {
+			c.SwitchType = SwitchTypeExternal
+		}
+	case "internal":
+		c.SwitchType = SwitchTypeInternal
+	case "private":
+		c.SwitchType = SwitchTypePrivate
+	case "external":
+		c.SwitchType = SwitchTypeExternal
+	default:
+		errs = append(errs, fmt.Errorf("switch_type: The switch type must be Internal, Private or External, but defined: %s", c.SwitchType))
+	}
+
+	if c.SwitchType == SwitchTypeExternal && !netAdapter {
+		errs = append(errs, fmt.Errorf("switch_type: An External switch requires switch_net_adapter_name or switch_net_adapter_description."))
+	} else if c.SwitchType != SwitchTypeExternal && netAdapter {
+		errs = append(errs, fmt.Errorf("switch_type: Only an External switch is bound to a physical network adapter, but defined: %s", c.SwitchType))
+	}
+
+	errs = append(errs, c.prepareNat()...)
+
+	if len(c.NetworkAdapters) == 0 {
+		c.NetworkAdapters = []NetworkAdapterConfig{{VlanID: c.VlanID}}
+	} else if c.VlanID != "" {
+		errs = append(errs, fmt.Errorf("VlanID: Set the vlan_id of the network_adapters instead."))
+	}
+
+	if len(c.NetworkAdapters) > MaxNetworkAdapters {
+		errs = append(errs, fmt.Errorf("network_adapters: A VM can have at most %v network adapters, but defined: %v", MaxNetworkAdapters, len(c.NetworkAdapters)))
+	}
+
+	communicators := 0
+	macAddresses := make(map[string]bool)
+	for i := range c.NetworkAdapters {
+		adapter := &c.NetworkAdapters[i]
+
+		templates := map[string]*string{
+			"switch_name": &adapter.SwitchName,
+			"vlan_id":     &adapter.VlanID,
+			"mac_address": &adapter.MacAddress,
+		}
+
+		for n, ptr := range templates {
+			var err error
+			*ptr, err = t.Process(*ptr, nil)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Error processing network_adapters[%d].%s: %s", i, n, err))
+			}
+		}
+
+		switchType := adapter.SwitchType
+		switch strings.ToLower(adapter.SwitchType) {
+		case "", "internal":
+			adapter.SwitchType = SwitchTypeInternal
+		case "private":
+			adapter.SwitchType = SwitchTypePrivate
+		default:
+			errs = append(errs, fmt.Errorf("network_adapters[%d].switch_type: The switch type must be Internal or Private, but defined: %s", i, adapter.SwitchType))
+			switchType = ""
+		}
+
+		// the switch of switch_name has the switch_type
+		if adapter.SwitchName == "" || adapter.SwitchName == c.SwitchName {
+			if switchType != "" && adapter.SwitchType != c.SwitchType {
+				errs = append(errs, fmt.Errorf("network_adapters[%d].switch_type: The switch of switch_name is %s, but defined: %s", i, c.SwitchType, switchType))
+			}
+			adapter.SwitchName = c.SwitchName
+			adapter.SwitchType = c.SwitchType
+		}
+
+		if adapter.VlanID != "" {
+			if id, err := strconv.Atoi(adapter.VlanID); err != nil || id < 1 || id > 4094 {
+				errs = append(errs, fmt.Errorf("network_adapters[%d].vlan_id: The VLAN ID must be between 1 and 4094, but defined: %s", i, adapter.VlanID))
+			}
+		}
+
+		if adapter.MacAddress != "" {
+			macAddress, err := parseMacAddress(adapter.MacAddress)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("network_adapters[%d].mac_address: %s", i, err))
+			} else if macAddresses[macAddress] {
+				errs = append(errs, fmt.Errorf("network_adapters[%d].mac_address: %s is the address of another adapter.", i, adapter.MacAddress))
+			}
+			adapter.MacAddress = macAddress
+			macAddresses[macAddress] = true
+		}
+
+		if adapter.Communicator {
+			communicators++
+		}
+	}
+
+	if c.NetworkMode == NetworkModeNat && !c.connects(c.SwitchName) {
+		errs = append(errs, fmt.Errorf("network_mode: None of the network_adapters is connected to the NAT network of switch_name."))
+	}
+
+	if communicators > 1 {
+		errs = append(errs, fmt.Errorf("network_adapters: Only one adapter can be the communicator adapter, but defined: %v", communicators))
+	} else if communicators == 0 {
+		c.NetworkAdapters[0].Communicator = true
+	}
+
+	return errs
+}
+
+func (c *NetworkConfig) prepareNat() []error {
+	errs := make([]error, 0)
+
+	switch strings.ToLower(c.NetworkMode) {
+	case "", NetworkModeSwitch:
+		c.NetworkMode = NetworkModeSwitch
+	case NetworkModeNat:
+		c.NetworkMode = NetworkModeNat
+	default:
+		errs = append(errs, fmt.Errorf("network_mode: The network mode must be %s or %s, but defined: %s", NetworkModeSwitch, NetworkModeNat, c.NetworkMode))
+	}
+
+	if c.NetworkMode != NetworkModeNat {
+		if c.NatPrefix != "" || len(c.NatDnsServers) > 0 {
+			errs = append(errs, fmt.Errorf("nat_prefix: The nat_prefix and nat_dns_servers require the network_mode %s.", NetworkModeNat))
+		}
+		return errs
+	}
+
+	if c.SwitchType != SwitchTypeInternal {
+		errs = append(errs, fmt.Errorf("network_mode: A NAT network requires an Internal switch, but defined: %s", c.SwitchType))
+	}
+
+	if c.NatPrefix == "" {
+		c.NatPrefix = DefaultNatPrefix
+	}
+
+	// the gateway, a VM and the network and broadcast addresses
+	_, subnet, err := net.ParseCIDR(c.NatPrefix)
+	if err == nil {
+		if ones, bits := subnet.Mask.Size(); bits != 8*net.IPv4len || ones > 30 {
+			err = fmt.Errorf("not an IPv4 network of at least 4 addresses")
+		}
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("nat_prefix: The prefix must be an IPv4 network of at least 4 addresses, such as %s, but defined: %s", DefaultNatPrefix, c.NatPrefix))
+	} else {
+		c.NatPrefix = subnet.String()
+	}
+
+	for i, server := range c.NatDnsServers {
+		if ip := net.ParseIP(server); ip == nil || ip.To4() == nil {
+			errs = append(errs, fmt.Errorf("nat_dns_servers[%d]: '%s' is not an IPv4 address.", i, server))
+		}
+	}
+
+	return errs
+}
+
+// connects reports whether one of the network adapters is connected to
+// the switch named.
+func (c *NetworkConfig) connects(switchName string) bool {
+	for _, adapter := range c.NetworkAdapters {
+		if adapter.SwitchName == switchName {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSwitch reports whether a switch of switch_type is created for the
+// build when switch_name is not set, rather than an existing external
+// switch used.
+func (c *NetworkConfig) NewSwitch() bool {
+	return c.SwitchType != "" || c.SwitchNetAdapterName != "" || c.SwitchNetAdapterDescription != "" ||
+		strings.ToLower(c.NetworkMode) == NetworkModeNat
+}
+
+// CheckHostNetAdapter checks that the physical network adapter of an
+// External switch exists on the host and is up.
+func (c *NetworkConfig) CheckHostNetAdapter(driver Driver) []error {
+	errs := make([]error, 0)
+	if c.SwitchType != SwitchTypeExternal {
+		return errs
+	}
+
+	n, netAdapter := "switch_net_adapter_name", c.SwitchNetAdapterName
+	if netAdapter == "" {
+		n, netAdapter = "switch_net_adapter_description", c.SwitchNetAdapterDescription
+	}
+
+	status, err := driver.GetNetAdapterStatus(c.SwitchNetAdapterName, c.SwitchNetAdapterDescription)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("%s: Error reading the network adapter '%s': %s", n, netAdapter, err))
+	} else if status == "" {
+		errs = append(errs, fmt.Errorf("%s: The host has no physical network adapter '%s'.", n, netAdapter))
+	} else if status != "Up" {
+		errs = append(errs, fmt.Errorf("%s: The network adapter '%s' must be Up, but it is %s.", n, netAdapter, status))
+	}
+
+	return errs
+}
+
+// SwitchNetAdapter returns the name and interface description of the
+// physical network adapter the switch named is bound to, which are empty
+// unless it is the External switch of switch_name.
+func (c *NetworkConfig) SwitchNetAdapter(switchName string) (string, string) {
+	if switchName != c.SwitchName {
+		return "", ""
+	}
+	return c.SwitchNetAdapterName, c.SwitchNetAdapterDescription
+}
+
+// CommunicatorSwitchName returns the switch of the network adapter of the
+// communicator, which the VM reaches the host through.
+func (c *NetworkConfig) CommunicatorSwitchName() string {
+	for _, adapter := range c.NetworkAdapters {
+		if adapter.Communicator {
+			return adapter.SwitchName
+		}
+	}
+	return c.SwitchName
+}
+
+// SwitchNames returns the switches of the network adapters, in order.
+func (c *NetworkConfig) SwitchNames() []string {
+	var switchNames []string
+	for _, adapter := range c.NetworkAdapters {
+		switchNames = append(switchNames, adapter.SwitchName)
+	}
+	return switchNames
+}
+
+// parseMacAddress returns the MAC address given, with its bytes separated
+// by dashes, colons or nothing, as the 12 hexadecimal digits Hyper-V
+// takes.
+func parseMacAddress(s string) (string, error) {
+	digits := strings.NewReplacer("-", "", ":", "").Replace(s)
+
+	b, err := hex.DecodeString(digits)
+	if err != nil || len(b) != 6 {
+		return "", fmt.Errorf("'%s' is not a MAC address of 6 bytes, such as 00-15-5D-01-02-03.", s)
+	}
+
+	if b[0]&1 != 0 {
+		return "", fmt.Errorf("'%s' is a multicast address.", s)
+	}
+
+	return strings.ToUpper(digits), nil
+}
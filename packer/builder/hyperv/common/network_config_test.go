@@ -0,0 +1,167 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNetworkConfigPrepare(t *testing.T) {
+	c := &NetworkConfig{SwitchName: "switch", VlanID: "42"}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	expected := []NetworkAdapterConfig{
+		{SwitchName: "switch", SwitchType: SwitchTypeInternal, VlanID: "42", Communicator: true},
+	}
+	if !reflect.DeepEqual(c.NetworkAdapters, expected) {
+		t.Fatalf("bad adapters: %#v", c.NetworkAdapters)
+	}
+}
+
+func TestNetworkConfigPrepare_adapters(t *testing.T) {
+	c := &NetworkConfig{
+		SwitchName: "switch",
+		NetworkAdapters: []NetworkAdapterConfig{
+			{VlanID: "10"},
+			{SwitchName: "private", SwitchType: "private", MacAddress: "00:15:5d:01:02:03", Communicator: true},
+		},
+	}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	expected := []NetworkAdapterConfig{
+		{SwitchName: "switch", SwitchType: SwitchTypeInternal, VlanID: "10"},
+		{SwitchName: "private", SwitchType: SwitchTypePrivate, MacAddress: "00155D010203", Communicator: true},
+	}
+	if !reflect.DeepEqual(c.NetworkAdapters, expected) {
+		t.Fatalf("bad adapters: %#v", c.NetworkAdapters)
+	}
+	if names := c.SwitchNames(); !reflect.DeepEqual(names, []string{"switch", "private"}) {
+		t.Fatalf("bad switch names: %#v", names)
+	}
+}
+
+func TestNetworkConfigPrepare_external(t *testing.T) {
+	c := &NetworkConfig{
+		SwitchName:           "switch",
+		SwitchNetAdapterName: "Ethernet",
+		NetworkAdapters: []NetworkAdapterConfig{
+			{SwitchName: "private", SwitchType: "private"},
+			{},
+		},
+	}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	if c.SwitchType != SwitchTypeExternal {
+		t.Fatalf("bad switch type: %s", c.SwitchType)
+	}
+	if adapter := c.NetworkAdapters[1]; adapter.SwitchName != "switch" || adapter.SwitchType != SwitchTypeExternal {
+		t.Fatalf("bad adapter: %#v", adapter)
+	}
+
+	if name, description := c.SwitchNetAdapter("switch"); name != "Ethernet" || description != "" {
+		t.Fatalf("bad net adapter: %s %s", name, description)
+	}
+	if name, description := c.SwitchNetAdapter("private"); name != "" || description != "" {
+		t.Fatalf("bad net adapter: %s %s", name, description)
+	}
+}
+
+func TestNetworkConfigPrepare_nat(t *testing.T) {
+	c := &NetworkConfig{SwitchName: "switch", NetworkMode: "NAT", NatPrefix: "172.30.0.1/16"}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	if c.NetworkMode != NetworkModeNat {
+		t.Fatalf("bad network mode: %s", c.NetworkMode)
+	}
+	if c.NatPrefix != "172.30.0.0/16" {
+		t.Fatalf("bad prefix: %s", c.NatPrefix)
+	}
+
+	c = &NetworkConfig{SwitchName: "switch", NetworkMode: "nat"}
+	if errs := c.Prepare(testConfigTemplate(t)); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if c.NatPrefix != DefaultNatPrefix {
+		t.Fatalf("bad prefix: %s", c.NatPrefix)
+	}
+}
+
+func TestNetworkConfigNewSwitch(t *testing.T) {
+	if (&NetworkConfig{}).NewSwitch() || (&NetworkConfig{NetworkMode: "switch"}).NewSwitch() {
+		t.Fatal("should use an existing switch")
+	}
+	if !(&NetworkConfig{NetworkMode: "nat"}).NewSwitch() || !(&NetworkConfig{SwitchType: "Private"}).NewSwitch() {
+		t.Fatal("should create a switch")
+	}
+}
+
+func TestNetworkConfigPrepare_bad(t *testing.T) {
+	cases := []NetworkConfig{
+		{VlanID: "42", NetworkAdapters: []NetworkAdapterConfig{{}}},
+		{NetworkAdapters: make([]NetworkAdapterConfig, MaxNetworkAdapters+1)},
+		{NetworkAdapters: []NetworkAdapterConfig{{SwitchType: "External"}}},
+		{NetworkAdapters: []NetworkAdapterConfig{{VlanID: "4095"}}},
+		{NetworkAdapters: []NetworkAdapterConfig{{MacAddress: "00-15-5D-01-02"}}},
+		{NetworkAdapters: []NetworkAdapterConfig{{MacAddress: "01-00-5E-01-02-03"}}},
+		{NetworkAdapters: []NetworkAdapterConfig{{MacAddress: "00155D010203"}, {MacAddress: "00-15-5d-01-02-03"}}},
+		{NetworkAdapters: []NetworkAdapterConfig{{Communicator: true}, {Communicator: true}}},
+		{SwitchType: "Bridged"},
+		{SwitchType: "External"},
+		{SwitchType: "Private", SwitchNetAdapterName: "Ethernet"},
+		{SwitchNetAdapterName: "Ethernet", SwitchNetAdapterDescription: "Fake Ethernet Adapter"},
+		{SwitchType: "Private", NetworkAdapters: []NetworkAdapterConfig{{SwitchType: "Internal"}}},
+		{NetworkMode: "bridged"},
+		{NatPrefix: "192.168.250.0/24"},
+		{NetworkMode: "nat", SwitchType: "Private"},
+		{NetworkMode: "nat", NatPrefix: "192.168.250.0/31"},
+		{NetworkMode: "nat", NatPrefix: "fd00::/64"},
+		{NetworkMode: "nat", NatDnsServers: []string{"dns.example.com"}},
+		{NetworkMode: "nat", NetworkAdapters: []NetworkAdapterConfig{{SwitchName: "private", SwitchType: "Private"}}},
+	}
+
+	for _, c := range cases {
+		c.SwitchName = "switch"
+		if errs := c.Prepare(testConfigTemplate(t)); len(errs) != 1 {
+			t.Fatalf("bad: %#v: %#v", c, errs)
+		}
+	}
+}
+
+func TestNetworkAdapterName(t *testing.T) {
+	if name := NetworkAdapterName(0); name != "Network Adapter" {
+		t.Fatalf("bad name: %s", name)
+	}
+	if name := NetworkAdapterName(2); name != "Network Adapter 3" {
+		t.Fatalf("bad name: %s", name)
+	}
+}
+
+func TestNetworkConfigCheckHostNetAdapter(t *testing.T) {
+	driver := NewFakeDriver()
+	driver.NetAdapters = append(driver.NetAdapters,
+		&FakeNetAdapter{Name: "Wi-Fi", InterfaceDescription: "Fake Wireless Adapter", Status: "Disconnected"})
+
+	cases := []struct {
+		config NetworkConfig
+		errs   int
+	}{
+		{NetworkConfig{SwitchType: SwitchTypeInternal}, 0},
+		{NetworkConfig{SwitchType: SwitchTypeExternal, SwitchNetAdapterName: "Ethernet"}, 0},
+		{NetworkConfig{SwitchType: SwitchTypeExternal, SwitchNetAdapterDescription: "Fake Ethernet Adapter"}, 0},
+		{NetworkConfig{SwitchType: SwitchTypeExternal, SwitchNetAdapterName: "Ethernet 2"}, 1},
+		{NetworkConfig{SwitchType: SwitchTypeExternal, SwitchNetAdapterDescription: "Fake Wireless Adapter"}, 1},
+	}
+
+	for _, tc := range cases {
+		if errs := tc.config.CheckHostNetAdapter(driver); len(errs) != tc.errs {
+			t.Fatalf("bad: %#v: %#v", tc.config, errs)
+		}
+	}
+}
@@ -6,13 +6,22 @@ package common
 
 import (
 	"fmt"
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/convert"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/packer"
 	"os"
+	"strings"
 )
 
 type OutputConfig struct {
 	OutputDir string `mapstructure:"output_directory"`
+	// The formats the exported VHDX hard disks are converted to, written
+	// into the ConvertedDiskDir directory of the output directory.
+	OutputDiskFormats []string `mapstructure:"output_disk_formats"`
+	// Writes an OVF package of the VM into the OvfDir directory of the
+	// output directory, as a single OVA file with OutputOVA.
+	OutputOVF bool `mapstructure:"output_ovf"`
+	OutputOVA bool `mapstructure:"output_ova"`
 }
 
 func (c *OutputConfig) Prepare(t *packer.ConfigTemplate, pc *common.PackerConfig) []error {
@@ -33,6 +42,17 @@ func (c *OutputConfig) Prepare(t *packer.ConfigTemplate, pc *common.PackerConfig
 		}
 	}
 
+	seen := make(map[string]bool)
+	for _, format := range c.OutputDiskFormats {
+		if !convert.IsFormat(format) {
+			errs = append(errs, fmt.Errorf(
+				"output_disk_formats: unknown format '%s'. It must be one of %s.", format, strings.Join(convert.Formats, ", ")))
+		} else if seen[format] {
+			errs = append(errs, fmt.Errorf("output_disk_formats: the format '%s' is given twice.", format))
+		}
+		seen[format] = true
+	}
+
 	if !pc.PackerForce {
 		if _, err := os.Stat(c.OutputDir); err == nil {
 			errs = append(errs, fmt.Errorf(
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mitchellh/packer/common"
+)
+
+func TestOutputConfigPrepare(t *testing.T) {
+	c := new(OutputConfig)
+	pc := &common.PackerConfig{PackerBuildName: "foo"}
+
+	errs := c.Prepare(testConfigTemplate(t), pc)
+	if len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+	if c.OutputDir != "output-foo" {
+		t.Fatalf("bad output_directory: %s", c.OutputDir)
+	}
+}
+
+func TestOutputConfigPrepare_exists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &OutputConfig{OutputDir: dir}
+	pc := &common.PackerConfig{PackerBuildName: "foo"}
+	if errs := c.Prepare(testConfigTemplate(t), pc); len(errs) != 1 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	pc.PackerForce = true
+	if errs := c.Prepare(testConfigTemplate(t), pc); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
+
+func TestOutputConfigPrepare_diskFormats(t *testing.T) {
+	pc := &common.PackerConfig{PackerBuildName: "foo"}
+
+	c := &OutputConfig{OutputDiskFormats: []string{"vhd-fixed", "vmdk", "qcow2"}}
+	if errs := c.Prepare(testConfigTemplate(t), pc); len(errs) > 0 {
+		t.Fatalf("bad: %#v", errs)
+	}
+
+	c = &OutputConfig{OutputDiskFormats: []string{"vdi", "raw", "raw"}}
+	if errs := c.Prepare(testConfigTemplate(t), pc); len(errs) != 2 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package ovf writes OVF 2.0 packages: the descriptor of a virtual
+// machine, the manifest of the digests of its files, and the OVA archive
+// holding them all in a single file.
+package ovf
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The format of the stream optimized VMDK disks of a package.
+const DiskFormatVMDK = "http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"
+
+// The CIM ID of an operating system the CIM schema does not name.
+const OSOther = 1
+
+// The CIM resource types of the items of the virtual hardware.
+const (
+	resourceProcessor      = 3
+	resourceMemory         = 4
+	resourceIDEController  = 5
+	resourceSCSIController = 6
+	resourceEthernet       = 10
+	resourceDisk           = 17
+)
+
+// Descriptor describes a virtual machine and the files of its package.
+type Descriptor struct {
+	// The name of the virtual machine.
+	Name string
+	// The generation of the Hyper-V VM, 1 for a BIOS VM and 2 for a UEFI
+	// one, whose disks are all on a SCSI controller.
+	Generation uint
+	// The CIM ID of the operating system of the guest, OSOther when 0.
+	OperatingSystem int
+	CPUs            uint
+	MemoryMB        int64
+	// The disks in the order of the controllers, the boot disk first.
+	Disks []Disk
+	// The networks the network adapters are connected to, one adapter a
+	// network.
+	Networks []string
+}
+
+// Disk is a disk of a package.
+type Disk struct {
+	// The name of the file of the disk in the package, and its size.
+	File     string
+	FileSize int64
+	// The format of the file, DiskFormatVMDK when empty.
+	Format string
+	// The size of the disk the VM sees, and the size of the data in it.
+	Capacity      int64
+	PopulatedSize int64
+}
+
+type envelope struct {
+	XMLName        xml.Name          `xml:"Envelope"`
+	Version        string            `xml:"ovf:version,attr"`
+	Lang           string            `xml:"xml:lang,attr"`
+	Xmlns          string            `xml:"xmlns,attr"`
+	XmlnsOVF       string            `xml:"xmlns:ovf,attr"`
+	XmlnsRASD      string            `xml:"xmlns:rasd,attr"`
+	XmlnsVSSD      string            `xml:"xmlns:vssd,attr"`
+	References     []file            `xml:"References>File"`
+	DiskSection    diskSection       `xml:"DiskSection"`
+	NetworkSection *networkSection   `xml:"NetworkSection,omitempty"`
+	VirtualSystem  virtualSystemNode `xml:"VirtualSystem"`
+}
+
+type file struct {
+	ID   string `xml:"ovf:id,attr"`
+	Href string `xml:"ovf:href,attr"`
+	Size int64  `xml:"ovf:size,attr"`
+}
+
+type diskSection struct {
+	Info  string     `xml:"Info"`
+	Disks []diskNode `xml:"Disk"`
+}
+
+type diskNode struct {
+	DiskID                  string `xml:"ovf:diskId,attr"`
+	FileRef                 string `xml:"ovf:fileRef,attr"`
+	Capacity                int64  `xml:"ovf:capacity,attr"`
+	CapacityAllocationUnits string `xml:"ovf:capacityAllocationUnits,attr"`
+	Format                  string `xml:"ovf:format,attr"`
+	PopulatedSize           int64  `xml:"ovf:populatedSize,attr,omitempty"`
+}
+
+type networkSection struct {
+	Info     string        `xml:"Info"`
+	Networks []networkNode `xml:"Network"`
+}
+
+type networkNode struct {
+	Name        string `xml:"ovf:name,attr"`
+	Description string `xml:"Description"`
+}
+
+type virtualSystemNode struct {
+	ID                     string                 `xml:"ovf:id,attr"`
+	Info                   string                 `xml:"Info"`
+	Name                   string                 `xml:"Name"`
+	OperatingSystemSection operatingSystemSection `xml:"OperatingSystemSection"`
+	VirtualHardwareSection virtualHardwareSection `xml:"VirtualHardwareSection"`
+}
+
+type operatingSystemSection struct {
+	ID   int    `xml:"ovf:id,attr"`
+	Info string `xml:"Info"`
+}
+
+type virtualHardwareSection struct {
+	Info   string `xml:"Info"`
+	System system `xml:"System"`
+	Items  []item `xml:"Item"`
+}
+
+type system struct {
+	ElementName             string `xml:"vssd:ElementName"`
+	InstanceID              string `xml:"vssd:InstanceID"`
+	VirtualSystemIdentifier string `xml:"vssd:VirtualSystemIdentifier"`
+	VirtualSystemType       string `xml:"vssd:VirtualSystemType"`
+}
+
+// The properties of an item are in the alphabetical order of the CIM
+// schema.
+type item struct {
+	AddressOnParent     string `xml:"rasd:AddressOnParent,omitempty"`
+	AllocationUnits     string `xml:"rasd:AllocationUnits,omitempty"`
+	AutomaticAllocation string `xml:"rasd:AutomaticAllocation,omitempty"`
+	Connection          string `xml:"rasd:Connection,omitempty"`
+	Description         string `xml:"rasd:Description,omitempty"`
+	ElementName         string `xml:"rasd:ElementName"`
+	HostResource        string `xml:"rasd:HostResource,omitempty"`
+	InstanceID          int    `xml:"rasd:InstanceID"`
+	Parent              string `xml:"rasd:Parent,omitempty"`
+	ResourceSubType     string `xml:"rasd:ResourceSubType,omitempty"`
+	ResourceType        int    `xml:"rasd:ResourceType"`
+	VirtualQuantity     int64  `xml:"rasd:VirtualQuantity,omitempty"`
+}
+
+// Marshal returns the OVF descriptor of the virtual machine.
+func (d *Descriptor) Marshal() ([]byte, error) {
+	if d.Generation != 1 && d.Generation != 2 {
+		return nil, fmt.Errorf("ovf: bad generation %d", d.Generation)
+	}
+	if len(d.Disks) == 0 {
+		return nil, fmt.Errorf("ovf: no disks")
+	}
+
+	osID := d.OperatingSystem
+	if osID == 0 {
+		osID = OSOther
+	}
+
+	e := &envelope{
+		Version:   "2.0",
+		Lang:      "en-US",
+		Xmlns:     "http://schemas.dmtf.org/ovf/envelope/2",
+		XmlnsOVF:  "http://schemas.dmtf.org/ovf/envelope/2",
+		XmlnsRASD: "http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData",
+		XmlnsVSSD: "http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData",
+		DiskSection: diskSection{
+			Info: "The virtual disks",
+		},
+		VirtualSystem: virtualSystemNode{
+			ID:   d.Name,
+			Info: "A Hyper-V virtual machine",
+			Name: d.Name,
+			OperatingSystemSection: operatingSystemSection{
+				ID:   osID,
+				Info: "The guest operating system",
+			},
+			VirtualHardwareSection: virtualHardwareSection{
+				Info: "The virtual hardware",
+				System: system{
+					ElementName:             "Virtual Hardware Family",
+					InstanceID:              "0",
+					VirtualSystemIdentifier: d.Name,
+					VirtualSystemType:       fmt.Sprintf("Microsoft:Hyper-V:SubType:%d", d.Generation),
+				},
+			},
+		},
+	}
+
+	items := []item{
+		{
+			AllocationUnits: "hertz * 10^6",
+			Description:     "Number of virtual CPUs",
+			ElementName:     fmt.Sprintf("%d virtual CPU(s)", d.CPUs),
+			InstanceID:      1,
+			ResourceType:    resourceProcessor,
+			VirtualQuantity: int64(d.CPUs),
+		},
+		{
+			AllocationUnits: "byte * 2^20",
+			Description:     "Memory size",
+			ElementName:     fmt.Sprintf("%d MB of memory", d.MemoryMB),
+			InstanceID:      2,
+			ResourceType:    resourceMemory,
+			VirtualQuantity: d.MemoryMB,
+		},
+	}
+
+	// A generation 1 VM boots from the IDE controller, and has its other
+	// disks on the SCSI controller a generation 2 VM has all of them on.
+	const ideID, scsiID = 3, 4
+	if d.Generation == 1 {
+		items = append(items, item{
+			AddressOnParent: "0",
+			Description:     "IDE Controller",
+			ElementName:     "IDE Controller 0",
+			InstanceID:      ideID,
+			ResourceType:    resourceIDEController,
+		})
+	}
+	if d.Generation == 2 || len(d.Disks) > 1 {
+		items = append(items, item{
+			AddressOnParent: "0",
+			Description:     "SCSI Controller",
+			ElementName:     "SCSI Controller 0",
+			InstanceID:      scsiID,
+			ResourceSubType: "lsilogic",
+			ResourceType:    resourceSCSIController,
+		})
+	}
+
+	id := scsiID + 1
+	for i, disk := range d.Disks {
+		fileID := fmt.Sprintf("file%d", i+1)
+		diskID := fmt.Sprintf("vmdisk%d", i+1)
+
+		format := disk.Format
+		if format == "" {
+			format = DiskFormatVMDK
+		}
+
+		e.References = append(e.References, file{ID: fileID, Href: disk.File, Size: disk.FileSize})
+		e.DiskSection.Disks = append(e.DiskSection.Disks, diskNode{
+			DiskID:                  diskID,
+			FileRef:                 fileID,
+			Capacity:                disk.Capacity,
+			CapacityAllocationUnits: "byte",
+			Format:                  format,
+			PopulatedSize:           disk.PopulatedSize,
+		})
+
+		parent, address := scsiID, i
+		if d.Generation == 1 {
+			if i == 0 {
+				parent = ideID
+			} else {
+				address = i - 1
+			}
+		}
+
+		items = append(items, item{
+			AddressOnParent: fmt.Sprintf("%d", address),
+			ElementName:     fmt.Sprintf("Hard Disk %d", i+1),
+			HostResource:    "ovf:/disk/" + diskID,
+			InstanceID:      id,
+			Parent:          fmt.Sprintf("%d", parent),
+			ResourceType:    resourceDisk,
+		})
+		id++
+	}
+
+	if len(d.Networks) > 0 {
+		e.NetworkSection = &networkSection{Info: "The logical networks"}
+	}
+	for i, network := range d.Networks {
+		e.NetworkSection.Networks = append(e.NetworkSection.Networks, networkNode{
+			Name:        network,
+			Description: fmt.Sprintf("The %s network", network),
+		})
+
+		items = append(items, item{
+			AddressOnParent:     fmt.Sprintf("%d", i),
+			AutomaticAllocation: "true",
+			Connection:          network,
+			Description:         fmt.Sprintf("Network adapter on %s", network),
+			ElementName:         fmt.Sprintf("Network Adapter %d", i+1),
+			InstanceID:          id,
+			ResourceSubType:     "E1000",
+			ResourceType:        resourceEthernet,
+		})
+		id++
+	}
+
+	e.VirtualSystem.VirtualHardwareSection.Items = items
+
+	b, err := xml.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(b, '\n')...), nil
+}
+
+// Manifest returns the manifest of the files given, the lines giving the
+// SHA-256 digest of each of them.
+func Manifest(files []string) ([]byte, error) {
+	var manifest []byte
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		hash := sha256.New()
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		line := fmt.Sprintf("SHA256(%s)= %s\n", filepath.Base(path), hex.EncodeToString(hash.Sum(nil)))
+		manifest = append(manifest, line...)
+	}
+	return manifest, nil
+}
+
+// WriteOVA writes the files given into an OVA archive at path, a tar
+// of them in the order given, which starts with the descriptor.
+func WriteOVA(path string, files []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := writeTar(f, files); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+func writeTar(w io.Writer, files []string) error {
+	tw := tar.NewWriter(w)
+
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		header := &tar.Header{
+			Name:     filepath.Base(path),
+			Mode:     0644,
+			Size:     info.Size(),
+			ModTime:  time.Now(),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,201 @@
+package ovf
+
+import (
+	"archive/tar"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testDescriptor() *Descriptor {
+	return &Descriptor{
+		Name:       "packer-test",
+		Generation: 1,
+		CPUs:       2,
+		MemoryMB:   1024,
+		Disks: []Disk{
+			{File: "packer-test-disk1.vmdk", FileSize: 4096, Capacity: 40 << 30, PopulatedSize: 2 << 30},
+			{File: "packer-test-disk2.vmdk", FileSize: 512, Capacity: 10 << 30},
+		},
+		Networks: []string{"External Switch"},
+	}
+}
+
+// testItems returns the resource type, parent and address of the items
+// of the virtual hardware of a descriptor.
+func testItems(t *testing.T, b []byte) [][3]string {
+	var e struct {
+		Items []struct {
+			AddressOnParent string
+			Parent          string
+			ResourceType    string
+		} `xml:"VirtualSystem>VirtualHardwareSection>Item"`
+	}
+	if err := xml.Unmarshal(b, &e); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var items [][3]string
+	for _, item := range e.Items {
+		items = append(items, [3]string{item.ResourceType, item.Parent, item.AddressOnParent})
+	}
+	return items
+}
+
+func TestDescriptorMarshal(t *testing.T) {
+	b, err := testDescriptor().Marshal()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, s := range []string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<Envelope ovf:version="2.0"`,
+		`xmlns="http://schemas.dmtf.org/ovf/envelope/2"`,
+		`<File ovf:id="file1" ovf:href="packer-test-disk1.vmdk" ovf:size="4096">`,
+		`<Disk ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:capacity="42949672960" ovf:capacityAllocationUnits="byte" ovf:format="` + DiskFormatVMDK + `" ovf:populatedSize="2147483648">`,
+		`<Network ovf:name="External Switch">`,
+		`<VirtualSystem ovf:id="packer-test">`,
+		`<OperatingSystemSection ovf:id="1">`,
+		`<vssd:VirtualSystemType>Microsoft:Hyper-V:SubType:1</vssd:VirtualSystemType>`,
+		`<rasd:Connection>External Switch</rasd:Connection>`,
+	} {
+		if !strings.Contains(string(b), s) {
+			t.Fatalf("descriptor should contain %s:\n%s", s, b)
+		}
+	}
+
+	// the boot disk on IDE 0, the other disk on SCSI 0
+	expected := [][3]string{
+		{"3", "", ""},
+		{"4", "", ""},
+		{"5", "", "0"},
+		{"6", "", "0"},
+		{"17", "3", "0"},
+		{"17", "4", "0"},
+		{"10", "", "0"},
+	}
+	if items := testItems(t, b); !reflect.DeepEqual(items, expected) {
+		t.Fatalf("bad items: %#v", items)
+	}
+}
+
+func TestDescriptorMarshal_generation2(t *testing.T) {
+	d := testDescriptor()
+	d.Generation = 2
+	d.Networks = nil
+
+	b, err := d.Marshal()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if strings.Contains(string(b), "NetworkSection") {
+		t.Fatal("should not have a network section")
+	}
+
+	// all disks on SCSI 0
+	expected := [][3]string{
+		{"3", "", ""},
+		{"4", "", ""},
+		{"6", "", "0"},
+		{"17", "4", "0"},
+		{"17", "4", "1"},
+	}
+	if items := testItems(t, b); !reflect.DeepEqual(items, expected) {
+		t.Fatalf("bad items: %#v", items)
+	}
+}
+
+func TestDescriptorMarshal_bad(t *testing.T) {
+	d := testDescriptor()
+	d.Generation = 3
+	if _, err := d.Marshal(); err == nil {
+		t.Fatal("should have error")
+	}
+
+	d = testDescriptor()
+	d.Disks = nil
+	if _, err := d.Marshal(); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func testFiles(t *testing.T) (string, []string) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := []string{filepath.Join(dir, "vm.ovf"), filepath.Join(dir, "vm-disk1.vmdk")}
+	for i, path := range files {
+		if err := ioutil.WriteFile(path, []byte(strings.Repeat("x", i+1)), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	return dir, files
+}
+
+func TestManifest(t *testing.T) {
+	dir, files := testFiles(t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := Manifest(files)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := "SHA256(vm.ovf)= 2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881\n" +
+		"SHA256(vm-disk1.vmdk)= 5dde896887f6754c9b15bfe3a441ae4806df2fde94001311e08bf110622e0bbe\n"
+	if string(manifest) != expected {
+		t.Fatalf("bad manifest: %s", manifest)
+	}
+}
+
+func TestWriteOVA(t *testing.T) {
+	dir, files := testFiles(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vm.ova")
+	if err := WriteOVA(path, files); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+
+	// the descriptor first
+	if !reflect.DeepEqual(names, []string{"vm.ovf", "vm-disk1.vmdk"}) {
+		t.Fatalf("bad names: %#v", names)
+	}
+}
+
+func TestWriteOVA_missing(t *testing.T) {
+	dir, files := testFiles(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "vm.ova")
+	if err := WriteOVA(path, append(files, filepath.Join(dir, "missing.vmdk"))); err == nil {
+		t.Fatal("should have error")
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("the archive should be removed")
+	}
+}
@@ -1,9 +1,10 @@
 package common
 
 import (
+	"errors"
 	"fmt"
-	"time"
-	"log"
+	"net"
+	"strconv"
 	"strings"
 
 	gossh "code.google.com/p/go.crypto/ssh"
@@ -11,14 +12,16 @@ import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/communicator/ssh"
 	"github.com/mitchellh/packer/packer"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
 func SSHAddress(state multistep.StateBag) (string, error) {
 	//sshHostPort := state.Get("sshHostPort").(uint)
 	sshHostPort := 22
-	ip, _ := getVMAddress(state)
-	return fmt.Sprintf("%v:%d", ip, sshHostPort), nil
+	ip, err := getVMAddress(state)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(sshHostPort)), nil
 }
 
 func SSHConfigFunc(config SSHConfig) func(multistep.StateBag) (*gossh.ClientConfig, error) {
@@ -45,49 +48,30 @@ func SSHConfigFunc(config SSHConfig) func(multistep.StateBag) (*gossh.ClientConf
 	}
 }
 
+// getVMAddress returns the address of the network adapter of the VM the
+// communicator connects to. It does not wait for the VM to get one: the
+// communicator steps call it again until their wait timeout expires or the
+// build is cancelled.
 func getVMAddress(state multistep.StateBag) (string, error) {
-
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	vmName := state.Get("vmName").(string)
+	adapterName, _ := state.Get("NetworkAdapterName").(string)
 
-	errorMsg := "Could not get ip address for VM."
-
-	count := 60
-	var duration time.Duration = 1
-	sleepTime := time.Minute * duration
-	var ip string
-
-	for count != 0 {
-
-		address, err := hyperv.GetVirtualMachineNetworkAdapterAddress(vmName)
-		if err != nil {
-			err := fmt.Errorf(errorMsg, err)
-			state.Put("error", err)
-			ui.Error(err.Error())
-			return "", err
-		}
-
-		ip = strings.TrimSpace(string(address))
-
-		if ip != "False" {
-			break;
-		}
-
-		log.Println(fmt.Sprintf("Waiting for another %v minutes...", uint(duration)))
-		time.Sleep(sleepTime)
-		count--
+	address, err := driver.GetVirtualMachineNetworkAdapterAddress(vmName, adapterName)
+	if err != nil {
+		return "", fmt.Errorf("Could not get the IP address of the VM: %s", err)
 	}
 
-	if(count == 0){
-		err := fmt.Errorf(errorMsg, "IP address assigned to the adapter is empty")
-		state.Put("error", err)
-		ui.Error(err.Error())
-		return "", err
+	ip := strings.TrimSpace(address)
+	if ip == "" || ip == "False" {
+		return "", errors.New("The VM has no IP address yet.")
 	}
 
-	ui.Say("ip address is " + ip)
-	state.Put("ip", ip)
+	if previous, _ := state.Get("ip").(string); previous != ip {
+		ui.Say("IP address of the VM is " + ip)
+		state.Put("ip", ip)
+	}
 
 	return ip, nil
-
 }
@@ -0,0 +1,114 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step creates the virtual machine as a copy of an exported VM, or of
+// a VM registered on the host, optionally at one of its checkpoints. The
+// files of the copy are kept in the temporary directory.
+//
+// Uses:
+//   packerTempDir string
+//
+// Produces:
+//   vmName string - The name of the VM
+//   generation uint - The generation of the VM
+type StepCloneVM struct {
+	// The directory of an exported VM, holding its "Virtual Machines" and
+	// "Virtual Hard Disks" directories.
+	CloneFromVMCXPath string
+	// The name of a VM registered on the host, used when CloneFromVMCXPath
+	// is empty, and the name of one of its checkpoints, or empty for its
+	// current state.
+	CloneFromVMName       string
+	CloneFromSnapshotName string
+
+	VMName     string
+	SwitchName string
+	// The memory of the VM in MB, or 0 to keep the memory of the source VM.
+	RamSizeMB uint
+
+	imported bool
+}
+
+func (s *StepCloneVM) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+
+	path := state.Get("packerTempDir").(string)
+
+	exportPath := s.CloneFromVMCXPath
+	if exportPath == "" {
+		// a registered VM is exported first, and imported from the export
+		exportDir := filepath.Join(path, "clone")
+		defer os.RemoveAll(exportDir)
+
+		var err error
+		if s.CloneFromSnapshotName != "" {
+			ui.Say(fmt.Sprintf("Exporting checkpoint '%s' of virtual machine '%s'...", s.CloneFromSnapshotName, s.CloneFromVMName))
+			err = driver.ExportVirtualMachineSnapshot(s.CloneFromVMName, s.CloneFromSnapshotName, exportDir)
+		} else {
+			ui.Say(fmt.Sprintf("Exporting virtual machine '%s'...", s.CloneFromVMName))
+			err = driver.ExportVirtualMachine(s.CloneFromVMName, exportDir)
+		}
+		if err != nil {
+			err := fmt.Errorf("Error exporting virtual machine to clone: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		exportPath = filepath.Join(exportDir, s.CloneFromVMName)
+	}
+
+	ui.Say("Importing virtual machine...")
+
+	ramBytes := int64(s.RamSizeMB) * 1024 * 1024
+	err := driver.ImportVirtualMachine(exportPath, s.VMName, path, ramBytes, s.SwitchName)
+	if err != nil {
+		err := fmt.Errorf("Error importing virtual machine: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	s.imported = true
+
+	generation, err := driver.GetVirtualMachineGeneration(s.VMName)
+	if err != nil {
+		err := fmt.Errorf("Error getting the generation of the virtual machine: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("vmName", s.VMName)
+	state.Put("generation", generation)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCloneVM) Cleanup(state multistep.StateBag) {
+	if !s.imported {
+		return
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	ui.Say("Unregistering and deleting virtual machine...")
+
+	err := driver.DeleteVirtualMachine(s.VMName)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Error deleting virtual machine: %s", err))
+	}
+	s.imported = false
+}
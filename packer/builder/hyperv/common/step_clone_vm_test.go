@@ -0,0 +1,177 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepCloneVM_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCloneVM)
+}
+
+// testCloneState returns a state bag holding a FakeDriver with a
+// generation 2 VM named "base" to clone, and a temporary directory.
+func testCloneState(t *testing.T) (multistep.StateBag, *FakeDriver) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	driver.CreateVirtualMachine("base", "path", 2048*1024*1024, "switch", 2)
+	driver.CreateVirtualHardDisk("base.vhdx", DiskTypeDynamic, 1024, 0, "")
+	if err := driver.AddVirtualMachineHardDiskDrive("base", "base.vhdx", ControllerTypeSCSI); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	state.Put("packerTempDir", dir)
+
+	return state, driver
+}
+
+func TestStepCloneVM_vm(t *testing.T) {
+	state, driver := testCloneState(t)
+	dir := state.Get("packerTempDir").(string)
+	defer os.RemoveAll(dir)
+
+	step := &StepCloneVM{
+		CloneFromVMName: "base",
+		VMName:          "clone",
+		SwitchName:      "switch",
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if name := state.Get("vmName").(string); name != "clone" {
+		t.Fatalf("bad vmName: %s", name)
+	}
+	if generation := state.Get("generation").(uint); generation != 2 {
+		t.Fatalf("bad generation: %d", generation)
+	}
+
+	// the clone keeps the memory and disks of the VM, with copies of the
+	// disks in the temporary directory
+	vm := driver.VMs["clone"]
+	if vm.Generation != 2 || vm.MemoryBytes != 2048*1024*1024 || vm.NetworkAdapters[0].SwitchName != "switch" {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+
+	diskPath := filepath.Join(dir, VhdDir, "base.vhdx")
+	if len(vm.HardDiskDrives) != 1 || vm.HardDiskDrives[0].Path != diskPath {
+		t.Fatalf("bad drives: %#v", vm.HardDiskDrives)
+	}
+	if _, ok := driver.Disks[diskPath]; !ok {
+		t.Fatal("disk should be copied")
+	}
+
+	// the export the clone is imported from is removed
+	if _, err := os.Stat(filepath.Join(dir, "clone")); !os.IsNotExist(err) {
+		t.Fatal("should remove the export")
+	}
+
+	step.Cleanup(state)
+	if _, ok := driver.VMs["clone"]; ok {
+		t.Fatal("clone should be deleted")
+	}
+	if _, ok := driver.VMs["base"]; !ok {
+		t.Fatal("VM cloned should be kept")
+	}
+}
+
+func TestStepCloneVM_snapshot(t *testing.T) {
+	state, driver := testCloneState(t)
+	defer os.RemoveAll(state.Get("packerTempDir").(string))
+
+	step := &StepCloneVM{
+		CloneFromVMName:       "base",
+		CloneFromSnapshotName: "installed",
+		VMName:                "clone",
+		SwitchName:            "switch",
+		RamSizeMB:             1024,
+	}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatal("should halt on a missing checkpoint")
+	}
+	if _, ok := driver.VMs["clone"]; ok {
+		t.Fatal("should not import anything")
+	}
+
+	state, driver = testCloneState(t)
+	defer os.RemoveAll(state.Get("packerTempDir").(string))
+
+	driver.VMs["base"].Snapshots = []string{"installed"}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if !driver.Called("ExportVirtualMachineSnapshot") || driver.VMs["clone"].MemoryBytes != 1024*1024*1024 {
+		t.Fatalf("bad VM: %#v", driver.VMs["clone"])
+	}
+}
+
+func TestStepCloneVM_vmcx(t *testing.T) {
+	state, driver := testCloneState(t)
+	defer os.RemoveAll(state.Get("packerTempDir").(string))
+
+	// an export the driver knows nothing of, as one from another host
+	exportPath := testExportedVM(t)
+	defer os.RemoveAll(exportPath)
+
+	step := &StepCloneVM{
+		CloneFromVMCXPath: exportPath,
+		VMName:            "clone",
+		SwitchName:        "switch",
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if driver.Called("ExportVirtualMachine") {
+		t.Fatal("should import the export directly")
+	}
+
+	vm := driver.VMs["clone"]
+	if vm.Generation != 1 || len(vm.HardDiskDrives) != 1 {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+	if vm.HardDiskDrives[0].ControllerType != ControllerTypeIDE || vm.HardDiskDrives[0].ControllerLocation != 0 {
+		t.Fatalf("bad drive: %#v", vm.HardDiskDrives[0])
+	}
+}
+
+func TestStepCloneVM_error(t *testing.T) {
+	state, driver := testCloneState(t)
+	defer os.RemoveAll(state.Get("packerTempDir").(string))
+	driver.FailOn("ImportVirtualMachine", errors.New("boom"))
+
+	step := &StepCloneVM{CloneFromVMName: "base", VMName: "clone", SwitchName: "switch"}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	if _, ok := state.GetOk("vmName"); ok {
+		t.Fatal("vmName should not be set")
+	}
+
+	step.Cleanup(state)
+	if driver.Called("DeleteVirtualMachine") {
+		t.Fatal("should not delete a VM it did not import")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// DiskCompaction is the size in bytes of the file of a hard disk before
+// and after it was compacted.
+type DiskCompaction struct {
+	SizeBefore int64 `json:"size_before"`
+	SizeAfter  int64 `json:"size_after"`
+}
+
+// This step compacts the hard disks of the VM once it is shut down, so
+// that the space the guest freed is not exported with them.
+//
+// Uses:
+//   driver Driver
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   disk_compaction map[string]DiskCompaction - The sizes of the disks
+//     compacted, keyed by file name
+type StepCompactDisk struct {
+	SkipCompaction bool
+}
+
+func (s *StepCompactDisk) Run(state multistep.StateBag) multistep.StepAction {
+	if s.SkipCompaction {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	paths, err := driver.GetVirtualMachineHardDiskPaths(vmName)
+	if err != nil {
+		err := fmt.Errorf("Error getting the hard disks of the virtual machine: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	compaction := make(map[string]DiskCompaction)
+	for _, path := range paths {
+		name := filepath.Base(path)
+		ui.Say(fmt.Sprintf("Compacting hard disk %s...", name))
+
+		before, after, err := driver.CompactVirtualHardDisk(path)
+		if err != nil {
+			err := fmt.Errorf("Error compacting hard disk %s: %s", name, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		ui.Message(fmt.Sprintf("%s: %d MB before, %d MB after compaction", name, before/(1024*1024), after/(1024*1024)))
+		compaction[name] = DiskCompaction{SizeBefore: before, SizeAfter: after}
+	}
+
+	state.Put("disk_compaction", compaction)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCompactDisk) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepCompactDisk_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCompactDisk)
+}
+
+func TestStepCompactDisk(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	driver.CreateVirtualHardDisk("data.vhdx", DiskTypeFixed, 1024, 0, "")
+	if err := driver.AddVirtualMachineHardDiskDrive("vm", "data.vhdx", ControllerTypeSCSI); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// the guest wrote 10 MB to the boot disk, then zeroed 6 MB of it
+	driver.Disks["vm.vhdx"].FileSizeBytes = 14 * 1024 * 1024
+	driver.Disks["vm.vhdx"].ReclaimableBytes = 6 * 1024 * 1024
+
+	step := new(StepCompactDisk)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	// the fixed disk is left as it is
+	expected := map[string]DiskCompaction{
+		"vm.vhdx":   {SizeBefore: 14 * 1024 * 1024, SizeAfter: 8 * 1024 * 1024},
+		"data.vhdx": {SizeBefore: 1024, SizeAfter: 1024},
+	}
+	if compaction := state.Get("disk_compaction"); !reflect.DeepEqual(compaction, expected) {
+		t.Fatalf("bad disk_compaction: %#v", compaction)
+	}
+	if driver.Disks["vm.vhdx"].FileSizeBytes != 8*1024*1024 {
+		t.Fatalf("bad disk: %#v", driver.Disks["vm.vhdx"])
+	}
+}
+
+func TestStepCompactDisk_skip(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := &StepCompactDisk{SkipCompaction: true}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if driver.Called("CompactVirtualHardDisk") {
+		t.Fatal("should not compact")
+	}
+	if _, ok := state.GetOk("disk_compaction"); ok {
+		t.Fatal("should not have disk_compaction")
+	}
+}
+
+func TestStepCompactDisk_running(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	driver.Start("vm")
+
+	step := new(StepCompactDisk)
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
+
+func TestStepCompactDisk_error(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	driver.FailOn("GetVirtualMachineHardDiskPaths", errors.New("boom"))
+
+	step := new(StepCompactDisk)
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if driver.Called("CompactVirtualHardDisk") {
+		t.Fatal("should not compact")
+	}
+}
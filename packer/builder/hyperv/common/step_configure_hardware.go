@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step sets the processors and memory of the VM once it is created,
+// and turns nested virtualization and MAC address spoofing on.
+//
+// Uses:
+//   driver Driver
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   <nothing>
+type StepConfigureHardware struct {
+	// The number of virtual processors, kept when 0.
+	CPUs uint
+
+	// The dynamic memory settings, in megabytes and percent, which keep
+	// the Hyper-V defaults when 0.
+	EnableDynamicMemory bool
+	DynamicMemoryMinMB  uint
+	DynamicMemoryMaxMB  uint
+	DynamicMemoryBuffer uint
+
+	EnableVirtualizationExtensions bool
+	EnableMacSpoofing              bool
+}
+
+func (s *StepConfigureHardware) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	if err := s.configure(driver, ui, vmName); err != nil {
+		err := fmt.Errorf("Error configuring the hardware of the virtual machine: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepConfigureHardware) configure(driver Driver, ui packer.Ui, vmName string) error {
+	if s.CPUs != 0 {
+		ui.Say(fmt.Sprintf("Setting the virtual processors to %d...", s.CPUs))
+		if err := driver.SetVirtualMachineProcessorCount(vmName, s.CPUs); err != nil {
+			return err
+		}
+	}
+
+	const mb = 1024 * 1024
+	if s.EnableDynamicMemory {
+		ui.Say("Turning dynamic memory on...")
+		err := driver.SetVirtualMachineDynamicMemory(vmName, true,
+			int64(s.DynamicMemoryMinMB)*mb, int64(s.DynamicMemoryMaxMB)*mb, s.DynamicMemoryBuffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.EnableVirtualizationExtensions {
+		ui.Say("Turning nested virtualization on...")
+
+		// a clone may have dynamic memory on
+		if err := driver.SetVirtualMachineDynamicMemory(vmName, false, 0, 0, 0); err != nil {
+			return err
+		}
+		if err := driver.SetVirtualMachineVirtualizationExtensions(vmName, true); err != nil {
+			return err
+		}
+	}
+
+	if s.EnableMacSpoofing {
+		ui.Say("Turning MAC address spoofing on...")
+		if err := driver.SetVirtualMachineMacSpoofing(vmName, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StepConfigureHardware) Cleanup(state multistep.StateBag) {}
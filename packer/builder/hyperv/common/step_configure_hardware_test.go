@@ -0,0 +1,118 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepConfigureHardware_impl(t *testing.T) {
+	var _ multistep.Step = new(StepConfigureHardware)
+}
+
+func TestStepConfigureHardware(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := &StepConfigureHardware{
+		CPUs:                4,
+		EnableDynamicMemory: true,
+		DynamicMemoryMinMB:  512,
+		DynamicMemoryMaxMB:  4096,
+		DynamicMemoryBuffer: 20,
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	vm := driver.VMs["vm"]
+	if vm.ProcessorCount != 4 {
+		t.Fatalf("bad processors: %d", vm.ProcessorCount)
+	}
+	if !vm.DynamicMemory || vm.MinimumMemoryBytes != 512*1024*1024 || vm.MaximumMemoryBytes != 4096*1024*1024 || vm.MemoryBuffer != 20 {
+		t.Fatalf("bad dynamic memory: %#v", vm)
+	}
+	if vm.VirtualizationExtensions || vm.NetworkAdapters[0].MacSpoofing {
+		t.Fatalf("should not turn nested virtualization on: %#v", vm)
+	}
+}
+
+func TestStepConfigureHardware_defaults(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := new(StepConfigureHardware)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	for _, method := range []string{
+		"SetVirtualMachineProcessorCount",
+		"SetVirtualMachineDynamicMemory",
+		"SetVirtualMachineVirtualizationExtensions",
+		"SetVirtualMachineMacSpoofing",
+	} {
+		if driver.Called(method) {
+			t.Fatalf("should not call %s", method)
+		}
+	}
+}
+
+func TestStepConfigureHardware_nested(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	// a clone of a VM with dynamic memory
+	driver.VMs["vm"].DynamicMemory = true
+
+	step := &StepConfigureHardware{
+		EnableVirtualizationExtensions: true,
+		EnableMacSpoofing:              true,
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	vm := driver.VMs["vm"]
+	if vm.DynamicMemory || !vm.VirtualizationExtensions || !vm.NetworkAdapters[0].MacSpoofing {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+}
+
+func TestStepConfigureHardware_macSpoofing(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	if err := driver.AddVirtualMachineNetworkAdapter("vm", "Network Adapter 2", "switch"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepConfigureHardware{EnableMacSpoofing: true}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	for _, adapter := range driver.VMs["vm"].NetworkAdapters {
+		if !adapter.MacSpoofing {
+			t.Fatalf("bad adapter: %#v", adapter)
+		}
+	}
+}
+
+func TestStepConfigureHardware_running(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	if err := driver.Start("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepConfigureHardware{CPUs: 2}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step connects the network adapters of the VM to their switches,
+// adding the adapters the VM does not have and creating the switches of
+// the adapters other than the first, which StepCreateSwitch creates. It
+// then sets their VLAN IDs and static MAC addresses. On cleanup, which
+// runs before the VM is deleted, the adapters are disconnected from the
+// switches it created before these are deleted.
+//
+// Uses:
+//   driver Driver
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   NetworkAdapterName string - The name of the adapter of the communicator
+type StepConfigureNetworkAdapters struct {
+	NetworkAdapters []NetworkAdapterConfig
+
+	// The switch of switch_name, which is bound to the physical network
+	// adapter of the name or interface description given when it is an
+	// External switch.
+	SwitchName                     string
+	NetAdapterName                 string
+	NetAdapterInterfaceDescription string
+
+	createdSwitches []string
+
+	// The adapters connected to the switches this step created.
+	connectedAdapters []string
+}
+
+func (s *StepConfigureNetworkAdapters) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	ui.Say("Configuring the network adapters...")
+
+	for i, adapter := range s.NetworkAdapters {
+		adapterName := NetworkAdapterName(i)
+
+		if err := s.configure(driver, ui, vmName, adapterName, i, adapter); err != nil {
+			err := fmt.Errorf("Error configuring network adapter '%s': %s", adapterName, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		if adapter.Communicator {
+			state.Put("NetworkAdapterName", adapterName)
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepConfigureNetworkAdapters) configure(driver Driver, ui packer.Ui, vmName string, adapterName string, index int, adapter NetworkAdapterConfig) error {
+	if index > 0 {
+		var netAdapterName, netAdapterInterfaceDescription string
+		if adapter.SwitchName == s.SwitchName {
+			netAdapterName, netAdapterInterfaceDescription = s.NetAdapterName, s.NetAdapterInterfaceDescription
+		}
+
+		created, err := createSwitch(driver, adapter.SwitchName, adapter.SwitchType, netAdapterName, netAdapterInterfaceDescription)
+		if err != nil {
+			return err
+		}
+		if created {
+			ui.Message(fmt.Sprintf("Created switch '%s'.", adapter.SwitchName))
+			s.createdSwitches = append(s.createdSwitches, adapter.SwitchName)
+		}
+	}
+
+	ui.Message(fmt.Sprintf("Connecting '%s' to switch '%s'...", adapterName, adapter.SwitchName))
+	if err := driver.AddVirtualMachineNetworkAdapter(vmName, adapterName, adapter.SwitchName); err != nil {
+		return err
+	}
+	for _, switchName := range s.createdSwitches {
+		if switchName == adapter.SwitchName {
+			s.connectedAdapters = append(s.connectedAdapters, adapterName)
+		}
+	}
+
+	if adapter.VlanID != "" {
+		ui.Message(fmt.Sprintf("Setting the VLAN ID of '%s' to %s...", adapterName, adapter.VlanID))
+		if err := driver.SetVirtualMachineNetworkAdapterVlanId(vmName, adapterName, adapter.VlanID); err != nil {
+			return err
+		}
+	}
+
+	if adapter.MacAddress != "" {
+		ui.Message(fmt.Sprintf("Setting the MAC address of '%s' to %s...", adapterName, adapter.MacAddress))
+		if err := driver.SetVirtualMachineNetworkAdapterMacAddress(vmName, adapterName, adapter.MacAddress); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StepConfigureNetworkAdapters) Cleanup(state multistep.StateBag) {
+	if len(s.createdSwitches) == 0 {
+		return
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	for _, adapterName := range s.connectedAdapters {
+		if err := driver.DisconnectVirtualMachineNetworkAdapter(vmName, adapterName); err != nil {
+			ui.Error(fmt.Sprintf("Error disconnecting network adapter '%s': %s", adapterName, err))
+		}
+	}
+
+	for _, switchName := range s.createdSwitches {
+		ui.Say(fmt.Sprintf("Deleting switch '%s'...", switchName))
+		if err := driver.DeleteVirtualSwitch(switchName); err != nil {
+			ui.Error(fmt.Sprintf("Error deleting switch: %s", err))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepConfigureNetworkAdapters_impl(t *testing.T) {
+	var _ multistep.Step = new(StepConfigureNetworkAdapters)
+}
+
+func TestStepConfigureNetworkAdapters(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := &StepConfigureNetworkAdapters{
+		NetworkAdapters: []NetworkAdapterConfig{
+			{SwitchName: "switch", SwitchType: SwitchTypeInternal, VlanID: "10"},
+			{SwitchName: "private", SwitchType: SwitchTypePrivate, MacAddress: "00155D010203", Communicator: true},
+		},
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	expected := []FakeNetworkAdapter{
+		{Name: "Network Adapter", SwitchName: "switch", VlanID: "10"},
+		{Name: "Network Adapter 2", SwitchName: "private", MacAddress: "00155D010203"},
+	}
+	var adapters []FakeNetworkAdapter
+	for _, adapter := range driver.VMs["vm"].NetworkAdapters {
+		adapters = append(adapters, *adapter)
+	}
+	if !reflect.DeepEqual(adapters, expected) {
+		t.Fatalf("bad adapters: %#v", adapters)
+	}
+
+	if sw := driver.Switches["private"]; sw == nil || sw.Type != SwitchTypePrivate {
+		t.Fatalf("bad switch: %#v", sw)
+	}
+	if name := state.Get("NetworkAdapterName"); name != "Network Adapter 2" {
+		t.Fatalf("bad NetworkAdapterName: %#v", name)
+	}
+
+	// the switch StepCreateSwitch creates is left to it, and the VM,
+	// which still exists, is disconnected from the created switch first
+	driver.Calls = nil
+	step.Cleanup(state)
+	if _, ok := driver.Switches["private"]; ok {
+		t.Fatal("should delete the created switch")
+	}
+	if _, ok := driver.Switches["switch"]; !ok {
+		t.Fatal("should not delete the switch of the first adapter")
+	}
+
+	calls := []string{"DisconnectVirtualMachineNetworkAdapter", "DeleteVirtualSwitch"}
+	if !reflect.DeepEqual(driver.Calls, calls) {
+		t.Fatalf("bad calls: %#v", driver.Calls)
+	}
+	connected := driver.VMs["vm"].NetworkAdapters
+	if connected[0].SwitchName != "switch" || connected[1].SwitchName != "" {
+		t.Fatalf("bad adapters: %#v %#v", connected[0], connected[1])
+	}
+}
+
+func TestStepConfigureNetworkAdapters_external(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := &StepConfigureNetworkAdapters{
+		NetworkAdapters: []NetworkAdapterConfig{
+			{SwitchName: "switch", SwitchType: SwitchTypeInternal},
+			{SwitchName: "external", SwitchType: SwitchTypeExternal},
+		},
+		SwitchName:     "external",
+		NetAdapterName: "Ethernet",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if sw := driver.Switches["external"]; sw == nil || sw.Type != SwitchTypeExternal || sw.NetAdapterName != "Ethernet" {
+		t.Fatalf("bad switch: %#v", sw)
+	}
+}
+
+func TestStepConfigureNetworkAdapters_address(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := &StepConfigureNetworkAdapters{
+		NetworkAdapters: []NetworkAdapterConfig{
+			{SwitchName: "switch"},
+			{SwitchName: "switch", Communicator: true},
+		},
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if err := driver.Start("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	driver.VMs["vm"].NetworkAdapters[0].IPAddress = "10.0.0.2"
+	driver.VMs["vm"].NetworkAdapters[1].IPAddress = "192.168.1.42"
+
+	address, err := getVMAddress(state)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if address != "192.168.1.42" {
+		t.Fatalf("bad address: %s", address)
+	}
+}
+
+func TestStepConfigureNetworkAdapters_running(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	if err := driver.Start("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepConfigureNetworkAdapters{
+		NetworkAdapters: []NetworkAdapterConfig{
+			{SwitchName: "switch"},
+			{SwitchName: "switch"},
+		},
+	}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/communicator/winrm"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// StepConnectWinRM waits until WinRM is available on the VM and puts a
+// WinRM communicator into the state bag.
+//
+// Uses:
+//   ui packer.Ui
+//
+// Produces:
+//   communicator packer.Communicator
+type StepConnectWinRM struct {
+	// WinRMAddress returns the host:port to connect to.
+	WinRMAddress func(multistep.StateBag) (string, error)
+
+	// WinRMConfig returns the communicator configuration, the host and
+	// port are filled in from WinRMAddress.
+	WinRMConfig func(multistep.StateBag) (*winrm.Config, error)
+
+	WinRMWaitTimeout time.Duration
+
+	// The time between connection attempts. Defaults to 5 seconds.
+	RetryInterval time.Duration
+
+	comm packer.Communicator
+}
+
+func (s *StepConnectWinRM) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+
+	var comm packer.Communicator
+	var err error
+
+	cancel := make(chan struct{})
+	waitDone := make(chan bool, 1)
+	go func() {
+		ui.Say("Waiting for WinRM to become available...")
+		comm, err = s.waitForWinRM(state, cancel)
+		waitDone <- true
+	}()
+
+	log.Printf("Waiting for WinRM, up to timeout: %s", s.WinRMWaitTimeout)
+	timeout := time.After(s.WinRMWaitTimeout)
+
+WaitLoop:
+	for {
+		// Wait for either WinRM to become available, a timeout to occur,
+		// or an interrupt to come through.
+		select {
+		case <-waitDone:
+			if err != nil {
+				err := fmt.Errorf("Error waiting for WinRM: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+
+			ui.Say("Connected to WinRM!")
+			s.comm = comm
+			state.Put("communicator", comm)
+			break WaitLoop
+		case <-timeout:
+			err := errors.New("Timeout waiting for WinRM.")
+			state.Put("error", err)
+			ui.Error(err.Error())
+			close(cancel)
+			return multistep.ActionHalt
+		case <-time.After(1 * time.Second):
+			if _, ok := state.GetOk(multistep.StateCancelled); ok {
+				// The step sequence was cancelled, so cancel waiting for
+				// WinRM and just start the halting process.
+				close(cancel)
+				log.Println("Interrupt detected, quitting waiting for WinRM.")
+				return multistep.ActionHalt
+			}
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepConnectWinRM) Cleanup(multistep.StateBag) {
+}
+
+func (s *StepConnectWinRM) waitForWinRM(state multistep.StateBag, cancel <-chan struct{}) (packer.Communicator, error) {
+	retryInterval := s.RetryInterval
+	if retryInterval == 0 {
+		retryInterval = 5 * time.Second
+	}
+
+	first := true
+	for {
+		if !first {
+			select {
+			case <-cancel:
+				log.Println("WinRM wait cancelled. Exiting loop.")
+				return nil, errors.New("WinRM wait cancelled")
+			case <-time.After(retryInterval):
+			}
+		}
+		first = false
+
+		address, err := s.WinRMAddress(state)
+		if err != nil {
+			log.Printf("Error getting WinRM address: %s", err)
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid WinRM address %s: %s", address, err)
+		}
+
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid WinRM port %s: %s", port, err)
+		}
+
+		config, err := s.WinRMConfig(state)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting WinRM config: %s", err)
+		}
+
+		config.Host = host
+		config.Port = uint(portNumber)
+
+		comm, err := winrm.New(config)
+		if err != nil {
+			return nil, err
+		}
+
+		// WinRM accepts connections before the guest is ready to run
+		// commands, so only a command that ran proves it is usable
+		log.Printf("Attempting WinRM connection to %s...", address)
+		cmd := &packer.RemoteCmd{Command: "echo packer"}
+		if err := comm.Start(cmd); err != nil {
+			log.Printf("WinRM connection error: %s", err)
+			continue
+		}
+		cmd.Wait()
+
+		if cmd.ExitStatus != 0 {
+			log.Printf("WinRM test command exited with status %d", cmd.ExitStatus)
+			continue
+		}
+
+		return comm, nil
+	}
+}
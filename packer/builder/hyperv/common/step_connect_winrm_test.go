@@ -0,0 +1,125 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/communicator/winrm"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// testWinRMServer answers every WS-Management request as if each command
+// succeeded, after refusing the first attempts.
+func testWinRMServer(t *testing.T, refuse int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		request := string(data)
+
+		if refuse > 0 {
+			refuse--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body := ""
+		switch {
+		case strings.Contains(request, "transfer/Create<"):
+			body = "<rsp:Shell><rsp:ShellId>shell</rsp:ShellId></rsp:Shell>"
+		case strings.Contains(request, "shell/Command<"):
+			body = "<rsp:CommandResponse><rsp:CommandId>command</rsp:CommandId></rsp:CommandResponse>"
+		case strings.Contains(request, "shell/Receive<"):
+			body = fmt.Sprintf(`<rsp:ReceiveResponse><rsp:Stream Name="stdout" CommandId="command">%s</rsp:Stream>`+
+				`<rsp:CommandState CommandId="command" State="http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done">`+
+				`<rsp:ExitCode>0</rsp:ExitCode></rsp:CommandState></rsp:ReceiveResponse>`,
+				base64.StdEncoding.EncodeToString([]byte("packer\r\n")))
+		}
+
+		fmt.Fprintf(w, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" `+
+			`xmlns:rsp="http://schemas.microsoft.com/wbem/wsman/1/windows/shell"><s:Body>%s</s:Body></s:Envelope>`, body)
+	}))
+}
+
+func testStepConnectWinRM(address string) *StepConnectWinRM {
+	return &StepConnectWinRM{
+		WinRMAddress: func(multistep.StateBag) (string, error) {
+			return address, nil
+		},
+		WinRMConfig: func(multistep.StateBag) (*winrm.Config, error) {
+			return &winrm.Config{Username: "vagrant", Password: "vagrant", Timeout: time.Second}, nil
+		},
+		WinRMWaitTimeout: 5 * time.Second,
+		RetryInterval:    time.Millisecond,
+	}
+}
+
+func TestStepConnectWinRM_impl(t *testing.T) {
+	var _ multistep.Step = new(StepConnectWinRM)
+}
+
+func TestStepConnectWinRM(t *testing.T) {
+	server := testWinRMServer(t, 2)
+	defer server.Close()
+
+	state := testState(t)
+	step := testStepConnectWinRM(strings.TrimPrefix(server.URL, "http://"))
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+	if _, ok := state.Get("communicator").(packer.Communicator); !ok {
+		t.Fatal("should have a communicator")
+	}
+}
+
+func TestStepConnectWinRM_timeout(t *testing.T) {
+	server := testWinRMServer(t, 1000000)
+	defer server.Close()
+
+	state := testState(t)
+	step := testStepConnectWinRM(strings.TrimPrefix(server.URL, "http://"))
+	step.WinRMWaitTimeout = 50 * time.Millisecond
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	if _, ok := state.GetOk("communicator"); ok {
+		t.Fatal("should NOT have a communicator")
+	}
+}
+
+func TestWinRMConfigPrepare(t *testing.T) {
+	tpl, err := packer.NewConfigTemplate()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &WinRMConfig{WinRMUser: "vagrant", WinRMUseSSL: true}
+	if errs := c.Prepare(tpl); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	if c.WinRMPort != 5986 || c.WinRMTransport != winrm.TransportBasic {
+		t.Fatalf("bad defaults: %d %s", c.WinRMPort, c.WinRMTransport)
+	}
+	if c.WinRMTimeout != 60*time.Second || c.WinRMWaitTimeout != 20*time.Minute {
+		t.Fatalf("bad timeouts: %s %s", c.WinRMTimeout, c.WinRMWaitTimeout)
+	}
+
+	c = &WinRMConfig{WinRMTransport: "kerberos", RawWinRMTimeout: "soon"}
+	if errs := c.Prepare(tpl); len(errs) != 3 {
+		t.Fatalf("bad: %#v", errs)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/convert"
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/vhdx"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// The directory of the output directory holding the converted disks.
+const ConvertedDiskDir string = "Converted Disks"
+
+// This step converts the VHDX hard disks exported to the output
+// directory to other formats.
+//
+// Uses:
+//   ui packer.Ui
+//
+// Produces:
+//   <nothing>
+type StepConvertDisks struct {
+	Formats   []string
+	OutputDir string
+}
+
+func (s *StepConvertDisks) Run(state multistep.StateBag) multistep.StepAction {
+	if len(s.Formats) == 0 {
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+
+	paths, err := filepath.Glob(filepath.Join(s.OutputDir, VhdDir, "*.vhdx"))
+	if err == nil && len(paths) == 0 {
+		err = fmt.Errorf("No VHDX hard disk was exported to '%s'.", filepath.Join(s.OutputDir, VhdDir))
+	}
+	if err != nil {
+		err := fmt.Errorf("Error converting hard disks: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	convertedPath := filepath.Join(s.OutputDir, ConvertedDiskDir)
+	if err := os.MkdirAll(convertedPath, 0755); err != nil {
+		err := fmt.Errorf("Error creating the converted disks directory: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	for _, path := range paths {
+		if err := s.convertDisk(ui, path, convertedPath); err != nil {
+			err := fmt.Errorf("Error converting hard disk %s: %s", filepath.Base(path), err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepConvertDisks) convertDisk(ui packer.Ui, path string, convertedPath string) error {
+	disk, err := openExportedDisk(path)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, format := range s.Formats {
+		ui.Say(fmt.Sprintf("Converting hard disk %s to %s...", filepath.Base(path), format))
+
+		if err := convert.Convert(filepath.Join(convertedPath, convert.FileName(name, format)), disk, format); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StepConvertDisks) Cleanup(state multistep.StateBag) {}
+
+// openExportedDisk opens an exported VHDX hard disk for reading, along
+// with the chain of parents of a differencing disk.
+func openExportedDisk(path string) (*vhdx.Disk, error) {
+	disk, err := vhdx.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for d := disk; d.HasParent; {
+		if d, err = d.OpenParent(); err != nil {
+			disk.Close()
+			return nil, err
+		}
+	}
+
+	return disk, nil
+}
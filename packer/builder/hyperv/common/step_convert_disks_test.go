@@ -0,0 +1,93 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/convert"
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/vhdx"
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepConvertDisks_impl(t *testing.T) {
+	var _ multistep.Step = new(StepConvertDisks)
+}
+
+func TestStepConvertDisks(t *testing.T) {
+	state := testState(t)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, VhdDir), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	disk, err := vhdx.Create(filepath.Join(dir, VhdDir, "vm.vhdx"), vhdx.CreateOptions{VirtualSize: 8 * vhdx.MB})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := disk.WriteAt([]byte("packer"), 3*vhdx.MB); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepConvertDisks{
+		Formats:   []string{convert.FormatRaw, convert.FormatQCOW2},
+		OutputDir: dir,
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, ConvertedDiskDir, "vm.raw"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(raw) != 8*vhdx.MB || !bytes.Equal(raw[3*vhdx.MB:3*vhdx.MB+6], []byte("packer")) {
+		t.Fatal("bad raw disk")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ConvertedDiskDir, "vm.qcow2")); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestStepConvertDisks_noFormats(t *testing.T) {
+	state := testState(t)
+
+	step := &StepConvertDisks{OutputDir: "output"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, err := os.Stat(filepath.Join("output", ConvertedDiskDir)); err == nil {
+		t.Fatal("should not create the converted disks directory")
+	}
+}
+
+func TestStepConvertDisks_noDisks(t *testing.T) {
+	state := testState(t)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	step := &StepConvertDisks{Formats: []string{convert.FormatVMDK}, OutputDir: dir}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
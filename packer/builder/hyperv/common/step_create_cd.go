@@ -0,0 +1,109 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/iso9660"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step creates an ISO image holding the Files, keeping the structure
+// of their directories. Generation 2 VMs have no floppy drive, so the
+// FloppyFiles and FloppyDirs are put on the image too, the same way they
+// would be put on a floppy.
+//
+// When Tpl is set, the files are processed as templates of the HTTP server
+// and the name of the VM, so the server has to be started before.
+//
+// Uses:
+//   http_ip string
+//   http_port uint
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   cd_path string - The path to the ISO image
+type StepCreateCD struct {
+	Files       []string
+	FloppyFiles []string
+	FloppyDirs  []string
+	Label       string
+	Tpl         *packer.ConfigTemplate
+
+	tempDir string
+}
+
+func (s *StepCreateCD) Run(state multistep.StateBag) multistep.StepAction {
+	if len(s.Files) == 0 && len(s.FloppyFiles) == 0 && len(s.FloppyDirs) == 0 {
+		log.Println("No CD files specified. CD disk will not be made.")
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	ui.Say("Creating CD disk...")
+
+	isoPath, err := s.createCD(state)
+	if err != nil {
+		err := fmt.Errorf("Error creating CD disk: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("cd_path", isoPath)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCreateCD) Cleanup(state multistep.StateBag) {
+	if s.tempDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(s.tempDir); err != nil {
+		ui := state.Get("ui").(packer.Ui)
+		ui.Error(fmt.Sprintf("Error removing CD disk: %s", err))
+	}
+}
+
+func (s *StepCreateCD) createCD(state multistep.StateBag) (string, error) {
+	var err error
+	s.tempDir, err = ioutil.TempDir("", "packer")
+	if err != nil {
+		return "", err
+	}
+
+	image := iso9660.NewImage(s.Label)
+	var files mediaImage = image
+	if s.Tpl != nil {
+		files = &templateImage{image, s.Tpl, newBootTemplateData(state), s.tempDir}
+	}
+
+	if err := addFlatFiles(files, s.FloppyFiles); err != nil {
+		return "", err
+	}
+
+	if err := addTrees(files, s.FloppyDirs); err != nil {
+		return "", err
+	}
+
+	if err := addTrees(files, s.Files); err != nil {
+		return "", err
+	}
+
+	isoPath := filepath.Join(s.tempDir, "packer.iso")
+	if err := writeImage(isoPath, image); err != nil {
+		return "", err
+	}
+
+	return isoPath, nil
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepCreateCD_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCreateCD)
+}
+
+func TestStepCreateCD_noFiles(t *testing.T) {
+	state := testState(t)
+
+	step := &StepCreateCD{}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if _, ok := state.GetOk("cd_path"); ok {
+		t.Fatal("should not create a CD")
+	}
+}
+
+func TestStepCreateCD(t *testing.T) {
+	state := testState(t)
+	dir := testMediaFiles(t)
+	defer os.RemoveAll(dir)
+
+	step := &StepCreateCD{
+		Files:       []string{filepath.Join(dir, "drivers")},
+		FloppyFiles: []string{filepath.Join(dir, "Autounattend.xml")},
+		Label:       "PACKER",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	isoPath := state.Get("cd_path").(string)
+	info, err := os.Stat(isoPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.Size() == 0 || info.Size()%2048 != 0 {
+		t.Fatalf("bad size: %d", info.Size())
+	}
+
+	step.Cleanup(state)
+	if _, err := os.Stat(isoPath); !os.IsNotExist(err) {
+		t.Fatal("should remove the CD")
+	}
+}
+
+func TestStepCreateCD_missingFiles(t *testing.T) {
+	state := testState(t)
+
+	step := &StepCreateCD{Files: []string{filepath.Join("missing", "*.ps1")}}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	"code.google.com/p/go-uuid/uuid"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
 // This step creates switch for VM.
@@ -22,7 +21,7 @@ type StepCreateExternalSwitch struct {
 }
 
 func (s *StepCreateExternalSwitch) Run(state multistep.StateBag) multistep.StepAction {
-	//driver := state.Get("driver").(Driver)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	vmName := state.Get("vmName").(string)
@@ -33,7 +32,7 @@ func (s *StepCreateExternalSwitch) Run(state multistep.StateBag) multistep.StepA
 
 	packerExternalSwitchName := "paes_" + uuid.New()
 
-	err = hyperv.CreateExternalVirtualSwitch(vmName, packerExternalSwitchName)
+	err = driver.CreateExternalVirtualSwitch(vmName, packerExternalSwitchName)
 	if err != nil {
 		err := fmt.Errorf("Error creating switch: %s", err)
 		state.Put(errorMsg, err)
@@ -42,7 +41,7 @@ func (s *StepCreateExternalSwitch) Run(state multistep.StateBag) multistep.StepA
 		return multistep.ActionHalt
 	}
 	
-	switchName, err := hyperv.GetVirtualMachineSwitchName(vmName)
+	switchName, err := driver.GetVirtualMachineSwitchName(vmName)
 	if err != nil {
 		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
@@ -76,7 +75,7 @@ func (s *StepCreateExternalSwitch) Cleanup(state multistep.StateBag) {
 	if s.SwitchName == "" {
 		return
 	}
-	//driver := state.Get("driver").(Driver)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	vmName := state.Get("vmName").(string)
 
@@ -92,7 +91,7 @@ func (s *StepCreateExternalSwitch) Cleanup(state multistep.StateBag) {
 		return
 	}
 
-	err = hyperv.ConnectVirtualMachineNetworkAdapterToSwitch(vmName, s.oldSwitchName)
+	err = driver.ConnectVirtualMachineNetworkAdapterToSwitch(vmName, s.oldSwitchName)
 	if err != nil {
 		ui.Error(fmt.Sprintf(errMsg, err))
 		return
@@ -100,7 +99,7 @@ func (s *StepCreateExternalSwitch) Cleanup(state multistep.StateBag) {
 
 	state.Put("SwitchName", s.oldSwitchName)
 
-	err = hyperv.DeleteVirtualSwitch(s.SwitchName)
+	err = driver.DeleteVirtualSwitch(s.SwitchName)
 	if err != nil {
 		ui.Error(fmt.Sprintf(errMsg, err))
 	}
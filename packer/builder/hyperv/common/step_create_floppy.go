@@ -0,0 +1,103 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/fat12"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step creates a floppy image holding the Files, all placed in the
+// root directory, and the Directories, keeping their structure. The image
+// is named with the .vfd extension Hyper-V needs.
+//
+// When Tpl is set, the files are processed as templates of the HTTP server
+// and the name of the VM, so the server has to be started before.
+//
+// Uses:
+//   http_ip string
+//   http_port uint
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   floppy_path string - The path to the floppy image
+type StepCreateFloppy struct {
+	Files       []string
+	Directories []string
+	Label       string
+	Tpl         *packer.ConfigTemplate
+
+	tempDir string
+}
+
+func (s *StepCreateFloppy) Run(state multistep.StateBag) multistep.StepAction {
+	if len(s.Files) == 0 && len(s.Directories) == 0 {
+		log.Println("No floppy files specified. Floppy disk will not be made.")
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	ui.Say("Creating floppy disk...")
+
+	floppyPath, err := s.createFloppy(state)
+	if err != nil {
+		err := fmt.Errorf("Error creating floppy disk: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	state.Put("floppy_path", floppyPath)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCreateFloppy) Cleanup(state multistep.StateBag) {
+	if s.tempDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(s.tempDir); err != nil {
+		ui := state.Get("ui").(packer.Ui)
+		ui.Error(fmt.Sprintf("Error removing floppy disk: %s", err))
+	}
+}
+
+func (s *StepCreateFloppy) createFloppy(state multistep.StateBag) (string, error) {
+	var err error
+	s.tempDir, err = ioutil.TempDir("", "packer")
+	if err != nil {
+		return "", err
+	}
+
+	image := fat12.NewImage(s.Label)
+	var files mediaImage = image
+	if s.Tpl != nil {
+		files = &templateImage{image, s.Tpl, newBootTemplateData(state), s.tempDir}
+	}
+
+	if err := addFlatFiles(files, s.Files); err != nil {
+		return "", err
+	}
+
+	if err := addTrees(files, s.Directories); err != nil {
+		return "", err
+	}
+
+	floppyPath := filepath.Join(s.tempDir, "floppy.vfd")
+	if err := writeImage(floppyPath, image); err != nil {
+		return "", err
+	}
+
+	return floppyPath, nil
+}
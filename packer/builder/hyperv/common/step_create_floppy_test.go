@@ -0,0 +1,97 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/fat12"
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepCreateFloppy_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCreateFloppy)
+}
+
+func TestStepCreateFloppy(t *testing.T) {
+	state := testState(t)
+	dir := testMediaFiles(t)
+	defer os.RemoveAll(dir)
+
+	step := &StepCreateFloppy{
+		Files:       []string{filepath.Join(dir, "Autounattend.xml")},
+		Directories: []string{filepath.Join(dir, "drivers")},
+		Label:       "PACKER",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	floppyPath := state.Get("floppy_path").(string)
+	if filepath.Ext(floppyPath) != ".vfd" {
+		t.Fatalf("Hyper-V needs the vfd extension: %s", floppyPath)
+	}
+
+	info, err := os.Stat(floppyPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if info.Size() != fat12.Size {
+		t.Fatalf("bad size: %d", info.Size())
+	}
+
+	step.Cleanup(state)
+	if _, err := os.Stat(floppyPath); !os.IsNotExist(err) {
+		t.Fatal("should remove the floppy")
+	}
+}
+
+func TestStepCreateFloppy_noFiles(t *testing.T) {
+	state := testState(t)
+
+	step := &StepCreateFloppy{}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if _, ok := state.GetOk("floppy_path"); ok {
+		t.Fatal("should not create a floppy")
+	}
+}
+
+func TestStepCreateFloppy_template(t *testing.T) {
+	state, _ := testStateWithVM(t)
+	state.Put("http_ip", "192.168.0.1")
+	state.Put("http_port", uint(8080))
+	dir := testMediaFiles(t)
+	defer os.RemoveAll(dir)
+
+	badTemplate := filepath.Join(dir, "bad.cfg")
+	if err := ioutil.WriteFile(badTemplate, []byte("{{ .HTTPIP"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepCreateFloppy{
+		Files: []string{filepath.Join(dir, "Autounattend.xml")},
+		Label: "PACKER",
+		Tpl:   testConfigTemplate(t),
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+
+	step = &StepCreateFloppy{
+		Files: []string{badTemplate},
+		Label: "PACKER",
+		Tpl:   testConfigTemplate(t),
+	}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	step.Cleanup(state)
+}
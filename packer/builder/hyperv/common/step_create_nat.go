@@ -0,0 +1,170 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/dhcp"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// The listener of the DHCP server, replaced by the tests.
+var dhcpListenPacket = net.ListenPacket
+
+// This step puts the internal switch of the VM behind a NAT network of the
+// host. The host adapter of the switch gets the first address of the
+// prefix, the gateway of the VM, and a DHCP server the step runs until
+// cleanup leases the other addresses to the VM.
+//
+// Uses:
+//   driver Driver
+//   ui packer.Ui
+//
+// Produces:
+//   <nothing>
+type StepCreateNat struct {
+	// The switch and prefix of the NAT network, which is not created when
+	// Prefix is empty.
+	SwitchName string
+	Prefix     string
+
+	// The DNS servers of the VM. By default, those of the host.
+	DnsServers []string
+
+	natName   string
+	gatewayIP string
+	server    *dhcp.Server
+}
+
+func (s *StepCreateNat) Run(state multistep.StateBag) multistep.StepAction {
+	if s.Prefix == "" {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+
+	if err := s.create(driver, ui); err != nil {
+		err := fmt.Errorf("Error creating the NAT network: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepCreateNat) create(driver Driver, ui packer.Ui) error {
+	_, subnet, err := net.ParseCIDR(s.Prefix)
+	if err != nil {
+		return err
+	}
+
+	gateway := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(gateway, binary.BigEndian.Uint32(subnet.IP.To4())+1)
+
+	// an existing switch of switch_name is used as it is, and the host
+	// only routes the traffic of an Internal switch
+	switchType, err := driver.GetVirtualSwitchType(s.SwitchName)
+	if err != nil {
+		return err
+	}
+	if switchType != SwitchTypeInternal {
+		return fmt.Errorf("A NAT network needs an Internal switch, but switch '%s' has type '%s'. Set a switch_name of an Internal switch or of one that does not exist.", s.SwitchName, switchType)
+	}
+
+	ui.Say(fmt.Sprintf("Creating NAT network %s on switch '%s'...", s.Prefix, s.SwitchName))
+
+	// cleanup removes whatever part of the network was created
+	s.natName = fmt.Sprintf("%s_nat", s.SwitchName)
+	s.gatewayIP = gateway.String()
+	if err := driver.CreateNetNat(s.natName, s.SwitchName, s.Prefix, s.gatewayIP); err != nil {
+		return err
+	}
+
+	server := dhcp.NewServer(gateway, subnet)
+	server.DNSServers, err = s.dnsServers(driver, ui)
+	if err != nil {
+		return err
+	}
+
+	conn, err := listenDhcp(gateway)
+	if err != nil {
+		return fmt.Errorf("DHCP server: %s", err)
+	}
+
+	ui.Message(fmt.Sprintf("Leasing the addresses of %s from %s...", s.Prefix, conn.LocalAddr()))
+	s.server = server
+	go func() {
+		if err := server.Serve(conn); err != nil {
+			log.Println(fmt.Sprintf("DHCP server stopped: %s", err))
+		}
+	}()
+
+	return nil
+}
+
+// dnsServers returns the DNS servers of the VM, without the loopback
+// addresses of the host, which the VM cannot reach.
+func (s *StepCreateNat) dnsServers(driver Driver, ui packer.Ui) ([]net.IP, error) {
+	servers := s.DnsServers
+	if len(servers) == 0 {
+		var err error
+		servers, err = driver.GetHostDnsServers()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ips []net.IP
+	for _, server := range servers {
+		if ip := net.ParseIP(server).To4(); ip != nil && !ip.IsLoopback() {
+			ips = append(ips, ip)
+		}
+	}
+
+	if len(ips) == 0 {
+		ui.Message("The VM has no DNS server, the host has none it can reach.")
+	}
+	return ips, nil
+}
+
+// listenDhcp listens on the server port of the gateway, which cannot be
+// bound until the host is done checking that the new address is unique.
+func listenDhcp(gateway net.IP) (net.PacketConn, error) {
+	address := net.JoinHostPort(gateway.String(), strconv.Itoa(dhcp.ServerPort))
+	for i := 0; ; i++ {
+		conn, err := dhcpListenPacket("udp4", address)
+		if err == nil || i == 10 {
+			return conn, err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *StepCreateNat) Cleanup(state multistep.StateBag) {
+	if s.natName == "" {
+		return
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+
+	if s.server != nil {
+		s.server.Close()
+	}
+
+	ui.Say("Deleting the NAT network...")
+	if err := driver.DeleteNetNat(s.natName, s.gatewayIP); err != nil {
+		ui.Error(fmt.Sprintf("Error deleting the NAT network: %s", err))
+	}
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/dhcp"
+	"github.com/mitchellh/multistep"
+)
+
+// testDhcpListenPacket makes the DHCP server of StepCreateNat listen on a
+// loopback port, recording the address it was asked for.
+func testDhcpListenPacket(t *testing.T) *string {
+	var address string
+	dhcpListenPacket = func(network string, a string) (net.PacketConn, error) {
+		address = a
+		return net.ListenPacket(network, "127.0.0.1:0")
+	}
+	return &address
+}
+
+func TestStepCreateNat_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCreateNat)
+}
+
+func TestStepCreateNat(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+	driver.Switches["switch"] = &FakeSwitch{Name: "switch", Type: SwitchTypeInternal}
+	driver.HostDnsServers = []string{"127.0.0.1", "10.0.0.53"}
+
+	address := testDhcpListenPacket(t)
+	defer func() { dhcpListenPacket = net.ListenPacket }()
+
+	step := &StepCreateNat{SwitchName: "switch", Prefix: "192.168.250.0/24"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	nat := driver.NetNats["switch_nat"]
+	if nat == nil || nat.SwitchName != "switch" || nat.Prefix != "192.168.250.0/24" || nat.GatewayIP != "192.168.250.1" {
+		t.Fatalf("bad NAT network: %#v", nat)
+	}
+	if *address != "192.168.250.1:67" {
+		t.Fatalf("bad DHCP address: %s", *address)
+	}
+
+	// the DHCP server leases to the VM
+	discover := &dhcp.Packet{
+		Op:      dhcp.BootRequest,
+		CHAddr:  net.HardwareAddr{0x00, 0x15, 0x5d, 0x01, 0x02, 0x03},
+		Options: map[byte][]byte{dhcp.OptionMessageType: {dhcp.Discover}},
+	}
+	offer := step.server.Handle(discover)
+	if offer == nil || !offer.YIAddr.Equal(net.IPv4(192, 168, 250, 2)) {
+		t.Fatalf("bad offer: %#v", offer)
+	}
+	if dns := offer.IPOption(dhcp.OptionDomainNameServer); !dns.Equal(net.IPv4(10, 0, 0, 53)) {
+		t.Fatalf("bad DNS server: %s", dns)
+	}
+
+	step.Cleanup(state)
+	if _, ok := driver.NetNats["switch_nat"]; ok {
+		t.Fatal("should delete the NAT network")
+	}
+}
+
+func TestStepCreateNat_none(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+
+	step := &StepCreateNat{SwitchName: "switch"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+
+	if len(driver.Calls) != 0 {
+		t.Fatalf("should not call the driver: %#v", driver.Calls)
+	}
+}
+
+func TestStepCreateNat_error(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+	driver.Switches["switch"] = &FakeSwitch{Name: "switch", Type: SwitchTypeInternal}
+	driver.FailOn("CreateNetNat", errors.New("the host has a NAT network already"))
+
+	step := &StepCreateNat{SwitchName: "switch", Prefix: "192.168.250.0/24"}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+
+	// the gateway address may be left
+	step.Cleanup(state)
+	if !driver.Called("DeleteNetNat") {
+		t.Fatal("should delete the NAT network")
+	}
+}
+
+func TestStepCreateNat_switchType(t *testing.T) {
+	for _, switchType := range []string{SwitchTypeExternal, SwitchTypePrivate, ""} {
+		state := testState(t)
+		driver := state.Get("driver").(*FakeDriver)
+		if switchType != "" {
+			driver.Switches["switch"] = &FakeSwitch{Name: "switch", Type: switchType}
+		}
+
+		step := &StepCreateNat{SwitchName: "switch", Prefix: "192.168.250.0/24"}
+		if action := step.Run(state); action != multistep.ActionHalt {
+			t.Fatalf("%s: bad action: %#v", switchType, action)
+		}
+		err, ok := state.GetOk("error")
+		if !ok || !strings.Contains(err.(error).Error(), "switch_name") {
+			t.Fatalf("%s: bad error: %v", switchType, err)
+		}
+
+		step.Cleanup(state)
+		if driver.Called("CreateNetNat") || driver.Called("DeleteNetNat") {
+			t.Fatalf("%s: should not create a NAT network: %#v", switchType, driver.Calls)
+		}
+	}
+}
@@ -8,12 +8,12 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
 const (
 	SwitchTypeInternal = "Internal"
 	SwitchTypePrivate = "Private"
+	SwitchTypeExternal = "External"
 	DefaultSwitchType = SwitchTypeInternal
 )
 
@@ -37,7 +37,7 @@ type StepCreateSwitch struct {
 }
 
 func (s *StepCreateSwitch) Run(state multistep.StateBag) multistep.StepAction {
-	//driver := state.Get("driver").(Driver)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	if len(s.SwitchType) == 0 {
@@ -46,7 +46,7 @@ func (s *StepCreateSwitch) Run(state multistep.StateBag) multistep.StepAction {
 
 	ui.Say(fmt.Sprintf("Creating switch '%v' if required...", s.SwitchName))
 
-	createdSwitch, err := hyperv.CreateVirtualSwitch(s.SwitchName, s.SwitchType)
+	createdSwitch, err := createSwitch(driver, s.SwitchName, s.SwitchType, s.NetAdapterName, s.NetAdapterInterfaceDescription)
 	if err != nil {
 		err := fmt.Errorf("Error creating switch: %s", err)
 		state.Put("error", err)
@@ -72,12 +72,22 @@ func (s *StepCreateSwitch) Cleanup(state multistep.StateBag) {
 		return
 	}
 
-	//driver := state.Get("driver").(Driver)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say("Unregistering and deleting switch...")
 
-	err := hyperv.DeleteVirtualSwitch(s.SwitchName)
+	err := driver.DeleteVirtualSwitch(s.SwitchName)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error deleting switch: %s", err))
 	}
 }
+
+// createSwitch creates the switch named unless it already exists, bound to
+// the physical network adapter given when there is one. Returns true if
+// the switch was created.
+func createSwitch(driver Driver, switchName string, switchType string, netAdapterName string, netAdapterInterfaceDescription string) (bool, error) {
+	if netAdapterName != "" || netAdapterInterfaceDescription != "" {
+		return driver.CreateExternalVirtualSwitchOnNetAdapter(switchName, netAdapterName, netAdapterInterfaceDescription)
+	}
+	return driver.CreateVirtualSwitch(switchName, switchType)
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepCreateSwitch_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCreateSwitch)
+}
+
+func TestStepCreateSwitch(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+
+	step := &StepCreateSwitch{SwitchName: "switch"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if sw := driver.Switches["switch"]; sw == nil || sw.Type != SwitchTypeInternal {
+		t.Fatalf("bad switch: %#v", sw)
+	}
+	if name := state.Get("SwitchName"); name != "switch" {
+		t.Fatalf("bad SwitchName: %#v", name)
+	}
+
+	step.Cleanup(state)
+	if _, ok := driver.Switches["switch"]; ok {
+		t.Fatal("should delete the created switch")
+	}
+}
+
+func TestStepCreateSwitch_external(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+
+	step := &StepCreateSwitch{
+		SwitchName:                     "switch",
+		SwitchType:                     SwitchTypeExternal,
+		NetAdapterInterfaceDescription: "Fake Ethernet Adapter",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if !driver.Called("CreateExternalVirtualSwitchOnNetAdapter") {
+		t.Fatal("should create an external switch")
+	}
+	if sw := driver.Switches["switch"]; sw == nil || sw.Type != SwitchTypeExternal || sw.NetAdapterName != "Ethernet" {
+		t.Fatalf("bad switch: %#v", sw)
+	}
+}
+
+func TestStepCreateSwitch_externalExists(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+	driver.Switches["switch"] = &FakeSwitch{Name: "switch", Type: SwitchTypeExternal, NetAdapterName: "Ethernet"}
+
+	step := &StepCreateSwitch{SwitchName: "switch", SwitchType: SwitchTypeExternal, NetAdapterName: "Ethernet"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	step.Cleanup(state)
+	if _, ok := driver.Switches["switch"]; !ok {
+		t.Fatal("should not delete a switch it did not create")
+	}
+}
+
+func TestStepCreateSwitch_externalBound(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+	driver.Switches["other"] = &FakeSwitch{Name: "other", Type: SwitchTypeExternal, NetAdapterName: "Ethernet"}
+
+	step := &StepCreateSwitch{SwitchName: "switch", SwitchType: SwitchTypeExternal, NetAdapterName: "Ethernet"}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
+
+func TestStepCreateSwitch_externalExistsMismatch(t *testing.T) {
+	for _, sw := range []*FakeSwitch{
+		{Name: "switch", Type: SwitchTypeInternal},
+		{Name: "switch", Type: SwitchTypeExternal, NetAdapterName: "Wi-Fi"},
+	} {
+		state := testState(t)
+		driver := state.Get("driver").(*FakeDriver)
+		driver.Switches["switch"] = sw
+
+		step := &StepCreateSwitch{SwitchName: "switch", SwitchType: SwitchTypeExternal, NetAdapterName: "Ethernet"}
+		if action := step.Run(state); action != multistep.ActionHalt {
+			t.Fatalf("bad action: %#v", action)
+		}
+		if _, ok := state.GetOk("error"); !ok {
+			t.Fatalf("should have error: %#v", sw)
+		}
+
+		step.Cleanup(state)
+		if _, ok := driver.Switches["switch"]; !ok {
+			t.Fatal("should not delete a switch it did not create")
+		}
+	}
+}
@@ -6,38 +6,78 @@ package common
 
 import (
 	"fmt"
-	"strconv"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
+	"path/filepath"
 )
 
-// This step creates the actual virtual machine.
+// The types of the virtual hard disks.
+const (
+	DiskTypeDynamic      = "Dynamic"
+	DiskTypeFixed        = "Fixed"
+	DiskTypeDifferencing = "Differencing"
+)
+
+// The types of the controllers hard disks are attached to.
+const (
+	ControllerTypeIDE  = "IDE"
+	ControllerTypeSCSI = "SCSI"
+)
+
+// This step creates the actual virtual machine, along with its hard disks.
+//
+// Uses:
+//   packerTempDir string
 //
 // Produces:
 //   VMName string - The name of the VM
+//   generation uint - The generation of the VM
+//   disk_paths []string - The paths of the hard disks of the VM
 type StepCreateVM struct {
 	VMName string
 	SwitchName string
 	RamSizeMB uint
+	// The size of the boot disk in MB, ignored for a differencing disk.
 	DiskSize uint
+	// The type of the boot disk, DiskTypeDynamic or DiskTypeFixed.
+	// Defaults to DiskTypeDynamic.
+	DiskType string
+	// The block size of the disks in MB, or 0 for the default of Hyper-V.
+	DiskBlockSize uint
+	// The sizes in MB of the data disks attached to the SCSI controller.
+	AdditionalDiskSize []uint
+	// The path of a parent disk to create the boot disk as a differencing
+	// disk of, rather than an empty disk.
+	DifferencingDiskParent string
+	// The path of a disk to copy as the boot disk, rather than creating an
+	// empty disk.
+	SourceDiskPath string
+	// The generation of the VM, 1 for BIOS or 2 for UEFI. Defaults to 1.
+	Generation uint
+	// Secure boot settings, only used for generation 2 VMs.
+	EnableSecureBoot bool
+	SecureBootTemplate string
+
+	diskPaths []string
 }
 
 func (s *StepCreateVM) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say("Creating virtual machine...")
 
 	path :=	state.Get("packerTempDir").(string)
 
 	// convert the MB to bytes
-	ramBytes := int64(s.RamSizeMB * 1024 * 1024)
-	diskSizeBytes := int64(s.DiskSize * 1024 * 1024)
-
-	ram := strconv.FormatInt(ramBytes, 10)
-	diskSize := strconv.FormatInt(diskSizeBytes, 10)
+	ramBytes := int64(s.RamSizeMB) * 1024 * 1024
 	switchName := s.SwitchName
 
-	err := hyperv.CreateVirtualMachine(s.VMName, path, ram, diskSize, switchName)
+	generation := s.Generation
+	if generation == 0 {
+		generation = 1
+	}
+
+	err := driver.CreateVirtualMachine(s.VMName, path, ramBytes, switchName, generation)
 	if err != nil {
 		err := fmt.Errorf("Error creating virtual machine: %s", err)
 		state.Put("error", err)
@@ -45,23 +85,129 @@ func (s *StepCreateVM) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
+	if generation == 2 {
+		templateName := ""
+		if s.EnableSecureBoot {
+			templateName = s.SecureBootTemplate
+		}
+
+		err = driver.SetVirtualMachineSecureBoot(s.VMName, s.EnableSecureBoot, templateName)
+		if err != nil {
+			err := fmt.Errorf("Error setting secure boot: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
 	// Set the final name in the state bag so others can use it
 	state.Put("vmName", s.VMName)
+	state.Put("generation", generation)
+
+	// the boot disk goes on the IDE controller of a generation 1 VM, so
+	// that the BIOS can boot from it
+	controllerType := ControllerTypeSCSI
+	if generation == 1 {
+		controllerType = ControllerTypeIDE
+	}
+
+	diskType := s.DiskType
+	if diskType == "" {
+		diskType = DiskTypeDynamic
+	}
+	if s.DifferencingDiskParent != "" {
+		diskType = DiskTypeDifferencing
+	}
+
+	if s.SourceDiskPath != "" {
+		ui.Say("Copying hard disk...")
+
+		diskPath := filepath.Join(path, s.VMName + filepath.Ext(s.SourceDiskPath))
+		err = s.copyDisk(driver, s.SourceDiskPath, diskPath, controllerType)
+	} else {
+		diskPath := filepath.Join(path, s.VMName + ".vhdx")
+		err = s.addDisk(driver, diskPath, diskType, s.DiskSize, controllerType)
+	}
+	if err != nil {
+		err := fmt.Errorf("Error creating hard disk: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	for i, size := range s.AdditionalDiskSize {
+		ui.Say(fmt.Sprintf("Creating additional hard disk %d of %d MB...", i + 1, size))
+
+		diskPath := filepath.Join(path, fmt.Sprintf("%s-%d.vhdx", s.VMName, i + 1))
+		if err := s.addDisk(driver, diskPath, s.DiskType, size, ControllerTypeSCSI); err != nil {
+			err := fmt.Errorf("Error creating additional hard disk: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	state.Put("disk_paths", s.diskPaths)
 
 	return multistep.ActionContinue
 }
 
+// addDisk creates a disk and attaches it to the VM. The disk is
+// remembered as soon as it is created, so that Cleanup removes it even
+// if it could not be attached.
+func (s *StepCreateVM) addDisk(driver Driver, path string, diskType string, sizeMB uint, controllerType string) error {
+	if diskType == "" {
+		diskType = DiskTypeDynamic
+	}
+
+	sizeBytes := int64(sizeMB) * 1024 * 1024
+	blockSizeBytes := int64(s.DiskBlockSize) * 1024 * 1024
+
+	parentPath := ""
+	if diskType == DiskTypeDifferencing {
+		parentPath = s.DifferencingDiskParent
+	}
+
+	err := driver.CreateVirtualHardDisk(path, diskType, sizeBytes, blockSizeBytes, parentPath)
+	if err != nil {
+		return err
+	}
+	s.diskPaths = append(s.diskPaths, path)
+
+	return driver.AddVirtualMachineHardDiskDrive(s.VMName, path, controllerType)
+}
+
+// copyDisk copies a disk and attaches the copy to the VM.
+func (s *StepCreateVM) copyDisk(driver Driver, sourcePath string, path string, controllerType string) error {
+	err := driver.CopyVirtualHardDisk(sourcePath, path)
+	if err != nil {
+		return err
+	}
+	s.diskPaths = append(s.diskPaths, path)
+
+	return driver.AddVirtualMachineHardDiskDrive(s.VMName, path, controllerType)
+}
+
 func (s *StepCreateVM) Cleanup(state multistep.StateBag) {
 	if s.VMName == "" {
 		return
 	}
 
-	//driver := state.Get("driver").(Driver)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say("Unregistering and deleting virtual machine...")
 
-	err := hyperv.DeleteVirtualMachine(s.VMName)
+	err := driver.DeleteVirtualMachine(s.VMName)
 	if err != nil {
 		ui.Error(fmt.Sprintf("Error deleting virtual machine: %s", err))
 	}
+
+	// the disks can only be deleted once the VM no longer holds them
+	for i := len(s.diskPaths) - 1; i >= 0; i-- {
+		err := driver.DeleteVirtualHardDisk(s.diskPaths[i])
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error deleting hard disk: %s", err))
+		}
+	}
+	s.diskPaths = nil
 }
@@ -0,0 +1,283 @@
+package common
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepCreateVM_impl(t *testing.T) {
+	var _ multistep.Step = new(StepCreateVM)
+}
+
+func TestStepCreateVM(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+
+	step := &StepCreateVM{
+		VMName:     "vm",
+		SwitchName: "switch",
+		RamSizeMB:  1024,
+		DiskSize:   40 * 1024,
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	vm, ok := driver.VMs["vm"]
+	if !ok {
+		t.Fatal("VM should be created")
+	}
+	if vm.MemoryBytes != 1024*1024*1024 {
+		t.Fatalf("bad memory: %d", vm.MemoryBytes)
+	}
+	if name := state.Get("vmName").(string); name != "vm" {
+		t.Fatalf("bad vmName: %s", name)
+	}
+
+	diskPath := filepath.Join("temp", "vm.vhdx")
+	disk, ok := driver.Disks[diskPath]
+	if !ok || disk.Type != DiskTypeDynamic || disk.SizeBytes != 40*1024*1024*1024 || disk.BlockSizeBytes != 0 {
+		t.Fatalf("bad disk: %#v", disk)
+	}
+
+	// the boot disk of a generation 1 VM is on the first IDE location
+	expected := []*FakeHardDiskDrive{{ControllerType: ControllerTypeIDE, Path: diskPath}}
+	if !reflect.DeepEqual(vm.HardDiskDrives, expected) {
+		t.Fatalf("bad drives: %#v", vm.HardDiskDrives)
+	}
+	if paths := state.Get("disk_paths").([]string); !reflect.DeepEqual(paths, []string{diskPath}) {
+		t.Fatalf("bad disk_paths: %#v", paths)
+	}
+
+	step.Cleanup(state)
+	if _, ok := driver.VMs["vm"]; ok {
+		t.Fatal("VM should be deleted")
+	}
+	if len(driver.Disks) != 0 {
+		t.Fatalf("disks should be deleted: %#v", driver.Disks)
+	}
+}
+
+func TestStepCreateVM_additionalDisks(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+
+	step := &StepCreateVM{
+		VMName:             "vm",
+		SwitchName:         "switch",
+		DiskSize:           40 * 1024,
+		DiskType:           DiskTypeFixed,
+		DiskBlockSize:      1,
+		AdditionalDiskSize: []uint{1024, 2048},
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	paths := []string{
+		filepath.Join("temp", "vm.vhdx"),
+		filepath.Join("temp", "vm-1.vhdx"),
+		filepath.Join("temp", "vm-2.vhdx"),
+	}
+	sizes := []int64{40 * 1024 * 1024 * 1024, 1024 * 1024 * 1024, 2048 * 1024 * 1024}
+
+	for i, path := range paths {
+		disk, ok := driver.Disks[path]
+		if !ok || disk.Type != DiskTypeFixed || disk.SizeBytes != sizes[i] || disk.BlockSizeBytes != 1024*1024 {
+			t.Fatalf("bad disk %s: %#v", path, disk)
+		}
+	}
+
+	// the data disks go on a SCSI controller added to the generation 1 VM
+	vm := driver.VMs["vm"]
+	expected := []*FakeHardDiskDrive{
+		{ControllerType: ControllerTypeIDE, Path: paths[0]},
+		{ControllerType: ControllerTypeSCSI, Path: paths[1]},
+		{ControllerType: ControllerTypeSCSI, ControllerLocation: 1, Path: paths[2]},
+	}
+	if !reflect.DeepEqual(vm.HardDiskDrives, expected) || vm.ScsiControllers != 1 {
+		t.Fatalf("bad drives: %#v", vm.HardDiskDrives)
+	}
+	if actual := state.Get("disk_paths").([]string); !reflect.DeepEqual(actual, paths) {
+		t.Fatalf("bad disk_paths: %#v", actual)
+	}
+
+	step.Cleanup(state)
+	if len(driver.Disks) != 0 {
+		t.Fatalf("disks should be deleted: %#v", driver.Disks)
+	}
+}
+
+func TestStepCreateVM_differencingDisk(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	driver.CreateVirtualHardDisk("parent.vhdx", DiskTypeDynamic, 60*1024*1024*1024, 0, "")
+
+	step := &StepCreateVM{
+		VMName:                 "vm",
+		SwitchName:             "switch",
+		DiskSize:               40 * 1024,
+		Generation:             2,
+		DifferencingDiskParent: "parent.vhdx",
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	diskPath := filepath.Join("temp", "vm.vhdx")
+	disk := driver.Disks[diskPath]
+	if disk.Type != DiskTypeDifferencing || disk.ParentPath != "parent.vhdx" || disk.SizeBytes != 60*1024*1024*1024 {
+		t.Fatalf("bad disk: %#v", disk)
+	}
+
+	// the boot disk of a generation 2 VM is on its SCSI controller
+	vm := driver.VMs["vm"]
+	if len(vm.HardDiskDrives) != 1 || vm.HardDiskDrives[0].ControllerType != ControllerTypeSCSI {
+		t.Fatalf("bad drives: %#v", vm.HardDiskDrives)
+	}
+
+	// the parent disk is left alone
+	step.Cleanup(state)
+	if _, ok := driver.Disks[diskPath]; ok {
+		t.Fatal("differencing disk should be deleted")
+	}
+	if _, ok := driver.Disks["parent.vhdx"]; !ok {
+		t.Fatal("parent disk should be kept")
+	}
+}
+
+func TestStepCreateVM_sourceDisk(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	driver.CreateVirtualHardDisk("base.vhd", DiskTypeFixed, 60*1024*1024*1024, 0, "")
+
+	step := &StepCreateVM{
+		VMName:         "vm",
+		SwitchName:     "switch",
+		SourceDiskPath: "base.vhd",
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	// the copy keeps the format of the disk it is copied from
+	diskPath := filepath.Join("temp", "vm.vhd")
+	disk, ok := driver.Disks[diskPath]
+	if !ok || disk.Type != DiskTypeFixed || disk.SizeBytes != 60*1024*1024*1024 {
+		t.Fatalf("bad disk: %#v", disk)
+	}
+	if generation := state.Get("generation").(uint); generation != 1 {
+		t.Fatalf("bad generation: %d", generation)
+	}
+
+	step.Cleanup(state)
+	if _, ok := driver.Disks[diskPath]; ok {
+		t.Fatal("copy should be deleted")
+	}
+	if _, ok := driver.Disks["base.vhd"]; !ok {
+		t.Fatal("source disk should be kept")
+	}
+}
+
+func TestStepCreateVM_diskError(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	driver.FailOn("AddVirtualMachineHardDiskDrive", errors.New("boom"))
+
+	step := &StepCreateVM{VMName: "vm", SwitchName: "switch", DiskSize: 40 * 1024}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+
+	// a disk created but not attached is still cleaned up
+	step.Cleanup(state)
+	if len(driver.VMs) != 0 || len(driver.Disks) != 0 {
+		t.Fatalf("should clean up: %#v %#v", driver.VMs, driver.Disks)
+	}
+}
+
+func TestStepCreateVM_error(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+	driver.FailOn("CreateVirtualMachine", errors.New("boom"))
+
+	step := &StepCreateVM{VMName: "vm", SwitchName: "switch"}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	if _, ok := state.GetOk("vmName"); ok {
+		t.Fatal("vmName should not be set")
+	}
+}
+
+func TestStepCreateVM_generation2(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+
+	step := &StepCreateVM{
+		VMName:             "vm",
+		SwitchName:         "switch",
+		DiskSize:           40 * 1024,
+		Generation:         2,
+		EnableSecureBoot:   true,
+		SecureBootTemplate: "MicrosoftUEFICertificateAuthority",
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vm := driver.VMs["vm"]
+	if vm.Generation != 2 || !vm.SecureBoot || vm.SecureBootTemplate != "MicrosoftUEFICertificateAuthority" {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+
+	// secure boot is turned off unless it is asked for
+	state = testState(t)
+	state.Put("packerTempDir", "temp")
+	driver = state.Get("driver").(*FakeDriver)
+	driver.CreateVirtualSwitch("switch", SwitchTypeInternal)
+
+	step = &StepCreateVM{VMName: "vm", SwitchName: "switch", DiskSize: 40 * 1024, Generation: 2, SecureBootTemplate: "MicrosoftWindows"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vm = driver.VMs["vm"]
+	if vm.SecureBoot || vm.SecureBootTemplate != "" {
+		t.Fatalf("bad VM: %#v", vm)
+	}
+}
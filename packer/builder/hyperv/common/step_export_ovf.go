@@ -0,0 +1,186 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/convert"
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/ovf"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// The directory of the output directory holding the OVF package.
+const OvfDir string = "OVF"
+
+// This step writes an OVF package of the VM exported to the output
+// directory: its descriptor, its hard disks as stream optimized VMDK
+// files and the manifest of their digests, or a single OVA file holding
+// them.
+//
+// Uses:
+//   driver Driver
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   <nothing>
+type StepExportOvf struct {
+	OVF bool
+	OVA bool
+
+	OutputDir string
+	// The hardware of the VM as configured, read from the VM when 0.
+	MemoryMB   uint
+	Generation uint
+	// The switches the network adapters of the VM are connected to, in
+	// order.
+	SwitchNames []string
+}
+
+func (s *StepExportOvf) Run(state multistep.StateBag) multistep.StepAction {
+	if !s.OVF && !s.OVA {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	ui.Say("Writing the OVF package...")
+
+	if err := s.writePackage(driver, ui, vmName); err != nil {
+		err := fmt.Errorf("Error writing the OVF package: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepExportOvf) writePackage(driver Driver, ui packer.Ui, vmName string) error {
+	descriptor := &ovf.Descriptor{
+		Name:       vmName,
+		Generation: s.Generation,
+		MemoryMB:   int64(s.MemoryMB),
+		Networks:   s.SwitchNames,
+	}
+
+	var err error
+	if descriptor.CPUs, err = driver.GetVirtualMachineProcessorCount(vmName); err != nil {
+		return err
+	}
+
+	if descriptor.MemoryMB == 0 {
+		memory, err := driver.GetVirtualMachineMemory(vmName)
+		if err != nil {
+			return err
+		}
+		descriptor.MemoryMB = memory / (1024 * 1024)
+	}
+
+	if descriptor.Generation == 0 {
+		if descriptor.Generation, err = driver.GetVirtualMachineGeneration(vmName); err != nil {
+			return err
+		}
+	}
+
+	paths, err := driver.GetVirtualMachineHardDiskPaths(vmName)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.OutputDir, OvfDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var diskFiles []string
+	for i, path := range paths {
+		name := fmt.Sprintf("%s-disk%d.vmdk", vmName, i+1)
+		ui.Message(fmt.Sprintf("Converting hard disk %s to %s...", filepath.Base(path), name))
+
+		disk, err := writeOvfDisk(filepath.Join(s.OutputDir, VhdDir, filepath.Base(path)), filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		descriptor.Disks = append(descriptor.Disks, disk)
+		diskFiles = append(diskFiles, filepath.Join(dir, name))
+	}
+
+	contents, err := descriptor.Marshal()
+	if err != nil {
+		return err
+	}
+
+	descriptorPath := filepath.Join(dir, vmName+".ovf")
+	if err := ioutil.WriteFile(descriptorPath, contents, 0644); err != nil {
+		return err
+	}
+
+	manifest, err := ovf.Manifest(append([]string{descriptorPath}, diskFiles...))
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(dir, vmName+".mf")
+	if err := ioutil.WriteFile(manifestPath, manifest, 0644); err != nil {
+		return err
+	}
+
+	if !s.OVA {
+		return nil
+	}
+
+	ui.Message(fmt.Sprintf("Writing %s.ova...", vmName))
+
+	files := append([]string{descriptorPath, manifestPath}, diskFiles...)
+	if err := ovf.WriteOVA(filepath.Join(dir, vmName+".ova"), files); err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeOvfDisk converts the exported hard disk at path to the VMDK file
+// at vmdkPath, and returns its description.
+func writeOvfDisk(path string, vmdkPath string) (ovf.Disk, error) {
+	disk, err := openExportedDisk(path)
+	if err != nil {
+		return ovf.Disk{}, err
+	}
+	defer disk.Close()
+
+	if err := convert.Convert(vmdkPath, disk, convert.FormatVMDK); err != nil {
+		return ovf.Disk{}, err
+	}
+
+	info, err := os.Stat(vmdkPath)
+	if err != nil {
+		return ovf.Disk{}, err
+	}
+
+	return ovf.Disk{
+		File:          filepath.Base(vmdkPath),
+		FileSize:      info.Size(),
+		Format:        ovf.DiskFormatVMDK,
+		Capacity:      disk.Size(),
+		PopulatedSize: disk.AllocatedSize(),
+	}, nil
+}
+
+func (s *StepExportOvf) Cleanup(state multistep.StateBag) {}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/vhdx"
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepExportOvf_impl(t *testing.T) {
+	var _ multistep.Step = new(StepExportOvf)
+}
+
+// testExportedDisk returns an output directory holding the boot disk of
+// the VM of testStateWithVM, as StepExportVm leaves it.
+func testExportedDisk(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, VhdDir), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	disk, err := vhdx.Create(filepath.Join(dir, VhdDir, "vm.vhdx"), vhdx.CreateOptions{VirtualSize: 8 * vhdx.MB})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := disk.WriteAt([]byte("packer"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return dir
+}
+
+func testDirNames(t *testing.T, dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names
+}
+
+func TestStepExportOvf(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	dir := testExportedDisk(t)
+	defer os.RemoveAll(dir)
+
+	step := &StepExportOvf{
+		OVF:         true,
+		OutputDir:   dir,
+		MemoryMB:    2048,
+		Generation:  1,
+		SwitchNames: []string{"switch"},
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	names := testDirNames(t, filepath.Join(dir, OvfDir))
+	if !reflect.DeepEqual(names, []string{"vm-disk1.vmdk", "vm.mf", "vm.ovf"}) {
+		t.Fatalf("bad files: %#v", names)
+	}
+
+	descriptor, err := ioutil.ReadFile(filepath.Join(dir, OvfDir, "vm.ovf"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, s := range []string{
+		`ovf:href="vm-disk1.vmdk"`,
+		`ovf:capacity="8388608"`,
+		"<vssd:VirtualSystemType>Microsoft:Hyper-V:SubType:1</vssd:VirtualSystemType>",
+		"<rasd:ElementName>1 virtual CPU(s)</rasd:ElementName>",
+		"<rasd:ElementName>2048 MB of memory</rasd:ElementName>",
+		"<rasd:Connection>switch</rasd:Connection>",
+	} {
+		if !strings.Contains(string(descriptor), s) {
+			t.Fatalf("descriptor should contain %s:\n%s", s, descriptor)
+		}
+	}
+
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, OvfDir, "vm.mf"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.HasPrefix(string(manifest), "SHA256(vm.ovf)= ") || !strings.Contains(string(manifest), "SHA256(vm-disk1.vmdk)= ") {
+		t.Fatalf("bad manifest: %s", manifest)
+	}
+
+	if driver.Called("GetVirtualMachineMemory") || driver.Called("GetVirtualMachineGeneration") {
+		t.Fatal("should not read the configured hardware from the VM")
+	}
+}
+
+func TestStepExportOvf_ova(t *testing.T) {
+	state, driver := testStateWithGeneration2VM(t)
+	dir := testExportedDisk(t)
+	defer os.RemoveAll(dir)
+
+	// a clone keeping the hardware of its VM
+	driver.VMs["vm"].MemoryBytes = 4096 * 1024 * 1024
+	driver.VMs["vm"].ProcessorCount = 4
+
+	step := &StepExportOvf{OVA: true, OutputDir: dir, SwitchNames: []string{"switch"}}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	names := testDirNames(t, filepath.Join(dir, OvfDir))
+	if !reflect.DeepEqual(names, []string{"vm.ova"}) {
+		t.Fatalf("bad files: %#v", names)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(dir, OvfDir, "vm.ova"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, s := range []string{
+		"Microsoft:Hyper-V:SubType:2",
+		"4 virtual CPU(s)",
+		"4096 MB of memory",
+	} {
+		if !strings.Contains(string(contents), s) {
+			t.Fatalf("the package should contain %s", s)
+		}
+	}
+}
+
+func TestStepExportOvf_disabled(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := &StepExportOvf{OutputDir: "output"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if driver.Called("GetVirtualMachineHardDiskPaths") {
+		t.Fatal("should do nothing")
+	}
+}
+
+func TestStepExportOvf_missingDisk(t *testing.T) {
+	state, _ := testStateWithVM(t)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	step := &StepExportOvf{OVF: true, OutputDir: dir, MemoryMB: 1024, SwitchNames: []string{"switch"}}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
@@ -10,12 +10,12 @@ import (
 	"io/ioutil"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
+// The directories of an exported VM, which the output directory holds.
 const(
-	vhdDir string = "Virtual Hard Disks"
-	vmDir string = "Virtual Machines"
+	VhdDir string = "Virtual Hard Disks"
+	VmDir string = "Virtual Machines"
 )
 
 type StepExportVm struct {
@@ -23,6 +23,7 @@ type StepExportVm struct {
 }
 
 func (s *StepExportVm) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	var err error
@@ -44,7 +45,7 @@ func (s *StepExportVm) Run(state multistep.StateBag) multistep.StepAction {
 
 	ui.Say("Exporting vm...")
 
-	err = hyperv.ExportVirtualMachine(vmName, vmExportPath)
+	err = driver.ExportVirtualMachine(vmName, vmExportPath)
 	if err != nil {
 		errorMsg = "Error exporting vm: %s"
 		err := fmt.Errorf(errorMsg, err)
@@ -57,7 +58,7 @@ func (s *StepExportVm) Run(state multistep.StateBag) multistep.StepAction {
 	expPath := filepath.Join(vmExportPath,vmName)
 
 	ui.Say("Coping to output dir...")
-	err = hyperv.CopyExportedVirtualMachine(expPath, outputPath, vhdDir, vmDir)
+	err = driver.CopyExportedVirtualMachine(expPath, outputPath, VhdDir, VmDir)
 	if err != nil {
 		errorMsg = "Error exporting vm: %s"
 		err := fmt.Errorf(errorMsg, err)
@@ -0,0 +1,83 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step wraps the communicator, so the commands the provisioners run
+// on the VM have the address of the HTTP server in the PACKER_HTTP_IP,
+// PACKER_HTTP_PORT and PACKER_HTTP_ADDR environment variables. They are
+// set in the shell of the communicator: sh for ssh and cmd.exe for winrm.
+// Without an HTTP server, the communicator is left as it is.
+//
+// Uses:
+//   communicator packer.Communicator
+//   http_ip string
+//   http_port uint
+//
+// Produces:
+//   communicator packer.Communicator - The communicator setting the variables
+type StepHTTPEnvironment struct {
+	Communicator string
+}
+
+func (s *StepHTTPEnvironment) Run(state multistep.StateBag) multistep.StepAction {
+	httpIP, _ := state.Get("http_ip").(string)
+	httpPort, _ := state.Get("http_port").(uint)
+	if httpPort == 0 {
+		return multistep.ActionContinue
+	}
+
+	comm := state.Get("communicator").(packer.Communicator)
+	state.Put("communicator", &httpEnvironmentCommunicator{
+		Communicator: comm,
+		environment:  s.environment(httpIP, httpPort),
+	})
+
+	return multistep.ActionContinue
+}
+
+func (s *StepHTTPEnvironment) Cleanup(state multistep.StateBag) {
+}
+
+// environment returns the shell commands setting the variables, to be put
+// before a command.
+func (s *StepHTTPEnvironment) environment(ip string, port uint) string {
+	vars := [][2]string{
+		{"PACKER_HTTP_IP", ip},
+		{"PACKER_HTTP_PORT", strconv.Itoa(int(port))},
+		{"PACKER_HTTP_ADDR", net.JoinHostPort(ip, strconv.Itoa(int(port)))},
+	}
+
+	var environment string
+	for _, v := range vars {
+		if s.Communicator == "winrm" {
+			environment += fmt.Sprintf(`set "%s=%s" && `, v[0], v[1])
+		} else {
+			environment += fmt.Sprintf("export %s='%s'; ", v[0], v[1])
+		}
+	}
+	return environment
+}
+
+// httpEnvironmentCommunicator is a communicator putting the environment
+// before the commands it starts. The communicator may read the command
+// once Start returns, so it is left changed.
+type httpEnvironmentCommunicator struct {
+	packer.Communicator
+	environment string
+}
+
+func (c *httpEnvironmentCommunicator) Start(cmd *packer.RemoteCmd) error {
+	cmd.Command = c.environment + cmd.Command
+	return c.Communicator.Start(cmd)
+}
@@ -0,0 +1,68 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+func TestStepHTTPEnvironment_impl(t *testing.T) {
+	var _ multistep.Step = new(StepHTTPEnvironment)
+}
+
+func testStepHTTPEnvironment(t *testing.T, communicator string) string {
+	state := testState(t)
+	state.Put("http_ip", "192.168.0.1")
+	state.Put("http_port", uint(8080))
+	comm := new(packer.MockCommunicator)
+	state.Put("communicator", comm)
+
+	step := &StepHTTPEnvironment{Communicator: communicator}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	cmd := &packer.RemoteCmd{Command: "setup"}
+	if err := state.Get("communicator").(packer.Communicator).Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return comm.StartCmd.Command
+}
+
+func TestStepHTTPEnvironment_ssh(t *testing.T) {
+	command := testStepHTTPEnvironment(t, "ssh")
+
+	expected := "export PACKER_HTTP_IP='192.168.0.1'; export PACKER_HTTP_PORT='8080'; " +
+		"export PACKER_HTTP_ADDR='192.168.0.1:8080'; setup"
+	if command != expected {
+		t.Fatalf("bad command: %s", command)
+	}
+}
+
+func TestStepHTTPEnvironment_winrm(t *testing.T) {
+	command := testStepHTTPEnvironment(t, "winrm")
+
+	expected := `set "PACKER_HTTP_IP=192.168.0.1" && set "PACKER_HTTP_PORT=8080" && ` +
+		`set "PACKER_HTTP_ADDR=192.168.0.1:8080" && setup`
+	if command != expected {
+		t.Fatalf("bad command: %s", command)
+	}
+}
+
+func TestStepHTTPEnvironment_noServer(t *testing.T) {
+	state := testState(t)
+	state.Put("http_ip", "")
+	state.Put("http_port", uint(0))
+	comm := new(packer.MockCommunicator)
+	state.Put("communicator", comm)
+
+	step := &StepHTTPEnvironment{Communicator: "ssh"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if state.Get("communicator") != comm {
+		t.Fatal("should leave the communicator")
+	}
+}
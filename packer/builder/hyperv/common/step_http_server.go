@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step serves the http_directory over HTTP, on a port picked at
+// random from the range given, until cleanup. It finds the address the VM
+// reaches the server at: the bind address, or else the address of the host
+// on the switch of the VM, failing when the host has none.
+//
+// Uses:
+//   driver Driver
+//   ui packer.Ui
+//
+// Produces:
+//   http_ip string - The address of the HTTP server, or empty without one
+//   http_port uint - The port of the HTTP server, or 0 without one
+type StepHTTPServer struct {
+	HTTPDir     string
+	HTTPPortMin uint
+	HTTPPortMax uint
+	HTTPAddress string
+
+	// The switch the VM reaches the host through.
+	SwitchName string
+
+	l net.Listener
+}
+
+func (s *StepHTTPServer) Run(state multistep.StateBag) multistep.StepAction {
+	if s.HTTPDir == "" {
+		state.Put("http_ip", "")
+		state.Put("http_port", uint(0))
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+
+	port, err := s.listen()
+	if err != nil {
+		err := fmt.Errorf("Error starting the HTTP server: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	ip := s.HTTPAddress
+	if net.ParseIP(ip).IsUnspecified() {
+		ip, err = driver.GetHostAdapterIpAddressForSwitch(s.SwitchName)
+		if err == nil && ip == "" {
+			err = fmt.Errorf("The host has no address on switch '%s'", s.SwitchName)
+		}
+		if err != nil {
+			err := fmt.Errorf("Error finding the address the VM reaches the HTTP server at, set http_bind_address: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Serving %s at http://%s...", s.HTTPDir, net.JoinHostPort(ip, strconv.Itoa(int(port)))))
+
+	state.Put("http_ip", ip)
+	state.Put("http_port", port)
+	return multistep.ActionContinue
+}
+
+// listen starts the server on a port of the range that is free, trying
+// them in a random order.
+func (s *StepHTTPServer) listen() (uint, error) {
+	var err error
+	for _, i := range rand.Perm(int(s.HTTPPortMax-s.HTTPPortMin) + 1) {
+		port := s.HTTPPortMin + uint(i)
+		s.l, err = net.Listen("tcp", net.JoinHostPort(s.HTTPAddress, strconv.Itoa(int(port))))
+		if err != nil {
+			continue
+		}
+
+		server := &http.Server{Handler: http.FileServer(http.Dir(s.HTTPDir))}
+		go func(l net.Listener) {
+			log.Println(fmt.Sprintf("HTTP server stopped: %s", server.Serve(l)))
+		}(s.l)
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("No port from %v to %v is free: %s", s.HTTPPortMin, s.HTTPPortMax, err)
+}
+
+func (s *StepHTTPServer) Cleanup(state multistep.StateBag) {
+	if s.l != nil {
+		s.l.Close()
+	}
+}
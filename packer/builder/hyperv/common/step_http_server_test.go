@@ -0,0 +1,163 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepHTTPServer_impl(t *testing.T) {
+	var _ multistep.Step = new(StepHTTPServer)
+}
+
+func TestStepHTTPServer(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+	driver.HostIPAddresses["switch"] = "192.168.1.10"
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "ks.cfg"), []byte("install"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := &StepHTTPServer{
+		HTTPDir:     dir,
+		HTTPPortMin: 20000,
+		HTTPPortMax: 20100,
+		HTTPAddress: "0.0.0.0",
+		SwitchName:  "switch",
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	defer step.Cleanup(state)
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	if ip := state.Get("http_ip"); ip != "192.168.1.10" {
+		t.Fatalf("bad http_ip: %#v", ip)
+	}
+	port := state.Get("http_port").(uint)
+	if port < 20000 || port > 20100 {
+		t.Fatalf("bad http_port: %d", port)
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/ks.cfg", port))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(body) != "install" {
+		t.Fatalf("bad body: %s", body)
+	}
+}
+
+func TestStepHTTPServer_bindAddress(t *testing.T) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	step := &StepHTTPServer{HTTPDir: dir, HTTPPortMin: 20000, HTTPPortMax: 20100, HTTPAddress: "127.0.0.1"}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if ip := state.Get("http_ip"); ip != "127.0.0.1" {
+		t.Fatalf("bad http_ip: %#v", ip)
+	}
+	if driver.Called("GetHostAdapterIpAddressForSwitch") {
+		t.Fatal("should not look up the address of the host")
+	}
+
+	step.Cleanup(state)
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", state.Get("http_port"))); err == nil {
+		t.Fatal("should stop the server")
+	}
+}
+
+func TestStepHTTPServer_noHostAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, failOn := range []bool{false, true} {
+		state := testState(t)
+		driver := state.Get("driver").(*FakeDriver)
+		if failOn {
+			driver.FailOn("GetHostAdapterIpAddressForSwitch", errors.New("Get-NetIPAddress failed"))
+		}
+
+		step := &StepHTTPServer{HTTPDir: dir, HTTPPortMin: 20000, HTTPPortMax: 20100, HTTPAddress: "0.0.0.0", SwitchName: "switch"}
+		if action := step.Run(state); action != multistep.ActionHalt {
+			t.Fatalf("bad action: %#v", action)
+		}
+		err, ok := state.GetOk("error")
+		if !ok {
+			t.Fatal("should have error")
+		}
+		if !strings.Contains(err.(error).Error(), "http_bind_address") || strings.Contains(err.(error).Error(), "<nil>") {
+			t.Fatalf("bad error: %s", err)
+		}
+
+		step.Cleanup(state)
+	}
+}
+
+func TestStepHTTPServer_portsTaken(t *testing.T) {
+	state := testState(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer l.Close()
+	port := uint(l.Addr().(*net.TCPAddr).Port)
+
+	step := &StepHTTPServer{HTTPDir: ".", HTTPPortMin: port, HTTPPortMax: port, HTTPAddress: "127.0.0.1"}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
+
+func TestStepHTTPServer_none(t *testing.T) {
+	state := testState(t)
+
+	step := new(StepHTTPServer)
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	step.Cleanup(state)
+
+	if port := state.Get("http_port"); port != uint(0) {
+		t.Fatalf("bad http_port: %#v", port)
+	}
+}
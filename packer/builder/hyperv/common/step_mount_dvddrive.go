@@ -8,26 +8,40 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
 
+// This step mounts the ISO at iso_path as the dvd drive of the VM.
+// Generation 2 VMs have no dvd drive to begin with, so one is added to
+// the SCSI controller and made the first boot device.
+//
+// Uses:
+//   driver Driver
+//   iso_path string
+//   ui packer.Ui
+//   vmName string
 type StepMountDvdDrive struct {
-	RawSingleISOUrl string
+	Generation uint
 	path string
 }
 
 func (s *StepMountDvdDrive) Run(state multistep.StateBag) multistep.StepAction {
-	//driver := state.Get("driver").(Driver)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	errorMsg := "Error mounting dvd drive: %s"
 	vmName := state.Get("vmName").(string)
-	isoPath := s.RawSingleISOUrl
+	isoPath := state.Get("iso_path").(string)
 
 	ui.Say("Mounting dvd drive...")
 
-	err := hyperv.MountDvdDrive(vmName, isoPath)
+	var err error
+	if s.Generation == 2 {
+		err = s.addBootDvdDrive(driver, vmName, isoPath)
+	} else {
+		err = driver.MountDvdDrive(vmName, isoPath)
+	}
+
 	if err != nil {
 		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
@@ -40,6 +54,15 @@ func (s *StepMountDvdDrive) Run(state multistep.StateBag) multistep.StepAction {
 	return multistep.ActionContinue
 }
 
+func (s *StepMountDvdDrive) addBootDvdDrive(driver Driver, vmName string, isoPath string) error {
+	controllerNumber, controllerLocation, err := driver.CreateDvdDrive(vmName, isoPath)
+	if err != nil {
+		return err
+	}
+
+	return driver.SetBootDvdDrive(vmName, controllerNumber, controllerLocation)
+}
+
 func (s *StepMountDvdDrive) Cleanup(state multistep.StateBag) {
 	if s.path == "" {
 		return
@@ -47,12 +70,13 @@ func (s *StepMountDvdDrive) Cleanup(state multistep.StateBag) {
 
 	errorMsg := "Error unmounting dvd drive: %s"
 
+	driver := state.Get("driver").(Driver)
 	vmName := state.Get("vmName").(string)
 	ui := state.Get("ui").(packer.Ui)
 
 	ui.Say("Unmounting dvd drive...")
 
-	err := hyperv.UnmountDvdDrive(vmName)
+	err := driver.UnmountDvdDrive(vmName)
 	if err != nil {
 		ui.Error(fmt.Sprintf(errorMsg, err))
 	}
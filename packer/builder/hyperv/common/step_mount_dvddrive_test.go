@@ -0,0 +1,99 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepMountDvdDrive_impl(t *testing.T) {
+	var _ multistep.Step = new(StepMountDvdDrive)
+}
+
+func TestStepMountDvdDrive(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	state.Put("iso_path", "install.iso")
+
+	step := &StepMountDvdDrive{}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vm := driver.VMs["vm"]
+	if len(vm.DvdDrives) != 1 || vm.DvdDrives[0].Path != "install.iso" {
+		t.Fatalf("bad drives: %#v", vm.DvdDrives)
+	}
+
+	step.Cleanup(state)
+	if vm.DvdDrives[0].Path != "" {
+		t.Fatal("should be unmounted")
+	}
+}
+
+func TestStepMountDvdDrive_generation2(t *testing.T) {
+	state, driver := testStateWithGeneration2VM(t)
+	state.Put("iso_path", "install.iso")
+
+	step := &StepMountDvdDrive{Generation: 2}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	vm := driver.VMs["vm"]
+	if len(vm.DvdDrives) != 1 || vm.DvdDrives[0].Path != "install.iso" {
+		t.Fatalf("bad drives: %#v", vm.DvdDrives)
+	}
+
+	if vm.BootDvdDrive != vm.DvdDrives[0] {
+		t.Fatal("should boot from the dvd drive")
+	}
+}
+
+func TestStepMountSecondaryDvdImages(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	state.Put("cd_path", "cd.iso")
+
+	step := &StepMountSecondaryDvdImages{Files: []string{"drivers.iso"}}
+	if action := step.Run(state); action == multistep.ActionContinue {
+		t.Fatal("generation 1 VMs have room for only two secondary images")
+	}
+
+	state, driver = testStateWithVM(t)
+	step = &StepMountSecondaryDvdImages{Files: []string{"drivers.iso"}}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	properties := state.Get("secondary.dvd.properties").([]DvdControllerProperties)
+	if len(properties) != 2 {
+		t.Fatalf("bad properties: %#v", properties)
+	}
+
+	if drive := driver.VMs["vm"].dvdDrive(properties[1].ControllerNumber, properties[1].ControllerLocation); drive.Path != "drivers.iso" {
+		t.Fatalf("bad drive: %#v", drive)
+	}
+}
+
+func TestStepMountSecondaryDvdImages_generation2(t *testing.T) {
+	state, driver := testStateWithGeneration2VM(t)
+	state.Put("cd_path", "cd.iso")
+
+	step := &StepMountSecondaryDvdImages{Files: []string{"drivers.iso"}, Generation: 2}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	// no integration services setup disk, the cd and then the files
+	var paths []string
+	for _, drive := range driver.VMs["vm"].DvdDrives {
+		paths = append(paths, drive.Path)
+	}
+
+	if len(paths) != 2 || paths[0] != "cd.iso" || paths[1] != "drivers.iso" {
+		t.Fatalf("bad paths: %#v", paths)
+	}
+
+	if len(state.Get("secondary.dvd.properties").([]DvdControllerProperties)) != 2 {
+		t.Fatal("should have the properties of both drives")
+	}
+}
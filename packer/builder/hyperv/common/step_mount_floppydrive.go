@@ -11,7 +11,6 @@ import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	"github.com/MSOpenTech/packer-hyperv/packer/powershell"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 	"log"
 	"io"
 	"io/ioutil"
@@ -100,6 +99,7 @@ func (s *StepSetUnattendedProductKey) Cleanup(state multistep.StateBag) {
 
 type StepMountFloppydrive struct {
 	floppyPath string
+	copyPath string
 }
 
 func (s *StepMountFloppydrive) Run(state multistep.StateBag) multistep.StepAction {
@@ -115,18 +115,24 @@ func (s *StepMountFloppydrive) Run(state multistep.StateBag) multistep.StepActio
 	// Hyper-V is really dumb and can't figure out the format of the file
 	// without an extension, so we need to add the "vfd" extension to the
 	// floppy.
-	floppyPath, err := s.copyFloppy(floppyPath)
-	if err != nil {
-		state.Put("error", fmt.Errorf("Error preparing floppy: %s", err))
-		return multistep.ActionHalt
-	}	
+	if !strings.EqualFold(filepath.Ext(floppyPath), ".vfd") {
+		copyPath, err := s.copyFloppy(floppyPath)
+		if err != nil {
+			state.Put("error", fmt.Errorf("Error preparing floppy: %s", err))
+			return multistep.ActionHalt
+		}
+
+		s.copyPath = copyPath
+		floppyPath = copyPath
+	}
 
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	vmName := state.Get("vmName").(string)
 
 	ui.Say("Mounting floppy drive...")
 
-	err = hyperv.MountFloppyDrive(vmName, floppyPath)
+	err := driver.MountFloppyDrive(vmName, floppyPath)
 	if err != nil {
 		state.Put("error", fmt.Errorf("Error mounting floppy drive: %s", err))
 		return multistep.ActionHalt
@@ -144,20 +150,24 @@ func (s *StepMountFloppydrive) Cleanup(state multistep.StateBag) {
 
 	errorMsg := "Error unmounting floppy drive: %s"
 
+	driver := state.Get("driver").(Driver)
 	vmName := state.Get("vmName").(string)
 	ui := state.Get("ui").(packer.Ui)
 
 	ui.Say("Unmounting floppy drive (cleanup)...")
 
-	err := hyperv.UnmountFloppyDrive(vmName)
+	err := driver.UnmountFloppyDrive(vmName)
 	if err != nil {
 		ui.Error(fmt.Sprintf(errorMsg, err))
 	}
 
-	err = os.Remove(s.floppyPath)
+	// Remove the copy with the "vfd" extension, if one was made
+	if s.copyPath != "" {
+		err = os.RemoveAll(filepath.Dir(s.copyPath))
 
-	if err != nil {
-		ui.Error(fmt.Sprintf(errorMsg, err))
+		if err != nil {
+			ui.Error(fmt.Sprintf(errorMsg, err))
+		}
 	}
 }
 
@@ -10,38 +10,57 @@ import (
 	"os"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
 )
 
+// This step adds a DVD drive for the integration services setup disk,
+// the ISO at cd_path if there is one, and each of the Files.
+//
+// Uses:
+//   cd_path string
+//   driver Driver
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   secondary.dvd.properties []DvdControllerProperties
 type StepMountSecondaryDvdImages struct {
 	Files [] string
+	// Generation 2 VMs have the integration services built in, so no
+	// setup disk is added for them.
+	Generation uint
 	dvdProperties []DvdControllerProperties
 }
 
 type DvdControllerProperties struct {
-	ControllerNumber string
-	ControllerLocation string
+	ControllerNumber uint
+	ControllerLocation uint
 }
 
 func (s *StepMountSecondaryDvdImages) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say("Mounting secondary DVD images...")
 
 	vmName := state.Get("vmName").(string)
 
-	// should be able to mount up to 60 additional iso images using SCSI
-	// but Windows would only allow a max of 22 due to available drive letters
-	// Will Windows assign DVD drives to A: and B: ?
-
 	// For IDE, there are only 2 controllers (0,1) with 2 locations each (0,1)
-	dvdProperties, err := s.mountFiles(vmName);
+	// and the hard disk and install dvd take two of them. Generation 2 VMs
+	// can mount up to 63 images on the SCSI controller, but Windows would
+	// only allow a max of 22 due to available drive letters.
+	var files []string
+	if cdPath, ok := state.GetOk("cd_path"); ok {
+		files = append(files, cdPath.(string))
+	}
+	files = append(files, s.Files...)
+
+	dvdProperties, err := s.mountFiles(driver, vmName, files);
 	if err != nil {
 		state.Put("error", err)
 		ui.Error(err.Error())
 		return multistep.ActionHalt
 	}
 	
-	log.Println(fmt.Sprintf("Saving DVD properties %s DVDs", len(dvdProperties)))
+	log.Println(fmt.Sprintf("Saving DVD properties %d DVDs", len(dvdProperties)))
 
 	state.Put("secondary.dvd.properties", dvdProperties)
 
@@ -53,19 +72,21 @@ func (s *StepMountSecondaryDvdImages) Cleanup(state multistep.StateBag) {
 }
 
 
-func (s *StepMountSecondaryDvdImages) mountFiles(vmName string) ([]DvdControllerProperties, error) {
+func (s *StepMountSecondaryDvdImages) mountFiles(driver Driver, vmName string, files []string) ([]DvdControllerProperties, error) {
 
 	var dvdProperties []DvdControllerProperties
 
-	properties, err := s.addAndMountIntegrationServicesSetupDisk(vmName)
-	if err != nil {
-		return dvdProperties, err
-	}
+	if s.Generation != 2 {
+		properties, err := s.addAndMountIntegrationServicesSetupDisk(driver, vmName)
+		if err != nil {
+			return dvdProperties, err
+		}
 
-	dvdProperties = append(dvdProperties, properties)
+		dvdProperties = append(dvdProperties, properties)
+	}
 
-	for _, value := range s.Files {
-		properties, err := s.addAndMountDvdDisk(vmName, value)
+	for _, value := range files {
+		properties, err := s.addAndMountDvdDisk(driver, vmName, value)
 		if err != nil {
 			return dvdProperties, err
 		}
@@ -77,10 +98,10 @@ func (s *StepMountSecondaryDvdImages) mountFiles(vmName string) ([]DvdController
 }
 
 
-func (s *StepMountSecondaryDvdImages) addAndMountIntegrationServicesSetupDisk(vmName string) (DvdControllerProperties, error) {
+func (s *StepMountSecondaryDvdImages) addAndMountIntegrationServicesSetupDisk(driver Driver, vmName string) (DvdControllerProperties, error) {
 
 	isoPath := os.Getenv("WINDIR") + "\\system32\\vmguest.iso"
-	properties, err := s.addAndMountDvdDisk(vmName, isoPath)
+	properties, err := s.addAndMountDvdDisk(driver, vmName, isoPath)
 	if err != nil {
 		return properties, err
 	}
@@ -91,44 +112,12 @@ func (s *StepMountSecondaryDvdImages) addAndMountIntegrationServicesSetupDisk(vm
 
 
 
-func (s *StepMountSecondaryDvdImages) addAndMountDvdDisk(vmName string, isoPath string) (DvdControllerProperties, error) {
+func (s *StepMountSecondaryDvdImages) addAndMountDvdDisk(driver Driver, vmName string, isoPath string) (DvdControllerProperties, error) {
 
 	var properties DvdControllerProperties
-	var script powershell.ScriptBuilder
-	powershell := new(powershell.PowerShellCmd)
-
-	// get the controller number that the OS install disk is mounted on	
-	script.Reset()
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("(Get-VMDvdDrive -VMName $vmName).ControllerNumber")
-	controllerNumber, err := powershell.Output(script.String(), vmName)
-	if err != nil {
-		return properties, err
-	}
-
-	script.Reset()
-	script.WriteLine("param([string]$vmName,[int]$controllerNumber)")
-	script.WriteLine("Add-VMDvdDrive -VMName $vmName -ControllerNumber $controllerNumber")
-	err = powershell.Run(script.String(), vmName, controllerNumber)
-	if err != nil {
-		return properties, err
-	}
-
-	// we could try to get the controller location and number in one call, but this way we do not
-	// need to parse the output
-	script.Reset()
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("(Get-VMDvdDrive -VMName $vmName | Where-Object {$_.Path -eq $null}).ControllerLocation")
-	controllerLocation, err := powershell.Output(script.String(), vmName)
-	if err != nil {
-		return properties, err
-	}
-
-	script.Reset()
-	script.WriteLine("param([string]$vmName,[string]$path,[string]$controllerNumber,[string]$controllerLocation)")
-	script.WriteLine("Set-VMDvdDrive -VMName $vmName -Path $path -ControllerNumber $controllerNumber -ControllerLocation $controllerLocation")
 
-	err = powershell.Run(script.String(), vmName, isoPath, controllerNumber, controllerLocation)
+	// the drive is added to the controller that the OS install disk is mounted on
+	controllerNumber, controllerLocation, err := driver.CreateDvdDrive(vmName, isoPath)
 	if err != nil {
 		return properties, err
 	}
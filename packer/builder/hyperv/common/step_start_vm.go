@@ -9,7 +9,6 @@ import (
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
 	"time"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
 type StepStartVm struct {
@@ -18,6 +17,7 @@ type StepStartVm struct {
 }
 
 func (s *StepStartVm) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	errorMsg := "Error starting vm: %s"
@@ -25,7 +25,7 @@ func (s *StepStartVm) Run(state multistep.StateBag) multistep.StepAction {
 
 	ui.Say("Starting vm for " + s.Reason + "...")
 
-	err := hyperv.StartVirtualMachine(vmName)
+	err := driver.StartVirtualMachine(vmName)
 	if err != nil {
 		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
@@ -8,13 +8,13 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
 type StepStopVm struct {
 }
 
 func (s *StepStopVm) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	errorMsg := "Error stopping vm: %s"
@@ -22,7 +22,7 @@ func (s *StepStopVm) Run(state multistep.StateBag) multistep.StepAction {
 
 	ui.Say("Stopping vm...")
 
-	err := hyperv.StopVirtualMachine(vmName)
+	err := driver.StopVirtualMachine(vmName)
 	if err != nil {
 		err := fmt.Errorf(errorMsg, err)
 		state.Put("error", err)
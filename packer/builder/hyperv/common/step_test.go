@@ -0,0 +1,105 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+func testState(t *testing.T) multistep.StateBag {
+	state := new(multistep.BasicStateBag)
+	state.Put("driver", NewFakeDriver())
+	state.Put("ui", &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	})
+	return state
+}
+
+// testStateWithVM returns a state bag holding a FakeDriver with a VM and
+// its boot disk already created, as the steps following StepCreateVM
+// expect.
+func testStateWithVM(t *testing.T) (multistep.StateBag, *FakeDriver) {
+	return testStateWithVMGeneration(t, 1)
+}
+
+func testStateWithGeneration2VM(t *testing.T) (multistep.StateBag, *FakeDriver) {
+	return testStateWithVMGeneration(t, 2)
+}
+
+func testStateWithVMGeneration(t *testing.T, generation uint) (multistep.StateBag, *FakeDriver) {
+	state := testState(t)
+	driver := state.Get("driver").(*FakeDriver)
+
+	if _, err := driver.CreateVirtualSwitch("switch", SwitchTypeInternal); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := driver.CreateVirtualMachine("vm", "path", 1024, "switch", generation); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// the boot disk, as StepCreateVM attaches it
+	controllerType := ControllerTypeIDE
+	if generation == 2 {
+		controllerType = ControllerTypeSCSI
+	}
+	if err := driver.CreateVirtualHardDisk("vm.vhdx", DiskTypeDynamic, 1024, 0, ""); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := driver.AddVirtualMachineHardDiskDrive("vm", "vm.vhdx", controllerType); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	state.Put("vmName", "vm")
+	state.Put("SwitchName", "switch")
+	return state, driver
+}
+
+func TestSteps_cleanupOrderOnHalt(t *testing.T) {
+	state := testState(t)
+	state.Put("packerTempDir", "temp")
+	state.Put("iso_path", "install.iso")
+	driver := state.Get("driver").(*FakeDriver)
+	driver.FailOn("EnableVirtualMachineIntegrationService", errors.New("boom"))
+
+	runner := &multistep.BasicRunner{
+		Steps: []multistep.Step{
+			&StepCreateSwitch{SwitchName: "switch"},
+			&StepCreateVM{VMName: "vm", SwitchName: "switch", DiskSize: 40 * 1024},
+			&StepMountDvdDrive{},
+			&StepEnableIntegrationService{},
+			&StepStartVm{Reason: "OS installation"},
+		},
+	}
+	runner.Run(state)
+
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+	if driver.Called("StartVirtualMachine") {
+		t.Fatal("should not start the VM after a halt")
+	}
+
+	expected := []string{
+		"CreateVirtualSwitch",
+		"CreateVirtualMachine",
+		"CreateVirtualHardDisk",
+		"AddVirtualMachineHardDiskDrive",
+		"MountDvdDrive",
+		"EnableVirtualMachineIntegrationService",
+		"UnmountDvdDrive",
+		"DeleteVirtualMachine",
+		"DeleteVirtualHardDisk",
+		"DeleteVirtualSwitch",
+	}
+	if !reflect.DeepEqual(driver.Calls, expected) {
+		t.Fatalf("bad calls: %#v", driver.Calls)
+	}
+	if len(driver.VMs) != 0 || len(driver.Disks) != 0 || len(driver.Switches) != 0 {
+		t.Fatal("cleanup should remove the VM, disk and switch")
+	}
+}
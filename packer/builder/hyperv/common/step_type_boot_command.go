@@ -0,0 +1,129 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// The data the entries of boot_command and the files of template_files
+// are processed with.
+type bootTemplateData struct {
+	HTTPIP   string
+	HTTPPort uint
+	Name     string
+}
+
+// newBootTemplateData returns the template data of the HTTP server and the
+// VM in the state.
+func newBootTemplateData(state multistep.StateBag) *bootTemplateData {
+	httpIP, _ := state.Get("http_ip").(string)
+	httpPort, _ := state.Get("http_port").(uint)
+	return &bootTemplateData{
+		HTTPIP:   httpIP,
+		HTTPPort: httpPort,
+		Name:     state.Get("vmName").(string),
+	}
+}
+
+// This step waits boot_wait for the VM to boot, then types the
+// boot_command on its keyboard.
+//
+// Uses:
+//   driver Driver
+//   http_ip string
+//   http_port uint
+//   ui packer.Ui
+//   vmName string
+//
+// Produces:
+//   <nothing>
+type StepTypeBootCommand struct {
+	BootCommand []string
+	BootWait    time.Duration
+	Tpl         *packer.ConfigTemplate
+}
+
+func (s *StepTypeBootCommand) Run(state multistep.StateBag) multistep.StepAction {
+	if len(s.BootCommand) == 0 {
+		return multistep.ActionContinue
+	}
+
+	driver := state.Get("driver").(Driver)
+	ui := state.Get("ui").(packer.Ui)
+	vmName := state.Get("vmName").(string)
+
+	if s.BootWait > 0 {
+		ui.Say(fmt.Sprintf("Waiting %s for the VM to boot...", s.BootWait))
+		if !waitUnlessCancelled(state, s.BootWait) {
+			return multistep.ActionHalt
+		}
+	}
+
+	data := newBootTemplateData(state)
+
+	ui.Say("Typing the boot command...")
+	for i, command := range s.BootCommand {
+		command, err := s.Tpl.Process(command, data)
+		if err != nil {
+			err := fmt.Errorf("Error processing boot_command[%d]: %s", i, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		actions, err := ParseBootCommand(command)
+		if err != nil {
+			err := fmt.Errorf("Error parsing boot_command[%d]: %s", i, err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+
+		for _, action := range actions {
+			if len(action.Scancodes) == 0 {
+				if !waitUnlessCancelled(state, action.Wait) {
+					return multistep.ActionHalt
+				}
+				continue
+			}
+
+			if err := driver.TypeScancodes(vmName, action.Scancodes); err != nil {
+				err := fmt.Errorf("Error typing the boot command: %s", err)
+				state.Put("error", err)
+				ui.Error(err.Error())
+				return multistep.ActionHalt
+			}
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+// waitUnlessCancelled sleeps for the duration given, returning false early
+// if the build is cancelled.
+func waitUnlessCancelled(state multistep.StateBag, d time.Duration) bool {
+	for end := time.Now().Add(d); time.Now().Before(end); {
+		if _, ok := state.GetOk(multistep.StateCancelled); ok {
+			return false
+		}
+
+		tick := end.Sub(time.Now())
+		if tick > time.Second {
+			tick = time.Second
+		}
+		time.Sleep(tick)
+	}
+
+	_, cancelled := state.GetOk(multistep.StateCancelled)
+	return !cancelled
+}
+
+func (s *StepTypeBootCommand) Cleanup(state multistep.StateBag) {
+}
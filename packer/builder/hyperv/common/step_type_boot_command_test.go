@@ -0,0 +1,89 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepTypeBootCommand_impl(t *testing.T) {
+	var _ multistep.Step = new(StepTypeBootCommand)
+}
+
+func TestStepTypeBootCommand(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	if err := driver.StartVirtualMachine("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	state.Put("http_ip", "10.0.0.1")
+	state.Put("http_port", uint(8080))
+
+	step := &StepTypeBootCommand{
+		BootCommand: []string{"{{ .HTTPIP }}:{{ .HTTPPort }}", "<wait0>{{ .Name }}<enter>"},
+		Tpl:         testConfigTemplate(t),
+	}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	var expected []byte
+	for _, command := range []string{"10.0.0.1:8080", "vm<enter>"} {
+		actions, err := ParseBootCommand(command)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		expected = append(expected, actions[0].Scancodes...)
+	}
+	if typed := driver.VMs["vm"].TypedScancodes; !reflect.DeepEqual(typed, expected) {
+		t.Fatalf("bad scancodes: %#v", typed)
+	}
+}
+
+func TestStepTypeBootCommand_noCommand(t *testing.T) {
+	state, driver := testStateWithVM(t)
+
+	step := &StepTypeBootCommand{Tpl: testConfigTemplate(t)}
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if driver.Called("TypeScancodes") {
+		t.Fatal("should NOT type")
+	}
+}
+
+func TestStepTypeBootCommand_cancelled(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	state.Put(multistep.StateCancelled, true)
+
+	step := &StepTypeBootCommand{
+		BootCommand: []string{"a"},
+		BootWait:    10 * time.Second,
+		Tpl:         testConfigTemplate(t),
+	}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if driver.Called("TypeScancodes") {
+		t.Fatal("should NOT type")
+	}
+}
+
+func TestStepTypeBootCommand_notRunning(t *testing.T) {
+	state, _ := testStateWithVM(t)
+
+	step := &StepTypeBootCommand{
+		BootCommand: []string{"a"},
+		Tpl:         testConfigTemplate(t),
+	}
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
 )
 
 
@@ -16,14 +15,14 @@ type StepUnmountDvdDrive struct {
 }
 
 func (s *StepUnmountDvdDrive) Run(state multistep.StateBag) multistep.StepAction {
-	//driver := state.Get("driver").(Driver)
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 
 	vmName := state.Get("vmName").(string)
 	
 	ui.Say("Unmounting dvd drive...")
 
-	err := hyperv.UnmountDvdDrive(vmName)
+	err := driver.UnmountDvdDrive(vmName)
 	if err != nil {
 		err := fmt.Errorf("Error unmounting dvd drive: %s", err)
 		state.Put("error", err)
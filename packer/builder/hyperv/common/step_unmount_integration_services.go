@@ -9,13 +9,13 @@ import (
 	"log"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
 )
 
 type StepUnmountSecondaryDvdImages struct {
 }
 
 func (s *StepUnmountSecondaryDvdImages) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	ui.Say("Unmounting Integration Services Setup Disk...")
 
@@ -25,18 +25,13 @@ func (s *StepUnmountSecondaryDvdImages) Run(state multistep.StateBag) multistep.
 
 	dvdProperties := state.Get("secondary.dvd.properties").([]DvdControllerProperties)
 
-	log.Println(fmt.Sprintf("Found DVD properties %s", len(dvdProperties)))
+	log.Println(fmt.Sprintf("Found DVD properties %d", len(dvdProperties)))
 
 	for _, dvdProperty := range dvdProperties {
 		controllerNumber := dvdProperty.ControllerNumber
 		controllerLocation := dvdProperty.ControllerLocation
 
-		var script powershell.ScriptBuilder
-		powershell := new(powershell.PowerShellCmd)
-
-		script.WriteLine("param([string]$vmName,[int]$controllerNumber,[int]$controllerLocation)")
-		script.WriteLine("Remove-VMDvdDrive -VMName $vmName -ControllerNumber $controllerNumber -ControllerLocation $controllerLocation")
-		err := powershell.Run(script.String(), vmName, controllerNumber, controllerLocation)
+		err := driver.DeleteDvdDrive(vmName, controllerNumber, controllerLocation)
 		if err != nil {
 			state.Put("error", err)
 			ui.Error(err.Error())
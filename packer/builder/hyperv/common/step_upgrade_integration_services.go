@@ -9,7 +9,6 @@ import (
 	"os"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
 )
 
 type StepUpdateIntegrationServices struct {
@@ -20,17 +19,18 @@ type StepUpdateIntegrationServices struct {
 }
 
 type dvdDriveProperties struct {
-	ControllerNumber string
-	ControllerLocation string
+	ControllerNumber uint
+	ControllerLocation uint
 }
 
 func (s *StepUpdateIntegrationServices) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	vmName := state.Get("vmName").(string)
 
 	ui.Say("Mounting Integration Services Setup Disk...")
 
-	_, err := s.mountIntegrationServicesSetupDisk(vmName);
+	_, err := s.mountIntegrationServicesSetupDisk(driver, vmName);
 	if err != nil {
 		state.Put("error", err)
 		ui.Error(err.Error())
@@ -52,53 +52,19 @@ func (s *StepUpdateIntegrationServices) Run(state multistep.StateBag) multistep.
 }
 
 func (s *StepUpdateIntegrationServices) Cleanup(state multistep.StateBag) {
+	driver := state.Get("driver").(Driver)
 	vmName := state.Get("vmName").(string)
 
-	var script powershell.ScriptBuilder
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("Set-VMDvdDrive -VMName $vmName -Path $null")
-
-	powershell := new(powershell.PowerShellCmd)
-	_ = powershell.Run(script.String(), vmName)
+	_ = driver.UnmountDvdDrive(vmName)
 }
 
-func (s *StepUpdateIntegrationServices) mountIntegrationServicesSetupDisk(vmName string) (dvdDriveProperties, error) {
+func (s *StepUpdateIntegrationServices) mountIntegrationServicesSetupDisk(driver Driver, vmName string) (dvdDriveProperties, error) {
 
 	var dvdProperties dvdDriveProperties
 
-	var script powershell.ScriptBuilder
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("Add-VMDvdDrive -VMName $vmName")
-
-	powershell := new(powershell.PowerShellCmd)
-	err := powershell.Run(script.String(), vmName)
-	if err != nil {
-		return dvdProperties, err
-	}
-
-	script.Reset()
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("(Get-VMDvdDrive -VMName $vmName | Where-Object {$_.Path -eq $null}).ControllerLocation")
-	controllerLocation, err := powershell.Output(script.String(), vmName)
-	if err != nil {
-		return dvdProperties, err
-	}
-
-	script.Reset()
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("(Get-VMDvdDrive -VMName $vmName | Where-Object {$_.Path -eq $null}).ControllerNumber")
-	controllerNumber, err := powershell.Output(script.String(), vmName)
-	if err != nil {
-		return dvdProperties, err
-	}
-
 	isoPath := os.Getenv("WINDIR") + "\\system32\\vmguest.iso"
 
-	script.Reset()
-	script.WriteLine("param([string]$vmName,[string]$path,[string]$controllerNumber,[string]$controllerLocation)")
-	script.WriteLine("Set-VMDvdDrive -VMName $vmName -Path $path -ControllerNumber $controllerNumber -ControllerLocation $controllerLocation")
-
-	err = powershell.Run(script.String(), vmName, isoPath, controllerNumber, controllerLocation)
+	controllerNumber, controllerLocation, err := driver.CreateDvdDrive(vmName, isoPath)
 	if err != nil {
 		return dvdProperties, err
 	}
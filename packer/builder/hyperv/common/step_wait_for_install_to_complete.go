@@ -8,37 +8,54 @@ import (
 	"fmt"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/packer"
-	"strings"
-	"strconv"
 	"time"
-	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
 )
 
 const (
 	SleepSeconds = 10
+	PowerOffInitialWaitSeconds = 300
 )
 
 type StepWaitForPowerOff struct {
+	// How long to wait before checking the VM's state for the first time.
+	// Defaults to PowerOffInitialWaitSeconds.
+	InitialWait time.Duration
+	// How long to wait between checks of the VM's state. Defaults to
+	// SleepSeconds.
+	PollInterval time.Duration
+	// How long to wait for the VM to power off before giving up. By
+	// default there is no limit.
+	Timeout time.Duration
 }
 
 func (s *StepWaitForPowerOff) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	vmName := state.Get("vmName").(string)
 	ui.Say("Waiting for vm to be powered down...")
 
+	initialWait := s.InitialWait
+	if initialWait == 0 {
+		initialWait = time.Second * PowerOffInitialWaitSeconds
+	}
+
+	pollInterval := s.PollInterval
+	if pollInterval == 0 {
+		pollInterval = time.Second * SleepSeconds
+	}
+
+	var timeout <-chan time.Time
+	if s.Timeout != 0 {
+		timeout = time.After(s.Timeout)
+	}
+
 	// unless the person has a super fast disk, it should take at least 5 minutes
 	// for the install and post-install operations to take. Wait 5 minutes to 
 	// avoid hammering on getting VM status via PowerShell
-	time.Sleep(time.Second * 300);
-
-	var script powershell.ScriptBuilder
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("(Get-VM -Name $vmName).State -eq [Microsoft.HyperV.PowerShell.VMState]::Off")
-	isOffScript := script.String()
+	time.Sleep(initialWait);
 
 	for {
-		powershell := new(powershell.PowerShellCmd)
-		cmdOut, err := powershell.Output(isOffScript, vmName);
+		isOff, err := driver.IsOff(vmName)
 		if err != nil {
 			err := fmt.Errorf("Error checking VM's state: %s", err)
 			state.Put("error", err)
@@ -46,10 +63,17 @@ func (s *StepWaitForPowerOff) Run(state multistep.StateBag) multistep.StepAction
 			return multistep.ActionHalt
 		}
 
-		if cmdOut == "True" {
+		if isOff {
 			break
-		} else {
-			time.Sleep(time.Second * SleepSeconds);
+		}
+
+		select {
+		case <-timeout:
+			err := fmt.Errorf("Timeout while waiting for the VM to power off.")
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		case <-time.After(pollInterval):
 		}
 	}
 
@@ -62,9 +86,13 @@ func (s *StepWaitForPowerOff) Cleanup(state multistep.StateBag) {
 type StepWaitForInstallToComplete struct {
 	ExpectedRebootCount uint
 	ActionName string
+	// How long to wait between checks of the VM's uptime. Defaults to
+	// SleepSeconds.
+	PollInterval time.Duration
 }
 
 func (s *StepWaitForInstallToComplete) Run(state multistep.StateBag) multistep.StepAction {
+	driver := state.Get("driver").(Driver)
 	ui := state.Get("ui").(packer.Ui)
 	vmName := state.Get("vmName").(string)
 
@@ -72,18 +100,16 @@ func (s *StepWaitForInstallToComplete) Run(state multistep.StateBag) multistep.S
 		ui.Say(fmt.Sprintf("%v ! Waiting for VM to reboot %v times...",s.ActionName, s.ExpectedRebootCount))
 	}
 
+	pollInterval := s.PollInterval
+	if pollInterval == 0 {
+		pollInterval = time.Second * SleepSeconds
+	}
+
 	var rebootCount uint
 	var lastUptime uint64
 
-	var script powershell.ScriptBuilder
-	script.WriteLine("param([string]$vmName)")
-	script.WriteLine("(Get-VM -Name $vmName).Uptime.TotalSeconds")
-
-	uptimeScript := script.String()
-
 	for rebootCount < s.ExpectedRebootCount {
-		powershell := new(powershell.PowerShellCmd)
-		cmdOut, err := powershell.Output(uptimeScript, vmName);
+		uptime, err := driver.Uptime(vmName)
 		if err != nil {
 			err := fmt.Errorf("Error checking uptime: %s", err)
 			state.Put("error", err)
@@ -91,8 +117,7 @@ func (s *StepWaitForInstallToComplete) Run(state multistep.StateBag) multistep.S
 			return multistep.ActionHalt
 		}
 
-		uptime, _ := strconv.ParseUint(strings.TrimSpace(string(cmdOut)), 10, 64)
-		if uint64(uptime) < lastUptime {
+		if uptime < lastUptime {
 			rebootCount++
 			ui.Say(fmt.Sprintf("%v  -> Detected reboot %v after %v seconds...", s.ActionName, rebootCount, lastUptime))
 		}
@@ -100,7 +125,7 @@ func (s *StepWaitForInstallToComplete) Run(state multistep.StateBag) multistep.S
 		lastUptime = uptime
 
 		if (rebootCount < s.ExpectedRebootCount) {
-			time.Sleep(time.Second * SleepSeconds);
+			time.Sleep(pollInterval);
 		}
 	}
 
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestStepWaitForPowerOff_impl(t *testing.T) {
+	var _ multistep.Step = new(StepWaitForPowerOff)
+}
+
+func TestStepWaitForPowerOff(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	driver.StartVirtualMachine("vm")
+	driver.PowerOffAfterPolls("vm", 3)
+
+	step := &StepWaitForPowerOff{
+		InitialWait:  time.Millisecond,
+		PollInterval: time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+	if driver.VMs["vm"].State != FakeVMStateOff {
+		t.Fatal("VM should be off")
+	}
+}
+
+func TestStepWaitForPowerOff_timeout(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	driver.StartVirtualMachine("vm")
+
+	step := &StepWaitForPowerOff{
+		InitialWait:  time.Millisecond,
+		PollInterval: time.Millisecond,
+		Timeout:      20 * time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
+
+func TestStepWaitForPowerOff_error(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	driver.FailOn("IsOff", errors.New("boom"))
+
+	step := &StepWaitForPowerOff{
+		InitialWait:  time.Millisecond,
+		PollInterval: time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
+
+func TestStepWaitForInstallToComplete(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	driver.StartVirtualMachine("vm")
+	driver.RebootAfterPolls("vm", 4, 9)
+
+	step := &StepWaitForInstallToComplete{
+		ExpectedRebootCount: 2,
+		PollInterval:        time.Millisecond,
+	}
+
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	polls := 0
+	for _, c := range driver.Calls {
+		if c == "Uptime" {
+			polls++
+		}
+	}
+	if polls != 9 {
+		t.Fatalf("expected the second reboot on poll 9, got %d polls", polls)
+	}
+}
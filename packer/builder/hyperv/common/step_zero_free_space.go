@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+// This step fills the free space of the guest with zeros through the
+// communicator, so that compacting its hard disks reclaims the space the
+// installation used and freed.
+//
+// Uses:
+//   communicator packer.Communicator
+//   ui packer.Ui
+//
+// Produces:
+//   <nothing>
+type StepZeroFreeSpace struct {
+	// The command zeroing the free space, or empty to do nothing.
+	Command string
+	// A script uploaded to ScriptPath before the command is run, or empty.
+	Script     string
+	ScriptPath string
+}
+
+func (s *StepZeroFreeSpace) Run(state multistep.StateBag) multistep.StepAction {
+	if s.Command == "" {
+		return multistep.ActionContinue
+	}
+
+	comm := state.Get("communicator").(packer.Communicator)
+	ui := state.Get("ui").(packer.Ui)
+
+	ui.Say("Zeroing the free space of the guest...")
+
+	if s.Script != "" {
+		if err := comm.Upload(s.ScriptPath, strings.NewReader(s.Script), nil); err != nil {
+			err := fmt.Errorf("Error uploading the script zeroing the free space: %s", err)
+			state.Put("error", err)
+			ui.Error(err.Error())
+			return multistep.ActionHalt
+		}
+	}
+
+	log.Printf("Executing zero free space command: %s", s.Command)
+
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{
+		Command: s.Command,
+		Stdout:  &stdout,
+		Stderr:  &stderr,
+	}
+	if err := comm.Start(cmd); err != nil {
+		err := fmt.Errorf("Failed to send the command zeroing the free space: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	cmd.Wait()
+
+	if cmd.ExitStatus != 0 {
+		err := fmt.Errorf(
+			"The command zeroing the free space has non-zero exit status.\n\nStdout: %s\n\nStderr: %s",
+			stdout.String(), stderr.String())
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if stdout.Len() > 0 {
+		log.Printf("Zero free space stdout: %s", stdout.String())
+	}
+
+	if stderr.Len() > 0 {
+		log.Printf("Zero free space stderr: %s", stderr.String())
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepZeroFreeSpace) Cleanup(state multistep.StateBag) {}
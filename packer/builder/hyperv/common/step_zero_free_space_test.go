@@ -0,0 +1,90 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/packer"
+)
+
+func TestStepZeroFreeSpace_impl(t *testing.T) {
+	var _ multistep.Step = new(StepZeroFreeSpace)
+}
+
+func TestStepZeroFreeSpace(t *testing.T) {
+	state := testState(t)
+	comm := new(packer.MockCommunicator)
+	state.Put("communicator", comm)
+
+	config := &CompactionConfig{ZeroFreeSpace: true}
+	step := config.ZeroFreeSpaceStep("winrm")
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+
+	// the script is uploaded and run
+	if !comm.UploadCalled || comm.UploadPath != zeroFreeSpaceScriptPath || comm.UploadData != zeroFreeSpaceScript {
+		t.Fatalf("bad upload: %s", comm.UploadPath)
+	}
+	if comm.StartCmd.Command != defaultZeroFreeSpaceCommands["winrm"] {
+		t.Fatalf("bad command: %s", comm.StartCmd.Command)
+	}
+}
+
+func TestStepZeroFreeSpace_command(t *testing.T) {
+	state := testState(t)
+	comm := new(packer.MockCommunicator)
+	state.Put("communicator", comm)
+
+	config := &CompactionConfig{ZeroFreeSpace: true, ZeroFreeSpaceCommand: "sudo zero"}
+	step := config.ZeroFreeSpaceStep("ssh")
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+
+	if comm.UploadCalled || comm.StartCmd.Command != "sudo zero" {
+		t.Fatalf("bad: %#v", comm)
+	}
+
+	comm.StartExitStatus = 1
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if _, ok := state.GetOk("error"); !ok {
+		t.Fatal("should have error")
+	}
+}
+
+func TestStepZeroFreeSpace_off(t *testing.T) {
+	state := testState(t)
+	comm := new(packer.MockCommunicator)
+	state.Put("communicator", comm)
+
+	step := new(CompactionConfig).ZeroFreeSpaceStep("ssh")
+	if action := step.Run(state); action != multistep.ActionContinue {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if comm.StartCalled {
+		t.Fatal("should not run anything")
+	}
+}
+
+func TestCompactionConfigPrepare(t *testing.T) {
+	tpl, err := packer.NewConfigTemplate()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	c := &CompactionConfig{ZeroFreeSpace: true, ZeroFreeSpaceCommand: "zero"}
+	if errs := c.Prepare(tpl); len(errs) > 0 {
+		t.Fatalf("err: %#v", errs)
+	}
+
+	c = &CompactionConfig{ZeroFreeSpaceCommand: "zero"}
+	if errs := c.Prepare(tpl); len(errs) == 0 {
+		t.Fatal("should error without zero_free_space")
+	}
+}
@@ -0,0 +1,440 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+package vhdx
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The layout of the disks created, after the header section.
+const (
+	logOffset      = 1 * MB
+	logLength      = 1 * MB
+	metadataOffset = 2 * MB
+	metadataLength = 1 * MB
+	batOffset      = 3 * MB
+)
+
+// The name of the program creating disks, recorded in the file identifier.
+const creator = "packer"
+
+// CreateOptions are the options of a disk created by Create.
+type CreateOptions struct {
+	// The virtual size of the disk in bytes, a multiple of the logical
+	// sector size. A differencing disk takes the size of its parent when
+	// it is 0.
+	VirtualSize uint64
+	// The block size in bytes, a power of 2 between MinBlockSize and
+	// MaxBlockSize, DefaultBlockSize when 0.
+	BlockSize uint32
+	// The sector sizes, 512 or 4096 bytes. The logical sector size is 512
+	// and the physical sector size 4096 when 0, or those of the parent of a
+	// differencing disk.
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+	// Whether all the blocks of the disk are allocated when it is created.
+	Fixed bool
+	// The path of the parent of a differencing disk.
+	ParentPath string
+}
+
+// Create creates a VHDX file at the path given, and opens it for reading
+// and writing, along with the parent of a differencing disk. The disk
+// reads as zeros, or as its parent for a differencing disk.
+func Create(path string, options CreateOptions) (*Disk, error) {
+	d := &Disk{
+		VirtualSize:          options.VirtualSize,
+		BlockSize:            options.BlockSize,
+		LogicalSectorSize:    options.LogicalSectorSize,
+		PhysicalSectorSize:   options.PhysicalSectorSize,
+		LeaveBlocksAllocated: options.Fixed,
+	}
+
+	if d.BlockSize == 0 {
+		d.BlockSize = DefaultBlockSize
+	}
+
+	if options.ParentPath != "" {
+		if options.Fixed {
+			return nil, errors.New("vhdx: a differencing disk cannot be fixed")
+		}
+		if err := d.setParent(path, options.ParentPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.LogicalSectorSize == 0 {
+		d.LogicalSectorSize = 512
+	}
+	if d.PhysicalSectorSize == 0 {
+		d.PhysicalSectorSize = 4096
+	}
+
+	if err := d.validateParameters(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if d.ID, err = NewGUID(); err != nil {
+		return nil, err
+	}
+	if d.Header.FileWriteGUID, err = NewGUID(); err != nil {
+		return nil, err
+	}
+	if d.Header.DataWriteGUID, err = NewGUID(); err != nil {
+		return nil, err
+	}
+	d.Header.Version = 1
+	d.Header.LogOffset = logOffset
+	d.Header.LogLength = logLength
+
+	entries := totalBATEntries(d.VirtualSize, d.BlockSize, d.LogicalSectorSize, d.HasParent)
+	batLength := alignUp(int64(entries*8), alignment)
+	if batLength > 1<<32-alignment {
+		return nil, errors.New("vhdx: the BAT of the disk is too large")
+	}
+
+	d.Regions = []Region{
+		{GUID: batRegionGUID, FileOffset: batOffset, Length: uint32(batLength), Required: true},
+		{GUID: metadataRegionGUID, FileOffset: metadataOffset, Length: metadataLength, Required: true},
+	}
+
+	d.BAT = make([]BATEntry, entries)
+	d.FileSize = batOffset + batLength
+	if options.Fixed {
+		for i := uint64(0); i < d.BlockCount(); i++ {
+			d.BAT[d.batIndex(i)] = newBATEntry(BlockFullyPresent, d.FileSize)
+			d.FileSize += int64(d.BlockSize)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.write(f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	d, err = OpenFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.HasParent {
+		if _, err := d.OpenParent(); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+
+	return d, nil
+}
+
+// setParent sets up the disk created at the path given as a differencing
+// disk of the disk at parentPath.
+func (d *Disk) setParent(path string, parentPath string) error {
+	parent, err := Open(parentPath)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	if d.VirtualSize == 0 {
+		d.VirtualSize = parent.VirtualSize
+	}
+	if d.VirtualSize != parent.VirtualSize {
+		return fmt.Errorf("vhdx: the size of a differencing disk must be the size of its parent, %d bytes", parent.VirtualSize)
+	}
+	if d.LogicalSectorSize == 0 {
+		d.LogicalSectorSize = parent.LogicalSectorSize
+	}
+	if d.PhysicalSectorSize == 0 {
+		d.PhysicalSectorSize = parent.PhysicalSectorSize
+	}
+	if d.LogicalSectorSize != parent.LogicalSectorSize {
+		return errors.New("vhdx: the logical sector size of a differencing disk must be that of its parent")
+	}
+
+	absolute, err := filepath.Abs(parentPath)
+	if err != nil {
+		return err
+	}
+
+	d.HasParent = true
+	d.ParentLocator = map[string]string{
+		ParentLinkage:     parent.Header.DataWriteGUID.braced(),
+		AbsoluteWin32Path: absolute,
+	}
+
+	if dir, err := filepath.Abs(filepath.Dir(path)); err == nil {
+		if relative, err := filepath.Rel(dir, absolute); err == nil {
+			d.ParentLocator[RelativePath] = `.\` + strings.Replace(relative, "/", `\`, -1)
+		}
+	}
+
+	return nil
+}
+
+// write writes the structures of a new disk to the file given.
+func (d *Disk) write(f *os.File) error {
+	if err := f.Truncate(d.FileSize); err != nil {
+		return err
+	}
+
+	identifier := make([]byte, fileIdentifierSize)
+	copy(identifier, fileIdentifierSignature)
+	copy(identifier[8:], encodeUTF16(creator))
+	d.Creator = creator
+
+	regionTable := marshalRegionTable(d.Regions)
+
+	writes := []struct {
+		b      []byte
+		offset int64
+	}{
+		{identifier, 0},
+		{regionTable, regionTable1Offset},
+		{regionTable, regionTable2Offset},
+		{d.marshalMetadata(), metadataOffset},
+		{d.marshalBAT(), batOffset},
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.b, w.offset); err != nil {
+			return err
+		}
+	}
+
+	return d.writeHeaders(f)
+}
+
+// writeHeaders writes the header of the disk to both header locations,
+// the second with the higher sequence number, making it current.
+func (d *Disk) writeHeaders(f *os.File) error {
+	for _, offset := range []int64{header1Offset, header2Offset} {
+		d.Header.SequenceNumber++
+		if _, err := f.WriteAt(d.Header.marshal(), offset); err != nil {
+			return err
+		}
+	}
+
+	return f.Sync()
+}
+
+func (d *Disk) marshalMetadata() []byte {
+	b := make([]byte, metadataLength)
+	copy(b[0:8], metadataSignature)
+
+	type item struct {
+		id    GUID
+		flags uint32
+		data  []byte
+	}
+
+	var fileParameters [8]byte
+	le.PutUint32(fileParameters[0:], d.BlockSize)
+	if d.LeaveBlocksAllocated {
+		fileParameters[4] |= 1
+	}
+	if d.HasParent {
+		fileParameters[4] |= 2
+	}
+
+	var virtualSize [8]byte
+	le.PutUint64(virtualSize[:], d.VirtualSize)
+
+	var logicalSectorSize, physicalSectorSize [4]byte
+	le.PutUint32(logicalSectorSize[:], d.LogicalSectorSize)
+	le.PutUint32(physicalSectorSize[:], d.PhysicalSectorSize)
+
+	// the flags are IsVirtualDisk (2) and IsRequired (4)
+	items := []item{
+		{fileParametersGUID, 4, fileParameters[:]},
+		{virtualDiskSizeGUID, 6, virtualSize[:]},
+		{virtualDiskIDGUID, 6, d.ID[:]},
+		{logicalSectorSizeGUID, 6, logicalSectorSize[:]},
+		{physicalSectorSizeGUID, 6, physicalSectorSize[:]},
+	}
+	if d.HasParent {
+		items = append(items, item{parentLocatorGUID, 4, marshalParentLocator(d.ParentLocator)})
+	}
+
+	le.PutUint16(b[10:], uint16(len(items)))
+
+	offset := metadataTableSize
+	for i, it := range items {
+		e := b[32+32*i:]
+		copy(e[0:16], it.id[:])
+		le.PutUint32(e[16:], uint32(offset))
+		le.PutUint32(e[20:], uint32(len(it.data)))
+		le.PutUint32(e[24:], it.flags)
+
+		copy(b[offset:], it.data)
+		d.Metadata = append(d.Metadata, MetadataItem{
+			ItemID:        it.id,
+			Offset:        uint32(offset),
+			Length:        uint32(len(it.data)),
+			IsVirtualDisk: it.flags&2 != 0,
+			IsRequired:    it.flags&4 != 0,
+		})
+
+		offset += int(alignUp(int64(len(it.data)), 8))
+	}
+
+	return b
+}
+
+func marshalParentLocator(locator map[string]string) []byte {
+	keys := []string{ParentLinkage, ParentLinkage2, RelativePath, VolumePath, AbsoluteWin32Path}
+
+	var entries []string
+	for _, key := range keys {
+		if _, ok := locator[key]; ok {
+			entries = append(entries, key)
+		}
+	}
+
+	b := make([]byte, 20+12*len(entries))
+	copy(b[0:16], vhdxParentLocatorGUID[:])
+	le.PutUint16(b[18:], uint16(len(entries)))
+
+	for i, key := range entries {
+		k, v := encodeUTF16(key), encodeUTF16(locator[key])
+
+		e := b[20+12*i:]
+		le.PutUint32(e[0:], uint32(len(b)))
+		le.PutUint32(e[4:], uint32(len(b)+len(k)))
+		le.PutUint16(e[8:], uint16(len(k)))
+		le.PutUint16(e[10:], uint16(len(v)))
+
+		b = append(b, k...)
+		b = append(b, v...)
+	}
+
+	return b
+}
+
+func (d *Disk) marshalBAT() []byte {
+	b := make([]byte, 8*len(d.BAT))
+	for i, entry := range d.BAT {
+		le.PutUint64(b[8*i:], uint64(entry))
+	}
+	return b
+}
+
+// batIndex returns the index in the BAT of the payload block given.
+func (d *Disk) batIndex(block uint64) uint64 {
+	return block + block/chunkRatio(d.BlockSize, d.LogicalSectorSize)
+}
+
+// WriteAt writes to the virtual contents of a disk opened by OpenFile or
+// Create, allocating blocks at the end of the file as needed. The blocks
+// of a differencing disk are allocated whole, with the sectors of the
+// parent they are not written with.
+func (d *Disk) WriteAt(p []byte, off int64) (int, error) {
+	if !d.writable {
+		return 0, ErrReadOnly
+	}
+	if off < 0 || off+int64(len(p)) > d.Size() {
+		return 0, errors.New("vhdx: write out of the disk")
+	}
+
+	// the first write to a disk changes its data write GUID, telling the
+	// differencing disks of the disk it has changed
+	if !d.written {
+		var err error
+		if d.Header.FileWriteGUID, err = NewGUID(); err != nil {
+			return 0, err
+		}
+		if d.Header.DataWriteGUID, err = NewGUID(); err != nil {
+			return 0, err
+		}
+		if err := d.writeHeaders(d.f); err != nil {
+			return 0, err
+		}
+		d.written = true
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		block := uint64(pos) / uint64(d.BlockSize)
+		inBlock := pos % int64(d.BlockSize)
+
+		chunk := p[n:]
+		if rest := int64(d.BlockSize) - inBlock; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+
+		if err := d.writeBlock(block, inBlock, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+
+	return n, nil
+}
+
+func (d *Disk) writeBlock(block uint64, inBlock int64, p []byte) error {
+	entry := d.Block(block)
+	if entry.State() == BlockFullyPresent {
+		_, err := d.f.WriteAt(p, entry.FileOffset()+inBlock)
+		return err
+	}
+
+	offset := alignUp(d.FileSize, alignment)
+
+	if d.HasParent {
+		// the block is written whole, with what it reads as now
+		data := make([]byte, d.BlockSize)
+		if last := d.Size() - int64(block)*int64(d.BlockSize); last < int64(len(data)) {
+			data = data[:last]
+		}
+		if err := d.readBlock(block, 0, data); err != nil {
+			return err
+		}
+		copy(data[inBlock:], p)
+
+		if _, err := d.f.WriteAt(data, offset); err != nil {
+			return err
+		}
+	} else if _, err := d.f.WriteAt(p, offset+inBlock); err != nil {
+		return err
+	}
+
+	if err := d.f.Truncate(offset + int64(d.BlockSize)); err != nil {
+		return err
+	}
+	d.FileSize = offset + int64(d.BlockSize)
+
+	return d.setBlock(block, newBATEntry(BlockFullyPresent, offset))
+}
+
+func (d *Disk) setBlock(block uint64, entry BATEntry) error {
+	i := d.batIndex(block)
+	d.BAT[i] = entry
+
+	var b [8]byte
+	le.PutUint64(b[:], uint64(entry))
+	_, err := d.f.WriteAt(b[:], d.batOffset+int64(8*i))
+	return err
+}
+
+func alignUp(n int64, alignment int64) int64 {
+	return (n + alignment - 1) / alignment * alignment
+}
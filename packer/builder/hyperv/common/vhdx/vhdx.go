@@ -0,0 +1,932 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package vhdx reads and writes VHDX files, the virtual hard disks of
+// Hyper-V, as described by the VHDX Format Specification (MS-VHDX).
+//
+// It parses the headers, region table, metadata and block allocation
+// table of a disk, reads its virtual contents, and creates empty dynamic,
+// fixed and differencing disks, so that disks can be inspected without
+// Hyper-V.
+package vhdx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	KB = 1024
+	MB = 1024 * KB
+	GB = 1024 * MB
+	TB = 1024 * GB
+
+	// The limits of the block size of a disk, which is a power of 2.
+	MinBlockSize     = 1 * MB
+	MaxBlockSize     = 256 * MB
+	DefaultBlockSize = 32 * MB
+
+	// The largest virtual size of a disk.
+	MaxVirtualSize = 64 * TB
+)
+
+// The layout of the start of every VHDX file.
+const (
+	fileIdentifierSize = 64 * KB
+	header1Offset      = 64 * KB
+	header2Offset      = 128 * KB
+	headerSize         = 4 * KB
+	regionTable1Offset = 192 * KB
+	regionTable2Offset = 256 * KB
+	regionTableSize    = 64 * KB
+
+	// The objects after the header section are aligned to 1 MB.
+	alignment = MB
+
+	// The number of sectors a sector bitmap block describes.
+	sectorsPerBitmap = 1 << 23
+
+	maxRegionEntries   = 2047
+	maxMetadataEntries = 2047
+	metadataTableSize  = 64 * KB
+)
+
+const (
+	fileIdentifierSignature = "vhdxfile"
+	headerSignature         = "head"
+	regionTableSignature    = "regi"
+	metadataSignature       = "metadata"
+)
+
+var (
+	batRegionGUID      = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	metadataRegionGUID = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	fileParametersGUID     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	virtualDiskSizeGUID    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	virtualDiskIDGUID      = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	logicalSectorSizeGUID  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	physicalSectorSizeGUID = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	parentLocatorGUID      = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+
+	// The type of the only parent locator defined, locating a VHDX parent.
+	vhdxParentLocatorGUID = mustParseGUID("B04AEFB7-D19E-4A81-B789-25B8E9445913")
+)
+
+// The keys of the parent locator of a differencing disk.
+const (
+	ParentLinkage     = "parent_linkage"
+	ParentLinkage2    = "parent_linkage2"
+	RelativePath      = "relative_path"
+	VolumePath        = "volume_path"
+	AbsoluteWin32Path = "absolute_win32_path"
+)
+
+var (
+	// ErrLog is returned for a disk whose log has entries to replay, as
+	// left by a host that did not close the disk cleanly.
+	ErrLog = errors.New("vhdx: the log of the disk must be replayed by Hyper-V first")
+	// ErrNoParent is returned reading sectors that a differencing disk
+	// leaves to a parent that is not open.
+	ErrNoParent = errors.New("vhdx: the parent of the differencing disk is not open")
+	// ErrReadOnly is returned writing to a disk not opened for writing.
+	ErrReadOnly = errors.New("vhdx: the disk is not open for writing")
+)
+
+var (
+	le         = binary.LittleEndian
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// A GUID is a globally unique identifier, in the byte order of Windows.
+type GUID [16]byte
+
+// ParseGUID parses a GUID in the form 2DC27766-F623-4200-9D64-115E9BFD4A08.
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if len(s) != 36 || err != nil || len(b) != 16 {
+		return g, fmt.Errorf("vhdx: bad GUID: %s", s)
+	}
+
+	// the first three fields are little endian
+	g[0], g[1], g[2], g[3] = b[3], b[2], b[1], b[0]
+	g[4], g[5] = b[5], b[4]
+	g[6], g[7] = b[7], b[6]
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+func mustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// NewGUID returns a random GUID.
+func NewGUID() (GUID, error) {
+	var g GUID
+	if _, err := io.ReadFull(rand.Reader, g[:]); err != nil {
+		return g, err
+	}
+
+	// version 4, variant 1
+	g[7] = g[7]&0x0f | 0x40
+	g[8] = g[8]&0x3f | 0x80
+	return g, nil
+}
+
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		le.Uint32(g[0:4]), le.Uint16(g[4:6]), le.Uint16(g[6:8]), g[8:10], g[10:16])
+}
+
+// IsZero reports whether the GUID is all zeros.
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// Header is the current header of a disk.
+type Header struct {
+	SequenceNumber uint64
+	FileWriteGUID  GUID
+	DataWriteGUID  GUID
+	LogGUID        GUID
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+func (h *Header) marshal() []byte {
+	b := make([]byte, headerSize)
+	copy(b[0:4], headerSignature)
+	le.PutUint64(b[8:], h.SequenceNumber)
+	copy(b[16:32], h.FileWriteGUID[:])
+	copy(b[32:48], h.DataWriteGUID[:])
+	copy(b[48:64], h.LogGUID[:])
+	le.PutUint16(b[64:], h.LogVersion)
+	le.PutUint16(b[66:], h.Version)
+	le.PutUint32(b[68:], h.LogLength)
+	le.PutUint64(b[72:], h.LogOffset)
+	le.PutUint32(b[4:], crc32.Checksum(b, castagnoli))
+	return b
+}
+
+func unmarshalHeader(b []byte) (*Header, bool) {
+	if string(b[0:4]) != headerSignature || !validChecksum(b) {
+		return nil, false
+	}
+
+	h := &Header{
+		SequenceNumber: le.Uint64(b[8:]),
+		LogVersion:     le.Uint16(b[64:]),
+		Version:        le.Uint16(b[66:]),
+		LogLength:      le.Uint32(b[68:]),
+		LogOffset:      le.Uint64(b[72:]),
+	}
+	copy(h.FileWriteGUID[:], b[16:32])
+	copy(h.DataWriteGUID[:], b[32:48])
+	copy(h.LogGUID[:], b[48:64])
+	return h, true
+}
+
+// validChecksum checks the CRC-32C checksum a structure stores at offset
+// 4, computed with the checksum itself zeroed.
+func validChecksum(b []byte) bool {
+	stored := le.Uint32(b[4:8])
+
+	c := make([]byte, len(b))
+	copy(c, b)
+	le.PutUint32(c[4:8], 0)
+
+	return crc32.Checksum(c, castagnoli) == stored
+}
+
+// Region is an entry of the region table, locating a region of a disk.
+type Region struct {
+	GUID       GUID
+	FileOffset uint64
+	Length     uint32
+	Required   bool
+}
+
+func marshalRegionTable(regions []Region) []byte {
+	b := make([]byte, regionTableSize)
+	copy(b[0:4], regionTableSignature)
+	le.PutUint32(b[8:], uint32(len(regions)))
+
+	for i, region := range regions {
+		e := b[16+32*i:]
+		copy(e[0:16], region.GUID[:])
+		le.PutUint64(e[16:], region.FileOffset)
+		le.PutUint32(e[24:], region.Length)
+		if region.Required {
+			le.PutUint32(e[28:], 1)
+		}
+	}
+
+	le.PutUint32(b[4:], crc32.Checksum(b, castagnoli))
+	return b
+}
+
+func unmarshalRegionTable(b []byte) ([]Region, bool) {
+	if string(b[0:4]) != regionTableSignature || !validChecksum(b) {
+		return nil, false
+	}
+
+	count := le.Uint32(b[8:])
+	if count > maxRegionEntries {
+		return nil, false
+	}
+
+	regions := make([]Region, count)
+	for i := range regions {
+		e := b[16+32*i:]
+		copy(regions[i].GUID[:], e[0:16])
+		regions[i].FileOffset = le.Uint64(e[16:])
+		regions[i].Length = le.Uint32(e[24:])
+		regions[i].Required = le.Uint32(e[28:])&1 != 0
+	}
+	return regions, true
+}
+
+// MetadataItem is an entry of the metadata table, locating an item of
+// metadata in the metadata region.
+type MetadataItem struct {
+	ItemID        GUID
+	Offset        uint32
+	Length        uint32
+	IsUser        bool
+	IsVirtualDisk bool
+	IsRequired    bool
+}
+
+// BlockState is the state of a block of a disk, from its entry in the
+// block allocation table.
+type BlockState uint8
+
+// The states of payload blocks. Sector bitmap blocks are either not
+// present or present, which has the value of BlockFullyPresent.
+const (
+	BlockNotPresent       BlockState = 0
+	BlockUndefined        BlockState = 1
+	BlockZero             BlockState = 2
+	BlockUnmapped         BlockState = 3
+	BlockFullyPresent     BlockState = 6
+	BlockPartiallyPresent BlockState = 7
+)
+
+// BATEntry is an entry of the block allocation table, the state of a
+// block and where it is in the file.
+type BATEntry uint64
+
+func newBATEntry(state BlockState, fileOffset int64) BATEntry {
+	return BATEntry(uint64(fileOffset/MB)<<20 | uint64(state))
+}
+
+// State returns the state of the block.
+func (e BATEntry) State() BlockState {
+	return BlockState(e & 7)
+}
+
+// FileOffset returns the offset of the block in the file.
+func (e BATEntry) FileOffset() int64 {
+	return int64(e>>20) * MB
+}
+
+// Disk is an open VHDX file.
+type Disk struct {
+	// The current header, the regions and the metadata items.
+	Header   Header
+	Regions  []Region
+	Metadata []MetadataItem
+	// The name of the program that created the file.
+	Creator string
+
+	// The size of the disk as the VM sees it, in bytes.
+	VirtualSize uint64
+	// The size of the payload blocks, in bytes.
+	BlockSize uint32
+	// The sector sizes the VM sees, 512 or 4096 bytes.
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+	// The identifier of the disk, reported to the VM as its SCSI page 83
+	// identifier.
+	ID GUID
+	// Whether the blocks are left allocated, as for a fixed disk.
+	LeaveBlocksAllocated bool
+	// Whether the disk is a differencing disk, and the parent locator
+	// finding its parent, keyed by ParentLinkage, RelativePath and so on.
+	HasParent     bool
+	ParentLocator map[string]string
+
+	// The block allocation table, with the entries of the payload blocks
+	// and of the sector bitmap blocks interleaved.
+	BAT []BATEntry
+
+	// The size of the file, in bytes.
+	FileSize int64
+
+	// The disk a differencing disk reads the sectors it does not hold from,
+	// opened by OpenParent or set by the caller.
+	Parent io.ReaderAt
+
+	r         io.ReaderAt
+	f         *os.File
+	path      string
+	writable  bool
+	written   bool
+	batOffset int64
+}
+
+// Open opens the VHDX file at the path given for reading.
+func Open(path string) (*Disk, error) {
+	return openFile(path, os.O_RDONLY)
+}
+
+// OpenFile opens the VHDX file at the path given for reading and writing.
+func OpenFile(path string) (*Disk, error) {
+	return openFile(path, os.O_RDWR)
+}
+
+func openFile(path string, flag int) (*Disk, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d, err := Read(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	d.f = f
+	d.path = path
+	d.writable = flag&os.O_RDWR != 0
+	return d, nil
+}
+
+// Read parses the VHDX file of the size given read from r.
+func Read(r io.ReaderAt, size int64) (*Disk, error) {
+	d := &Disk{r: r, FileSize: size}
+
+	if size < regionTable2Offset+regionTableSize {
+		return nil, errors.New("vhdx: the file is too small")
+	}
+
+	identifier := make([]byte, fileIdentifierSize)
+	if _, err := r.ReadAt(identifier, 0); err != nil {
+		return nil, err
+	}
+	if string(identifier[0:8]) != fileIdentifierSignature {
+		return nil, errors.New("vhdx: not a VHDX file")
+	}
+	d.Creator = decodeUTF16(identifier[8 : 8+512])
+
+	if err := d.readHeader(); err != nil {
+		return nil, err
+	}
+	if err := d.readRegionTable(); err != nil {
+		return nil, err
+	}
+
+	var bat, metadata *Region
+	for i := range d.Regions {
+		switch region := &d.Regions[i]; {
+		case region.GUID == batRegionGUID:
+			bat = region
+		case region.GUID == metadataRegionGUID:
+			metadata = region
+		case region.Required:
+			return nil, fmt.Errorf("vhdx: unknown required region %s", region.GUID)
+		}
+	}
+	if bat == nil || metadata == nil {
+		return nil, errors.New("vhdx: the region table has no BAT or metadata region")
+	}
+
+	if err := d.readMetadata(metadata); err != nil {
+		return nil, err
+	}
+	if err := d.readBAT(bat); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *Disk) readHeader() error {
+	var current *Header
+	for _, offset := range []int64{header1Offset, header2Offset} {
+		b := make([]byte, headerSize)
+		if _, err := d.r.ReadAt(b, offset); err != nil {
+			return err
+		}
+
+		if h, ok := unmarshalHeader(b); ok && (current == nil || h.SequenceNumber > current.SequenceNumber) {
+			current = h
+		}
+	}
+
+	if current == nil {
+		return errors.New("vhdx: no valid header")
+	}
+	if current.Version != 1 {
+		return fmt.Errorf("vhdx: unsupported version %d", current.Version)
+	}
+	if !current.LogGUID.IsZero() {
+		return ErrLog
+	}
+
+	d.Header = *current
+	return nil
+}
+
+func (d *Disk) readRegionTable() error {
+	for _, offset := range []int64{regionTable1Offset, regionTable2Offset} {
+		b := make([]byte, regionTableSize)
+		if _, err := d.r.ReadAt(b, offset); err != nil {
+			return err
+		}
+
+		if regions, ok := unmarshalRegionTable(b); ok {
+			d.Regions = regions
+			return nil
+		}
+	}
+
+	return errors.New("vhdx: no valid region table")
+}
+
+func (d *Disk) readMetadata(region *Region) error {
+	if region.Length < metadataTableSize {
+		return errors.New("vhdx: the metadata region is too small")
+	}
+
+	b := make([]byte, region.Length)
+	if _, err := d.r.ReadAt(b, int64(region.FileOffset)); err != nil {
+		return err
+	}
+
+	if string(b[0:8]) != metadataSignature {
+		return errors.New("vhdx: bad metadata table signature")
+	}
+
+	count := int(le.Uint16(b[10:]))
+	if count > maxMetadataEntries {
+		return errors.New("vhdx: too many metadata entries")
+	}
+
+	items := make(map[GUID][]byte)
+	for i := 0; i < count; i++ {
+		e := b[32+32*i:]
+		flags := le.Uint32(e[24:])
+		item := MetadataItem{
+			Offset:        le.Uint32(e[16:]),
+			Length:        le.Uint32(e[20:]),
+			IsUser:        flags&1 != 0,
+			IsVirtualDisk: flags&2 != 0,
+			IsRequired:    flags&4 != 0,
+		}
+		copy(item.ItemID[:], e[0:16])
+
+		end := uint64(item.Offset) + uint64(item.Length)
+		if item.Length > 0 && (item.Offset < metadataTableSize || end > uint64(len(b))) {
+			return fmt.Errorf("vhdx: metadata item %s is out of the metadata region", item.ItemID)
+		}
+
+		d.Metadata = append(d.Metadata, item)
+		items[item.ItemID] = b[item.Offset:end]
+	}
+
+	for _, item := range d.Metadata {
+		if err := d.parseMetadataItem(item, items[item.ItemID]); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range []GUID{fileParametersGUID, virtualDiskSizeGUID, virtualDiskIDGUID, logicalSectorSizeGUID, physicalSectorSizeGUID} {
+		if _, ok := items[id]; !ok {
+			return fmt.Errorf("vhdx: missing metadata item %s", id)
+		}
+	}
+	if _, ok := items[parentLocatorGUID]; d.HasParent && !ok {
+		return errors.New("vhdx: the differencing disk has no parent locator")
+	}
+
+	return d.validateParameters()
+}
+
+func (d *Disk) parseMetadataItem(item MetadataItem, b []byte) error {
+	size := map[GUID]int{
+		fileParametersGUID:     8,
+		virtualDiskSizeGUID:    8,
+		virtualDiskIDGUID:      16,
+		logicalSectorSizeGUID:  4,
+		physicalSectorSizeGUID: 4,
+	}
+	if n, ok := size[item.ItemID]; ok && len(b) < n {
+		return fmt.Errorf("vhdx: metadata item %s is too small", item.ItemID)
+	}
+
+	switch item.ItemID {
+	case fileParametersGUID:
+		d.BlockSize = le.Uint32(b[0:])
+		flags := le.Uint32(b[4:])
+		d.LeaveBlocksAllocated = flags&1 != 0
+		d.HasParent = flags&2 != 0
+	case virtualDiskSizeGUID:
+		d.VirtualSize = le.Uint64(b)
+	case virtualDiskIDGUID:
+		copy(d.ID[:], b)
+	case logicalSectorSizeGUID:
+		d.LogicalSectorSize = le.Uint32(b)
+	case physicalSectorSizeGUID:
+		d.PhysicalSectorSize = le.Uint32(b)
+	case parentLocatorGUID:
+		locator, err := parseParentLocator(b)
+		if err != nil {
+			return err
+		}
+		d.ParentLocator = locator
+	default:
+		if item.IsRequired {
+			return fmt.Errorf("vhdx: unknown required metadata item %s", item.ItemID)
+		}
+	}
+
+	return nil
+}
+
+func parseParentLocator(b []byte) (map[string]string, error) {
+	if len(b) < 20 {
+		return nil, errors.New("vhdx: the parent locator is too small")
+	}
+
+	var locatorType GUID
+	copy(locatorType[:], b[0:16])
+	if locatorType != vhdxParentLocatorGUID {
+		return nil, fmt.Errorf("vhdx: unknown parent locator type %s", locatorType)
+	}
+
+	count := int(le.Uint16(b[18:]))
+	if 20+12*count > len(b) {
+		return nil, errors.New("vhdx: the parent locator is too small")
+	}
+
+	locator := make(map[string]string)
+	for i := 0; i < count; i++ {
+		e := b[20+12*i:]
+		keyOffset, valueOffset := int(le.Uint32(e[0:])), int(le.Uint32(e[4:]))
+		keyLength, valueLength := int(le.Uint16(e[8:])), int(le.Uint16(e[10:]))
+
+		if keyOffset+keyLength > len(b) || valueOffset+valueLength > len(b) {
+			return nil, errors.New("vhdx: a parent locator entry is out of the locator")
+		}
+
+		key := decodeUTF16(b[keyOffset : keyOffset+keyLength])
+		locator[key] = decodeUTF16(b[valueOffset : valueOffset+valueLength])
+	}
+
+	return locator, nil
+}
+
+func (d *Disk) validateParameters() error {
+	if d.BlockSize < MinBlockSize || d.BlockSize > MaxBlockSize || d.BlockSize&(d.BlockSize-1) != 0 {
+		return fmt.Errorf("vhdx: bad block size %d", d.BlockSize)
+	}
+
+	if d.LogicalSectorSize != 512 && d.LogicalSectorSize != 4096 {
+		return fmt.Errorf("vhdx: bad logical sector size %d", d.LogicalSectorSize)
+	}
+	if d.PhysicalSectorSize != 512 && d.PhysicalSectorSize != 4096 {
+		return fmt.Errorf("vhdx: bad physical sector size %d", d.PhysicalSectorSize)
+	}
+
+	if d.VirtualSize == 0 || d.VirtualSize > MaxVirtualSize || d.VirtualSize%uint64(d.LogicalSectorSize) != 0 {
+		return fmt.Errorf("vhdx: bad virtual size %d", d.VirtualSize)
+	}
+
+	return nil
+}
+
+func (d *Disk) readBAT(region *Region) error {
+	entries := totalBATEntries(d.VirtualSize, d.BlockSize, d.LogicalSectorSize, d.HasParent)
+	if uint64(region.Length) < entries*8 {
+		return errors.New("vhdx: the BAT region is too small")
+	}
+
+	b := make([]byte, entries*8)
+	if _, err := d.r.ReadAt(b, int64(region.FileOffset)); err != nil {
+		return err
+	}
+
+	d.BAT = make([]BATEntry, entries)
+	for i := range d.BAT {
+		d.BAT[i] = BATEntry(le.Uint64(b[8*i:]))
+	}
+
+	d.batOffset = int64(region.FileOffset)
+	return nil
+}
+
+// chunkRatio returns the number of payload blocks described by a sector
+// bitmap block.
+func chunkRatio(blockSize uint32, logicalSectorSize uint32) uint64 {
+	return sectorsPerBitmap * uint64(logicalSectorSize) / uint64(blockSize)
+}
+
+func totalBATEntries(virtualSize uint64, blockSize uint32, logicalSectorSize uint32, hasParent bool) uint64 {
+	blocks := (virtualSize + uint64(blockSize) - 1) / uint64(blockSize)
+	ratio := chunkRatio(blockSize, logicalSectorSize)
+
+	if hasParent {
+		chunks := (blocks + ratio - 1) / ratio
+		return chunks * (ratio + 1)
+	}
+	return blocks + (blocks-1)/ratio
+}
+
+// BlockCount returns the number of payload blocks of the disk.
+func (d *Disk) BlockCount() uint64 {
+	return (d.VirtualSize + uint64(d.BlockSize) - 1) / uint64(d.BlockSize)
+}
+
+// Block returns the BAT entry of the payload block given.
+func (d *Disk) Block(i uint64) BATEntry {
+	return d.BAT[d.batIndex(i)]
+}
+
+// Allocated reports whether any of the n bytes of the disk at offset off
+// may hold data, as opposed to reading as zeros for sure because their
+// blocks are not allocated in the disk or in its parent.
+func (d *Disk) Allocated(off int64, n int64) bool {
+	if n <= 0 || off >= d.Size() {
+		return false
+	}
+
+	end := off + n
+	if end > d.Size() {
+		end = d.Size()
+	}
+
+	first := uint64(off) / uint64(d.BlockSize)
+	last := uint64(end-1) / uint64(d.BlockSize)
+	for block := first; block <= last; block++ {
+		switch d.Block(block).State() {
+		case BlockFullyPresent, BlockPartiallyPresent:
+			return true
+		case BlockNotPresent:
+			if !d.HasParent {
+				continue
+			}
+
+			// a parent that cannot tell may hold data anywhere
+			parent, ok := d.Parent.(interface {
+				Allocated(int64, int64) bool
+			})
+			blockOffset := int64(block) * int64(d.BlockSize)
+			if !ok || parent.Allocated(blockOffset, int64(d.BlockSize)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// AllocatedSize returns the size in bytes of the payload blocks allocated
+// in the file, the actual size of the data of the disk as opposed to its
+// virtual size.
+func (d *Disk) AllocatedSize() int64 {
+	var size int64
+	for i := uint64(0); i < d.BlockCount(); i++ {
+		switch d.Block(i).State() {
+		case BlockFullyPresent, BlockPartiallyPresent:
+			size += int64(d.BlockSize)
+		}
+	}
+	return size
+}
+
+// Size returns the virtual size of the disk in bytes.
+func (d *Disk) Size() int64 {
+	return int64(d.VirtualSize)
+}
+
+// ReadAt reads the virtual contents of the disk. Blocks that are not
+// allocated read as zeros, or from the parent of a differencing disk.
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("vhdx: negative offset")
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= d.Size() {
+			return n, io.EOF
+		}
+
+		block := uint64(pos) / uint64(d.BlockSize)
+		inBlock := pos % int64(d.BlockSize)
+
+		chunk := p[n:]
+		if rest := int64(d.BlockSize) - inBlock; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if rest := d.Size() - pos; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+
+		if err := d.readBlock(block, inBlock, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+
+	return n, nil
+}
+
+func (d *Disk) readBlock(block uint64, inBlock int64, p []byte) error {
+	entry := d.Block(block)
+	pos := int64(block)*int64(d.BlockSize) + inBlock
+
+	switch entry.State() {
+	case BlockFullyPresent:
+		_, err := d.r.ReadAt(p, entry.FileOffset()+inBlock)
+		return err
+	case BlockPartiallyPresent:
+		return d.readSectors(block, entry, inBlock, p)
+	case BlockNotPresent:
+		if d.HasParent {
+			return d.readParent(p, pos)
+		}
+	}
+
+	for i := range p {
+		p[i] = 0
+	}
+	return nil
+}
+
+// readSectors reads a partially present block of a differencing disk,
+// sector by sector from the disk or from its parent as the sector bitmap
+// says.
+func (d *Disk) readSectors(block uint64, entry BATEntry, inBlock int64, p []byte) error {
+	ratio := chunkRatio(d.BlockSize, d.LogicalSectorSize)
+	bitmapEntry := d.BAT[(block/ratio)*(ratio+1)+ratio]
+	if bitmapEntry.State() != BlockFullyPresent {
+		return fmt.Errorf("vhdx: block %d is partially present without a sector bitmap", block)
+	}
+
+	// the sector of the chunk the block starts at
+	sectorSize := int64(d.LogicalSectorSize)
+	chunkSector := int64(block%ratio) * int64(d.BlockSize) / sectorSize
+
+	for n := 0; n < len(p); {
+		pos := inBlock + int64(n)
+		sector := chunkSector + pos/sectorSize
+
+		chunk := p[n:]
+		if rest := sectorSize - pos%sectorSize; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+
+		var bits [1]byte
+		if _, err := d.r.ReadAt(bits[:], bitmapEntry.FileOffset()+sector/8); err != nil {
+			return err
+		}
+
+		if bits[0]&(1<<uint(sector%8)) != 0 {
+			if _, err := d.r.ReadAt(chunk, entry.FileOffset()+pos); err != nil {
+				return err
+			}
+		} else if err := d.readParent(chunk, int64(block)*int64(d.BlockSize)+pos); err != nil {
+			return err
+		}
+
+		n += len(chunk)
+	}
+
+	return nil
+}
+
+func (d *Disk) readParent(p []byte, off int64) error {
+	if d.Parent == nil {
+		return ErrNoParent
+	}
+
+	_, err := d.Parent.ReadAt(p, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// OpenParent opens the parent of a differencing disk opened from a file,
+// found through the relative or absolute path of its parent locator, and
+// makes it the Parent of the disk. The parent must be the disk the
+// differencing disk was created from.
+func (d *Disk) OpenParent() (*Disk, error) {
+	if !d.HasParent {
+		return nil, errors.New("vhdx: not a differencing disk")
+	}
+
+	var paths []string
+	if relative := d.ParentLocator[RelativePath]; relative != "" && d.path != "" {
+		paths = append(paths, filepath.Join(filepath.Dir(d.path), filepath.FromSlash(strings.Replace(relative, `\`, "/", -1))))
+	}
+	if absolute := d.ParentLocator[AbsoluteWin32Path]; absolute != "" {
+		paths = append(paths, absolute)
+	}
+
+	for _, path := range paths {
+		parent, err := Open(path)
+		if err != nil {
+			continue
+		}
+
+		if linkage := d.ParentLocator[ParentLinkage]; !strings.EqualFold(linkage, parent.Header.DataWriteGUID.braced()) {
+			parent.Close()
+			return nil, fmt.Errorf("vhdx: %s has changed since the differencing disk was created", path)
+		}
+
+		d.Parent = parent
+		return parent, nil
+	}
+
+	return nil, fmt.Errorf("vhdx: the parent of the differencing disk was not found: %v", paths)
+}
+
+// braced returns the GUID as the parent locator stores it.
+func (g GUID) braced() string {
+	return "{" + strings.ToLower(g.String()) + "}"
+}
+
+// Close closes the file of a disk opened by Open, OpenFile or Create, and
+// its parent when it was opened by OpenParent.
+func (d *Disk) Close() error {
+	var err error
+	if parent, ok := d.Parent.(*Disk); ok {
+		err = parent.Close()
+	}
+	if d.f != nil {
+		if closeErr := d.f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = le.Uint16(b[2*i:])
+	}
+
+	if i := indexUint16(u, 0); i >= 0 {
+		u = u[:i]
+	}
+	return string(utf16.Decode(u))
+}
+
+func encodeUTF16(s string) []byte {
+	var buf bytes.Buffer
+	for _, u := range utf16.Encode([]rune(s)) {
+		binary.Write(&buf, le, u)
+	}
+	return buf.Bytes()
+}
+
+func indexUint16(u []uint16, v uint16) int {
+	for i := range u {
+		if u[i] == v {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,420 @@
+package vhdx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "vhdx")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return dir
+}
+
+func testCreate(t *testing.T, path string, options CreateOptions) *Disk {
+	d, err := Create(path, options)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return d
+}
+
+func testReadAt(t *testing.T, d *Disk, n int, off int64) []byte {
+	b := make([]byte, n)
+	if _, err := d.ReadAt(b, off); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return b
+}
+
+func TestGUID(t *testing.T) {
+	g, err := ParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := GUID{0x66, 0x77, 0xc2, 0x2d, 0x23, 0xf6, 0x00, 0x42, 0x9d, 0x64, 0x11, 0x5e, 0x9b, 0xfd, 0x4a, 0x08}
+	if g != expected {
+		t.Fatalf("bad: %x", g)
+	}
+	if g.String() != "2DC27766-F623-4200-9D64-115E9BFD4A08" {
+		t.Fatalf("bad: %s", g)
+	}
+
+	for _, s := range []string{"", "2DC27766F6234200-9D64-115E9BFD4A08", "2DC27766-F623-4200-9D64-115E9BFD4A0Z"} {
+		if _, err := ParseGUID(s); err == nil {
+			t.Fatalf("should error: %s", s)
+		}
+	}
+
+	a, _ := NewGUID()
+	b, _ := NewGUID()
+	if a == b || a.IsZero() {
+		t.Fatalf("bad: %s %s", a, b)
+	}
+}
+
+func TestCreate_dynamic(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disk.vhdx")
+	d := testCreate(t, path, CreateOptions{VirtualSize: 100 * MB, BlockSize: 2 * MB})
+	d.Close()
+
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer d.Close()
+
+	if d.Creator != "packer" {
+		t.Fatalf("bad creator: %s", d.Creator)
+	}
+	if d.Size() != 100*MB || d.BlockSize != 2*MB || d.BlockCount() != 50 {
+		t.Fatalf("bad size: %d %d", d.VirtualSize, d.BlockSize)
+	}
+	if d.LogicalSectorSize != 512 || d.PhysicalSectorSize != 4096 {
+		t.Fatalf("bad sector sizes: %d %d", d.LogicalSectorSize, d.PhysicalSectorSize)
+	}
+	if d.ID.IsZero() || d.LeaveBlocksAllocated || d.HasParent {
+		t.Fatalf("bad: %#v", d)
+	}
+	if len(d.Regions) != 2 || len(d.Metadata) != 5 {
+		t.Fatalf("bad: %#v %#v", d.Regions, d.Metadata)
+	}
+
+	// nothing is allocated, and the file holds only its structures
+	if d.AllocatedSize() != 0 {
+		t.Fatalf("bad allocated size: %d", d.AllocatedSize())
+	}
+	if d.FileSize != 4*MB {
+		t.Fatalf("bad file size: %d", d.FileSize)
+	}
+
+	if b := testReadAt(t, d, 4096, 99*MB); !bytes.Equal(b, make([]byte, 4096)) {
+		t.Fatal("should read zeros")
+	}
+
+	if _, err := d.WriteAt([]byte("data"), 0); err != ErrReadOnly {
+		t.Fatalf("bad: %s", err)
+	}
+}
+
+func TestCreate_fixed(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	d := testCreate(t, filepath.Join(dir, "disk.vhdx"), CreateOptions{VirtualSize: 5 * MB, BlockSize: MB, Fixed: true})
+	defer d.Close()
+
+	if !d.LeaveBlocksAllocated {
+		t.Fatal("should leave blocks allocated")
+	}
+	if d.AllocatedSize() != 5*MB || d.FileSize != 9*MB {
+		t.Fatalf("bad: %d %d", d.AllocatedSize(), d.FileSize)
+	}
+	for i := uint64(0); i < d.BlockCount(); i++ {
+		if entry := d.Block(i); entry.State() != BlockFullyPresent || entry.FileOffset() != int64(4+i)*MB {
+			t.Fatalf("bad block %d: %x", i, entry)
+		}
+	}
+}
+
+func TestCreate_bad(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	cases := []CreateOptions{
+		{},
+		{VirtualSize: MB + 1},
+		{VirtualSize: MaxVirtualSize + MB},
+		{VirtualSize: MB, BlockSize: 3 * MB},
+		{VirtualSize: MB, BlockSize: 512 * MB},
+		{VirtualSize: MB, LogicalSectorSize: 1024},
+		{VirtualSize: MB, ParentPath: filepath.Join(dir, "missing.vhdx")},
+	}
+	for _, options := range cases {
+		if _, err := Create(filepath.Join(dir, "disk.vhdx"), options); err == nil {
+			t.Fatalf("should error: %#v", options)
+		}
+	}
+
+	path := filepath.Join(dir, "disk.vhdx")
+	testCreate(t, path, CreateOptions{VirtualSize: MB}).Close()
+	if _, err := Create(path, CreateOptions{VirtualSize: MB}); err == nil {
+		t.Fatal("should not overwrite a disk")
+	}
+}
+
+func TestDisk_WriteAt(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disk.vhdx")
+	d := testCreate(t, path, CreateOptions{VirtualSize: 8 * MB, BlockSize: MB})
+	dataWriteGUID := d.Header.DataWriteGUID
+
+	// a write across two blocks allocates both
+	data := bytes.Repeat([]byte("packer"), 1000)
+	if _, err := d.WriteAt(data, MB-100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := d.WriteAt([]byte("again"), MB); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	d.Close()
+
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer d.Close()
+
+	if d.Header.DataWriteGUID == dataWriteGUID {
+		t.Fatal("should change the data write GUID")
+	}
+	if d.AllocatedSize() != 2*MB || d.FileSize != 6*MB {
+		t.Fatalf("bad: %d %d", d.AllocatedSize(), d.FileSize)
+	}
+
+	if !d.Allocated(MB-100, 10) || !d.Allocated(0, 8*MB) || d.Allocated(2*MB, 6*MB) {
+		t.Fatal("bad allocation")
+	}
+
+	copy(data[100:], "again")
+	if b := testReadAt(t, d, len(data), MB-100); !bytes.Equal(b, data) {
+		t.Fatal("bad data")
+	}
+	if b := testReadAt(t, d, 100, MB-200); !bytes.Equal(b, make([]byte, 100)) {
+		t.Fatal("should read zeros")
+	}
+
+	// reads stop at the end of the disk
+	b := make([]byte, 200)
+	if n, err := d.ReadAt(b, 8*MB-100); n != 100 || err == nil {
+		t.Fatalf("bad: %d %s", n, err)
+	}
+}
+
+func TestDisk_differencing(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	parentPath := filepath.Join(dir, "parent.vhdx")
+	parent := testCreate(t, parentPath, CreateOptions{VirtualSize: 4 * MB, BlockSize: MB})
+	if _, err := parent.WriteAt([]byte("parent"), 0); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := parent.WriteAt([]byte("parent"), 3*MB); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	parent.Close()
+
+	if _, err := Create(filepath.Join(dir, "bad.vhdx"), CreateOptions{VirtualSize: 8 * MB, ParentPath: parentPath}); err == nil {
+		t.Fatal("should error on a size other than the parent's")
+	}
+
+	path := filepath.Join(dir, "child.vhdx")
+	d := testCreate(t, path, CreateOptions{BlockSize: MB, ParentPath: parentPath})
+	d.Close()
+
+	d, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer d.Close()
+
+	if !d.HasParent || d.Size() != 4*MB {
+		t.Fatalf("bad: %#v", d)
+	}
+	if d.ParentLocator[RelativePath] != `.\parent.vhdx` || d.ParentLocator[AbsoluteWin32Path] != parentPath {
+		t.Fatalf("bad locator: %#v", d.ParentLocator)
+	}
+
+	if _, err := d.ReadAt(make([]byte, 6), 0); err != ErrNoParent {
+		t.Fatalf("bad: %s", err)
+	}
+	if _, err := d.OpenParent(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if b := testReadAt(t, d, 6, 0); string(b) != "parent" {
+		t.Fatalf("bad: %q", b)
+	}
+
+	// the blocks of the parent are allocated in the differencing disk too
+	if !d.Allocated(0, MB) || d.Allocated(MB, 2*MB) {
+		t.Fatal("bad allocation")
+	}
+
+	// a write allocates the block with the data of the parent
+	if _, err := d.WriteAt([]byte("child"), 3*MB+100); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if b := testReadAt(t, d, 6, 3*MB); string(b) != "parent" {
+		t.Fatalf("bad: %q", b)
+	}
+	if b := testReadAt(t, d, 5, 3*MB+100); string(b) != "child" {
+		t.Fatalf("bad: %q", b)
+	}
+	if d.AllocatedSize() != MB {
+		t.Fatalf("bad allocated size: %d", d.AllocatedSize())
+	}
+
+	parent, err = Open(parentPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer parent.Close()
+	if b := testReadAt(t, parent, 5, 3*MB+100); !bytes.Equal(b, make([]byte, 5)) {
+		t.Fatal("should not change the parent")
+	}
+}
+
+func TestDisk_partiallyPresent(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	parentPath := filepath.Join(dir, "parent.vhdx")
+	parent := testCreate(t, parentPath, CreateOptions{VirtualSize: 2 * MB, BlockSize: MB})
+	parent.WriteAt(bytes.Repeat([]byte("p"), 2*MB), 0)
+	parent.Close()
+
+	path := filepath.Join(dir, "child.vhdx")
+	d := testCreate(t, path, CreateOptions{BlockSize: MB, ParentPath: parentPath})
+	if _, err := d.WriteAt(bytes.Repeat([]byte("c"), MB), MB); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// as Hyper-V leaves a block only some sectors of which were written,
+	// with a sector bitmap holding only the second sector of the block
+	entry := d.Block(1)
+	if err := d.setBlock(1, newBATEntry(BlockPartiallyPresent, entry.FileOffset())); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	bitmapOffset := alignUp(d.FileSize, MB)
+	bitmap := make([]byte, MB)
+	sector := MB/512 + 1
+	bitmap[sector/8] = 1 << uint(sector%8)
+	if _, err := d.f.WriteAt(bitmap, bitmapOffset); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ratio := chunkRatio(d.BlockSize, d.LogicalSectorSize)
+	d.BAT[ratio] = newBATEntry(BlockFullyPresent, bitmapOffset)
+	if _, err := d.f.WriteAt(d.marshalBAT(), d.batOffset); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	d.Close()
+
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer d.Close()
+	if _, err := d.OpenParent(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	b := testReadAt(t, d, 1536, MB)
+	expected := append(bytes.Repeat([]byte("p"), 512), bytes.Repeat([]byte("c"), 512)...)
+	expected = append(expected, bytes.Repeat([]byte("p"), 512)...)
+	if !bytes.Equal(b, expected) {
+		t.Fatal("bad data")
+	}
+}
+
+func TestDisk_OpenParent_changed(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	parentPath := filepath.Join(dir, "parent.vhdx")
+	testCreate(t, parentPath, CreateOptions{VirtualSize: MB}).Close()
+
+	path := filepath.Join(dir, "child.vhdx")
+	testCreate(t, path, CreateOptions{ParentPath: parentPath}).Close()
+
+	parent, err := OpenFile(parentPath)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	parent.WriteAt([]byte("changed"), 0)
+	parent.Close()
+
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer d.Close()
+
+	if _, err := d.OpenParent(); err == nil {
+		t.Fatal("should error on a parent written since")
+	}
+}
+
+func TestRead_headers(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disk.vhdx")
+	d := testCreate(t, path, CreateOptions{VirtualSize: MB})
+	sequenceNumber := d.Header.SequenceNumber
+	d.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	info, _ := f.Stat()
+
+	// a corrupt current header falls back to the other one
+	f.WriteAt([]byte{0xff}, header2Offset+100)
+	d, err = Read(f, info.Size())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if d.Header.SequenceNumber != sequenceNumber-1 {
+		t.Fatalf("bad sequence number: %d", d.Header.SequenceNumber)
+	}
+
+	// a log to replay is refused
+	d.Header.SequenceNumber = sequenceNumber + 1
+	d.Header.LogGUID, _ = NewGUID()
+	f.WriteAt(d.Header.marshal(), header1Offset)
+	if _, err := Read(f, info.Size()); err != ErrLog {
+		t.Fatalf("bad: %s", err)
+	}
+
+	f.WriteAt([]byte{0xff}, header1Offset+100)
+	if _, err := Read(f, info.Size()); err == nil {
+		t.Fatal("should error without a valid header")
+	}
+
+	f.WriteAt([]byte("notvhdx!"), 0)
+	if _, err := Read(f, info.Size()); err == nil {
+		t.Fatal("should error on a file that is not VHDX")
+	}
+}
+
+func TestOpen_bad(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "disk.vhdx")
+	if _, err := Open(path); err == nil {
+		t.Fatal("should error on a missing file")
+	}
+
+	ioutil.WriteFile(path, []byte("vhdxfile"), 0644)
+	if _, err := Open(path); err == nil {
+		t.Fatal("should error on a truncated file")
+	}
+}
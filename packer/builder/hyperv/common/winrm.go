@@ -0,0 +1,48 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/communicator/winrm"
+	"github.com/mitchellh/multistep"
+)
+
+func WinRMAddress(config WinRMConfig) func(multistep.StateBag) (string, error) {
+	return func(state multistep.StateBag) (string, error) {
+		ip, err := getVMAddress(state)
+		if err != nil {
+			return "", err
+		}
+
+		return net.JoinHostPort(ip, strconv.Itoa(int(config.WinRMPort))), nil
+	}
+}
+
+func WinRMConfigFunc(config WinRMConfig) func(multistep.StateBag) (*winrm.Config, error) {
+	return func(state multistep.StateBag) (*winrm.Config, error) {
+		var caCert []byte
+		if config.WinRMCACertPath != "" {
+			var err error
+			caCert, err = ioutil.ReadFile(config.WinRMCACertPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return &winrm.Config{
+			Username:  config.WinRMUser,
+			Password:  config.WinRMPassword,
+			Https:     config.WinRMUseSSL,
+			Insecure:  config.WinRMInsecure,
+			CACert:    caCert,
+			Transport: config.WinRMTransport,
+			Timeout:   config.WinRMTimeout,
+		}, nil
+	}
+}
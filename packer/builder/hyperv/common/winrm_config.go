@@ -0,0 +1,101 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/communicator/winrm"
+	"github.com/mitchellh/packer/packer"
+)
+
+type WinRMConfig struct {
+	WinRMUser           string `mapstructure:"winrm_username"`
+	WinRMPassword       string `mapstructure:"winrm_password"`
+	WinRMPort           uint   `mapstructure:"winrm_port"`
+	WinRMUseSSL         bool   `mapstructure:"winrm_use_ssl"`
+	WinRMInsecure       bool   `mapstructure:"winrm_insecure"`
+	WinRMCACertPath     string `mapstructure:"winrm_cacert"`
+	WinRMTransport      string `mapstructure:"winrm_transport"`
+	RawWinRMTimeout     string `mapstructure:"winrm_timeout"`
+	RawWinRMWaitTimeout string `mapstructure:"winrm_wait_timeout"`
+
+	WinRMTimeout     time.Duration
+	WinRMWaitTimeout time.Duration
+}
+
+func (c *WinRMConfig) Prepare(t *packer.ConfigTemplate) []error {
+	if c.WinRMPort == 0 {
+		if c.WinRMUseSSL {
+			c.WinRMPort = 5986
+		} else {
+			c.WinRMPort = 5985
+		}
+	}
+
+	if c.WinRMTransport == "" {
+		c.WinRMTransport = winrm.TransportBasic
+	}
+
+	if c.RawWinRMTimeout == "" {
+		c.RawWinRMTimeout = "60s"
+	}
+
+	if c.RawWinRMWaitTimeout == "" {
+		c.RawWinRMWaitTimeout = "20m"
+	}
+
+	templates := map[string]*string{
+		"winrm_username":     &c.WinRMUser,
+		"winrm_password":     &c.WinRMPassword,
+		"winrm_cacert":       &c.WinRMCACertPath,
+		"winrm_transport":    &c.WinRMTransport,
+		"winrm_timeout":      &c.RawWinRMTimeout,
+		"winrm_wait_timeout": &c.RawWinRMWaitTimeout,
+	}
+
+	errs := make([]error, 0)
+	for n, ptr := range templates {
+		var err error
+		*ptr, err = t.Process(*ptr, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error processing %s: %s", n, err))
+		}
+	}
+
+	if c.WinRMUser == "" {
+		errs = append(errs, errors.New("A winrm_username must be specified."))
+	}
+
+	if c.WinRMTransport != winrm.TransportBasic && c.WinRMTransport != winrm.TransportNTLM {
+		errs = append(errs, fmt.Errorf("winrm_transport must be either %s or %s", winrm.TransportBasic, winrm.TransportNTLM))
+	}
+
+	if c.WinRMCACertPath != "" {
+		if !c.WinRMUseSSL {
+			errs = append(errs, errors.New("winrm_cacert requires winrm_use_ssl"))
+		}
+
+		if _, err := ioutil.ReadFile(c.WinRMCACertPath); err != nil {
+			errs = append(errs, fmt.Errorf("winrm_cacert is invalid: %s", err))
+		}
+	}
+
+	var err error
+	c.WinRMTimeout, err = time.ParseDuration(c.RawWinRMTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_timeout: %s", err))
+	}
+
+	c.WinRMWaitTimeout, err = time.ParseDuration(c.RawWinRMWaitTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Failed parsing winrm_wait_timeout: %s", err))
+	}
+
+	return errs
+}
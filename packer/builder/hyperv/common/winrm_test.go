@@ -0,0 +1,92 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mitchellh/multistep"
+)
+
+func TestWinRMAddress(t *testing.T) {
+	cases := map[string]string{
+		"192.168.1.42": "192.168.1.42:5985",
+		"fe80::1%eth0": "[fe80::1%eth0]:5985",
+		"2001:db8::42": "[2001:db8::42]:5985",
+	}
+
+	for ip, expected := range cases {
+		state, driver := testStateWithVM(t)
+		if err := driver.StartVirtualMachine("vm"); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		driver.VMs["vm"].NetworkAdapters[0].IPAddress = ip
+
+		address, err := WinRMAddress(WinRMConfig{WinRMPort: 5985})(state)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if address != expected {
+			t.Fatalf("bad address for %s: %s", ip, address)
+		}
+	}
+}
+
+func TestWinRMAddress_noAddress(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	if err := driver.StartVirtualMachine("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// the VM has no address yet, which the caller retries
+	if _, err := WinRMAddress(WinRMConfig{WinRMPort: 5985})(state); err == nil {
+		t.Fatal("should have error")
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT put an error in the state")
+	}
+}
+
+func TestStepConnectWinRM_waitForAddress(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	if err := driver.StartVirtualMachine("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	step := testStepConnectWinRM("")
+	step.WinRMAddress = WinRMAddress(WinRMConfig{WinRMPort: 5985})
+	step.WinRMWaitTimeout = 50 * time.Millisecond
+
+	if action := step.Run(state); action != multistep.ActionHalt {
+		t.Fatalf("bad action: %#v", action)
+	}
+	if err, ok := state.GetOk("error"); !ok || err.(error).Error() != "Timeout waiting for WinRM." {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestStepConnectWinRM_cancelWaitForAddress(t *testing.T) {
+	state, driver := testStateWithVM(t)
+	if err := driver.StartVirtualMachine("vm"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	state.Put(multistep.StateCancelled, true)
+
+	step := testStepConnectWinRM("")
+	step.WinRMAddress = WinRMAddress(WinRMConfig{WinRMPort: 5985})
+	step.WinRMWaitTimeout = time.Hour
+
+	done := make(chan multistep.StepAction, 1)
+	go func() { done <- step.Run(state) }()
+
+	select {
+	case action := <-done:
+		if action != multistep.ActionHalt {
+			t.Fatalf("bad action: %#v", action)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("should stop waiting when the build is cancelled")
+	}
+	if _, ok := state.GetOk("error"); ok {
+		t.Fatal("should NOT have error")
+	}
+}
@@ -5,17 +5,16 @@
 package iso
 
 import (
-	"code.google.com/p/go-uuid/uuid"
 	"errors"
 	"fmt"
-	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
-	"github.com/MSOpenTech/packer-hyperv/packer/powershell/hyperv"
+	hypervcommon "github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common"
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/vhdx"
 	"github.com/mitchellh/multistep"
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/packer"
-	hypervcommon "hyperv/common"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -23,14 +22,18 @@ import (
 
 const (
 	DefaultDiskSize = 127 * 1024   // 127GB
-	MinDiskSize     = 10 * 1024    // 10GB
 	MaxDiskSize     = 65536 * 1024 // 64TB
 
-	DefaultRamSize = 1024  // 1GB
-	MinRamSize     = 512   // 512MB
-	MaxRamSize     = 32768 // 32GB
+	MaxDiskBlockSize = 256 // 256MB
 
-	LowRam = 512 // 512MB
+	// leaves room on the SCSI controller of a generation 2 VM for the boot
+	// disk and the DVD drives
+	MaxAdditionalDisks = 60
+
+	DefaultRamSize = 1024 // 1GB
+
+	DefaultFloppyLabel = "PACKER"
+	DefaultCDLabel     = "PACKER"
 
 	//DefaultUsername = "vagrant1"
 	//DefaultPassword = "vagrant1"
@@ -47,6 +50,22 @@ type config struct {
 	// The size, in megabytes, of the hard disk to create for the VM.
 	// By default, this is 130048 (about 127 GB).
 	DiskSize uint `mapstructure:"disk_size"`
+	// The type of the hard disks, "dynamic" for disks growing as they are
+	// written to or "fixed" for disks allocated in full when created.
+	// By default, this is "dynamic".
+	DiskType string `mapstructure:"disk_type"`
+	// The block size, in megabytes, of the hard disks, a power of 2 up to
+	// 256. By default, Hyper-V picks the block size.
+	DiskBlockSize uint `mapstructure:"disk_block_size"`
+	// The sizes, in megabytes, of data disks to create and attach to a SCSI
+	// controller of the VM, in addition to the hard disk the OS is installed
+	// to. By default, there are no data disks.
+	AdditionalDiskSize []uint `mapstructure:"disk_additional_size"`
+	// Creates the hard disk as a differencing disk of the disk at
+	// differencing_disk_parent, so that only the changes are written to it.
+	// The disk_size is then ignored. By default, an empty disk is created.
+	UseDifferencingDisk    bool   `mapstructure:"use_differencing_disk"`
+	DifferencingDiskParent string `mapstructure:"differencing_disk_parent"`
 	// The size, in megabytes, of the computer memory in the VM.
 	// By default, this is 1024 (about 1 GB).
 	RamSizeMB uint `mapstructure:"ram_size_mb"`
@@ -55,57 +74,42 @@ type config struct {
 	// which look for an Autounattend.xml file on removable media. By default,
 	// no floppy will be attached. All files listed in this setting get
 	// placed into the root directory of the floppy and the floppy is attached
-	// as the first floppy device. Currently, no support exists for creating
-	// sub-directories on the floppy. Wildcard characters (*, ?, and [])
+	// as the first floppy device. Wildcard characters (*, ?, and [])
 	// are allowed. Directory names are also allowed, which will add all
-	// the files found in the directory to the floppy.
+	// the files found in the directory to the floppy. Generation 2 VMs
+	// have no floppy drive, so the files are put on a secondary DVD.
 	FloppyFiles []string `mapstructure:"floppy_files"`
+	// A list of directories to place onto the floppy, keeping the structure
+	// of their sub-directories. A directory is placed under its own name,
+	// or when its path ends with a slash, its contents are placed into the
+	// root directory of the floppy.
+	FloppyDirs []string `mapstructure:"floppy_dirs"`
+	// A list of files and directories to place onto a CD that is attached as
+	// a secondary DVD when the VM is booted, keeping the structure of the
+	// directories like floppy_dirs. By default, no CD will be attached.
+	CDFiles []string `mapstructure:"cd_files"`
+	// The volume label of the CD. By default, this is "PACKER".
+	CDLabel string `mapstructure:"cd_label"`
+	// Process the files of the floppy and the CD as templates of the HTTP
+	// server, such as an answer file holding the URL of the http_directory.
+	// By default, the files are copied as they are.
+	TemplateFiles bool `mapstructure:"template_files"`
 	//
 	SecondaryDvdImages []string `mapstructure:"secondary_iso_images"`
-	// The checksum for the OS ISO file. Because ISO files are so large,
-	// this is required and Packer will verify it prior to booting a virtual
-	// machine with the ISO attached. The type of the checksum is specified
-	// with iso_checksum_type, documented below.
-	ISOChecksum string `mapstructure:"iso_checksum"`
-	// The type of the checksum specified in iso_checksum. Valid values are
-	// "none", "md5", "sha1", "sha256", or "sha512" currently. While "none"
-	// will skip checksumming, this is not recommended since ISO files are
-	// generally large and corruption does happen from time to time.
-	ISOChecksumType string `mapstructure:"iso_checksum_type"`
-	// A URL to the ISO containing the installation image. This URL can be
-	// either an HTTP URL or a file URL (or path to a file). If this is an
-	// HTTP URL, Packer will download it and cache it between runs.
-	RawSingleISOUrl string `mapstructure:"iso_url"`
-	// Multiple URLs for the ISO to download. Packer will try these in order.
-	// If anything goes wrong attempting to download or while downloading a
-	// single URL, it will move on to the next. All URLs must point to the
-	// same file (same checksum). By default this is empty and iso_url is
-	// used. Only one of iso_url or iso_urls can be specified.
-	ISOUrls []string `mapstructure:"iso_urls"`
-	// This is the name of the new virtual machine.
-	// By default this is "packer-BUILDNAME", where "BUILDNAME" is the name of the build.
-	VMName string `mapstructure:"vm_name"`
 	//user and password strings from config
 	ProductKey string `mapstructure:"product_key"`
 
-	common.PackerConfig         `mapstructure:",squash"`
-	hypervcommon.OutputConfig   `mapstructure:",squash"`
-	hypervcommon.SSHConfig      `mapstructure:",squash"`
-	hypervcommon.ShutdownConfig `mapstructure:",squash"`
-	VlanID                      string `mapstructure:"VlanID"`
-	SwitchName                  string `mapstructure:"switch_name"`
+	hypervcommon.BuilderConfig    `mapstructure:",squash"`
+	hypervcommon.ISOConfig        `mapstructure:",squash"`
+	hypervcommon.GenerationConfig `mapstructure:",squash"`
 
 	//Username string `mapstructure:"Username"`
 	//Password string `mapstructure:"Password"`
 
-	Communicator string `mapstructure:"communicator"`
-
 	// The time in seconds to wait for the virtual machine to report an IP address.
 	// This defaults to 120 seconds. This may have to be increased if your VM takes longer to boot.
 	IPAddressTimeout time.Duration `mapstructure:"ip_address_timeout"`
 
-	SSHWaitTimeout time.Duration
-
 	tpl *packer.ConfigTemplate
 }
 
@@ -128,51 +132,56 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 
 	// Accumulate any errors and warnings
 	errs := common.CheckUnusedConfig(md)
-	errs = packer.MultiErrorAppend(errs, b.config.OutputConfig.Prepare(b.config.tpl, &b.config.PackerConfig)...)
-	errs = packer.MultiErrorAppend(errs, b.config.SSHConfig.Prepare(b.config.tpl)...)
-	errs = packer.MultiErrorAppend(errs, b.config.ShutdownConfig.Prepare(b.config.tpl)...)
+	isoWarnings, isoErrs := b.config.ISOConfig.Prepare(b.config.tpl)
+	errs = packer.MultiErrorAppend(errs, isoErrs...)
+	errs = packer.MultiErrorAppend(errs, b.config.BuilderConfig.Prepare(b.config.tpl)...)
 
 	warnings := make([]string, 0)
+	warnings = append(warnings, isoWarnings...)
 
-	err = b.checkDiskSize()
+	diskWarnings, diskErrs := b.checkDiskSize()
+	warnings = appendWarnings(warnings, diskWarnings...)
+	errs = packer.MultiErrorAppend(errs, diskErrs...)
+
+	err = b.checkDiskType()
 	if err != nil {
 		errs = packer.MultiErrorAppend(errs, err)
 	}
 
-	err = b.checkRamSize()
+	err = b.checkAdditionalDiskSize()
 	if err != nil {
 		errs = packer.MultiErrorAppend(errs, err)
 	}
 
-	if b.config.VMName == "" {
-		b.config.VMName = fmt.Sprintf("pvm_%s", uuid.New())
+	if b.config.RamSizeMB == 0 {
+		b.config.RamSizeMB = DefaultRamSize
 	}
 
-	if b.config.SwitchName == "" {
-		// no switch name, try to get one attached to a online network adapter
-		onlineSwitchName, err := hyperv.GetExternalOnlineVirtualSwitch()
-		if onlineSwitchName == "" || err != nil {
-			b.config.SwitchName = fmt.Sprintf("pis_%s", uuid.New())
-		} else {
-			b.config.SwitchName = onlineSwitchName
-		}
+	errs = packer.MultiErrorAppend(errs, b.config.GenerationConfig.Prepare()...)
+
+	err = b.checkSecondaryDvdImages()
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
 	}
 
-	log.Println(fmt.Sprintf("Using switch %s", b.config.SwitchName))
+	if b.config.Generation == 2 && (len(b.config.FloppyFiles) > 0 || len(b.config.FloppyDirs) > 0) {
+		warnings = appendWarnings(warnings,
+			"Generation 2 VMs have no floppy drive. The floppy_files and floppy_dirs will be\n"+
+				"put on a secondary DVD instead.")
+	}
 
-	if b.config.Communicator == "" {
-		b.config.Communicator = "ssh"
-	} else if b.config.Communicator == "ssh" || b.config.Communicator == "winrm" {
-		// good
-	} else {
-		err = errors.New("communicator must be either ssh or winrm")
-		errs = packer.MultiErrorAppend(errs, err)
+	if b.config.CDLabel == "" {
+		b.config.CDLabel = DefaultCDLabel
 	}
 
+	vmWarnings, vmErrs := b.config.BuilderConfig.PrepareVM(b.config.tpl, hypervcommon.HostDriver(), b.config.RamSizeMB, b.config.Generation)
+	warnings = appendWarnings(warnings, vmWarnings...)
+	errs = packer.MultiErrorAppend(errs, vmErrs...)
+
 	// Errors
 	templates := map[string]*string{
-		"iso_url":     &b.config.RawSingleISOUrl,
-		"product_key": &b.config.ProductKey,
+		"product_key":              &b.config.ProductKey,
+		"differencing_disk_parent": &b.config.DifferencingDiskParent,
 	}
 
 	for n, ptr := range templates {
@@ -183,6 +192,32 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 		}
 	}
 
+	err = b.checkDifferencingDisk()
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	if b.config.UseDifferencingDisk {
+		for _, k := range md.Keys {
+			if k != "disk_size" {
+				continue
+			}
+
+			// a parent of the same size as disk_size makes no difference
+			parentSize := b.getDifferencingDiskParentSize()
+			if parentSize == 0 {
+				warnings = appendWarnings(warnings,
+					"The disk_size is ignored with use_differencing_disk, the hard disk takes the\n"+
+						"size of the differencing_disk_parent.")
+			} else if parentSize != b.config.DiskSize {
+				warnings = appendWarnings(warnings,
+					fmt.Sprintf("The disk_size of %v MB is ignored with use_differencing_disk, the hard disk\n"+
+						"takes the size of the differencing_disk_parent, %v MB.", b.config.DiskSize, parentSize))
+			}
+			break
+		}
+	}
+
 	// TODO: remove product key, use Autounattend.xml on a floppy instead
 	pk := strings.TrimSpace(b.config.ProductKey)
 	if len(pk) != 0 {
@@ -195,32 +230,8 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 		}
 	}
 
-	log.Println(fmt.Sprintf("%s: %v", "VMName", b.config.VMName))
-	log.Println(fmt.Sprintf("%s: %v", "SwitchName", b.config.SwitchName))
 	log.Println(fmt.Sprintf("%s: %v", "ProductKey", b.config.ProductKey))
-	log.Println(fmt.Sprintf("%s: %v", "Communicator", b.config.Communicator))
-
-	if b.config.RawSingleISOUrl == "" {
-		errs = packer.MultiErrorAppend(errs, errors.New("iso_url: The option can't be missed and a path must be specified."))
-	} else if _, err := os.Stat(b.config.RawSingleISOUrl); err != nil {
-		errs = packer.MultiErrorAppend(errs, errors.New("iso_url: Check the path is correct"))
-	}
-
-	log.Println(fmt.Sprintf("%s: %v", "RawSingleISOUrl", b.config.RawSingleISOUrl))
-
-	b.config.SSHWaitTimeout, err = time.ParseDuration(b.config.RawSSHWaitTimeout)
-
-	// Warnings
-	warning := b.checkHostAvailableMemory()
-	if warning != "" {
-		warnings = appendWarnings(warnings, warning)
-	}
-
-	if b.config.ShutdownCommand == "" {
-		warnings = append(warnings,
-			"A shutdown_command was not specified. Without a shutdown command, Packer\n"+
-				"will forcibly halt the virtual machine, which may result in data loss.")
-	}
+	log.Println(fmt.Sprintf("%s: %v", "ISOUrls", b.config.ISOUrls))
 
 	if errs != nil && len(errs.Errors) > 0 {
 		return warnings, errs
@@ -232,6 +243,8 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
 // Run executes a Packer build and returns a packer.Artifact representing
 // a Hyperv appliance.
 func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
+	buildStarted := time.Now()
+
 	// Create the driver that we'll use to communicate with Hyperv
 	driver, err := hypervcommon.NewHypervPS4Driver()
 	if err != nil {
@@ -240,52 +253,70 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 
 	// Set up the state.
 	state := new(multistep.BasicStateBag)
+	state.Put("cache", cache)
 	state.Put("config", &b.config)
 	state.Put("driver", driver)
 	state.Put("hook", hook)
 	state.Put("ui", ui)
 
 	steps := []multistep.Step{
+		&common.StepDownload{
+			Checksum:     b.config.ISOChecksum,
+			ChecksumType: b.config.ISOChecksumType,
+			Description:  "ISO",
+			ResultKey:    "iso_path",
+			Url:          b.config.ISOUrls,
+		},
 		&hypervcommon.StepCreateTempDir{},
 		&hypervcommon.StepOutputDir{
 			Force: b.config.PackerForce,
 			Path:  b.config.OutputDir,
 		},
-		&hypervcommon.StepSetUnattendedProductKey{
-			Files:      b.config.FloppyFiles,
-			ProductKey: b.config.ProductKey,
-		},
-		&common.StepCreateFloppy{
-			Files: b.config.FloppyFiles,
-		},
-		&hypervcommon.StepCreateSwitch{
-			SwitchName: b.config.SwitchName,
-		},
+		b.config.CreateSwitchStep(),
 		&hypervcommon.StepCreateVM{
 			VMName:     b.config.VMName,
-			SwitchName: b.config.SwitchName,
+			SwitchName: b.config.NetworkAdapters[0].SwitchName,
 			RamSizeMB:  b.config.RamSizeMB,
 			DiskSize:   b.config.DiskSize,
+
+			DiskType:               b.config.DiskType,
+			DiskBlockSize:          b.config.DiskBlockSize,
+			AdditionalDiskSize:     b.config.AdditionalDiskSize,
+			DifferencingDiskParent: b.getDifferencingDiskParent(),
+
+			Generation:         b.config.Generation,
+			EnableSecureBoot:   b.config.EnableSecureBoot,
+			SecureBootTemplate: b.config.SecureBootTemplate,
 		},
-		&hypervcommon.StepConfigureVlan{
-			VlanID: b.config.VlanID,
+	}
+
+	steps = append(steps, b.config.ConfigureVMSteps()...)
+
+	steps = append(steps,
+		// the floppy and the CD are created once the HTTP server runs, as
+		// their files may be templates of its address
+		b.config.HTTPServerStep(),
+		&hypervcommon.StepSetUnattendedProductKey{
+			Files:      b.config.FloppyFiles,
+			ProductKey: b.config.ProductKey,
 		},
-		&hypervcommon.StepEnableIntegrationService{},
+		b.getFloppyStep(),
+		b.getCDStep(),
 
 		&hypervcommon.StepMountDvdDrive{
-			RawSingleISOUrl: b.config.RawSingleISOUrl,
+			Generation: b.config.Generation,
 		},
 		&hypervcommon.StepMountFloppydrive{},
 
-		&hypervcommon.StepMountSecondaryDvdImages{},
-
-		//
-		//
-		//
-		&hypervcommon.StepStartVm{
-			Reason: "OS installation",
+		&hypervcommon.StepMountSecondaryDvdImages{
+			Files:      b.config.SecondaryDvdImages,
+			Generation: b.config.Generation,
 		},
+	)
+
+	steps = append(steps, b.config.BootSteps("OS installation", b.config.tpl)...)
 
+	steps = append(steps,
 		// wait for the vm to be powered off
 		&hypervcommon.StepWaitForPowerOff{},
 
@@ -300,14 +331,8 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		},
 
 		// configure the communicator ssh, winrm
-		b.getCommunicatorStep(b.config),
-
-		// new(hypervcommon.StepConfigureIp),
-
-		//&hypervcommon.StepSetRemoting{
-		//	Username: b.config.Username,
-		//	Password: b.config.Password,
-		//},
+		b.config.CommunicatorStep(),
+		b.config.HTTPEnvironmentStep(),
 
 		// &hypervcommon.StepCheckRemoting{},
 
@@ -318,46 +343,21 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 
 		&hypervcommon.StepUnmountFloppyDrive{},
 		&hypervcommon.StepUnmountDvdDrive{},
+	)
 
-		//&hypervcommon.StepStopVm{},
-		&hypervcommon.StepShutdown{
-			Command: b.config.ShutdownCommand,
-			Timeout: b.config.ShutdownTimeout,
-		},
-
-		&hypervcommon.StepExportVm{
-			OutputDir: b.config.OutputDir,
-		},
-
-		// the clean up actions for each step will be executed reverse order
-	}
+	// the clean up actions for each step will be executed reverse order
+	steps = append(steps, b.config.ExportSteps(b.config.RamSizeMB, b.config.Generation)...)
 
 	// Run the steps.
-	if b.config.PackerDebug {
-		b.runner = &multistep.DebugRunner{
-			Steps:   steps,
-			PauseFn: common.MultistepDebugFn(ui),
-		}
-	} else {
-		b.runner = &multistep.BasicRunner{Steps: steps}
-	}
+	b.runner = hypervcommon.NewRunner(steps, b.config.PackerConfig, ui)
 	b.runner.Run(state)
 
-	// Report any errors.
-	if rawErr, ok := state.GetOk("error"); ok {
-		return nil, rawErr.(error)
-	}
-
-	// If we were interrupted or cancelled, then just exit.
-	if _, ok := state.GetOk(multistep.StateCancelled); ok {
-		return nil, errors.New("Build was cancelled.")
-	}
-
-	if _, ok := state.GetOk(multistep.StateHalted); ok {
-		return nil, errors.New("Build was halted.")
+	if err := hypervcommon.BuildError(state); err != nil {
+		return nil, err
 	}
 
-	return hypervcommon.NewArtifact(b.config.OutputDir)
+	compaction, _ := state.Get("disk_compaction").(map[string]hypervcommon.DiskCompaction)
+	return hypervcommon.NewArtifact(b.config.OutputDir, b.config.VMName, b.config.Generation, buildStarted, compaction)
 }
 
 // Cancel.
@@ -382,62 +382,167 @@ func appendWarnings(slice []string, data ...string) []string {
 	return slice
 }
 
-func (b *Builder) checkDiskSize() error {
+func (b *Builder) checkDiskSize() ([]string, []error) {
 	if b.config.DiskSize == 0 {
 		b.config.DiskSize = DefaultDiskSize
 	}
 
 	log.Println(fmt.Sprintf("%s: %v", "DiskSize", b.config.DiskSize))
 
-	if b.config.DiskSize < MinDiskSize {
-		return fmt.Errorf("disk_size_gb: Windows server requires disk space >= %v GB, but defined: %v", MinDiskSize, b.config.DiskSize/1024)
-	} else if b.config.DiskSize > MaxDiskSize {
-		return fmt.Errorf("disk_size_gb: Windows server requires disk space <= %v GB, but defined: %v", MaxDiskSize, b.config.DiskSize/1024)
+	if b.config.DiskSize > MaxDiskSize {
+		return nil, []error{fmt.Errorf("disk_size: A VHDX holds at most %v GB, but defined: %v", MaxDiskSize/1024, b.config.DiskSize/1024)}
 	}
 
-	return nil
+	return b.config.GuestOSConfig.CheckDiskSize(b.config.DiskSize)
 }
 
-func (b *Builder) checkRamSize() error {
-	if b.config.RamSizeMB == 0 {
-		b.config.RamSizeMB = DefaultRamSize
+func (b *Builder) checkDiskType() error {
+	switch strings.ToLower(b.config.DiskType) {
+	case "", "dynamic":
+		b.config.DiskType = hypervcommon.DiskTypeDynamic
+	case "fixed":
+		b.config.DiskType = hypervcommon.DiskTypeFixed
+	default:
+		return fmt.Errorf("disk_type: The disk type must be dynamic or fixed, but defined: %v", b.config.DiskType)
 	}
 
-	log.Println(fmt.Sprintf("%s: %v", "RamSize", b.config.RamSizeMB))
+	log.Println(fmt.Sprintf("%s: %v", "DiskType", b.config.DiskType))
 
-	if b.config.RamSizeMB < MinRamSize {
-		return fmt.Errorf("ram_size_mb: Windows server requires memory size >= %v MB, but defined: %v", MinRamSize, b.config.RamSizeMB)
-	} else if b.config.RamSizeMB > MaxRamSize {
-		return fmt.Errorf("ram_size_mb: Windows server requires memory size <= %v MB, but defined: %v", MaxRamSize, b.config.RamSizeMB)
+	size := b.config.DiskBlockSize
+	if size > MaxDiskBlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("disk_block_size: The block size must be a power of 2 up to %v MB, but defined: %v", MaxDiskBlockSize, size)
 	}
 
 	return nil
 }
 
-func (b *Builder) checkHostAvailableMemory() string {
-	freeMB := powershell.GetHostAvailableMemory()
+func (b *Builder) checkAdditionalDiskSize() error {
+	if len(b.config.AdditionalDiskSize) > MaxAdditionalDisks {
+		return fmt.Errorf("disk_additional_size: There can be at most %v additional disks, but defined: %v", MaxAdditionalDisks, len(b.config.AdditionalDiskSize))
+	}
 
-	if (freeMB - float64(b.config.RamSizeMB)) < LowRam {
-		return fmt.Sprintf("Hyper-V might fail to create a VM if there is not enough free memory in the system.")
+	for _, size := range b.config.AdditionalDiskSize {
+		if size == 0 || size > MaxDiskSize {
+			return fmt.Errorf("disk_additional_size: The size of an additional disk must be between 1 MB and %v GB, but defined: %v MB", MaxDiskSize/1024, size)
+		}
 	}
 
-	return ""
+	return nil
 }
 
-func (b *Builder) getCommunicatorStep(config config) multistep.Step {
-
-	if b.config.Communicator == "ssh" {
-		return &common.StepConnectSSH{
-			SSHAddress:     hypervcommon.SSHAddress,
-			SSHConfig:      hypervcommon.SSHConfigFunc(b.config.SSHConfig),
-			SSHWaitTimeout: config.SSHWaitTimeout,
+func (b *Builder) checkDifferencingDisk() error {
+	if !b.config.UseDifferencingDisk {
+		if b.config.DifferencingDiskParent != "" {
+			return errors.New("differencing_disk_parent: The parent disk requires use_differencing_disk.")
 		}
-	} else {
-		// TODO: should be WinRM
-		return &common.StepConnectSSH{
-			SSHAddress:     hypervcommon.SSHAddress,
-			SSHConfig:      hypervcommon.SSHConfigFunc(b.config.SSHConfig),
-			SSHWaitTimeout: config.SSHWaitTimeout,
+		return nil
+	}
+
+	if b.config.DiskType == hypervcommon.DiskTypeFixed {
+		return errors.New("use_differencing_disk: A differencing disk cannot be a fixed disk.")
+	}
+
+	if b.config.DifferencingDiskParent == "" {
+		return errors.New("differencing_disk_parent: The parent disk is required with use_differencing_disk.")
+	}
+
+	if _, err := os.Stat(b.config.DifferencingDiskParent); err != nil {
+		return fmt.Errorf("differencing_disk_parent: '%v' check the path is correct.", b.config.DifferencingDiskParent)
+	}
+
+	if strings.ToLower(filepath.Ext(b.config.DifferencingDiskParent)) == ".vhdx" {
+		d, err := vhdx.Open(b.config.DifferencingDiskParent)
+		if err != nil {
+			return fmt.Errorf("differencing_disk_parent: '%v' is not a valid VHDX file: %s", b.config.DifferencingDiskParent, err)
 		}
+		d.Close()
+	}
+
+	return nil
+}
+
+// checkSecondaryDvdImages checks a generation 1 VM has room for the
+// secondary ISO images on its IDE controllers.
+func (b *Builder) checkSecondaryDvdImages() error {
+	if b.config.Generation != 1 {
+		return nil
+	}
+
+	// the hard disk, the install dvd and the integration services
+	// setup disk leave one of the four IDE locations free
+	images := len(b.config.SecondaryDvdImages)
+	if len(b.config.CDFiles) > 0 {
+		images++
+	}
+
+	if images > 1 {
+		return errors.New("secondary_iso_images: Generation 1 VMs have room for only one secondary ISO image, including the CD of the cd_files.")
 	}
+
+	return nil
+}
+
+// getDifferencingDiskParentSize returns the virtual size in MB of the
+// parent of the hard disk, or 0 when it is not a VHDX file that can be read.
+func (b *Builder) getDifferencingDiskParentSize() uint {
+	d, err := vhdx.Open(b.config.DifferencingDiskParent)
+	if err != nil {
+		return 0
+	}
+	defer d.Close()
+
+	return uint(d.Size() / (1024 * 1024))
+}
+
+// getDifferencingDiskParent returns the parent of the hard disk, or an
+// empty string when the hard disk is not a differencing disk.
+func (b *Builder) getDifferencingDiskParent() string {
+	if !b.config.UseDifferencingDisk {
+		return ""
+	}
+
+	return b.config.DifferencingDiskParent
+}
+
+// getFloppyStep returns the step putting the floppy_files and floppy_dirs
+// on a floppy. Generation 2 VMs have no floppy drive, so getCDStep puts
+// them on the CD instead.
+func (b *Builder) getFloppyStep() multistep.Step {
+	if b.config.Generation == 2 {
+		return &hypervcommon.StepCreateFloppy{}
+	}
+
+	return &hypervcommon.StepCreateFloppy{
+		Files:       b.config.FloppyFiles,
+		Directories: b.config.FloppyDirs,
+		Label:       DefaultFloppyLabel,
+		Tpl:         b.getFilesTemplate(),
+	}
+}
+
+// getCDStep returns the step putting the cd_files on a CD, along with the
+// floppy_files and floppy_dirs for generation 2 VMs.
+func (b *Builder) getCDStep() multistep.Step {
+	step := &hypervcommon.StepCreateCD{
+		Files: b.config.CDFiles,
+		Label: b.config.CDLabel,
+		Tpl:   b.getFilesTemplate(),
+	}
+
+	if b.config.Generation == 2 {
+		step.FloppyFiles = b.config.FloppyFiles
+		step.FloppyDirs = b.config.FloppyDirs
+	}
+
+	return step
+}
+
+// getFilesTemplate returns the template the files of the floppy and the CD
+// are processed with, or nil unless template_files is set.
+func (b *Builder) getFilesTemplate() *packer.ConfigTemplate {
+	if !b.config.TemplateFiles {
+		return nil
+	}
+
+	return b.config.tpl
 }
@@ -0,0 +1,349 @@
+package iso
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	hypervcommon "github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"iso_checksum":            "foo",
+		"iso_checksum_type":       "md5",
+		"iso_url":                 "http://www.packer.io/install.iso",
+		"ssh_username":            "foo",
+		"shutdown_command":        "foo",
+		packer.BuildNameConfigKey: "foo",
+	}
+}
+
+func testPrepare(t *testing.T, config map[string]interface{}) (*Builder, []string, error) {
+	var b Builder
+	warnings, err := b.Prepare(config)
+	return &b, warnings, err
+}
+
+func TestBuilder_ImplementsBuilder(t *testing.T) {
+	var raw interface{}
+	raw = &Builder{}
+	if _, ok := raw.(packer.Builder); !ok {
+		t.Error("Builder must implement builder.")
+	}
+}
+
+func TestBuilderPrepare_Defaults(t *testing.T) {
+	b, _, err := testPrepare(t, testConfig())
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if b.config.DiskSize != DefaultDiskSize {
+		t.Errorf("bad disk_size: %v", b.config.DiskSize)
+	}
+	if b.config.DiskType != hypervcommon.DiskTypeDynamic {
+		t.Errorf("bad disk_type: %v", b.config.DiskType)
+	}
+	if b.config.RamSizeMB != DefaultRamSize {
+		t.Errorf("bad ram_size_mb: %v", b.config.RamSizeMB)
+	}
+	if b.config.Generation != 1 {
+		t.Errorf("bad generation: %v", b.config.Generation)
+	}
+	if b.config.CDLabel != DefaultCDLabel {
+		t.Errorf("bad cd_label: %v", b.config.CDLabel)
+	}
+	if !strings.HasPrefix(b.config.VMName, "pvm_") {
+		t.Errorf("bad vm_name: %v", b.config.VMName)
+	}
+	if b.config.SwitchName == "" {
+		t.Error("should have a switch_name")
+	}
+	if len(b.config.NetworkAdapters) != 1 || b.config.NetworkAdapters[0].SwitchName != b.config.SwitchName {
+		t.Errorf("bad network_adapters: %#v", b.config.NetworkAdapters)
+	}
+	if b.config.Communicator != "ssh" {
+		t.Errorf("bad communicator: %v", b.config.Communicator)
+	}
+	if b.config.OutputDir != "output-foo" {
+		t.Errorf("bad output_directory: %v", b.config.OutputDir)
+	}
+	if b.config.BootWait != 10*time.Second {
+		t.Errorf("bad boot_wait: %v", b.config.BootWait)
+	}
+	if b.config.SSHWaitTimeout != 20*time.Minute {
+		t.Errorf("bad ssh_wait_timeout: %v", b.config.SSHWaitTimeout)
+	}
+}
+
+func TestBuilderPrepare_InvalidKey(t *testing.T) {
+	config := testConfig()
+	config["i_should_not_be_valid"] = true
+
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_ISOUrl(t *testing.T) {
+	config := testConfig()
+	delete(config, "iso_url")
+
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_Communicator(t *testing.T) {
+	config := testConfig()
+	config["communicator"] = "telnet"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config = testConfig()
+	config["communicator"] = "winrm"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("winrm requires a winrm_username")
+	}
+
+	config["winrm_username"] = "vagrant"
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.WinRMPort != 5985 {
+		t.Errorf("bad winrm_port: %v", b.config.WinRMPort)
+	}
+}
+
+func TestBuilderPrepare_DiskSize(t *testing.T) {
+	config := testConfig()
+	config["disk_size"] = MaxDiskSize + 1
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["disk_size"] = 60 * 1024
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.DiskSize != 60*1024 {
+		t.Errorf("bad disk_size: %v", b.config.DiskSize)
+	}
+}
+
+func TestBuilderPrepare_DiskType(t *testing.T) {
+	config := testConfig()
+	config["disk_type"] = "Fixed"
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.DiskType != hypervcommon.DiskTypeFixed {
+		t.Errorf("bad disk_type: %v", b.config.DiskType)
+	}
+
+	config["disk_type"] = "sparse"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config = testConfig()
+	config["disk_block_size"] = 3
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_DifferencingDisk(t *testing.T) {
+	config := testConfig()
+	config["differencing_disk_parent"] = "parent.vhdx"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("the parent requires use_differencing_disk")
+	}
+
+	config["use_differencing_disk"] = true
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("the parent should exist")
+	}
+}
+
+func TestBuilderPrepare_RamSize(t *testing.T) {
+	config := testConfig()
+	config["ram_size_mb"] = 16
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["ram_size_mb"] = 4096
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.RamSizeMB != 4096 {
+		t.Errorf("bad ram_size_mb: %v", b.config.RamSizeMB)
+	}
+}
+
+func TestBuilderPrepare_Hardware(t *testing.T) {
+	config := testConfig()
+	config["cpus"] = 2
+	config["enable_virtualization_extensions"] = true
+	config["enable_mac_spoofing"] = true
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.CPUs != 2 || !b.config.EnableVirtualizationExtensions || !b.config.EnableMacSpoofing {
+		t.Errorf("bad hardware: %#v", b.config.HardwareConfig)
+	}
+
+	// nested virtualization requires static memory
+	config["enable_dynamic_memory"] = true
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_Generation(t *testing.T) {
+	config := testConfig()
+	config["generation"] = 3
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["generation"] = 1
+	config["enable_secure_boot"] = true
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("secure boot requires generation 2")
+	}
+
+	config["generation"] = 2
+	config["floppy_files"] = []string{"Autounattend.xml"}
+	b, warnings, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.Generation != 2 || !b.config.EnableSecureBoot {
+		t.Errorf("bad generation: %#v", b.config.GenerationConfig)
+	}
+	if !hasWarning(warnings, "floppy") {
+		t.Errorf("should warn the floppy files go on a DVD: %#v", warnings)
+	}
+}
+
+func TestBuilderPrepare_SecondaryIsoImages(t *testing.T) {
+	config := testConfig()
+	config["secondary_iso_images"] = []string{"a.iso"}
+	if _, _, err := testPrepare(t, config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	config["cd_files"] = []string{"meta-data"}
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("a generation 1 VM has room for one secondary image")
+	}
+
+	config["generation"] = 2
+	if _, _, err := testPrepare(t, config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_ProductKey(t *testing.T) {
+	config := testConfig()
+	config["product_key"] = "foo"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["product_key"] = "ABCDE-ABCDE-ABCDE-ABCDE-ABCDE"
+	if _, _, err := testPrepare(t, config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+}
+
+func TestBuilderPrepare_Network(t *testing.T) {
+	config := testConfig()
+	config["switch_name"] = "build"
+	config["network_mode"] = "nat"
+	config["network_adapters"] = []map[string]interface{}{
+		{},
+		{"switch_name": "private", "switch_type": "Private", "vlan_id": "42"},
+	}
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	adapters := b.config.NetworkAdapters
+	if len(adapters) != 2 || adapters[0].SwitchName != "build" || adapters[1].SwitchName != "private" || adapters[1].VlanID != "42" {
+		t.Errorf("bad network_adapters: %#v", adapters)
+	}
+	if b.config.NatPrefix != hypervcommon.DefaultNatPrefix {
+		t.Errorf("bad nat_prefix: %v", b.config.NatPrefix)
+	}
+
+	config["switch_type"] = "External"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("nat requires an Internal switch")
+	}
+}
+
+func TestBuilderPrepare_HTTPAndBootCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := testConfig()
+	config["http_directory"] = dir
+	config["boot_command"] = []string{"<esc><wait>linux ks=http://{{ .HTTPIP }}:{{ .HTTPPort }}/ks.cfg<enter>"}
+	config["boot_wait"] = "30s"
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.HTTPDir != dir || b.config.BootWait != 30*time.Second || len(b.config.BootCommand) != 1 {
+		t.Errorf("bad config: %#v %#v", b.config.HTTPConfig, b.config.BootConfig)
+	}
+
+	config["boot_command"] = []string{"é"}
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config = testConfig()
+	config["http_directory"] = dir + "-missing"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_ShutdownCommand(t *testing.T) {
+	config := testConfig()
+	delete(config, "shutdown_command")
+	_, warnings, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if !hasWarning(warnings, "shutdown_command") {
+		t.Errorf("should warn: %#v", warnings)
+	}
+}
+
+func hasWarning(warnings []string, s string) bool {
+	for _, warning := range warnings {
+		if strings.Contains(warning, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package vmcx implements a builder starting from an existing VM rather
+// than an ISO: an exported VM, a VM registered on the host or a bare
+// virtual hard disk. The VM is copied, provisioned and exported again.
+package vmcx
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	hypervcommon "github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common"
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common/vhdx"
+	"github.com/mitchellh/multistep"
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+const (
+	DefaultRamSize = 1024 // 1GB
+)
+
+// Builder implements packer.Builder and builds Hyper-V images from an
+// existing VM or virtual hard disk.
+type Builder struct {
+	config config
+	runner multistep.Runner
+}
+
+type config struct {
+	// The directory of an exported VM to clone, holding its
+	// "Virtual Machines" and "Virtual Hard Disks" directories.
+	CloneFromVMCXPath string `mapstructure:"clone_from_vmcx_path"`
+	// The name of a VM registered on the host to clone.
+	CloneFromVMName string `mapstructure:"clone_from_vm_name"`
+	// The name of a checkpoint of the VM of clone_from_vm_name to clone
+	// rather than its current state.
+	CloneFromSnapshotName string `mapstructure:"clone_from_snapshot_name"`
+	// The path of a virtual hard disk with an installed OS to copy and
+	// attach to a new VM.
+	CloneFromVHDXPath string `mapstructure:"clone_from_vhdx_path"`
+	// The generation and firmware of the VM created for
+	// clone_from_vhdx_path. A clone of a VM keeps the generation and
+	// firmware of the VM.
+	hypervcommon.GenerationConfig `mapstructure:",squash"`
+	// The size, in megabytes, of the computer memory in the VM. By default,
+	// a clone of a VM keeps the memory of the VM, and a VM created for
+	// clone_from_vhdx_path has 1024 (about 1 GB).
+	RamSizeMB uint `mapstructure:"ram_size_mb"`
+
+	hypervcommon.BuilderConfig `mapstructure:",squash"`
+
+	tpl *packer.ConfigTemplate
+}
+
+// Prepare processes the build configuration parameters.
+func (b *Builder) Prepare(raws ...interface{}) ([]string, error) {
+	md, err := common.DecodeConfig(&b.config, raws...)
+	if err != nil {
+		return nil, err
+	}
+
+	b.config.tpl, err = packer.NewConfigTemplate()
+	if err != nil {
+		return nil, err
+	}
+	b.config.tpl.UserVars = b.config.PackerUserVars
+
+	// Accumulate any errors and warnings
+	errs := common.CheckUnusedConfig(md)
+	errs = packer.MultiErrorAppend(errs, b.config.BuilderConfig.Prepare(b.config.tpl)...)
+
+	templates := map[string]*string{
+		"clone_from_vmcx_path":     &b.config.CloneFromVMCXPath,
+		"clone_from_vm_name":       &b.config.CloneFromVMName,
+		"clone_from_snapshot_name": &b.config.CloneFromSnapshotName,
+		"clone_from_vhdx_path":     &b.config.CloneFromVHDXPath,
+	}
+
+	for n, ptr := range templates {
+		var err error
+		*ptr, err = b.config.tpl.Process(*ptr, nil)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error processing %s: %s", n, err))
+		}
+	}
+
+	err = b.checkSource()
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs, err)
+	}
+
+	// a clone keeps the memory, the generation and the firmware of the VM
+	// it is cloned from
+	if b.config.CloneFromVHDXPath != "" {
+		if b.config.RamSizeMB == 0 {
+			b.config.RamSizeMB = DefaultRamSize
+		}
+		errs = packer.MultiErrorAppend(errs, b.config.GenerationConfig.Prepare()...)
+	} else if b.config.GenerationConfig.IsSet() {
+		errs = packer.MultiErrorAppend(errs, errors.New("generation: A clone keeps the generation and firmware of the VM, these only apply to clone_from_vhdx_path."))
+	}
+
+	warnings, vmErrs := b.config.BuilderConfig.PrepareVM(b.config.tpl, hypervcommon.HostDriver(), b.config.RamSizeMB, b.config.Generation)
+	errs = packer.MultiErrorAppend(errs, vmErrs...)
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return warnings, errs
+	}
+
+	return warnings, nil
+}
+
+// Run executes a Packer build and returns a packer.Artifact representing
+// a Hyperv appliance.
+func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packer.Artifact, error) {
+	buildStarted := time.Now()
+
+	// Create the driver that we'll use to communicate with Hyperv
+	driver, err := hypervcommon.NewHypervPS4Driver()
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating Hyper-V driver: %s", err)
+	}
+
+	// Set up the state.
+	state := new(multistep.BasicStateBag)
+	state.Put("cache", cache)
+	state.Put("config", &b.config)
+	state.Put("driver", driver)
+	state.Put("hook", hook)
+	state.Put("ui", ui)
+
+	steps := []multistep.Step{
+		&hypervcommon.StepCreateTempDir{},
+		&hypervcommon.StepOutputDir{
+			Force: b.config.PackerForce,
+			Path:  b.config.OutputDir,
+		},
+		b.config.CreateSwitchStep(),
+		b.getCloneStep(),
+	}
+
+	steps = append(steps, b.config.ConfigureVMSteps()...)
+	steps = append(steps, b.config.HTTPServerStep())
+	steps = append(steps, b.config.BootSteps("provisioning", b.config.tpl)...)
+
+	steps = append(steps,
+		// configure the communicator ssh, winrm
+		b.config.CommunicatorStep(),
+		b.config.HTTPEnvironmentStep(),
+
+		// provision requires communicator to be setup
+		&common.StepProvision{},
+	)
+
+	// the generation of a clone is read from the VM
+	steps = append(steps, b.config.ExportSteps(b.config.RamSizeMB, b.config.Generation)...)
+
+	// Run the steps.
+	b.runner = hypervcommon.NewRunner(steps, b.config.PackerConfig, ui)
+	b.runner.Run(state)
+
+	if err := hypervcommon.BuildError(state); err != nil {
+		return nil, err
+	}
+
+	generation := state.Get("generation").(uint)
+	compaction, _ := state.Get("disk_compaction").(map[string]hypervcommon.DiskCompaction)
+	return hypervcommon.NewArtifact(b.config.OutputDir, b.config.VMName, generation, buildStarted, compaction)
+}
+
+// Cancel.
+func (b *Builder) Cancel() {
+	if b.runner != nil {
+		log.Println("Cancelling the step runner...")
+		b.runner.Cancel()
+	}
+}
+
+// checkSource checks exactly one source to clone is given, and that it
+// exists when it is a path.
+func (b *Builder) checkSource() error {
+	sources := 0
+	for _, source := range []string{b.config.CloneFromVMCXPath, b.config.CloneFromVMName, b.config.CloneFromVHDXPath} {
+		if source != "" {
+			sources++
+		}
+	}
+
+	if sources != 1 {
+		return errors.New("clone_from_vmcx_path: Exactly one of clone_from_vmcx_path, clone_from_vm_name and clone_from_vhdx_path is required.")
+	}
+
+	if b.config.CloneFromSnapshotName != "" && b.config.CloneFromVMName == "" {
+		return errors.New("clone_from_snapshot_name: A checkpoint can only be cloned with clone_from_vm_name.")
+	}
+
+	if b.config.CloneFromVMCXPath != "" {
+		info, err := os.Stat(b.config.CloneFromVMCXPath)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("clone_from_vmcx_path: '%v' check the path is correct.", b.config.CloneFromVMCXPath)
+		}
+
+		info, err = os.Stat(filepath.Join(b.config.CloneFromVMCXPath, hypervcommon.VmDir))
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("clone_from_vmcx_path: '%v' holds no exported VM, %s is missing.", b.config.CloneFromVMCXPath, hypervcommon.VmDir)
+		}
+	}
+
+	if b.config.CloneFromVHDXPath != "" {
+		if _, err := os.Stat(b.config.CloneFromVHDXPath); err != nil {
+			return fmt.Errorf("clone_from_vhdx_path: '%v' check the path is correct.", b.config.CloneFromVHDXPath)
+		}
+
+		switch strings.ToLower(filepath.Ext(b.config.CloneFromVHDXPath)) {
+		case ".vhd":
+		case ".vhdx":
+			return b.checkSourceDisk()
+		default:
+			return fmt.Errorf("clone_from_vhdx_path: '%v' is not a .vhd or .vhdx file.", b.config.CloneFromVHDXPath)
+		}
+	}
+
+	return nil
+}
+
+// checkSourceDisk checks the VHDX file clone_from_vhdx_path can be read,
+// and is a disk of its own rather than a differencing disk, the copy of
+// which would lose its parent.
+func (b *Builder) checkSourceDisk() error {
+	d, err := vhdx.Open(b.config.CloneFromVHDXPath)
+	if err != nil {
+		return fmt.Errorf("clone_from_vhdx_path: '%v' is not a valid VHDX file: %s", b.config.CloneFromVHDXPath, err)
+	}
+	defer d.Close()
+
+	if d.HasParent {
+		return fmt.Errorf("clone_from_vhdx_path: '%v' is a differencing disk. Merge it into its parent first.", b.config.CloneFromVHDXPath)
+	}
+
+	log.Println(fmt.Sprintf("Cloning disk %s of %v bytes, %v bytes allocated", b.config.CloneFromVHDXPath, d.Size(), d.AllocatedSize()))
+	return nil
+}
+
+// getCloneStep returns the step creating the VM: a new VM for a virtual
+// hard disk, or an imported copy of a VM.
+func (b *Builder) getCloneStep() multistep.Step {
+	if b.config.CloneFromVHDXPath != "" {
+		return &hypervcommon.StepCreateVM{
+			VMName:         b.config.VMName,
+			SwitchName:     b.config.NetworkAdapters[0].SwitchName,
+			RamSizeMB:      b.config.RamSizeMB,
+			SourceDiskPath: b.config.CloneFromVHDXPath,
+
+			Generation:         b.config.Generation,
+			EnableSecureBoot:   b.config.EnableSecureBoot,
+			SecureBootTemplate: b.config.SecureBootTemplate,
+		}
+	}
+
+	return &hypervcommon.StepCloneVM{
+		CloneFromVMCXPath:     b.config.CloneFromVMCXPath,
+		CloneFromVMName:       b.config.CloneFromVMName,
+		CloneFromSnapshotName: b.config.CloneFromSnapshotName,
+		VMName:                b.config.VMName,
+		SwitchName:            b.config.NetworkAdapters[0].SwitchName,
+		RamSizeMB:             b.config.RamSizeMB,
+	}
+}
@@ -0,0 +1,241 @@
+package vmcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	hypervcommon "github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+func testConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"clone_from_vm_name":      "base",
+		"ssh_username":            "foo",
+		"shutdown_command":        "foo",
+		packer.BuildNameConfigKey: "foo",
+	}
+}
+
+func testPrepare(t *testing.T, config map[string]interface{}) (*Builder, []string, error) {
+	var b Builder
+	warnings, err := b.Prepare(config)
+	return &b, warnings, err
+}
+
+// testSourceDir returns a directory holding the source files of a clone:
+// an exported VM and a VHD.
+func testSourceDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "export", hypervcommon.VmDir), 0755); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "disk.vhd"), []byte("disk"), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return dir
+}
+
+func TestBuilder_ImplementsBuilder(t *testing.T) {
+	var raw interface{}
+	raw = &Builder{}
+	if _, ok := raw.(packer.Builder); !ok {
+		t.Error("Builder must implement builder.")
+	}
+}
+
+func TestBuilderPrepare_Defaults(t *testing.T) {
+	b, _, err := testPrepare(t, testConfig())
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// a clone keeps the memory and generation of its VM
+	if b.config.RamSizeMB != 0 {
+		t.Errorf("bad ram_size_mb: %v", b.config.RamSizeMB)
+	}
+	if b.config.Generation != 0 {
+		t.Errorf("bad generation: %v", b.config.Generation)
+	}
+	if !strings.HasPrefix(b.config.VMName, "pvm_") {
+		t.Errorf("bad vm_name: %v", b.config.VMName)
+	}
+	if b.config.SwitchName == "" || len(b.config.NetworkAdapters) != 1 {
+		t.Errorf("bad network: %#v", b.config.NetworkConfig)
+	}
+	if b.config.Communicator != "ssh" {
+		t.Errorf("bad communicator: %v", b.config.Communicator)
+	}
+}
+
+func TestBuilderPrepare_InvalidKey(t *testing.T) {
+	config := testConfig()
+	config["i_should_not_be_valid"] = true
+
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_Source(t *testing.T) {
+	dir := testSourceDir(t)
+	defer os.RemoveAll(dir)
+
+	config := testConfig()
+	delete(config, "clone_from_vm_name")
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("a source is required")
+	}
+
+	config["clone_from_vmcx_path"] = filepath.Join(dir, "export")
+	if _, _, err := testPrepare(t, config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	config["clone_from_vm_name"] = "base"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("only one source may be given")
+	}
+
+	config = testConfig()
+	config["clone_from_snapshot_name"] = "clean"
+	if _, _, err := testPrepare(t, config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	config = testConfig()
+	delete(config, "clone_from_vm_name")
+	config["clone_from_vmcx_path"] = dir
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("the directory holds no exported VM")
+	}
+
+	config = testConfig()
+	delete(config, "clone_from_vm_name")
+	config["clone_from_snapshot_name"] = "clean"
+	config["clone_from_vhdx_path"] = filepath.Join(dir, "disk.vhd")
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("a checkpoint requires clone_from_vm_name")
+	}
+}
+
+func TestBuilderPrepare_VHDX(t *testing.T) {
+	dir := testSourceDir(t)
+	defer os.RemoveAll(dir)
+
+	config := testConfig()
+	delete(config, "clone_from_vm_name")
+	config["clone_from_vhdx_path"] = filepath.Join(dir, "disk.vhd")
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	// a new VM is created for the disk
+	if b.config.RamSizeMB != DefaultRamSize {
+		t.Errorf("bad ram_size_mb: %v", b.config.RamSizeMB)
+	}
+	if b.config.Generation != 1 {
+		t.Errorf("bad generation: %v", b.config.Generation)
+	}
+
+	config["generation"] = 2
+	config["enable_secure_boot"] = true
+	if _, _, err := testPrepare(t, config); err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	config["generation"] = 1
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("secure boot requires generation 2")
+	}
+
+	config["clone_from_vhdx_path"] = filepath.Join(dir, "disk.img")
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_Generation(t *testing.T) {
+	config := testConfig()
+	config["generation"] = 2
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("a clone keeps the generation of its VM")
+	}
+}
+
+func TestBuilderPrepare_RamSize(t *testing.T) {
+	config := testConfig()
+	config["ram_size_mb"] = 16
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+
+	config["ram_size_mb"] = 2048
+	config["enable_dynamic_memory"] = true
+	config["dynamic_memory_max_mb"] = 1024
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("the maximum memory is below the startup memory")
+	}
+
+	config["dynamic_memory_max_mb"] = 4096
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if b.config.RamSizeMB != 2048 || b.config.DynamicMemoryMaxMB != 4096 {
+		t.Errorf("bad memory: %v %#v", b.config.RamSizeMB, b.config.HardwareConfig)
+	}
+}
+
+func TestBuilderPrepare_Network(t *testing.T) {
+	config := testConfig()
+	config["switch_name"] = "build"
+	config["network_adapters"] = []map[string]interface{}{
+		{"mac_address": "00-15-5D-01-02-03"},
+		{"switch_name": "private", "switch_type": "Private", "communicator": true},
+	}
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	if b.config.CommunicatorSwitchName() != "private" {
+		t.Errorf("bad communicator switch: %v", b.config.CommunicatorSwitchName())
+	}
+	if names := b.config.SwitchNames(); len(names) != 2 {
+		t.Errorf("bad switch names: %#v", names)
+	}
+
+	config["network_adapters"] = []map[string]interface{}{
+		{"mac_address": "not a MAC"},
+	}
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestBuilderPrepare_BootCommand(t *testing.T) {
+	config := testConfig()
+	config["boot_command"] = []string{"<enter><wait5>{{ .Name }}<enter>"}
+	b, _, err := testPrepare(t, config)
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+	if len(b.config.BootCommand) != 1 {
+		t.Errorf("bad boot_command: %#v", b.config.BootCommand)
+	}
+
+	config["boot_wait"] = "soon"
+	if _, _, err := testPrepare(t, config); err == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -5,74 +5,110 @@
 package powershell
 
 import (
-//	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
 	"github.com/mitchellh/packer/packer"
 	"io"
-//	"io/ioutil"
+	"io/ioutil"
 	"log"
-	"path/filepath"
 	"os"
-	"container/list"
-	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
+// Files are sent to and from the guest over remoting in chunks of this
+// many bytes, each one base64 encoded into a single command.
+const transferChunkSize = 512 * 1024
 
 type comm struct {
-	config *Config
+	config  *Config
+	session *session
+
+	guestServices *bool
 }
 
 type Config struct {
-	Username string
-	Password string
+	Username   string
+	Password   string
 	RemoteHost string
-	VmName string
-	Ui packer.Ui
+	VmName     string
+	Ui         packer.Ui
+
+	// The Executor running the host PowerShell scripts. The default
+	// executor is used if this is nil.
+	Executor powershell.Executor
 }
 
-// Creates a new packer.Communicator implementation over SSH. This takes
-// an already existing TCP connection and SSH configuration.
+// Creates a new packer.Communicator implementation over PowerShell
+// remoting. The remoting session is opened by the first command run and
+// kept open until Close is called.
 func New(config *Config) (result *comm, err error) {
-	// Establish an initial connection and connect
 	result = &comm{
 		config: config,
+		session: &session{
+			start: func() (*hostProcess, error) {
+				return startLocalHost(config)
+			},
+		},
 	}
 
 	return
 }
 
+// Close removes the remoting session and stops the PowerShell host
+// holding it.
+func (c *comm) Close() error {
+	return c.session.close()
+}
+
+// Start runs the command in the guest with Invoke-Command in the remoting
+// session. It returns straight away, streaming the output to the writers
+// of the command and marking it exited once done. The exit status is the
+// $LASTEXITCODE of the session, or 1 if the command raised a terminating
+// error.
 func (c *comm) Start(cmd *packer.RemoteCmd) (err error) {
-	username := c.config.Username
-	password := c.config.Password
-	remoteHost := c.config.RemoteHost
+	log.Printf("Executing remote command: %s", cmd.Command)
 
-	log.Printf(fmt.Sprintf("Executing remote script..."))
+	go func() {
+		exitStatus, err := c.session.run(cmd.Command, nil, cmd.Stdout, cmd.Stderr)
+		if err != nil {
+			log.Printf("Error running remote command: %s", err)
+			if cmd.Stderr != nil {
+				io.WriteString(cmd.Stderr, err.Error())
+			}
+			exitStatus = 1
+		}
 
-	var script powershell.ScriptBuilder
-	script.WriteLine("param([string]$username,[string]$password,[string]$computerName)")
-	script.WriteLine("$securePassword = ConvertTo-SecureString $password -AsPlainText -Force")
-	script.WriteLine("$credential = New-Object -TypeName System.Management.Automation.PSCredential -ArgumentList $computerName\\$username, $securePassword")
-	script.WriteString("Invoke-Command -ComputerName $computerName ")
-	script.WriteString(cmd.Command)
-	script.WriteString(" -Credential $credential")
+		log.Printf("Remote command exited with status %d", exitStatus)
+		cmd.SetExited(exitStatus)
+	}()
 
-	powershell := new(powershell.PowerShellCmd)
+	return nil
+}
 
-	if cmd.Stdout  != nil {
-		powershell.Stdout = cmd.Stdout
+// Upload copies the input to dst on the guest. Copy-VMFile is used when
+// the Guest Service Interface is enabled on the VM, otherwise the file is
+// sent in chunks over a PowerShell remoting session.
+func (c *comm) Upload(dst string, input io.Reader, fi *os.FileInfo) error {
+	file, err := ioutil.TempFile("", "packer-upload")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(file.Name())
 
-	if cmd.Stderr != nil {
-		powershell.Stderr = cmd.Stderr
+	_, err = io.Copy(file, input)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("Error saving the file to upload: %s", err)
 	}
 
-	err = powershell.Run(script.String(), username, password, remoteHost)
-
-	return err
-}
-
-func (c *comm) Upload(string, io.Reader, *os.FileInfo) error {
-	panic("not implemented for powershell")
+	log.Printf("Uploading file to the VM => '%s'", dst)
+	return c.uploadFile(dst, file.Name())
 }
 
 func (c *comm) UploadDir(dst string, src string, excl []string) error {
@@ -84,13 +120,13 @@ func (c *comm) UploadDir(dst string, src string, excl []string) error {
 	ui := c.config.Ui
 
 	if info.IsDir() {
-		ui.Say(fmt.Sprintf("Uploading folder to the VM '%s' => '%s'...",  src, dst))
+		ui.Say(fmt.Sprintf("Uploading folder to the VM '%s' => '%s'...", src, dst))
 		err := c.uploadFolder(dst, src)
 		if err != nil {
 			return err
 		}
 	} else {
-		target_file := filepath.Join(dst,filepath.Base(src))
+		target_file := filepath.Join(dst, filepath.Base(src))
 		ui.Say(fmt.Sprintf("Uploading file to the VM '%s' => '%s'...", src, target_file))
 		err := c.uploadFile(target_file, src)
 		if err != nil {
@@ -101,8 +137,48 @@ func (c *comm) UploadDir(dst string, src string, excl []string) error {
 	return err
 }
 
-func (c *comm) Download(string, io.Writer) error {
-	panic("not implemented yet")
+// Download copies src from the guest to the output in base64 chunks over
+// the remoting session.
+func (c *comm) Download(src string, output io.Writer) error {
+	lengthOutput, err := c.runChecked("-ScriptBlock { param($path) (Get-Item -LiteralPath $path).Length }", src)
+	if err != nil {
+		return fmt.Errorf("Error downloading '%s': %s", src, err)
+	}
+
+	length, err := strconv.ParseInt(strings.TrimSpace(lengthOutput), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Error downloading '%s': unexpected length %q", src, lengthOutput)
+	}
+
+	var script powershell.ScriptBuilder
+	script.WriteLine("-ScriptBlock {")
+	script.WriteLine("  param($path, $offset, $count)")
+	script.WriteLine("  $stream = [IO.File]::OpenRead($path)")
+	script.WriteLine("  try {")
+	script.WriteLine("    $stream.Seek($offset, [IO.SeekOrigin]::Begin) | Out-Null")
+	script.WriteLine("    $buffer = New-Object byte[] $count")
+	script.WriteLine("    $read = $stream.Read($buffer, 0, $count)")
+	script.WriteLine("    [Convert]::ToBase64String($buffer, 0, $read)")
+	script.WriteLine("  } finally { $stream.Close() }")
+	script.WriteString("}")
+
+	for offset := int64(0); offset < length; offset += transferChunkSize {
+		chunk, err := c.runChecked(script.String(), src, strconv.FormatInt(offset, 10), strconv.Itoa(transferChunkSize))
+		if err != nil {
+			return fmt.Errorf("Error downloading '%s': %s", src, err)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(chunk))
+		if err != nil {
+			return fmt.Errorf("Error downloading '%s': %s", src, err)
+		}
+
+		if _, err := output.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (c *comm) uploadFile(dscPath string, srcPath string) error {
@@ -110,19 +186,126 @@ func (c *comm) uploadFile(dscPath string, srcPath string) error {
 	dscPath = filepath.FromSlash(dscPath)
 	srcPath = filepath.FromSlash(srcPath)
 
+	guestServices, err := c.guestServicesEnabled()
+	if err != nil {
+		return err
+	}
+
+	if !guestServices {
+		return c.uploadFileChunked(dscPath, srcPath)
+	}
+
 	vmName := c.config.VmName
 
 	var script powershell.ScriptBuilder
 	script.WriteLine("param([string]$vmName,[string]$sourcePath,[string]$destinationPath)")
 	script.WriteLine("Copy-VMFile -Name $vmName -SourcePath $sourcePath -DestinationPath $destinationPath -CreateFullPath -FileSource Host -Force")
 
-	powershell := new(powershell.PowerShellCmd)
-	err := powershell.Run(script.String(), vmName, srcPath, dscPath)
+	powershell := c.newPowerShellCmd()
+	err = powershell.Run(script.String(), vmName, srcPath, dscPath)
 
 	return err
 }
 
-func (c *comm) uploadFolder(dscPath string, srcPath string ) error {
+// uploadFileChunked sends a file to the guest in base64 chunks over the
+// remoting session, for VMs without the Guest Service Interface.
+func (c *comm) uploadFileChunked(dscPath string, srcPath string) error {
+	source, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	var script powershell.ScriptBuilder
+	script.WriteLine("-ScriptBlock {")
+	script.WriteLine("  param($path)")
+	script.WriteLine("  $dir = Split-Path -Parent $path")
+	script.WriteLine("  if ($dir -and -not (Test-Path -LiteralPath $dir)) { New-Item -ItemType Directory -Path $dir -Force | Out-Null }")
+	script.WriteLine("  [IO.File]::WriteAllBytes($path, [byte[]]@())")
+	script.WriteString("}")
+
+	if _, err := c.runChecked(script.String(), dscPath); err != nil {
+		return fmt.Errorf("Error uploading '%s': %s", dscPath, err)
+	}
+
+	script.Reset()
+	script.WriteLine("-ScriptBlock {")
+	script.WriteLine("  param($path, $chunk)")
+	script.WriteLine("  $bytes = [Convert]::FromBase64String($chunk)")
+	script.WriteLine("  $stream = [IO.File]::Open($path, [IO.FileMode]::Append)")
+	script.WriteLine("  try { $stream.Write($bytes, 0, $bytes.Length) } finally { $stream.Close() }")
+	script.WriteString("}")
+
+	buffer := make([]byte, transferChunkSize)
+	for {
+		n, err := io.ReadFull(source, buffer)
+		if n > 0 {
+			chunk := base64.StdEncoding.EncodeToString(buffer[:n])
+			if _, err := c.runChecked(script.String(), dscPath, chunk); err != nil {
+				return fmt.Errorf("Error uploading '%s': %s", dscPath, err)
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// runChecked runs a command in the remoting session and returns its
+// output, failing if it exits with a non-zero code.
+func (c *comm) runChecked(command string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	exitCode, err := c.session.run(command, args, &stdout, &stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if exitCode != 0 {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = fmt.Sprintf("exit code %d", exitCode)
+		}
+		return "", errors.New(message)
+	}
+
+	return stdout.String(), nil
+}
+
+// guestServicesEnabled checks once whether the Guest Service Interface
+// needed by Copy-VMFile is enabled on the VM.
+func (c *comm) guestServicesEnabled() (bool, error) {
+	if c.guestServices != nil {
+		return *c.guestServices, nil
+	}
+
+	enabled := false
+	if c.config.VmName != "" {
+		var script powershell.ScriptBuilder
+		script.WriteLine("param([string]$vmName)")
+		script.WriteLine("$service = Get-VMIntegrationService -VMName $vmName -Name 'Guest Service Interface' -ErrorAction SilentlyContinue")
+		script.WriteLine("$service -ne $null -and $service.Enabled")
+
+		powershell := c.newPowerShellCmd()
+		cmdOut, err := powershell.Output(script.String(), c.config.VmName)
+		if err != nil {
+			return false, err
+		}
+
+		enabled = strings.TrimSpace(cmdOut) == "True"
+	}
+
+	log.Printf("Guest Service Interface enabled: %t", enabled)
+	c.guestServices = &enabled
+
+	return enabled, nil
+}
+
+func (c *comm) uploadFolder(dscPath string, srcPath string) error {
 	l := list.New()
 
 	type dstSrc struct {
@@ -149,7 +332,7 @@ func (c *comm) uploadFolder(dscPath string, srcPath string ) error {
 		l.PushBack(
 			dstSrc{
 				src: path,
-				dst: filepath.Join(dscPath,rel),
+				dst: filepath.Join(dscPath, rel),
 			})
 
 		return nil
@@ -171,3 +354,6 @@ func (c *comm) uploadFolder(dscPath string, srcPath string ) error {
 	return err
 }
 
+func (c *comm) newPowerShellCmd() *powershell.PowerShellCmd {
+	return &powershell.PowerShellCmd{Executor: c.config.Executor}
+}
@@ -0,0 +1,285 @@
+package powershell
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+type executorFunc func(string, []string, io.Writer, io.Writer) (int, error)
+
+func (f executorFunc) Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	return f(script, params, stdout, stderr)
+}
+
+// testComm returns a communicator for a VM with or without the Guest
+// Service Interface, running host scripts with the executor given and
+// remote commands with the host handler given.
+func testComm(t *testing.T, guestServices bool, executor executorFunc, handler testHostHandler) (*comm, *testHost) {
+	c, err := New(&Config{
+		Username:   "vagrant",
+		Password:   "vagrant",
+		RemoteHost: "guest",
+		VmName:     "vm",
+		Ui: &packer.BasicUi{
+			Reader: new(bytes.Buffer),
+			Writer: new(bytes.Buffer),
+		},
+		Executor: executorFunc(func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+			if strings.Contains(script, "Get-VMIntegrationService") {
+				if guestServices {
+					io.WriteString(stdout, "True\n")
+				} else {
+					io.WriteString(stdout, "False\n")
+				}
+				return 0, nil
+			}
+			return executor(script, params, stdout, stderr)
+		}),
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	host := &testHost{Handler: handler}
+	c.session.start = host.start
+
+	return c, host
+}
+
+// testGuestFiles answers the commands transferring files with the files
+// given, keyed by guest path.
+func testGuestFiles(files map[string][]byte) testHostHandler {
+	return func(request sessionRequest, send func(sessionFrame)) bool {
+		path := request.Args[0]
+		switch {
+		case strings.Contains(request.Command, "WriteAllBytes"):
+			files[path] = []byte{}
+		case strings.Contains(request.Command, "FromBase64String"):
+			data, _ := base64.StdEncoding.DecodeString(request.Args[1])
+			files[path] = append(files[path], data...)
+		case strings.Contains(request.Command, ".Length"):
+			content, ok := files[path]
+			if !ok {
+				send(sessionFrame{Stream: "stderr", Data: "Cannot find path '" + path + "' because it does not exist.\r\n"})
+				send(testExit(1))
+				return true
+			}
+			send(sessionFrame{Stream: "stdout", Data: strconv.Itoa(len(content)) + "\r\n"})
+		case strings.Contains(request.Command, "ToBase64String"):
+			offset, _ := strconv.Atoi(request.Args[1])
+			count, _ := strconv.Atoi(request.Args[2])
+			content := files[path][offset:]
+			if len(content) > count {
+				content = content[:count]
+			}
+			send(sessionFrame{Stream: "stdout", Data: base64.StdEncoding.EncodeToString(content) + "\r\n"})
+		}
+
+		send(testExit(0))
+		return true
+	}
+}
+
+func testNoExecutor(t *testing.T) executorFunc {
+	return func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+		t.Fatalf("should not run a host script: %s", script)
+		return 0, nil
+	}
+}
+
+func testNoHost(t *testing.T) testHostHandler {
+	return func(request sessionRequest, send func(sessionFrame)) bool {
+		t.Fatalf("should not run a remote command: %s", request.Command)
+		return true
+	}
+}
+
+func TestComm_implementsCommunicator(t *testing.T) {
+	var raw interface{}
+	raw = &comm{}
+	if _, ok := raw.(packer.Communicator); !ok {
+		t.Fatal("comm must be a Communicator")
+	}
+}
+
+func TestCommStart(t *testing.T) {
+	release := make(chan struct{})
+	c, _ := testComm(t, false, testNoExecutor(t), func(request sessionRequest, send func(sessionFrame)) bool {
+		if request.Command != "-ScriptBlock { exit 3 }" {
+			t.Fatalf("bad command: %s", request.Command)
+		}
+
+		send(sessionFrame{Stream: "stdout", Data: "first\n"})
+		<-release
+		send(sessionFrame{Stream: "stderr", Data: "failed\n"})
+		send(testExit(3))
+		return true
+	})
+
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: "-ScriptBlock { exit 3 }", Stdout: &stdout, Stderr: &stderr}
+	if err := c.Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// Start must not wait for the command to finish
+	if cmd.Exited {
+		t.Fatal("should not have exited yet")
+	}
+	close(release)
+	cmd.Wait()
+
+	if cmd.ExitStatus != 3 {
+		t.Fatalf("bad exit status: %d", cmd.ExitStatus)
+	}
+
+	if stdout.String() != "first\n" || stderr.String() != "failed\n" {
+		t.Fatalf("bad output: %q %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestCommStart_reusesSession(t *testing.T) {
+	c, host := testComm(t, false, testNoExecutor(t), func(request sessionRequest, send func(sessionFrame)) bool {
+		send(testExit(0))
+		return true
+	})
+
+	for i := 0; i < 3; i++ {
+		cmd := &packer.RemoteCmd{Command: "-ScriptBlock { hostname }"}
+		if err := c.Start(cmd); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		cmd.Wait()
+	}
+
+	if host.Starts != 1 || len(host.Requests) != 3 {
+		t.Fatalf("bad: %d starts, %d requests", host.Starts, len(host.Requests))
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestCommStart_sessionError(t *testing.T) {
+	c, _ := testComm(t, false, testNoExecutor(t), func(request sessionRequest, send func(sessionFrame)) bool {
+		send(sessionFrame{Error: "WinRM cannot complete the operation."})
+		return true
+	})
+
+	var stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: "-ScriptBlock { hostname }", Stderr: &stderr}
+	if err := c.Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+
+	if cmd.ExitStatus == 0 {
+		t.Fatal("should have a non-zero exit status")
+	}
+
+	if !strings.Contains(stderr.String(), "WinRM cannot complete the operation.") {
+		t.Fatalf("bad stderr: %q", stderr.String())
+	}
+}
+
+func TestCommUpload_copyVMFile(t *testing.T) {
+	var uploaded string
+	c, _ := testComm(t, true, func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+		if !strings.Contains(script, "Copy-VMFile") {
+			t.Fatalf("bad script: %s", script)
+		}
+
+		if params[0] != "vm" || params[2] != `C:\Windows\Temp\script.ps1` {
+			t.Fatalf("bad params: %#v", params)
+		}
+
+		data, err := ioutil.ReadFile(params[1])
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		uploaded = string(data)
+		return 0, nil
+	}, testNoHost(t))
+
+	if err := c.Upload(`C:\Windows\Temp\script.ps1`, strings.NewReader("Write-Host hello"), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if uploaded != "Write-Host hello" {
+		t.Fatalf("bad: %q", uploaded)
+	}
+}
+
+func TestCommUploadDownload_chunked(t *testing.T) {
+	files := make(map[string][]byte)
+	c, host := testComm(t, false, testNoExecutor(t), testGuestFiles(files))
+
+	content := bytes.Repeat([]byte{0, 1, 2, 0xff}, transferChunkSize/2+3)
+	if err := c.Upload(`C:\Windows\Temp\data.bin`, bytes.NewReader(content), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(files[`C:\Windows\Temp\data.bin`], content) {
+		t.Fatal("uploaded content does not match")
+	}
+
+	var output bytes.Buffer
+	if err := c.Download(`C:\Windows\Temp\data.bin`, &output); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), content) {
+		t.Fatal("downloaded content does not match")
+	}
+
+	// create, three chunks up, length and three chunks down
+	if len(host.Requests) != 8 || host.Starts != 1 {
+		t.Fatalf("bad: %d requests, %d starts", len(host.Requests), host.Starts)
+	}
+}
+
+func TestCommUpload_error(t *testing.T) {
+	c, _ := testComm(t, false, testNoExecutor(t), func(request sessionRequest, send func(sessionFrame)) bool {
+		send(sessionFrame{Stream: "stderr", Data: "Access is denied."})
+		send(testExit(1))
+		return true
+	})
+
+	err := c.Upload(`C:\Windows\data.bin`, strings.NewReader("data"), nil)
+	if err == nil || !strings.Contains(err.Error(), "Access is denied.") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestCommUpload_readError(t *testing.T) {
+	c, _ := testComm(t, true, testNoExecutor(t), testNoHost(t))
+
+	if err := c.Upload(`C:\data.bin`, &errorReader{}, nil); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestCommDownload_error(t *testing.T) {
+	c, _ := testComm(t, false, testNoExecutor(t), testGuestFiles(make(map[string][]byte)))
+
+	var output bytes.Buffer
+	err := c.Download(`C:\missing.txt`, &output)
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+type errorReader struct{}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, errors.New("read failed")
+}
@@ -0,0 +1,301 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package powershell
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	powershell "github.com/MSOpenTech/packer-hyperv/packer/powershell"
+)
+
+// hostScript is run by a long-lived PowerShell process on the host. It
+// holds a remoting session to the guest, reopening it whenever it is
+// lost, and runs the commands it reads from stdin in that session.
+//
+// The credential of the guest is the first line of stdin, as
+// {"username":"...","password":"..."}, so that the password is not on the
+// command line of the process for any user of the host to see.
+//
+// The protocol is then one JSON object per line in each direction. Requests
+// are {"id":1,"command":"-ScriptBlock { ... }","args":[...]}, where the
+// command is the rest of an Invoke-Command command line. The responses
+// to a request are any number of {"id":1,"stream":"stdout","data":"..."}
+// frames followed by {"id":1,"exit":0}, or a single {"id":1,"error":"..."}
+// if the session could not be opened.
+const hostScript = `param([string]$computerName)
+
+$login = [Console]::In.ReadLine() | ConvertFrom-Json
+$securePassword = ConvertTo-SecureString $login.password -AsPlainText -Force
+$credential = New-Object -TypeName System.Management.Automation.PSCredential -ArgumentList "$computerName\$($login.username)", $securePassword
+$login = $null
+$session = $null
+
+function Send-Frame($frame) {
+  [Console]::Out.WriteLine(($frame | ConvertTo-Json -Compress))
+  [Console]::Out.Flush()
+}
+
+function Connect-Session {
+  if ($script:session -ne $null -and $script:session.State -eq 'Opened') {
+    return
+  }
+
+  if ($script:session -ne $null) {
+    Remove-PSSession $script:session -ErrorAction SilentlyContinue
+  }
+
+  $script:session = New-PSSession -ComputerName $computerName -Credential $credential -ErrorAction Stop
+}
+
+while (($line = [Console]::In.ReadLine()) -ne $null) {
+  $request = $line | ConvertFrom-Json
+
+  try {
+    Connect-Session
+  } catch {
+    Send-Frame @{ id = $request.id; error = $_.Exception.Message }
+    continue
+  }
+
+  try {
+    Invoke-Command -Session $session -ScriptBlock { $global:LASTEXITCODE = 0 }
+    $block = [ScriptBlock]::Create('param($session, $arguments) Invoke-Command -Session $session ' + $request.command + ' -ArgumentList $arguments -ErrorAction Stop')
+    & $block $session $request.args *>&1 | ForEach-Object {
+      $stream = 'stdout'
+      if ($_ -is [System.Management.Automation.ErrorRecord]) {
+        $stream = 'stderr'
+      }
+      Send-Frame @{ id = $request.id; stream = $stream; data = ($_ | Out-String) }
+    }
+    $exitCode = Invoke-Command -Session $session -ScriptBlock { if ($global:LASTEXITCODE) { $global:LASTEXITCODE } else { 0 } }
+  } catch {
+    Send-Frame @{ id = $request.id; stream = 'stderr'; data = $_.Exception.Message + [Environment]::NewLine }
+    $exitCode = 1
+  }
+
+  Send-Frame @{ id = $request.id; exit = [int]$exitCode }
+}
+
+if ($session -ne $null) {
+  Remove-PSSession $session
+}
+`
+
+// hostLogin is the credential a host process reads first.
+type hostLogin struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type sessionRequest struct {
+	Id      int      `json:"id"`
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type sessionFrame struct {
+	Id     int    `json:"id"`
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+	Exit   *int   `json:"exit"`
+	Error  string `json:"error"`
+}
+
+// hostProcess is a running PowerShell process serving hostScript.
+type hostProcess struct {
+	stdin  io.WriteCloser
+	stdout io.Reader
+	wait   func() error
+}
+
+// session runs commands in the remoting session of a host process,
+// starting a new process whenever the last one has died.
+type session struct {
+	start func() (*hostProcess, error)
+
+	host    *hostProcess
+	decoder *json.Decoder
+	nextId  int
+	l       sync.Mutex
+}
+
+// run runs an Invoke-Command command line in the guest, writing the output
+// to stdout and stderr as it arrives, and returns the exit code. A command
+// that failed before producing any output because the host process died
+// is retried once in a new process.
+func (s *session) run(command string, args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	for attempt := 0; ; attempt++ {
+		exitCode, streamed, err := s.runOnce(command, args, stdout, stderr)
+		if err == nil {
+			return exitCode, nil
+		}
+
+		if _, ok := err.(*sessionError); ok {
+			return 0, err
+		}
+
+		s.closeHost()
+
+		if streamed || attempt > 0 {
+			return 0, err
+		}
+
+		log.Printf("PowerShell host failed, restarting it: %s", err)
+	}
+}
+
+// sessionError is an error reported by a working host process, as
+// opposed to the process itself failing.
+type sessionError struct {
+	message string
+}
+
+func (e *sessionError) Error() string {
+	return fmt.Sprintf("Error opening the PowerShell remoting session: %s", e.message)
+}
+
+func (s *session) runOnce(command string, args []string, stdout io.Writer, stderr io.Writer) (int, bool, error) {
+	if s.host == nil {
+		host, err := s.start()
+		if err != nil {
+			return 0, false, err
+		}
+
+		s.host = host
+		s.decoder = json.NewDecoder(bufio.NewReader(host.stdout))
+	}
+
+	s.nextId++
+	request := sessionRequest{Id: s.nextId, Command: command, Args: args}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if _, err := s.host.stdin.Write(append(data, '\n')); err != nil {
+		return 0, false, err
+	}
+
+	streamed := false
+	for {
+		var frame sessionFrame
+		if err := s.decoder.Decode(&frame); err != nil {
+			if err == io.EOF {
+				err = errors.New("The PowerShell host exited")
+			}
+			return 0, streamed, err
+		}
+
+		// ignore anything left over from a request that was abandoned
+		if frame.Id != request.Id {
+			continue
+		}
+
+		switch {
+		case frame.Error != "":
+			return 0, streamed, &sessionError{message: frame.Error}
+		case frame.Exit != nil:
+			return *frame.Exit, streamed, nil
+		case frame.Stream == "stderr":
+			streamed = true
+			io.WriteString(stderr, frame.Data)
+		default:
+			streamed = true
+			io.WriteString(stdout, frame.Data)
+		}
+	}
+}
+
+// close stops the host process, which removes the remoting session.
+func (s *session) close() error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	return s.closeHost()
+}
+
+func (s *session) closeHost() error {
+	if s.host == nil {
+		return nil
+	}
+
+	host := s.host
+	s.host = nil
+	s.decoder = nil
+
+	host.stdin.Close()
+	return host.wait()
+}
+
+// startLocalHost starts hostScript with the executor of the config, and
+// sends it the credential of the guest.
+func startLocalHost(config *Config) (*hostProcess, error) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	ps := &powershell.PowerShellCmd{
+		Stdin:    stdinReader,
+		Stdout:   stdoutWriter,
+		Stderr:   os.Stderr,
+		Executor: config.Executor,
+	}
+
+	log.Printf("Starting PowerShell host for the remoting session to %s", config.RemoteHost)
+	done := make(chan error, 1)
+	go func() {
+		exitCode, err := ps.Execute(hostScript, config.RemoteHost)
+		if err == nil && exitCode != 0 {
+			err = fmt.Errorf("The PowerShell host exited with code %d", exitCode)
+		}
+
+		// unblock the session, whether it writes or reads
+		stdinReader.Close()
+		stdoutWriter.Close()
+		done <- err
+	}()
+
+	host := &hostProcess{
+		stdin:  stdinWriter,
+		stdout: stdoutReader,
+		wait: func() error {
+			return <-done
+		},
+	}
+
+	login, err := json.Marshal(hostLogin{Username: config.Username, Password: config.Password})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := stdinWriter.Write(append(login, '\n')); err != nil {
+		stdinWriter.Close()
+		if err := host.wait(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("The PowerShell host exited")
+	}
+
+	return host, nil
+}
@@ -0,0 +1,255 @@
+package powershell
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testHostHandler answers a request of the session protocol by calling
+// send for each frame. Returning false kills the host process.
+type testHostHandler func(request sessionRequest, send func(sessionFrame)) bool
+
+// testHost serves the session protocol in-process.
+type testHost struct {
+	Handler testHostHandler
+
+	Starts   int
+	Requests []sessionRequest
+
+	l sync.Mutex
+}
+
+func (h *testHost) start() (*hostProcess, error) {
+	h.l.Lock()
+	h.Starts++
+	h.l.Unlock()
+
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer responseWriter.Close()
+
+		decoder := json.NewDecoder(requestReader)
+		encoder := json.NewEncoder(responseWriter)
+		for {
+			var request sessionRequest
+			if err := decoder.Decode(&request); err != nil {
+				return
+			}
+
+			h.l.Lock()
+			h.Requests = append(h.Requests, request)
+			h.l.Unlock()
+
+			send := func(frame sessionFrame) {
+				frame.Id = request.Id
+				encoder.Encode(frame)
+			}
+
+			if !h.Handler(request, send) {
+				requestReader.Close()
+				return
+			}
+		}
+	}()
+
+	return &hostProcess{
+		stdin:  requestWriter,
+		stdout: responseReader,
+		wait: func() error {
+			<-done
+			return nil
+		},
+	}, nil
+}
+
+func testExit(code int) sessionFrame {
+	return sessionFrame{Exit: &code}
+}
+
+func TestSessionRun(t *testing.T) {
+	host := &testHost{
+		Handler: func(request sessionRequest, send func(sessionFrame)) bool {
+			send(sessionFrame{Stream: "stdout", Data: request.Command + "\r\n"})
+			send(sessionFrame{Stream: "stderr", Data: "warning\r\n"})
+			send(testExit(2))
+			return true
+		},
+	}
+	s := &session{start: host.start}
+
+	for i := 0; i < 2; i++ {
+		var stdout, stderr bytes.Buffer
+		exitCode, err := s.run("-ScriptBlock { hostname }", []string{"a"}, &stdout, &stderr)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if exitCode != 2 || stdout.String() != "-ScriptBlock { hostname }\r\n" || stderr.String() != "warning\r\n" {
+			t.Fatalf("bad: %d %q %q", exitCode, stdout.String(), stderr.String())
+		}
+	}
+
+	if host.Starts != 1 {
+		t.Fatalf("the host should be reused: %d starts", host.Starts)
+	}
+
+	if host.Requests[0].Id == host.Requests[1].Id || host.Requests[1].Args[0] != "a" {
+		t.Fatalf("bad requests: %#v", host.Requests)
+	}
+
+	if err := s.close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestSessionRun_restartsDeadHost(t *testing.T) {
+	host := &testHost{}
+	host.Handler = func(request sessionRequest, send func(sessionFrame)) bool {
+		if host.Starts == 1 {
+			return false
+		}
+		send(testExit(0))
+		return true
+	}
+	s := &session{start: host.start}
+
+	exitCode, err := s.run("-ScriptBlock { hostname }", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if exitCode != 0 || host.Starts != 2 {
+		t.Fatalf("bad: %d %d", exitCode, host.Starts)
+	}
+}
+
+func TestSessionRun_hostDiesAfterOutput(t *testing.T) {
+	host := &testHost{
+		Handler: func(request sessionRequest, send func(sessionFrame)) bool {
+			send(sessionFrame{Stream: "stdout", Data: "partial"})
+			return false
+		},
+	}
+	s := &session{start: host.start}
+
+	// the command may have had side effects, so it must not be retried
+	if _, err := s.run("-ScriptBlock { hostname }", nil, nil, nil); err == nil {
+		t.Fatal("should error")
+	}
+
+	if host.Starts != 1 {
+		t.Fatalf("bad starts: %d", host.Starts)
+	}
+}
+
+func TestSessionRun_sessionError(t *testing.T) {
+	host := &testHost{
+		Handler: func(request sessionRequest, send func(sessionFrame)) bool {
+			send(sessionFrame{Error: "Access is denied."})
+			return true
+		},
+	}
+	s := &session{start: host.start}
+
+	_, err := s.run("-ScriptBlock { hostname }", nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "Access is denied.") {
+		t.Fatalf("bad: %v", err)
+	}
+
+	if host.Starts != 1 {
+		t.Fatalf("bad starts: %d", host.Starts)
+	}
+}
+
+type stdinExecutorFunc func(string, []string, io.Reader, io.Writer, io.Writer) (int, error)
+
+func (f stdinExecutorFunc) Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	return f(script, params, nil, stdout, stderr)
+}
+
+func (f stdinExecutorFunc) ExecuteStdin(script string, params []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	return f(script, params, stdin, stdout, stderr)
+}
+
+func TestStartLocalHost(t *testing.T) {
+	config := &Config{
+		Username:   "vagrant",
+		Password:   "secret",
+		RemoteHost: "guest",
+		Executor: stdinExecutorFunc(func(script string, params []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+			for _, param := range params {
+				if strings.Contains(param, "secret") {
+					t.Fatalf("the password should not be a parameter: %#v", params)
+				}
+			}
+
+			decoder := json.NewDecoder(stdin)
+			var login hostLogin
+			if err := decoder.Decode(&login); err != nil {
+				t.Fatalf("err: %s", err)
+			}
+			if login.Username != "vagrant" || login.Password != "secret" {
+				t.Fatalf("bad login: %#v", login)
+			}
+
+			encoder := json.NewEncoder(stdout)
+			for {
+				var request sessionRequest
+				if err := decoder.Decode(&request); err != nil {
+					return 0, nil
+				}
+				encoder.Encode(sessionFrame{Id: request.Id, Stream: "stdout", Data: params[0]})
+				encoder.Encode(sessionFrame{Id: request.Id, Exit: new(int)})
+			}
+		}),
+	}
+	s := &session{start: func() (*hostProcess, error) { return startLocalHost(config) }}
+
+	var stdout bytes.Buffer
+	exitCode, err := s.run("-ScriptBlock { hostname }", nil, &stdout, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if exitCode != 0 || stdout.String() != "guest" {
+		t.Fatalf("bad: %d %q", exitCode, stdout.String())
+	}
+
+	if err := s.close(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestStartLocalHost_exits(t *testing.T) {
+	config := &Config{
+		RemoteHost: "guest",
+		Executor: stdinExecutorFunc(func(script string, params []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+			return 1, nil
+		}),
+	}
+
+	if _, err := startLocalHost(config); err == nil || !strings.Contains(err.Error(), "code 1") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestStartLocalHost_noStdin(t *testing.T) {
+	config := &Config{
+		RemoteHost: "guest",
+		Executor: executorFunc(func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+			t.Fatal("should not run the host script")
+			return 0, nil
+		}),
+	}
+
+	if _, err := startLocalHost(config); err == nil {
+		t.Fatal("should have error")
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package winrm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+const (
+	nsEnvelope   = "http://www.w3.org/2003/05/soap-envelope"
+	nsAddressing = "http://schemas.xmlsoap.org/ws/2004/08/addressing"
+	nsWsman      = "http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd"
+	nsWsmanMs    = "http://schemas.microsoft.com/wbem/wsman/1/wsman.xsd"
+	nsShell      = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell"
+
+	resourceURICmd = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+
+	actionCreate  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	actionDelete  = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	actionCommand = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Command"
+	actionReceive = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Receive"
+	actionSend    = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Send"
+	actionSignal  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/Signal"
+
+	signalTerminate  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/signal/terminate"
+	commandStateDone = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/CommandState/Done"
+
+	// The WSManFault code returned when a Receive times out before the
+	// command produced any output.
+	faultCodeOperationTimeout = "2150858793"
+
+	maxEnvelopeSize = 153600
+)
+
+// client speaks just enough WS-Management to run commands in a remote
+// Windows shell.
+type client struct {
+	endpoint string
+	timeout  time.Duration
+	http     *http.Client
+	username string
+	password string
+	ntlm     bool
+}
+
+// shell is a remote cmd shell opened by a client.
+type shell struct {
+	client *client
+	id     string
+}
+
+// receiveResult is the output of a command collected by one Receive.
+type receiveResult struct {
+	stdout   []byte
+	stderr   []byte
+	done     bool
+	exitCode int
+}
+
+// soapFault is a SOAP fault returned by the server.
+type soapFault struct {
+	Code   string `xml:"Code>Subcode>Value"`
+	Reason string `xml:"Reason>Text"`
+	Detail struct {
+		Code    string `xml:"Code,attr"`
+		Message string `xml:"Message"`
+	} `xml:"Detail>WSManFault"`
+}
+
+func (f *soapFault) Error() string {
+	message := strings.TrimSpace(f.Detail.Message)
+	if message == "" {
+		message = strings.TrimSpace(f.Reason)
+	}
+	return fmt.Sprintf("WinRM fault %s: %s", f.Code, message)
+}
+
+func (f *soapFault) timedOut() bool {
+	return f.Detail.Code == faultCodeOperationTimeout || strings.HasSuffix(f.Code, "TimedOut")
+}
+
+type selector struct {
+	Name  string `xml:"Name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type stream struct {
+	Name      string `xml:"Name,attr"`
+	CommandId string `xml:"CommandId,attr"`
+	End       bool   `xml:"End,attr"`
+	Value     string `xml:",chardata"`
+}
+
+type responseEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Selectors    []selector `xml:"ResourceCreated>ReferenceParameters>SelectorSet>Selector"`
+		ShellId      string     `xml:"Shell>ShellId"`
+		CommandId    string     `xml:"CommandResponse>CommandId"`
+		Streams      []stream   `xml:"ReceiveResponse>Stream"`
+		CommandState struct {
+			State    string `xml:"State,attr"`
+			ExitCode string `xml:"ExitCode"`
+		} `xml:"ReceiveResponse>CommandState"`
+		Fault *soapFault `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+func newClient(config *Config) (*client, error) {
+	scheme := "http"
+	if config.Https {
+		scheme = "https"
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	if config.Https {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.Insecure}
+		if len(config.CACert) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(config.CACert) {
+				return nil, errors.New("Unable to read the WinRM CA certificate")
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	c := &client{
+		endpoint: fmt.Sprintf("%s://%s/wsman", scheme, net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))),
+		timeout:  config.Timeout,
+		username: config.Username,
+		password: config.Password,
+		ntlm:     config.Transport == TransportNTLM,
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if c.ntlm {
+		roundTripper = &ntlmTransport{
+			transport: transport,
+			username:  config.Username,
+			password:  config.Password,
+		}
+	}
+
+	// the server holds a Receive for up to the operation timeout, so the
+	// HTTP timeout has to be longer than that
+	c.http = &http.Client{
+		Transport: roundTripper,
+		Timeout:   c.timeout + 30*time.Second,
+	}
+
+	return c, nil
+}
+
+// createShell opens a new remote cmd shell.
+func (c *client) createShell() (*shell, error) {
+	options := map[string]string{
+		"WINRS_NOPROFILE": "FALSE",
+		"WINRS_CODEPAGE":  "65001",
+	}
+
+	body := "<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>"
+
+	response, err := c.send(actionCreate, "", options, body)
+	if err != nil {
+		return nil, err
+	}
+
+	id := response.Body.ShellId
+	for _, s := range response.Body.Selectors {
+		if s.Name == "ShellId" {
+			id = s.Value
+		}
+	}
+
+	if id == "" {
+		return nil, errors.New("The WinRM server did not return a shell id")
+	}
+
+	return &shell{client: c, id: strings.TrimSpace(id)}, nil
+}
+
+// execute starts a command in the shell and returns its id.
+func (s *shell) execute(command string) (string, error) {
+	options := map[string]string{
+		"WINRS_CONSOLEMODE_STDIN": "TRUE",
+		"WINRS_SKIP_CMD_SHELL":    "FALSE",
+	}
+
+	body := "<rsp:CommandLine><rsp:Command>" + escape(command) + "</rsp:Command></rsp:CommandLine>"
+
+	response, err := s.client.send(actionCommand, s.id, options, body)
+	if err != nil {
+		return "", err
+	}
+
+	commandId := strings.TrimSpace(response.Body.CommandId)
+	if commandId == "" {
+		return "", errors.New("The WinRM server did not return a command id")
+	}
+
+	return commandId, nil
+}
+
+// sendInput writes to the standard input of a command.
+func (s *shell) sendInput(commandId string, input []byte, end bool) error {
+	body := fmt.Sprintf(`<rsp:Send><rsp:Stream Name="stdin" CommandId="%s" End="%t">%s</rsp:Stream></rsp:Send>`,
+		escape(commandId), end, base64.StdEncoding.EncodeToString(input))
+
+	_, err := s.client.send(actionSend, s.id, nil, body)
+	return err
+}
+
+// receive collects the output of a command produced since the last call.
+func (s *shell) receive(commandId string) (*receiveResult, error) {
+	body := fmt.Sprintf(`<rsp:Receive><rsp:DesiredStream CommandId="%s">stdout stderr</rsp:DesiredStream></rsp:Receive>`,
+		escape(commandId))
+
+	response, err := s.client.send(actionReceive, s.id, nil, body)
+	if err != nil {
+		if fault, ok := err.(*soapFault); ok && fault.timedOut() {
+			return &receiveResult{}, nil
+		}
+		return nil, err
+	}
+
+	result := new(receiveResult)
+	for _, st := range response.Body.Streams {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(st.Value))
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding %s stream: %s", st.Name, err)
+		}
+
+		switch st.Name {
+		case "stdout":
+			result.stdout = append(result.stdout, data...)
+		case "stderr":
+			result.stderr = append(result.stderr, data...)
+		}
+	}
+
+	state := response.Body.CommandState
+	if state.State == commandStateDone {
+		result.done = true
+		if state.ExitCode != "" {
+			result.exitCode, err = strconv.Atoi(strings.TrimSpace(state.ExitCode))
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing exit code: %s", err)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// run starts a command and copies its output to the writers given until
+// it is done, returning its exit code.
+func (s *shell) run(command string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	commandId, err := s.execute(command)
+	if err != nil {
+		return 0, err
+	}
+	defer s.signal(commandId)
+
+	if stdin != nil {
+		input, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := s.sendInput(commandId, input, true); err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		result, err := s.receive(commandId)
+		if err != nil {
+			return 0, err
+		}
+
+		if stdout != nil && len(result.stdout) > 0 {
+			if _, err := stdout.Write(result.stdout); err != nil {
+				return 0, err
+			}
+		}
+
+		if stderr != nil && len(result.stderr) > 0 {
+			if _, err := stderr.Write(result.stderr); err != nil {
+				return 0, err
+			}
+		}
+
+		if result.done {
+			return result.exitCode, nil
+		}
+	}
+}
+
+// signal terminates a command, releasing its resources on the server.
+func (s *shell) signal(commandId string) error {
+	body := fmt.Sprintf(`<rsp:Signal CommandId="%s"><rsp:Code>%s</rsp:Code></rsp:Signal>`,
+		escape(commandId), signalTerminate)
+
+	_, err := s.client.send(actionSignal, s.id, nil, body)
+	return err
+}
+
+// close deletes the shell.
+func (s *shell) close() error {
+	_, err := s.client.send(actionDelete, s.id, nil, "")
+	return err
+}
+
+func (c *client) send(action string, shellId string, options map[string]string, body string) (*responseEnvelope, error) {
+	request := c.envelope(action, shellId, options, body)
+
+	req, err := http.NewRequest("POST", c.endpoint, strings.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	if !c.ntlm {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("WinRM authentication failed, check the username, password and transport")
+	}
+
+	var response responseEnvelope
+	if len(data) > 0 {
+		if err := xml.Unmarshal(data, &response); err != nil {
+			return nil, fmt.Errorf("Error parsing WinRM response (HTTP %d): %s", resp.StatusCode, err)
+		}
+	}
+
+	if response.Body.Fault != nil {
+		return nil, response.Body.Fault
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("WinRM request failed with HTTP status %s", resp.Status)
+	}
+
+	return &response, nil
+}
+
+func (c *client) envelope(action string, shellId string, options map[string]string, body string) string {
+	var b bytes.Buffer
+
+	b.WriteString(`<env:Envelope xmlns:env="` + nsEnvelope + `" xmlns:a="` + nsAddressing +
+		`" xmlns:w="` + nsWsman + `" xmlns:p="` + nsWsmanMs + `" xmlns:rsp="` + nsShell + `">`)
+	b.WriteString("<env:Header>")
+	b.WriteString("<a:To>" + escape(c.endpoint) + "</a:To>")
+	b.WriteString(`<a:ReplyTo><a:Address env:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`)
+	b.WriteString(fmt.Sprintf(`<w:MaxEnvelopeSize env:mustUnderstand="true">%d</w:MaxEnvelopeSize>`, maxEnvelopeSize))
+	b.WriteString("<a:MessageID>uuid:" + uuid.New() + "</a:MessageID>")
+	b.WriteString(`<w:Locale env:mustUnderstand="false" xml:lang="en-US"/>`)
+	b.WriteString(`<p:DataLocale env:mustUnderstand="false" xml:lang="en-US"/>`)
+	b.WriteString(fmt.Sprintf("<w:OperationTimeout>PT%dS</w:OperationTimeout>", int(c.timeout.Seconds())))
+	b.WriteString(`<w:ResourceURI env:mustUnderstand="true">` + resourceURICmd + "</w:ResourceURI>")
+	b.WriteString(`<a:Action env:mustUnderstand="true">` + action + "</a:Action>")
+
+	if len(options) > 0 {
+		b.WriteString("<w:OptionSet>")
+		for _, name := range sortedKeys(options) {
+			b.WriteString(`<w:Option Name="` + escape(name) + `">` + escape(options[name]) + "</w:Option>")
+		}
+		b.WriteString("</w:OptionSet>")
+	}
+
+	if shellId != "" {
+		b.WriteString(`<w:SelectorSet><w:Selector Name="ShellId">` + escape(shellId) + "</w:Selector></w:SelectorSet>")
+	}
+
+	b.WriteString("</env:Header>")
+	b.WriteString("<env:Body>" + body + "</env:Body>")
+	b.WriteString("</env:Envelope>")
+
+	return b.String()
+}
+
+func escape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
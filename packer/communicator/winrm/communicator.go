@@ -0,0 +1,324 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package winrm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mitchellh/packer/packer"
+)
+
+const (
+	// TransportBasic authenticates with HTTP basic authentication.
+	TransportBasic = "basic"
+
+	// TransportNTLM authenticates with NTLMv2.
+	TransportNTLM = "ntlm"
+)
+
+// Commands run through cmd.exe are limited to 8191 characters, so files
+// are uploaded in base64 chunks a bit smaller than that.
+const uploadChunkSize = 8000
+
+type comm struct {
+	config *Config
+	client *client
+}
+
+type Config struct {
+	Host     string
+	Port     uint
+	Username string
+	Password string
+
+	// Https connects to the HTTPS listener. Insecure skips verifying its
+	// certificate and CACert, if set, is the PEM encoded certificate of
+	// the authority that signed it.
+	Https    bool
+	Insecure bool
+	CACert   []byte
+
+	// Transport is either TransportBasic or TransportNTLM. Both require
+	// AllowUnencrypted on the WinRM service when HTTPS is not used.
+	Transport string
+
+	// Timeout is the WS-Management operation timeout.
+	Timeout time.Duration
+}
+
+// Creates a new packer.Communicator implementation over WinRM. No
+// connection is made until the first command is run.
+func New(config *Config) (result *comm, err error) {
+	if config.Transport == "" {
+		config.Transport = TransportBasic
+	}
+
+	if config.Transport != TransportBasic && config.Transport != TransportNTLM {
+		return nil, fmt.Errorf("Unknown WinRM transport: %s", config.Transport)
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = 60 * time.Second
+	}
+
+	client, err := newClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &comm{
+		config: config,
+		client: client,
+	}
+
+	return
+}
+
+func (c *comm) Start(cmd *packer.RemoteCmd) (err error) {
+	shell, err := c.client.createShell()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Executing remote command: %s", cmd.Command)
+
+	go func() {
+		defer shell.close()
+
+		exitStatus, err := shell.run(cmd.Command, cmd.Stdin, cmd.Stdout, cmd.Stderr)
+		if err != nil {
+			log.Printf("Remote command failed: %s", err)
+			exitStatus = 1
+		}
+
+		cmd.SetExited(exitStatus)
+	}()
+
+	return nil
+}
+
+func (c *comm) Upload(dst string, input io.Reader, fi *os.FileInfo) error {
+	shell, err := c.client.createShell()
+	if err != nil {
+		return err
+	}
+	defer shell.close()
+
+	return c.upload(shell, dst, input)
+}
+
+func (c *comm) UploadDir(dst string, src string, excl []string) error {
+	// a trailing slash uploads the contents of the directory rather than
+	// the directory itself
+	if !strings.HasSuffix(src, "/") && !strings.HasSuffix(src, `\`) {
+		dst = strings.TrimRight(dst, `/\`) + `\` + filepath.Base(src)
+	}
+
+	shell, err := c.client.createShell()
+	if err != nil {
+		return err
+	}
+	defer shell.close()
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		for _, pattern := range excl {
+			if matched, _ := filepath.Match(pattern, rel); matched {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		target := strings.TrimRight(dst, `/\`) + `\` + strings.Replace(filepath.ToSlash(rel), "/", `\`, -1)
+		log.Printf("Uploading '%s' ==> '%s'", path, target)
+
+		return c.upload(shell, target, f)
+	})
+}
+
+func (c *comm) Download(src string, output io.Writer) error {
+	shell, err := c.client.createShell()
+	if err != nil {
+		return err
+	}
+	defer shell.close()
+
+	script := fmt.Sprintf("$path = $ExecutionContext.SessionState.Path.GetUnresolvedProviderPathFromPSPath(%s)\r\n"+
+		"[Convert]::ToBase64String([IO.File]::ReadAllBytes($path))", quote(src))
+
+	var stdout, stderr bytes.Buffer
+	exitStatus, err := shell.run(encodedCommand(script), nil, &stdout, &stderr)
+	if err != nil {
+		return err
+	}
+
+	if exitStatus != 0 {
+		return fmt.Errorf("Error downloading %s: %s", src, strings.TrimSpace(stderr.String()))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(stripSpace(stdout.String()))
+	if err != nil {
+		return fmt.Errorf("Error decoding %s: %s", src, err)
+	}
+
+	_, err = output.Write(data)
+	return err
+}
+
+// upload copies the input to a temporary file on the guest in base64
+// chunks, then decodes it to the destination.
+func (c *comm) upload(shell *shell, dst string, input io.Reader) error {
+	tempFile := fmt.Sprintf(`%%TEMP%%\packer-%s.tmp`, uuid.New())
+
+	if err := c.runChecked(shell, fmt.Sprintf(`type nul > "%s"`, tempFile)); err != nil {
+		return err
+	}
+
+	var chunk bytes.Buffer
+	flush := func() error {
+		if chunk.Len() == 0 {
+			return nil
+		}
+
+		err := c.runChecked(shell, fmt.Sprintf(`echo %s >> "%s"`, chunk.String(), tempFile))
+		chunk.Reset()
+		return err
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, &chunkWriter{
+		buf:   &chunk,
+		size:  uploadChunkSize,
+		flush: flush,
+	})
+
+	if _, err := io.Copy(encoder, input); err != nil {
+		return err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	script := fmt.Sprintf("$tmp = [Environment]::ExpandEnvironmentVariables(%s)\r\n"+
+		"$dest = $ExecutionContext.SessionState.Path.GetUnresolvedProviderPathFromPSPath(%s)\r\n"+
+		"$dir = Split-Path -Parent $dest\r\n"+
+		"if ($dir -and -not (Test-Path $dir)) { New-Item -ItemType Directory -Path $dir -Force | Out-Null }\r\n"+
+		"$b64 = [IO.File]::ReadAllText($tmp) -replace '\\s',''\r\n"+
+		"[IO.File]::WriteAllBytes($dest, [Convert]::FromBase64String($b64))\r\n"+
+		"Remove-Item $tmp -Force", quote(tempFile), quote(dst))
+
+	if err := c.runChecked(shell, encodedCommand(script)); err != nil {
+		return fmt.Errorf("Error uploading %s: %s", dst, err)
+	}
+
+	return nil
+}
+
+// runChecked runs a command and fails if it exits with a non-zero code.
+func (c *comm) runChecked(shell *shell, command string) error {
+	var stderr bytes.Buffer
+	exitStatus, err := shell.run(command, nil, nil, &stderr)
+	if err != nil {
+		return err
+	}
+
+	if exitStatus != 0 {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = fmt.Sprintf("exit code %d", exitStatus)
+		}
+		return errors.New(message)
+	}
+
+	return nil
+}
+
+// chunkWriter buffers writes and flushes them every size bytes.
+type chunkWriter struct {
+	buf   *bytes.Buffer
+	size  int
+	flush func() error
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := w.size - w.buf.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+
+		w.buf.Write(p[:n])
+		p = p[n:]
+		written += n
+
+		if w.buf.Len() >= w.size {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// encodedCommand returns a command line running a PowerShell script
+// passed as base64 encoded UTF-16, which avoids any quoting by cmd.exe.
+func encodedCommand(script string) string {
+	return "powershell -NoProfile -NonInteractive -ExecutionPolicy Bypass -EncodedCommand " +
+		base64.StdEncoding.EncodeToString(encodeUTF16(script))
+}
+
+// quote returns a PowerShell single quoted string literal.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,500 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package winrm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// testServer is a WS-Management endpoint simulating a Windows guest. It
+// understands the commands the communicator runs to transfer files and
+// answers others from Commands.
+type testServer struct {
+	*httptest.Server
+
+	Username string
+	Password string
+	NTLM     bool
+
+	// Canned output of commands, keyed by command line.
+	Commands map[string]testCommand
+
+	// Files on the guest, keyed by path.
+	Files map[string][]byte
+
+	Actions []string
+
+	shells   int
+	commands map[string]*testCommand
+	received map[string]bool
+	l        sync.Mutex
+}
+
+type testCommand struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+type testRequest struct {
+	Header struct {
+		Action string `xml:"Action"`
+	} `xml:"Header"`
+	Body struct {
+		Command string `xml:"CommandLine>Command"`
+		Receive struct {
+			CommandId string `xml:"CommandId,attr"`
+		} `xml:"Receive>DesiredStream"`
+		Send stream `xml:"Send>Stream"`
+	} `xml:"Body"`
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{
+		Username: "vagrant",
+		Password: "vagrant",
+		Commands: make(map[string]testCommand),
+		Files:    make(map[string][]byte),
+		commands: make(map[string]*testCommand),
+		received: make(map[string]bool),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/wsman" {
+			t.Errorf("bad path: %s", r.URL.Path)
+		}
+
+		if !s.authorize(w, r) {
+			return
+		}
+
+		data, _ := ioutil.ReadAll(r.Body)
+
+		var request testRequest
+		if err := xml.Unmarshal(data, &request); err != nil {
+			t.Errorf("bad request: %s\n%s", err, data)
+			return
+		}
+
+		s.l.Lock()
+		defer s.l.Unlock()
+
+		s.Actions = append(s.Actions, request.Header.Action[strings.LastIndex(request.Header.Action, "/")+1:])
+
+		switch request.Header.Action {
+		case actionCreate:
+			s.shells++
+			s.respond(w, fmt.Sprintf(`<rsp:Shell><rsp:ShellId>shell-%d</rsp:ShellId></rsp:Shell>`, s.shells))
+		case actionCommand:
+			id := fmt.Sprintf("command-%d", len(s.commands)+1)
+			s.commands[id] = s.run(request.Body.Command)
+			s.respond(w, `<rsp:CommandResponse><rsp:CommandId>`+id+`</rsp:CommandId></rsp:CommandResponse>`)
+		case actionSend:
+			input, _ := base64.StdEncoding.DecodeString(request.Body.Send.Value)
+			command := s.commands[request.Body.Send.CommandId]
+			command.Stdout = string(input)
+			s.respond(w, "")
+		case actionReceive:
+			id := request.Body.Receive.CommandId
+
+			// the first receive of every command times out
+			if !s.received[id] {
+				s.received[id] = true
+				w.WriteHeader(http.StatusInternalServerError)
+				s.respond(w, `<s:Fault xmlns:s="`+nsEnvelope+`"><s:Code><s:Value>s:Receiver</s:Value>`+
+					`<s:Subcode><s:Value>w:TimedOut</s:Value></s:Subcode></s:Code>`+
+					`<s:Detail><f:WSManFault xmlns:f="http://schemas.microsoft.com/wbem/wsman/1/wsmanfault" Code="2150858793"/></s:Detail></s:Fault>`)
+				return
+			}
+
+			command := s.commands[id]
+			s.respond(w, fmt.Sprintf(`<rsp:ReceiveResponse>`+
+				`<rsp:Stream Name="stdout" CommandId="%s">%s</rsp:Stream>`+
+				`<rsp:Stream Name="stderr" CommandId="%s">%s</rsp:Stream>`+
+				`<rsp:CommandState CommandId="%s" State="%s"><rsp:ExitCode>%d</rsp:ExitCode></rsp:CommandState>`+
+				`</rsp:ReceiveResponse>`,
+				id, base64.StdEncoding.EncodeToString([]byte(command.Stdout)),
+				id, base64.StdEncoding.EncodeToString([]byte(command.Stderr)),
+				id, commandStateDone, command.ExitCode))
+		case actionSignal, actionDelete:
+			s.respond(w, "")
+		default:
+			t.Errorf("unknown action: %s", request.Header.Action)
+		}
+	}))
+
+	return s
+}
+
+func (s *testServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if !s.NTLM {
+		username, password, ok := testBasicAuth(r)
+		if !ok || username != s.Username || password != s.Password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	header := r.Header.Get("Authorization")
+	message, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, "Negotiate "))
+	if err != nil || len(message) < 12 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+
+	switch binary.LittleEndian.Uint32(message[8:]) {
+	case 1:
+		ioutil.ReadAll(r.Body)
+		challenge := testNtlmChallengeMessage(testNtlmTargetInfo)
+		w.Header().Set("WWW-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(challenge))
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	case 3:
+		user := testNtlmField(message, 3)
+		if !bytes.Equal(user, encodeUTF16(s.Username)) ||
+			!testNtlmVerify(testNtlmField(message, 1), s.Username, "", s.Password) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+func (s *testServer) respond(w http.ResponseWriter, body string) {
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="%s" xmlns:rsp="%s"><s:Header/><s:Body>%s</s:Body></s:Envelope>`,
+		nsEnvelope, nsShell, body)
+}
+
+var (
+	testTypeNul   = regexp.MustCompile(`^type nul > "(.*)"$`)
+	testEcho      = regexp.MustCompile(`^echo (\S+) >> "(.*)"$`)
+	testTempFile  = regexp.MustCompile(`ExpandEnvironmentVariables\('([^']*)'\)`)
+	testPSPath    = regexp.MustCompile(`GetUnresolvedProviderPathFromPSPath\('((?:[^']|'')*)'\)`)
+	testEncodedPS = regexp.MustCompile(`^powershell .*-EncodedCommand (\S+)$`)
+)
+
+func (s *testServer) run(command string) *testCommand {
+	if m := testTypeNul.FindStringSubmatch(command); m != nil {
+		s.Files[m[1]] = nil
+		return &testCommand{}
+	}
+
+	if m := testEcho.FindStringSubmatch(command); m != nil {
+		s.Files[m[2]] = append(s.Files[m[2]], []byte(m[1]+" \r\n")...)
+		return &testCommand{}
+	}
+
+	if m := testEncodedPS.FindStringSubmatch(command); m != nil {
+		data, _ := base64.StdEncoding.DecodeString(m[1])
+		codes := make([]uint16, len(data)/2)
+		for i := range codes {
+			codes[i] = binary.LittleEndian.Uint16(data[2*i:])
+		}
+		script := string(testDecodeUTF16(codes))
+
+		path := strings.Replace(testPSPath.FindStringSubmatch(script)[1], "''", "'", -1)
+
+		if tmp := testTempFile.FindStringSubmatch(script); tmp != nil {
+			content, err := base64.StdEncoding.DecodeString(stripSpace(string(s.Files[tmp[1]])))
+			if err != nil {
+				return &testCommand{Stderr: err.Error(), ExitCode: 1}
+			}
+			s.Files[path] = content
+			delete(s.Files, tmp[1])
+			return &testCommand{}
+		}
+
+		content, ok := s.Files[path]
+		if !ok {
+			return &testCommand{Stderr: "Could not find file " + path, ExitCode: 1}
+		}
+		return &testCommand{Stdout: base64.StdEncoding.EncodeToString(content) + "\r\n"}
+	}
+
+	canned, ok := s.Commands[command]
+	if !ok {
+		return &testCommand{Stderr: fmt.Sprintf("'%s' is not recognized as an internal or external command", command), ExitCode: 1}
+	}
+	return &canned
+}
+
+func testDecodeUTF16(codes []uint16) []rune {
+	runes := make([]rune, len(codes))
+	for i, c := range codes {
+		runes[i] = rune(c)
+	}
+	return runes
+}
+
+func testBasicAuth(r *http.Request) (string, string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Basic ") {
+		return "", "", false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(header[len("Basic "):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(data), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+func testComm(t *testing.T, s *testServer, transport string) *comm {
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	portNumber, _ := strconv.Atoi(port)
+
+	c, err := New(&Config{
+		Host:      host,
+		Port:      uint(portNumber),
+		Username:  s.Username,
+		Password:  s.Password,
+		Transport: transport,
+		Timeout:   5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	return c
+}
+
+func TestComm_implementsCommunicator(t *testing.T) {
+	var raw interface{}
+	raw = &comm{}
+	if _, ok := raw.(packer.Communicator); !ok {
+		t.Fatal("comm must be a Communicator")
+	}
+}
+
+func TestNew_badTransport(t *testing.T) {
+	if _, err := New(&Config{Transport: "kerberos"}); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestCommStart(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Commands["hostname"] = testCommand{Stdout: "packer-guest\r\n"}
+	s.Commands["exit 3"] = testCommand{Stderr: "failed\r\n", ExitCode: 3}
+
+	c := testComm(t, s, "")
+
+	var stdout, stderr bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: "hostname", Stdout: &stdout, Stderr: &stderr}
+	if err := c.Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+
+	if cmd.ExitStatus != 0 {
+		t.Fatalf("bad exit status: %d", cmd.ExitStatus)
+	}
+
+	if stdout.String() != "packer-guest\r\n" {
+		t.Fatalf("bad stdout: %q", stdout.String())
+	}
+
+	stdout.Reset()
+	cmd = &packer.RemoteCmd{Command: "exit 3", Stdout: &stdout, Stderr: &stderr}
+	if err := c.Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+
+	if cmd.ExitStatus != 3 {
+		t.Fatalf("bad exit status: %d", cmd.ExitStatus)
+	}
+
+	if stderr.String() != "failed\r\n" {
+		t.Fatalf("bad stderr: %q", stderr.String())
+	}
+
+	expected := []string{"Create", "Command", "Receive", "Receive", "Signal", "Delete"}
+	if actions := strings.Join(s.Actions[:6], " "); actions != strings.Join(expected, " ") {
+		t.Fatalf("bad actions: %s", actions)
+	}
+}
+
+func TestCommStart_stdin(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.Commands["more"] = testCommand{}
+
+	c := testComm(t, s, "")
+
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: "more", Stdin: strings.NewReader("input"), Stdout: &stdout}
+	if err := c.Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+
+	if stdout.String() != "input" {
+		t.Fatalf("bad stdout: %q", stdout.String())
+	}
+}
+
+func TestCommStart_unauthorized(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	c := testComm(t, s, "")
+	c.client.password = "wrong"
+
+	if err := c.Start(&packer.RemoteCmd{Command: "hostname"}); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestCommStart_ntlm(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	s.NTLM = true
+	s.Commands["hostname"] = testCommand{Stdout: "packer-guest"}
+
+	c := testComm(t, s, TransportNTLM)
+
+	var stdout bytes.Buffer
+	cmd := &packer.RemoteCmd{Command: "hostname", Stdout: &stdout}
+	if err := c.Start(cmd); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	cmd.Wait()
+
+	if cmd.ExitStatus != 0 || stdout.String() != "packer-guest" {
+		t.Fatalf("bad: %d %q", cmd.ExitStatus, stdout.String())
+	}
+
+	c.client.http.Transport.(*ntlmTransport).password = "wrong"
+	if err := c.Start(&packer.RemoteCmd{Command: "hostname"}); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestCommUploadDownload(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	c := testComm(t, s, "")
+
+	// large enough to need several chunks
+	content := bytes.Repeat([]byte("packer\x00\xff"), 3*uploadChunkSize/8+5)
+
+	if err := c.Upload(`C:\Windows\Temp\it's.bin`, bytes.NewReader(content), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(s.Files[`C:\Windows\Temp\it's.bin`], content) {
+		t.Fatal("uploaded content does not match")
+	}
+
+	if len(s.Files) != 1 {
+		t.Fatalf("temporary file not removed: %d files", len(s.Files))
+	}
+
+	var output bytes.Buffer
+	if err := c.Download(`C:\Windows\Temp\it's.bin`, &output); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(output.Bytes(), content) {
+		t.Fatal("downloaded content does not match")
+	}
+
+	if err := c.Download(`C:\missing.txt`, &output); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestCommUpload_empty(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	c := testComm(t, s, "")
+
+	if err := c.Upload(`C:\empty.txt`, bytes.NewReader(nil), nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	content, ok := s.Files[`C:\empty.txt`]
+	if !ok || len(content) != 0 {
+		t.Fatalf("bad: %v %q", ok, content)
+	}
+}
+
+func TestCommUploadDir(t *testing.T) {
+	s := newTestServer(t)
+	defer s.Close()
+
+	c := testComm(t, s, "")
+
+	src, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(src)
+
+	os.MkdirAll(filepath.Join(src, "scripts", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "scripts", "a.ps1"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "scripts", "sub", "b.ps1"), []byte("b"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "scripts", "skip.tmp"), []byte("skip"), 0644)
+
+	if err := c.UploadDir(`C:\packer`, filepath.Join(src, "scripts"), []string{"*.tmp"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(s.Files[`C:\packer\scripts\a.ps1`]) != "a" || string(s.Files[`C:\packer\scripts\sub\b.ps1`]) != "b" {
+		t.Fatalf("bad files: %v", s.Files)
+	}
+
+	if _, ok := s.Files[`C:\packer\scripts\skip.tmp`]; ok {
+		t.Fatal("excluded file uploaded")
+	}
+
+	// a trailing slash uploads the contents only
+	if err := c.UploadDir(`C:\contents`, filepath.Join(src, "scripts")+"/", nil); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if string(s.Files[`C:\contents\a.ps1`]) != "a" {
+		t.Fatalf("bad files: %v", s.Files)
+	}
+}
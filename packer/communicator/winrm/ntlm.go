@@ -0,0 +1,306 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package winrm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"code.google.com/p/go.crypto/md4"
+)
+
+// NTLM negotiate flags, see [MS-NLMP] 2.2.2.5.
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+	ntlmNegotiate128                     = 0x20000000
+	ntlmNegotiate56                      = 0x80000000
+
+	ntlmNegotiateFlags = ntlmNegotiateUnicode | ntlmRequestTarget | ntlmNegotiateNTLM |
+		ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity |
+		ntlmNegotiateTargetInfo | ntlmNegotiate128 | ntlmNegotiate56
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// ntlmTransport authenticates every request with an NTLMv2 handshake
+// using the Negotiate scheme. Messages are authenticated but not sealed,
+// so the WinRM service has to allow unencrypted traffic unless HTTPS is
+// used.
+type ntlmTransport struct {
+	transport http.RoundTripper
+	username  string
+	password  string
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body has to be sent with every leg of the handshake
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	domain, user := splitDomain(t.username)
+
+	resp, err := t.roundTrip(req, body, ntlmNegotiateMessage())
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge, ok := ntlmChallengeFromResponse(resp)
+
+	// drain the response so the connection is reused for the next leg,
+	// NTLM authenticates the connection rather than the request
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if !ok {
+		return nil, errors.New("The WinRM server did not send an NTLM challenge, check winrm_transport")
+	}
+
+	authenticate, err := ntlmAuthenticateMessage(challenge, user, domain, t.password, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return t.roundTrip(req, body, authenticate)
+}
+
+func (t *ntlmTransport) roundTrip(req *http.Request, body []byte, message []byte) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+
+	r.Header.Set("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(message))
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	return t.transport.RoundTrip(r)
+}
+
+func ntlmChallengeFromResponse(resp *http.Response) ([]byte, bool) {
+	for _, header := range resp.Header[http.CanonicalHeaderKey("WWW-Authenticate")] {
+		for _, scheme := range []string{"Negotiate ", "NTLM "} {
+			if strings.HasPrefix(header, scheme) {
+				data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(scheme):]))
+				if err == nil {
+					return data, true
+				}
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// splitDomain splits a DOMAIN\user name into its parts.
+func splitDomain(username string) (string, string) {
+	if i := strings.Index(username, `\`); i >= 0 {
+		return username[:i], username[i+1:]
+	}
+
+	return "", username
+}
+
+func ntlmNegotiateMessage() []byte {
+	message := make([]byte, 32)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 1)
+	binary.LittleEndian.PutUint32(message[12:], ntlmNegotiateFlags)
+
+	return message
+}
+
+// ntlmChallenge is the part of a CHALLENGE_MESSAGE needed to answer it.
+type ntlmChallenge struct {
+	flags           uint32
+	serverChallenge []byte
+	targetInfo      []byte
+}
+
+func parseNtlmChallenge(message []byte) (*ntlmChallenge, error) {
+	if len(message) < 48 || !bytes.Equal(message[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(message[8:]) != 2 {
+		return nil, errors.New("Invalid NTLM challenge message")
+	}
+
+	challenge := &ntlmChallenge{
+		flags:           binary.LittleEndian.Uint32(message[20:]),
+		serverChallenge: message[24:32],
+	}
+
+	length := int(binary.LittleEndian.Uint16(message[40:]))
+	offset := int(binary.LittleEndian.Uint32(message[44:]))
+	if offset+length > len(message) {
+		return nil, errors.New("Invalid NTLM challenge message")
+	}
+	challenge.targetInfo = message[offset : offset+length]
+
+	return challenge, nil
+}
+
+// ntlmAuthenticateMessage answers a CHALLENGE_MESSAGE with NTLMv2
+// responses, see [MS-NLMP] 3.3.2.
+func ntlmAuthenticateMessage(message []byte, user string, domain string, password string, now time.Time) ([]byte, error) {
+	challenge, err := parseNtlmChallenge(message)
+	if err != nil {
+		return nil, err
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	timestamp, serverTimestamp := ntlmTimestamp(challenge.targetInfo)
+	if !serverTimestamp {
+		timestamp = ntlmFileTime(now)
+	}
+
+	ntResponse, lmResponse := ntlmV2Responses(user, domain, password,
+		challenge.serverChallenge, clientChallenge, timestamp, challenge.targetInfo)
+
+	// the LMv2 response must be empty when the server sent a timestamp
+	if serverTimestamp {
+		lmResponse = make([]byte, 24)
+	}
+
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		encodeUTF16(domain),
+		encodeUTF16(user),
+		nil, // workstation
+		nil, // encrypted random session key
+	}
+
+	const headerLength = 64
+	auth := make([]byte, headerLength)
+	copy(auth, ntlmSignature)
+	binary.LittleEndian.PutUint32(auth[8:], 3)
+
+	offset := headerLength
+	for i, field := range fields {
+		header := auth[12+i*8:]
+		binary.LittleEndian.PutUint16(header[0:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(offset))
+		offset += len(field)
+	}
+
+	binary.LittleEndian.PutUint32(auth[60:], challenge.flags&ntlmNegotiateFlags)
+
+	for _, field := range fields {
+		auth = append(auth, field...)
+	}
+
+	return auth, nil
+}
+
+// ntlmV2Responses computes the NTLMv2 and LMv2 responses to a challenge.
+func ntlmV2Responses(user string, domain string, password string, serverChallenge []byte, clientChallenge []byte, timestamp []byte, targetInfo []byte) ([]byte, []byte) {
+	key := ntowfv2(user, domain, password)
+
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	ntProof := hmacMD5(key, serverChallenge, temp.Bytes())
+	ntResponse := append(ntProof, temp.Bytes()...)
+
+	lmResponse := append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+
+	return ntResponse, lmResponse
+}
+
+func ntowfv2(user string, domain string, password string) []byte {
+	hash := md4.New()
+	hash.Write(encodeUTF16(password))
+
+	return hmacMD5(hash.Sum(nil), encodeUTF16(strings.ToUpper(user)+domain))
+}
+
+// ntlmTimestamp finds the MsvAvTimestamp pair in the target info.
+func ntlmTimestamp(targetInfo []byte) ([]byte, bool) {
+	for len(targetInfo) >= 4 {
+		id := binary.LittleEndian.Uint16(targetInfo[0:])
+		length := int(binary.LittleEndian.Uint16(targetInfo[2:]))
+		if id == ntlmAvEOL || 4+length > len(targetInfo) {
+			break
+		}
+
+		if id == ntlmAvTimestamp && length == 8 {
+			return targetInfo[4:12], true
+		}
+
+		targetInfo = targetInfo[4+length:]
+	}
+
+	return nil, false
+}
+
+// ntlmFileTime encodes a time as a Windows FILETIME, the number of 100ns
+// intervals since January 1, 1601.
+func ntlmFileTime(t time.Time) []byte {
+	const epochDelta = 116444736000000000
+
+	fileTime := make([]byte, 8)
+	binary.LittleEndian.PutUint64(fileTime, uint64(t.UnixNano()/100+epochDelta))
+
+	return fileTime
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+
+	return mac.Sum(nil)
+}
+
+func encodeUTF16(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(codes))
+	for i, c := range codes {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+
+	return b
+}
@@ -0,0 +1,154 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package winrm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// The NTLMv2 example in [MS-NLMP] 4.2.4.
+var (
+	testNtlmServerChallenge = mustHex("0123456789abcdef")
+	testNtlmClientChallenge = mustHex("aaaaaaaaaaaaaaaa")
+	testNtlmTargetInfo      = mustHex("02000c0044006f006d00610069006e00" +
+		"01000c00530065007200760065007200" + "00000000")
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestNtowfv2(t *testing.T) {
+	key := ntowfv2("User", "Domain", "Password")
+	if expected := mustHex("0c868a403bfd7a93a3001ef22ef02e3f"); !bytes.Equal(key, expected) {
+		t.Fatalf("bad: %x", key)
+	}
+}
+
+func TestNtlmV2Responses(t *testing.T) {
+	ntResponse, lmResponse := ntlmV2Responses("User", "Domain", "Password",
+		testNtlmServerChallenge, testNtlmClientChallenge, make([]byte, 8), testNtlmTargetInfo)
+
+	if expected := mustHex("86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa"); !bytes.Equal(lmResponse, expected) {
+		t.Fatalf("bad LMv2 response: %x", lmResponse)
+	}
+
+	if expected := mustHex("68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(ntResponse[:16], expected) {
+		t.Fatalf("bad NTProofStr: %x", ntResponse[:16])
+	}
+
+	if !bytes.Equal(ntResponse[44:44+len(testNtlmTargetInfo)], testNtlmTargetInfo) {
+		t.Fatalf("target info not in the response: %x", ntResponse)
+	}
+}
+
+func TestNtlmAuthenticateMessage(t *testing.T) {
+	challenge := testNtlmChallengeMessage(testNtlmTargetInfo)
+
+	message, err := ntlmAuthenticateMessage(challenge, "User", "Domain", "Password", time.Unix(0, 0))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !bytes.Equal(message[:8], ntlmSignature) || binary.LittleEndian.Uint32(message[8:]) != 3 {
+		t.Fatalf("bad header: %x", message[:12])
+	}
+
+	if user := testNtlmField(message, 3); !bytes.Equal(user, encodeUTF16("User")) {
+		t.Fatalf("bad user: %x", user)
+	}
+
+	if domain := testNtlmField(message, 2); !bytes.Equal(domain, encodeUTF16("Domain")) {
+		t.Fatalf("bad domain: %x", domain)
+	}
+
+	if !testNtlmVerify(testNtlmField(message, 1), "User", "Domain", "Password") {
+		t.Fatal("NTLMv2 response does not verify")
+	}
+
+	if testNtlmVerify(testNtlmField(message, 1), "User", "Domain", "wrong") {
+		t.Fatal("NTLMv2 response verifies with the wrong password")
+	}
+}
+
+func TestNtlmAuthenticateMessage_serverTimestamp(t *testing.T) {
+	timestamp := mustHex("0090d336b734c301")
+	targetInfo := append(mustHex("07000800"), timestamp...)
+	targetInfo = append(targetInfo, 0, 0, 0, 0)
+
+	message, err := ntlmAuthenticateMessage(testNtlmChallengeMessage(targetInfo), "User", "", "Password", time.Now())
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if lm := testNtlmField(message, 0); !bytes.Equal(lm, make([]byte, 24)) {
+		t.Fatalf("LMv2 response should be empty: %x", lm)
+	}
+
+	if nt := testNtlmField(message, 1); !bytes.Equal(nt[24:32], timestamp) {
+		t.Fatalf("server timestamp not used: %x", nt[24:32])
+	}
+}
+
+func TestParseNtlmChallenge_invalid(t *testing.T) {
+	if _, err := parseNtlmChallenge([]byte("NTLMSSP\x00")); err == nil {
+		t.Fatal("should error")
+	}
+
+	if _, err := ntlmAuthenticateMessage(ntlmNegotiateMessage(), "User", "", "Password", time.Now()); err == nil {
+		t.Fatal("should error")
+	}
+}
+
+func TestSplitDomain(t *testing.T) {
+	domain, user := splitDomain(`CONTOSO\packer`)
+	if domain != "CONTOSO" || user != "packer" {
+		t.Fatalf("bad: %s %s", domain, user)
+	}
+
+	domain, user = splitDomain("packer")
+	if domain != "" || user != "packer" {
+		t.Fatalf("bad: %s %s", domain, user)
+	}
+}
+
+func testNtlmChallengeMessage(targetInfo []byte) []byte {
+	message := make([]byte, 48)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 2)
+	binary.LittleEndian.PutUint32(message[20:], ntlmNegotiateFlags)
+	copy(message[24:], testNtlmServerChallenge)
+	binary.LittleEndian.PutUint16(message[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(message[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(message[44:], 48)
+
+	return append(message, targetInfo...)
+}
+
+func testNtlmField(message []byte, index int) []byte {
+	header := message[12+index*8:]
+	length := int(binary.LittleEndian.Uint16(header[0:]))
+	offset := int(binary.LittleEndian.Uint32(header[4:]))
+
+	return message[offset : offset+length]
+}
+
+// testNtlmVerify checks an NTLMv2 response the way a server would.
+func testNtlmVerify(ntResponse []byte, user string, domain string, password string) bool {
+	if len(ntResponse) < 16 {
+		return false
+	}
+
+	proof := hmacMD5(ntowfv2(user, domain, password), testNtlmServerChallenge, ntResponse[16:])
+	return bytes.Equal(proof, ntResponse[:16])
+}
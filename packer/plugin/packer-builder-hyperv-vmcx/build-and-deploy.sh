@@ -0,0 +1,3 @@
+go build
+cp packer-builder-hyperv-vmcx.exe ../../../bin/
+
@@ -0,0 +1,19 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package main
+
+import (
+	"github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/vmcx"
+	"github.com/mitchellh/packer/packer/plugin"
+)
+
+func main() {
+	server, err := plugin.Server()
+	if err != nil {
+		panic(err)
+	}
+	server.RegisterBuilder(new(vmcx.Builder))
+	server.Serve()
+}
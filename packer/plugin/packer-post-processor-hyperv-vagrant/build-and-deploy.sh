@@ -0,0 +1,2 @@
+go build
+cp packer-post-processor-hyperv-vagrant.exe ../../../bin/
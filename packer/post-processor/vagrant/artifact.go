@@ -0,0 +1,49 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package vagrant
+
+import (
+	"fmt"
+	"os"
+)
+
+const BuilderId = "MSOpenTech.post-processor.vagrant"
+
+// Artifact is a Vagrant box for the Hyper-V provider.
+type Artifact struct {
+	Path     string
+	Provider string
+}
+
+func NewArtifact(provider, path string) *Artifact {
+	return &Artifact{
+		Path:     path,
+		Provider: provider,
+	}
+}
+
+func (*Artifact) BuilderId() string {
+	return BuilderId
+}
+
+func (a *Artifact) Files() []string {
+	return []string{a.Path}
+}
+
+func (a *Artifact) Id() string {
+	return a.Provider
+}
+
+func (a *Artifact) String() string {
+	return fmt.Sprintf("'%s' provider box: %s", a.Provider, a.Path)
+}
+
+func (a *Artifact) State(name string) interface{} {
+	return nil
+}
+
+func (a *Artifact) Destroy() error {
+	return os.Remove(a.Path)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package vagrant
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A boxWriter writes a box, a gzip'd tar of the files in it.
+type boxWriter struct {
+	f  *os.File
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newBoxWriter(path string, level int) (*boxWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gz, err := gzip.NewWriterLevel(f, level)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &boxWriter{f: f, gz: gz, tw: tar.NewWriter(gz)}, nil
+}
+
+// WriteContents adds a file with the contents given to the box.
+func (w *boxWriter) WriteContents(name string, contents []byte) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err := w.tw.Write(contents)
+	return err
+}
+
+// WriteDir adds the files in dir to the box, named by their path
+// relative to root.
+func (w *boxWriter) WriteDir(root string, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+
+		if info.IsDir() {
+			header.Name += "/"
+			return w.tw.WriteHeader(header)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		log.Printf("Box add: '%s' as '%s'", path, header.Name)
+		if err := w.tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(w.tw, f)
+		return err
+	})
+}
+
+// Close finishes the box. The box is incomplete unless Close succeeds.
+func (w *boxWriter) Close() error {
+	err := w.tw.Close()
+	if gzErr := w.gz.Close(); err == nil {
+		err = gzErr
+	}
+	if fErr := w.f.Close(); err == nil {
+		err = fErr
+	}
+	return err
+}
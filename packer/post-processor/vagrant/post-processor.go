@@ -0,0 +1,213 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+
+// Package vagrant implements a post-processor packaging the VMs exported
+// by the Hyper-V builder as Vagrant boxes for the hyperv provider.
+package vagrant
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	hypervcommon "github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common"
+	"github.com/mitchellh/packer/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+const (
+	Provider = "hyperv"
+
+	DefaultOutputPath = "packer_{{ .BuildName }}_{{ .Provider }}.box"
+)
+
+type Config struct {
+	common.PackerConfig `mapstructure:",squash"`
+
+	// The compression level of the box, from 0 for no compression to 9 for
+	// the best compression. By default, this is 6.
+	CompressionLevel int `mapstructure:"compression_level"`
+	// Keeps the exported VM after the box is made. By default, it is
+	// removed.
+	KeepInputArtifact bool `mapstructure:"keep_input_artifact"`
+	// The path of the box, a template with the BuildName, Provider and
+	// ArtifactId. By default, this is "packer_{{ .BuildName }}_{{ .Provider }}.box".
+	OutputPath string `mapstructure:"output"`
+	// The path of a template for the Vagrantfile packaged in the box, which
+	// is given the BuildName. By default, no Vagrantfile is packaged.
+	VagrantfileTemplate string `mapstructure:"vagrantfile_template"`
+
+	tpl *packer.ConfigTemplate
+}
+
+type PostProcessor struct {
+	config Config
+}
+
+type outputPathTemplate struct {
+	ArtifactId string
+	BuildName  string
+	Provider   string
+}
+
+type vagrantfileTemplate struct {
+	BuildName string
+}
+
+func (p *PostProcessor) Configure(raws ...interface{}) error {
+	md, err := common.DecodeConfig(&p.config, raws...)
+	if err != nil {
+		return err
+	}
+
+	p.config.tpl, err = packer.NewConfigTemplate()
+	if err != nil {
+		return err
+	}
+	p.config.tpl.UserVars = p.config.PackerUserVars
+
+	// Accumulate any errors
+	errs := common.CheckUnusedConfig(md)
+
+	if p.config.OutputPath == "" {
+		p.config.OutputPath = DefaultOutputPath
+	}
+
+	found := false
+	for _, k := range md.Keys {
+		if k == "compression_level" {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		p.config.CompressionLevel = flate.DefaultCompression
+	} else if p.config.CompressionLevel < flate.NoCompression || p.config.CompressionLevel > flate.BestCompression {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("compression_level: must be between %d and %d, but defined: %d",
+				flate.NoCompression, flate.BestCompression, p.config.CompressionLevel))
+	}
+
+	var tplErr error
+	p.config.VagrantfileTemplate, tplErr = p.config.tpl.Process(p.config.VagrantfileTemplate, nil)
+	if tplErr != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error processing vagrantfile_template: %s", tplErr))
+	}
+
+	if err := p.config.tpl.Validate(p.config.OutputPath); err != nil {
+		errs = packer.MultiErrorAppend(errs, fmt.Errorf("Error parsing output template: %s", err))
+	}
+
+	if p.config.VagrantfileTemplate != "" {
+		if _, err := os.Stat(p.config.VagrantfileTemplate); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("vagrantfile_template: '%v' check the path is correct.", p.config.VagrantfileTemplate))
+		}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	if artifact.BuilderId() != hypervcommon.BuilderId {
+		return nil, false, fmt.Errorf("Unknown artifact type, requires an artifact of the Hyper-V builder: %s", artifact.BuilderId())
+	}
+
+	dir, ok := artifact.State(hypervcommon.ArtifactStateDir).(string)
+	if !ok || dir == "" {
+		return nil, false, fmt.Errorf("The artifact does not give its output directory.")
+	}
+
+	for _, name := range []string{hypervcommon.VmDir, hypervcommon.VhdDir} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.IsDir() {
+			return nil, false, fmt.Errorf("The output directory %s holds no exported VM, %s is missing.", dir, name)
+		}
+	}
+
+	ui.Say(fmt.Sprintf("Creating Vagrant box for '%s' provider", Provider))
+
+	outputPath, err := p.config.tpl.Process(p.config.OutputPath, &outputPathTemplate{
+		ArtifactId: artifact.Id(),
+		BuildName:  p.config.PackerBuildName,
+		Provider:   Provider,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return nil, false, err
+	}
+
+	ui.Message(fmt.Sprintf("Compressing: %s", outputPath))
+	if err := p.writeBox(outputPath, dir); err != nil {
+		os.Remove(outputPath)
+		return nil, false, fmt.Errorf("Error creating box: %s", err)
+	}
+
+	return NewArtifact(Provider, outputPath), p.config.KeepInputArtifact, nil
+}
+
+func (p *PostProcessor) writeBox(path string, dir string) error {
+	box, err := newBoxWriter(path, p.config.CompressionLevel)
+	if err != nil {
+		return err
+	}
+
+	err = p.writeBoxFiles(box, dir)
+	if closeErr := box.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (p *PostProcessor) writeBoxFiles(box *boxWriter, dir string) error {
+	metadata, err := json.Marshal(map[string]string{"provider": Provider})
+	if err != nil {
+		return err
+	}
+
+	if err := box.WriteContents("metadata.json", metadata); err != nil {
+		return err
+	}
+
+	if p.config.VagrantfileTemplate != "" {
+		vagrantfile, err := p.vagrantfile()
+		if err != nil {
+			return err
+		}
+
+		if err := box.WriteContents("Vagrantfile", []byte(vagrantfile)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{hypervcommon.VmDir, hypervcommon.VhdDir} {
+		if err := box.WriteDir(dir, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *PostProcessor) vagrantfile() (string, error) {
+	contents, err := ioutil.ReadFile(p.config.VagrantfileTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	return p.config.tpl.Process(string(contents), &vagrantfileTemplate{
+		BuildName: p.config.PackerBuildName,
+	})
+}
@@ -0,0 +1,240 @@
+package vagrant
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	hypervcommon "github.com/MSOpenTech/packer-hyperv/packer/builder/hyperv/common"
+	"github.com/mitchellh/packer/packer"
+)
+
+func testUi() *packer.BasicUi {
+	return &packer.BasicUi{
+		Reader: new(bytes.Buffer),
+		Writer: new(bytes.Buffer),
+	}
+}
+
+// testOutputDir creates an output directory as the Hyper-V builder
+// leaves it, and returns the artifact of the builder.
+func testOutputDir(t *testing.T) (string, *packer.MockArtifact) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := map[string]string{
+		filepath.Join(hypervcommon.VmDir, "vm.xml"):   "<configuration/>",
+		filepath.Join(hypervcommon.VhdDir, "vm.vhdx"): "vhdx",
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	artifact := &packer.MockArtifact{
+		BuilderIdValue: hypervcommon.BuilderId,
+		IdValue:        "VM",
+		StateValues:    map[string]interface{}{hypervcommon.ArtifactStateDir: dir},
+	}
+
+	return dir, artifact
+}
+
+// readBox returns the contents of the files in the box by their name,
+// and the names of the directories in the box.
+func readBox(t *testing.T, path string) (map[string]string, []string) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	files := make(map[string]string)
+	var dirs []string
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, header.Name)
+			continue
+		}
+
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		files[header.Name] = string(contents)
+	}
+
+	return files, dirs
+}
+
+func TestPostProcessor_ImplementsPostProcessor(t *testing.T) {
+	var _ packer.PostProcessor = new(PostProcessor)
+}
+
+func TestPostProcessorConfigure(t *testing.T) {
+	var p PostProcessor
+	if err := p.Configure(map[string]interface{}{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if p.config.OutputPath != DefaultOutputPath {
+		t.Fatalf("bad: %s", p.config.OutputPath)
+	}
+
+	if p.config.CompressionLevel != flate.DefaultCompression {
+		t.Fatalf("bad: %d", p.config.CompressionLevel)
+	}
+}
+
+func TestPostProcessorConfigure_vagrantfileTemplate(t *testing.T) {
+	var p PostProcessor
+	p.config.VagrantfileTemplate = filepath.Join("missing", "Vagrantfile.template")
+	if err := p.Configure(map[string]interface{}{}); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestPostProcessorPostProcess(t *testing.T) {
+	dir, artifact := testOutputDir(t)
+	defer os.RemoveAll(dir)
+
+	boxDir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(boxDir)
+
+	template := filepath.Join(boxDir, "Vagrantfile.template")
+	if err := ioutil.WriteFile(template, []byte(`config.vm.box = "{{ .BuildName }}"`), 0644); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	var p PostProcessor
+	p.config.OutputPath = filepath.Join(boxDir, "boxes", "{{ .BuildName }}_{{ .Provider }}.box")
+	p.config.VagrantfileTemplate = template
+	p.config.PackerBuildName = "windows"
+	p.config.KeepInputArtifact = true
+	if err := p.Configure(map[string]interface{}{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	result, keep, err := p.PostProcess(testUi(), artifact)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if !keep {
+		t.Fatal("should keep the input artifact")
+	}
+
+	boxPath := filepath.Join(boxDir, "boxes", "windows_hyperv.box")
+	if result.BuilderId() != BuilderId || result.Id() != Provider || !reflect.DeepEqual(result.Files(), []string{boxPath}) {
+		t.Fatalf("bad artifact: %#v", result)
+	}
+
+	files, dirs := readBox(t, boxPath)
+
+	expected := map[string]string{
+		"metadata.json":              `{"provider":"hyperv"}`,
+		"Vagrantfile":                `config.vm.box = "windows"`,
+		"Virtual Machines/vm.xml":    "<configuration/>",
+		"Virtual Hard Disks/vm.vhdx": "vhdx",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Fatalf("bad files: %#v", files)
+	}
+
+	if !reflect.DeepEqual(dirs, []string{"Virtual Machines/", "Virtual Hard Disks/"}) {
+		t.Fatalf("bad directories: %#v", dirs)
+	}
+
+	if err := result.Destroy(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := os.Stat(boxPath); !os.IsNotExist(err) {
+		t.Fatal("should remove the box")
+	}
+}
+
+func TestPostProcessorPostProcess_noCompression(t *testing.T) {
+	dir, artifact := testOutputDir(t)
+	defer os.RemoveAll(dir)
+
+	var p PostProcessor
+	p.config.OutputPath = filepath.Join(dir, "test.box")
+	if err := p.Configure(map[string]interface{}{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p.config.CompressionLevel = flate.NoCompression
+
+	result, keep, err := p.PostProcess(testUi(), artifact)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if keep {
+		t.Fatal("should not keep the input artifact")
+	}
+
+	if files, _ := readBox(t, result.Files()[0]); files["Virtual Hard Disks/vm.vhdx"] != "vhdx" {
+		t.Fatalf("bad files: %#v", files)
+	}
+}
+
+func TestPostProcessorPostProcess_badArtifact(t *testing.T) {
+	dir, artifact := testOutputDir(t)
+	defer os.RemoveAll(dir)
+
+	var p PostProcessor
+	p.config.OutputPath = filepath.Join(dir, "test.box")
+	if err := p.Configure(map[string]interface{}{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	artifact.BuilderIdValue = "mitchellh.virtualbox"
+	if _, _, err := p.PostProcess(testUi(), artifact); err == nil {
+		t.Fatal("should have error for an artifact of another builder")
+	}
+
+	artifact.BuilderIdValue = hypervcommon.BuilderId
+	if err := os.RemoveAll(filepath.Join(dir, hypervcommon.VhdDir)); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, _, err := p.PostProcess(testUi(), artifact); err == nil {
+		t.Fatal("should have error for an output directory without an exported VM")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "test.box")); !os.IsNotExist(err) {
+		t.Fatal("should not create a box")
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package powershell
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// An Executor runs PowerShell scripts for a PowerShellCmd.
+type Executor interface {
+	// Execute runs the script with the parameters given, writing what the
+	// script prints to stdout and stderr, and returns its exit code. An
+	// error is only returned if the script could not be run at all.
+	Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error)
+}
+
+// A StdinExecutor is an Executor that can also give a script a stdin to
+// read from, such as a long-running script serving requests.
+type StdinExecutor interface {
+	Executor
+
+	// ExecuteStdin runs the script as Execute does, feeding it stdin.
+	ExecuteStdin(script string, params []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error)
+}
+
+// DefaultExecutor is used by every PowerShellCmd that does not set its
+// own Executor. If it is nil, Windows PowerShell is used when it can be
+// found in the path, then PowerShell 7.
+var DefaultExecutor Executor
+
+// LocalExecutor runs scripts with a PowerShell executable on this machine.
+type LocalExecutor struct {
+	// The name or path of the PowerShell executable.
+	Path string
+}
+
+// NewPowerShellExecutor returns an Executor running Windows PowerShell.
+func NewPowerShellExecutor() *LocalExecutor {
+	return &LocalExecutor{Path: "powershell"}
+}
+
+// NewPwshExecutor returns an Executor running PowerShell 7.
+func NewPwshExecutor() *LocalExecutor {
+	return &LocalExecutor{Path: "pwsh"}
+}
+
+func (e *LocalExecutor) Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	return e.ExecuteStdin(script, params, nil, stdout, stderr)
+}
+
+func (e *LocalExecutor) ExecuteStdin(script string, params []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
+	path, err := exec.LookPath(e.Path)
+	if err != nil {
+		return 0, fmt.Errorf("Cannot find %s in the path: %s", e.Path, err)
+	}
+
+	filename, err := saveScript(script)
+	if err != nil {
+		return 0, err
+	}
+
+	debug := os.Getenv("PACKER_POWERSHELL_DEBUG") != ""
+	verbose := debug || os.Getenv("PACKER_POWERSHELL_VERBOSE") != ""
+
+	if !debug {
+		defer os.Remove(filename)
+	}
+
+	args := createArgs(filename, params...)
+
+	if verbose {
+		log.Printf("Run: %s %s", path, args)
+	}
+
+	command := exec.Command(path, args...)
+	command.Stdout = stdout
+	command.Stderr = stderr
+
+	// stdin is copied through a pipe of our own, so that the command is
+	// not waited on until stdin ends, which it may never do
+	if stdin != nil {
+		pipe, err := command.StdinPipe()
+		if err != nil {
+			return 0, err
+		}
+
+		go func() {
+			io.Copy(pipe, stdin)
+			pipe.Close()
+		}()
+	}
+
+	err = command.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), nil
+		}
+		return 1, nil
+	}
+
+	return 0, err
+}
+
+func defaultExecutor() (Executor, error) {
+	if DefaultExecutor != nil {
+		return DefaultExecutor, nil
+	}
+
+	path, err := FindPowerShell()
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalExecutor{Path: path}, nil
+}
+
+// FindPowerShell returns the name of the PowerShell executable scripts
+// are run with by default, Windows PowerShell if it can be found in the
+// path, then PowerShell 7.
+func FindPowerShell() (string, error) {
+	for _, executor := range []*LocalExecutor{NewPowerShellExecutor(), NewPwshExecutor()} {
+		if _, err := exec.LookPath(executor.Path); err == nil {
+			return executor.Path, nil
+		}
+	}
+
+	return "", errors.New("Cannot find PowerShell in the path")
+}
+
+func saveScript(fileContents string) (string, error) {
+	file, err := ioutil.TempFile(os.TempDir(), "ps")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write([]byte(fileContents))
+	if err != nil {
+		return "", err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+
+	newFilename := file.Name() + ".ps1"
+	err = os.Rename(file.Name(), newFilename)
+	if err != nil {
+		return "", err
+	}
+
+	return newFilename, nil
+}
+
+func createArgs(filename string, params ...string) []string {
+	args := make([]string, len(params)+4)
+	args[0] = "-ExecutionPolicy"
+	args[1] = "Bypass"
+
+	args[2] = "-File"
+	args[3] = filename
+
+	for key, value := range params {
+		args[key+4] = value
+	}
+
+	return args
+}
@@ -0,0 +1,150 @@
+// Copyright (c) Microsoft Open Technologies, Inc.
+// All Rights Reserved.
+// Licensed under the Apache License, Version 2.0.
+// See License.txt in the project root for license information.
+package powershell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// An Execution is a script run by an Executor together with what it
+// printed and its exit code. A transcript is a list of executions saved
+// as JSON to a golden file.
+type Execution struct {
+	Script   string   `json:"script"`
+	Params   []string `json:"params"`
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	ExitCode int      `json:"exitCode"`
+}
+
+// RecordingExecutor runs scripts with another Executor and saves every
+// execution, in order, to the transcript at Path.
+type RecordingExecutor struct {
+	Executor Executor
+	Path     string
+
+	executions []Execution
+	l          sync.Mutex
+}
+
+func (e *RecordingExecutor) Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+
+	exitCode, err := e.Executor.Execute(script, params,
+		io.MultiWriter(stdout, &stdoutBuf), io.MultiWriter(stderr, &stderrBuf))
+	if err != nil {
+		return exitCode, err
+	}
+
+	e.l.Lock()
+	defer e.l.Unlock()
+
+	e.executions = append(e.executions, Execution{
+		Script:   script,
+		Params:   append([]string{}, params...),
+		Stdout:   stdoutBuf.String(),
+		Stderr:   stderrBuf.String(),
+		ExitCode: exitCode,
+	})
+
+	if err := writeTranscript(e.Path, e.executions); err != nil {
+		return exitCode, err
+	}
+
+	return exitCode, nil
+}
+
+// ReplayExecutor plays back a transcript saved by a RecordingExecutor
+// without running PowerShell. Scripts must be executed with the same
+// parameters and in the same order as they were recorded.
+type ReplayExecutor struct {
+	executions []Execution
+	next       int
+	l          sync.Mutex
+}
+
+// NewReplayExecutor loads the transcript at path.
+func NewReplayExecutor(path string) (*ReplayExecutor, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var executions []Execution
+	if err := json.Unmarshal(data, &executions); err != nil {
+		return nil, fmt.Errorf("Error reading transcript %s: %s", path, err)
+	}
+
+	return &ReplayExecutor{executions: executions}, nil
+}
+
+func (e *ReplayExecutor) Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	e.l.Lock()
+	defer e.l.Unlock()
+
+	if e.next >= len(e.executions) {
+		return 0, fmt.Errorf("Unexpected script %d, the transcript only has %d", e.next+1, len(e.executions))
+	}
+
+	execution := e.executions[e.next]
+
+	if script != execution.Script {
+		return 0, fmt.Errorf("Script %d does not match the transcript.\n\nExpected:\n%s\n\nGot:\n%s",
+			e.next+1, execution.Script, script)
+	}
+
+	if !equalParams(params, execution.Params) {
+		return 0, fmt.Errorf("Parameters of script %d do not match the transcript. Expected %q, got %q",
+			e.next+1, execution.Params, params)
+	}
+
+	e.next++
+
+	if _, err := io.WriteString(stdout, execution.Stdout); err != nil {
+		return 0, err
+	}
+
+	if _, err := io.WriteString(stderr, execution.Stderr); err != nil {
+		return 0, err
+	}
+
+	return execution.ExitCode, nil
+}
+
+// Remaining returns the number of executions in the transcript that have
+// not been replayed yet.
+func (e *ReplayExecutor) Remaining() int {
+	e.l.Lock()
+	defer e.l.Unlock()
+	return len(e.executions) - e.next
+}
+
+func equalParams(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeTranscript(path string, executions []Execution) error {
+	data, err := json.MarshalIndent(executions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,77 @@
+package powershell
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type executorFunc func(string, []string, io.Writer, io.Writer) (int, error)
+
+func (f executorFunc) Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	return f(script, params, stdout, stderr)
+}
+
+func TestExecutor_impl(t *testing.T) {
+	var _ Executor = new(LocalExecutor)
+	var _ Executor = new(RecordingExecutor)
+	var _ Executor = new(ReplayExecutor)
+}
+
+func TestRecordingExecutor_replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "packer")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "transcript.json")
+
+	recorder := &RecordingExecutor{
+		Path: path,
+		Executor: executorFunc(func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+			io.WriteString(stdout, params[0]+"\n")
+			io.WriteString(stderr, "warning\n")
+			return 3, nil
+		}),
+	}
+
+	recorded := &PowerShellCmd{Executor: recorder}
+	if _, err := recorded.Output("param([string]$a) $a", "first"); err == nil {
+		t.Fatal("should have error")
+	}
+	recorded.Output("param([string]$a) $a", "second")
+
+	replayer, err := NewReplayExecutor(path)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	replayed := &PowerShellCmd{Executor: replayer}
+	output, err := replayed.Output("param([string]$a) $a", "first")
+	if err == nil || err.Error() != "PowerShell exited with code 3: warning" {
+		t.Fatalf("bad error: %s", err)
+	}
+	if output != "first" {
+		t.Fatalf("bad output: %q", output)
+	}
+
+	if _, err := replayed.Output("param([string]$a) $a", "other"); err == nil {
+		t.Fatal("should error when the parameters do not match")
+	}
+
+	output, _ = replayed.Output("param([string]$a) $a", "second")
+	if output != "second" {
+		t.Fatalf("bad output: %q", output)
+	}
+
+	if n := replayer.Remaining(); n != 0 {
+		t.Fatalf("bad remaining: %d", n)
+	}
+
+	if _, err := replayed.Output("$True"); err == nil {
+		t.Fatal("should error past the end of the transcript")
+	}
+}
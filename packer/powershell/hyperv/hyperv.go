@@ -1,17 +1,25 @@
 package hyperv
 
 import (
+  "fmt"
+  "strconv"
   "strings"
   "github.com/MSOpenTech/packer-hyperv/packer/powershell"
 )
 
 
-func GetVirtualMachineNetworkAdapterAddress(vmName string) (string, error) {
+// GetVirtualMachineNetworkAdapterAddress returns the first address of the
+// network adapter named, or of any network adapter when the name is empty.
+func GetVirtualMachineNetworkAdapterAddress(vmName string, adapterName string) (string, error) {
 
 	var script = `
-param([string]$vmName, [int]$addressIndex)
+param([string]$vmName, [string]$adapterName, [int]$addressIndex)
 try {
-  $adapter = Get-VMNetworkAdapter -VMName $vmName -ErrorAction SilentlyContinue
+  $params = @{ VMName = $vmName }
+  if ($adapterName) {
+    $params.Name = $adapterName
+  }
+  $adapter = Get-VMNetworkAdapter @params -ErrorAction SilentlyContinue
   $ip = $adapter.IPAddresses[$addressIndex]
   if($ip -eq $null) {
     return $false
@@ -23,7 +31,7 @@ $ip
 `
 
 	var ps powershell.PowerShellCmd
-	cmdOut, err := ps.Output(script, vmName, "0");
+	cmdOut, err := ps.Output(script, vmName, adapterName, "0");
 
 	return cmdOut, err;
 }
@@ -40,6 +48,224 @@ Set-VMDvdDrive -VMName $vmName -Path $path
   return err
 }
 
+func CreateDvdDrive(vmName string, isoPath string) (uint, uint, error) {
+
+  var script = `
+param([string]$vmName,[string]$isoPath)
+$vm = Get-VM -Name $vmName
+if ($vm.Generation -eq 2) {
+  $controller = Get-VMScsiController -VM $vm | Select-Object -First 1
+} else {
+  $controller = Get-VMIdeController -VM $vm | Where-Object { $_.Drives.Count -lt 2 } | Select-Object -First 1
+}
+if ($controller -eq $null) {
+  throw "There is no free location for a DVD drive on '$vmName'."
+}
+$dvdDrive = Add-VMDvdDrive -VMName $vmName -ControllerNumber $controller.ControllerNumber -Path $isoPath -Passthru
+"$($dvdDrive.ControllerNumber),$($dvdDrive.ControllerLocation)"
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, vmName, isoPath)
+  if err != nil {
+    return 0, 0, err
+  }
+
+  return parseControllerProperties(cmdOut)
+}
+
+func DeleteDvdDrive(vmName string, controllerNumber uint, controllerLocation uint) error {
+
+  var script = `
+param([string]$vmName,[int]$controllerNumber,[int]$controllerLocation)
+Remove-VMDvdDrive -VMName $vmName -ControllerNumber $controllerNumber -ControllerLocation $controllerLocation
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, strconv.FormatUint(uint64(controllerNumber), 10), strconv.FormatUint(uint64(controllerLocation), 10))
+  return err
+}
+
+func SetBootDvdDrive(vmName string, controllerNumber uint, controllerLocation uint) error {
+
+  var script = `
+param([string]$vmName,[int]$controllerNumber,[int]$controllerLocation)
+$dvdDrive = Get-VMDvdDrive -VMName $vmName -ControllerNumber $controllerNumber -ControllerLocation $controllerLocation
+Set-VMFirmware -VMName $vmName -FirstBootDevice $dvdDrive
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, strconv.FormatUint(uint64(controllerNumber), 10), strconv.FormatUint(uint64(controllerLocation), 10))
+  return err
+}
+
+func SetVirtualMachineSecureBoot(vmName string, enable bool, templateName string) error {
+
+  var script = `
+param([string]$vmName,[string]$enableSecureBoot,[string]$templateName)
+if ($templateName) {
+  Set-VMFirmware -VMName $vmName -EnableSecureBoot $enableSecureBoot -SecureBootTemplate $templateName
+} else {
+  Set-VMFirmware -VMName $vmName -EnableSecureBoot $enableSecureBoot
+}
+`
+
+  enableSecureBoot := "Off"
+  if enable {
+    enableSecureBoot = "On"
+  }
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, enableSecureBoot, templateName)
+  return err
+}
+
+func SetVirtualMachineProcessorCount(vmName string, count uint) error {
+
+  var script = `
+param([string]$vmName, [int]$count)
+Set-VMProcessor -VMName $vmName -Count $count
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, strconv.FormatUint(uint64(count), 10))
+  return err
+}
+
+// SetVirtualMachineDynamicMemory turns dynamic memory of the VM on, with
+// the minimum and maximum memory in bytes and the memory buffer in percent
+// given unless they are 0, or off.
+func SetVirtualMachineDynamicMemory(vmName string, enable bool, minimumBytes int64, maximumBytes int64, buffer uint) error {
+
+  var script = `
+param([string]$vmName, [string]$enable, [long]$minimumBytes, [long]$maximumBytes, [int]$buffer)
+if ($enable -ne 'True') {
+  Set-VMMemory -VMName $vmName -DynamicMemoryEnabled $false
+  return
+}
+$options = @{ DynamicMemoryEnabled = $true }
+if ($minimumBytes -gt 0) { $options.MinimumBytes = $minimumBytes }
+if ($maximumBytes -gt 0) { $options.MaximumBytes = $maximumBytes }
+if ($buffer -gt 0) { $options.Buffer = $buffer }
+Set-VMMemory -VMName $vmName @options
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, strconv.FormatBool(enable), strconv.FormatInt(minimumBytes, 10), strconv.FormatInt(maximumBytes, 10), strconv.FormatUint(uint64(buffer), 10))
+  return err
+}
+
+// SetVirtualMachineVirtualizationExtensions exposes the virtualization
+// extensions of the processor to the VM, for nested virtualization, or
+// hides them.
+func SetVirtualMachineVirtualizationExtensions(vmName string, enable bool) error {
+
+  var script = `
+param([string]$vmName, [string]$enable)
+Set-VMProcessor -VMName $vmName -ExposeVirtualizationExtensions ($enable -eq 'True')
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, strconv.FormatBool(enable))
+  return err
+}
+
+func SetVirtualMachineMacSpoofing(vmName string, enable bool) error {
+
+  var script = `
+param([string]$vmName, [string]$enable)
+Set-VMNetworkAdapter -VMName $vmName -MacAddressSpoofing $enable
+`
+
+  enableMacSpoofing := "Off"
+  if enable {
+    enableMacSpoofing = "On"
+  }
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, enableMacSpoofing)
+  return err
+}
+
+// AddVirtualMachineNetworkAdapter connects the network adapter named to
+// the switch, adding it to the VM unless the VM has an adapter of that
+// name.
+func AddVirtualMachineNetworkAdapter(vmName string, adapterName string, switchName string) error {
+
+  var script = `
+param([string]$vmName, [string]$adapterName, [string]$switchName)
+$adapter = Get-VMNetworkAdapter -VMName $vmName -Name $adapterName -ErrorAction SilentlyContinue
+if ($adapter) {
+  Connect-VMNetworkAdapter -VMNetworkAdapter $adapter -SwitchName $switchName
+} else {
+  Add-VMNetworkAdapter -VMName $vmName -Name $adapterName -SwitchName $switchName
+}
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, adapterName, switchName)
+  return err
+}
+
+func SetVirtualMachineNetworkAdapterVlanId(vmName string, adapterName string, vlanId string) error {
+
+  var script = `
+param([string]$vmName, [string]$adapterName, [string]$vlanId)
+Set-VMNetworkAdapterVlan -VMName $vmName -VMNetworkAdapterName $adapterName -Access -VlanId $vlanId
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, adapterName, vlanId)
+  return err
+}
+
+// SetVirtualMachineNetworkAdapterMacAddress gives the network adapter
+// named a static MAC address, of 12 hexadecimal digits.
+func SetVirtualMachineNetworkAdapterMacAddress(vmName string, adapterName string, macAddress string) error {
+
+  var script = `
+param([string]$vmName, [string]$adapterName, [string]$macAddress)
+Get-VMNetworkAdapter -VMName $vmName -Name $adapterName -ErrorAction Stop | Set-VMNetworkAdapter -StaticMacAddress $macAddress
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, adapterName, macAddress)
+  return err
+}
+
+// DisconnectVirtualMachineNetworkAdapter disconnects the network adapter
+// named from its switch.
+func DisconnectVirtualMachineNetworkAdapter(vmName string, adapterName string) error {
+
+  var script = `
+param([string]$vmName, [string]$adapterName)
+Disconnect-VMNetworkAdapter -VMName $vmName -Name $adapterName -ErrorAction Stop
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, adapterName)
+  return err
+}
+
+func parseControllerProperties(cmdOut string) (uint, uint, error) {
+  parts := strings.Split(strings.TrimSpace(cmdOut), ",")
+  if len(parts) != 2 {
+    return 0, 0, fmt.Errorf("Unexpected DVD controller properties: '%s'", cmdOut)
+  }
+
+  controllerNumber, err := strconv.ParseUint(parts[0], 10, 32)
+  if err != nil {
+    return 0, 0, err
+  }
+
+  controllerLocation, err := strconv.ParseUint(parts[1], 10, 32)
+  if err != nil {
+    return 0, 0, err
+  }
+
+  return uint(controllerNumber), uint(controllerLocation), nil
+}
+
 func UnmountDvdDrive(vmName string) error {
 
   var script = `
@@ -75,17 +301,51 @@ Set-VMFloppyDiskDrive -VMName $vmName -Path $null
   return err
 }
 
-func CreateVirtualMachine(vmName string, path string, ram string, diskSize string, switchName string) error {
+func CreateVirtualMachine(vmName string, path string, ram int64, switchName string, generation uint) error {
+
+  var script = `
+param([string]$vmName, [string]$path, [long]$memoryStartupBytes, [string]$switchName, [int]$generation)
+New-VM -Name $vmName -Path $path -MemoryStartupBytes $memoryStartupBytes -NoVHD -SwitchName $switchName -Generation $generation
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, path, strconv.FormatInt(ram, 10), switchName, strconv.FormatUint(uint64(generation), 10))
+  return err
+}
+
+func CreateVirtualHardDisk(path string, diskType string, sizeBytes int64, blockSizeBytes int64, parentPath string) error {
 
   var script = `
-param([string]$vmName, [string]$path, [long]$memoryStartupBytes, [long]$newVHDSizeBytes, [string]$switchName)
-$vhdx = $vmName + '.vhdx'
-$vhdPath = Join-Path -Path $path -ChildPath $vhdx
-New-VM -Name $vmName -Path $path -MemoryStartupBytes $memoryStartupBytes -NewVHDPath $vhdPath -NewVHDSizeBytes $newVHDSizeBytes -SwitchName $switchName
+param([string]$path, [string]$diskType, [long]$sizeBytes, [long]$blockSizeBytes, [string]$parentPath)
+$params = @{ Path = $path }
+switch ($diskType) {
+  'Differencing' { $params.Differencing = $true; $params.ParentPath = $parentPath }
+  'Fixed' { $params.Fixed = $true; $params.SizeBytes = $sizeBytes }
+  default { $params.Dynamic = $true; $params.SizeBytes = $sizeBytes }
+}
+if ($blockSizeBytes -gt 0) {
+  $params.BlockSizeBytes = $blockSizeBytes
+}
+New-VHD @params | Out-Null
 `
 
   var ps powershell.PowerShellCmd
-  err := ps.Run(script, vmName, path, ram, diskSize, switchName)
+  err := ps.Run(script, path, diskType, strconv.FormatInt(sizeBytes, 10), strconv.FormatInt(blockSizeBytes, 10), parentPath)
+  return err
+}
+
+func AddVirtualMachineHardDiskDrive(vmName string, path string, controllerType string) error {
+
+  var script = `
+param([string]$vmName, [string]$path, [string]$controllerType)
+if ($controllerType -eq 'SCSI' -and @(Get-VMScsiController -VMName $vmName).Count -eq 0) {
+  Add-VMScsiController -VMName $vmName
+}
+Add-VMHardDiskDrive -VMName $vmName -Path $path -ControllerType $controllerType
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, path, controllerType)
   return err
 }
 
@@ -115,6 +375,234 @@ Export-VM -Name $vmName -Path $path
   return err
 }
 
+func ExportVirtualMachineSnapshot(vmName string, snapshotName string, path string) error {
+
+  var script = `
+param([string]$vmName, [string]$snapshotName, [string]$path)
+$snapshot = Get-VMSnapshot -VMName $vmName -Name $snapshotName -ErrorAction Stop
+Export-VMSnapshot -VMSnapshot $snapshot -Path $path
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, snapshotName, path)
+  return err
+}
+
+// ImportVirtualMachine imports a copy of the exported VM into path as the
+// VM named. A VM that is imported but cannot be renamed is removed, so
+// that no VM is left behind when the import fails.
+func ImportVirtualMachine(exportPath string, vmName string, path string, ram int64, switchName string) error {
+
+  var script = `
+param([string]$exportPath, [string]$vmName, [string]$path, [long]$memoryStartupBytes, [string]$switchName)
+$configPath = Join-Path -Path $exportPath -ChildPath 'Virtual Machines'
+$config = Get-ChildItem -Path $configPath -Recurse -Include *.vmcx,*.xml | Select-Object -First 1
+if (!$config) {
+  throw "No virtual machine configuration was found in '$configPath'."
+}
+$vhdPath = Join-Path -Path $path -ChildPath 'Virtual Hard Disks'
+$report = Compare-VM -Path $config.FullName -Copy -GenerateNewId -VirtualMachinePath $path -SnapshotFilePath $path -SmartPagingFilePath $path -VhdDestinationPath $vhdPath
+Get-VMNetworkAdapter -VM $report.VM | Connect-VMNetworkAdapter -SwitchName $switchName
+if ($memoryStartupBytes -gt 0) {
+  Set-VMMemory -VM $report.VM -StartupBytes $memoryStartupBytes
+}
+$vm = Import-VM -CompatibilityReport $report -ErrorAction Stop
+try {
+  Rename-VM -VM $vm -NewName $vmName -ErrorAction Stop
+} catch {
+  Remove-VM -VM $vm -Force
+  throw
+}
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, exportPath, vmName, path, strconv.FormatInt(ram, 10), switchName)
+  return err
+}
+
+func GetVirtualMachineGeneration(vmName string) (uint, error) {
+
+  var script = `
+param([string]$vmName)
+$vm = Get-VM -Name $vmName -ErrorAction Stop
+$vm.Generation
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, vmName)
+  if err != nil {
+    return 0, err
+  }
+
+  generation, err := strconv.ParseUint(strings.TrimSpace(cmdOut), 10, 32)
+  return uint(generation), err
+}
+
+func GetVirtualMachineProcessorCount(vmName string) (uint, error) {
+
+  var script = `
+param([string]$vmName)
+$vm = Get-VM -Name $vmName -ErrorAction Stop
+$vm.ProcessorCount
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, vmName)
+  if err != nil {
+    return 0, err
+  }
+
+  count, err := strconv.ParseUint(strings.TrimSpace(cmdOut), 10, 32)
+  return uint(count), err
+}
+
+// GetVirtualMachineMemory returns the startup memory of the VM in bytes.
+func GetVirtualMachineMemory(vmName string) (int64, error) {
+
+  var script = `
+param([string]$vmName)
+$vm = Get-VM -Name $vmName -ErrorAction Stop
+$vm.MemoryStartup
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, vmName)
+  if err != nil {
+    return 0, err
+  }
+
+  return strconv.ParseInt(strings.TrimSpace(cmdOut), 10, 64)
+}
+
+// GetHostMemoryCapacity returns the physical memory of the host in bytes.
+func GetHostMemoryCapacity() (int64, error) {
+
+  var script = `
+(Get-VMHost -ErrorAction Stop).MemoryCapacity
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script)
+  if err != nil {
+    return 0, err
+  }
+
+  return strconv.ParseInt(strings.TrimSpace(cmdOut), 10, 64)
+}
+
+// GetHostAvailableMemory returns the free physical memory of the host in
+// megabytes.
+func GetHostAvailableMemory() (float64, error) {
+
+  // whole megabytes, so the output does not depend on the decimal
+  // separator of the culture of the host
+  var script = `
+[Math]::Floor((Get-WmiObject -Class Win32_OperatingSystem -ErrorAction Stop).FreePhysicalMemory / 1024)
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script)
+  if err != nil {
+    return 0, err
+  }
+
+  return strconv.ParseFloat(strings.TrimSpace(cmdOut), 64)
+}
+
+// GetHostSupportedVersions returns the configuration versions of the VMs
+// the host can create, such as 5.0 or 8.0.
+func GetHostSupportedVersions() ([]string, error) {
+
+  // Windows Server 2012 R2 only creates VMs of version 5.0, and has no
+  // Get-VMHostSupportedVersion
+  var script = `
+if (Get-Command Get-VMHostSupportedVersion -ErrorAction SilentlyContinue) {
+  Get-VMHostSupportedVersion -ErrorAction Stop | ForEach-Object { $_.Version.ToString() }
+} else {
+  '5.0'
+}
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script)
+  if err != nil {
+    return nil, err
+  }
+
+  var versions []string
+  for _, line := range strings.Split(cmdOut, "\n") {
+    if version := strings.TrimSpace(line); version != "" {
+      versions = append(versions, version)
+    }
+  }
+  return versions, nil
+}
+
+func CopyVirtualHardDisk(sourcePath string, path string) error {
+
+  var script = `
+param([string]$sourcePath, [string]$path)
+Copy-Item -Path $sourcePath -Destination $path
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, sourcePath, path)
+  return err
+}
+
+func GetVirtualMachineHardDiskPaths(vmName string) ([]string, error) {
+
+  var script = `
+param([string]$vmName)
+Get-VMHardDiskDrive -VMName $vmName -ErrorAction Stop | Select-Object -ExpandProperty Path
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, vmName)
+  if err != nil {
+    return nil, err
+  }
+
+  var paths []string
+  for _, line := range strings.Split(cmdOut, "\n") {
+    if path := strings.TrimSpace(line); path != "" {
+      paths = append(paths, path)
+    }
+  }
+  return paths, nil
+}
+
+func CompactVirtualHardDisk(path string) (int64, int64, error) {
+
+  // a full optimization needs the disk mounted read-only, so that the
+  // blocks the file system leaves unused can be reclaimed as well, and a
+  // fixed disk cannot be compacted
+  var script = `
+param([string]$path)
+$before = (Get-Item -Path $path -ErrorAction Stop).Length
+if ((Get-VHD -Path $path -ErrorAction Stop).VhdType -ne 'Fixed') {
+  Mount-VHD -Path $path -ReadOnly -NoDriveLetter -ErrorAction Stop
+  try {
+    Optimize-VHD -Path $path -Mode Full -ErrorAction Stop
+  } finally {
+    Dismount-VHD -Path $path
+  }
+}
+$after = (Get-Item -Path $path).Length
+"$before $after"
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, path)
+  if err != nil {
+    return 0, 0, err
+  }
+
+  var before, after int64
+  _, err = fmt.Sscanf(strings.TrimSpace(cmdOut), "%d %d", &before, &after)
+  return before, after, err
+}
+
 func CopyExportedVirtualMachine(expPath string, outputPath string, vhdDir string, vmDir string) error {
 
   var script = `
@@ -135,7 +623,7 @@ func CreateVirtualSwitch(switchName string, switchType string) (bool,error) {
 param([string]$switchName,[string]$switchType)
 $switches = Get-VMSwitch -Name $switchName -ErrorAction SilentlyContinue
 if ($switches.Count -eq 0) {
-  New-VMSwitch -Name $switchName -SwitchType $switchType
+  New-VMSwitch -Name $switchName -SwitchType $switchType | Out-Null
   return $true
 }
 return $false
@@ -147,6 +635,152 @@ return $false
   return created, err
 }
 
+// CreateExternalVirtualSwitchOnNetAdapter creates an External switch bound
+// to the physical network adapter, unless the switch exists. An existing
+// switch must be External and bound to that adapter.
+func CreateExternalVirtualSwitchOnNetAdapter(switchName string, netAdapterName string, netAdapterInterfaceDescription string) (bool,error) {
+
+  var script = `
+param([string]$switchName,[string]$netAdapterName,[string]$netAdapterInterfaceDescription)
+$switch = Get-VMSwitch -Name $switchName -ErrorAction SilentlyContinue | Select-Object -First 1
+if ($switch -eq $null) {
+  $params = @{ Name = $switchName; AllowManagementOS = $true }
+  if ($netAdapterName) {
+    $params.NetAdapterName = $netAdapterName
+  } else {
+    $params.NetAdapterInterfaceDescription = $netAdapterInterfaceDescription
+  }
+  New-VMSwitch @params | Out-Null
+  return $true
+}
+if ($netAdapterName) {
+  $netAdapterInterfaceDescription = (Get-NetAdapter -Physical -Name $netAdapterName -ErrorAction Stop).InterfaceDescription
+}
+if ($switch.SwitchType -ne 'External' -or $switch.NetAdapterInterfaceDescription -ne $netAdapterInterfaceDescription) {
+  throw "The switch '$switchName' exists with type $($switch.SwitchType) on '$($switch.NetAdapterInterfaceDescription)', expected an External switch on '$netAdapterInterfaceDescription'."
+}
+return $false
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, switchName, netAdapterName, netAdapterInterfaceDescription)
+  var created = strings.TrimSpace(cmdOut) == "True"
+  return created, err
+}
+
+// GetVirtualSwitchType returns the type of the switch named, Internal,
+// Private or External, or an empty string when there is no such switch.
+func GetVirtualSwitchType(switchName string) (string, error) {
+
+  var script = `
+param([string]$switchName)
+$switch = Get-VMSwitch -Name $switchName -ErrorAction SilentlyContinue | Select-Object -First 1
+if ($switch -ne $null) {
+  $switch.SwitchType.ToString()
+}
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, switchName)
+  var switchType = strings.TrimSpace(cmdOut)
+  return switchType, err
+}
+
+func GetNetAdapterStatus(netAdapterName string, netAdapterInterfaceDescription string) (string,error) {
+
+  var script = `
+param([string]$netAdapterName,[string]$netAdapterInterfaceDescription)
+if ($netAdapterName) {
+  $adapter = Get-NetAdapter -Physical -Name $netAdapterName -ErrorAction SilentlyContinue
+} else {
+  $adapter = Get-NetAdapter -Physical -InterfaceDescription $netAdapterInterfaceDescription -ErrorAction SilentlyContinue
+}
+if ($adapter -ne $null) {
+  $adapter | Select-Object -First 1 -ExpandProperty Status
+}
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, netAdapterName, netAdapterInterfaceDescription)
+  var status = strings.TrimSpace(cmdOut)
+  return status, err
+}
+
+func CreateNetNat(natName string, switchName string, prefix string, gatewayIP string) error {
+
+  // the host adapter of an internal switch is named after it
+  var script = `
+param([string]$natName,[string]$switchName,[string]$prefix,[string]$gatewayIP)
+$adapter = Get-NetAdapter -Name "vEthernet ($switchName)" -ErrorAction Stop
+$prefixLength = [int]$prefix.Split('/')[1]
+$address = Get-NetIPAddress -InterfaceIndex $adapter.ifIndex -IPAddress $gatewayIP -ErrorAction SilentlyContinue
+if ($address -eq $null) {
+  New-NetIPAddress -InterfaceIndex $adapter.ifIndex -IPAddress $gatewayIP -PrefixLength $prefixLength -ErrorAction Stop | Out-Null
+}
+New-NetNat -Name $natName -InternalIPInterfaceAddressPrefix $prefix -ErrorAction Stop | Out-Null
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, natName, switchName, prefix, gatewayIP)
+  return err
+}
+
+func DeleteNetNat(natName string, gatewayIP string) error {
+
+  var script = `
+param([string]$natName,[string]$gatewayIP)
+Get-NetNat -Name $natName -ErrorAction SilentlyContinue | Remove-NetNat -Confirm:$false
+Get-NetIPAddress -IPAddress $gatewayIP -ErrorAction SilentlyContinue | Remove-NetIPAddress -Confirm:$false
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, natName, gatewayIP)
+  return err
+}
+
+func GetHostDnsServers() ([]string, error) {
+
+  var script = `
+Get-DnsClientServerAddress -AddressFamily IPv4 | ForEach-Object { $_.ServerAddresses } | Select-Object -Unique
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script)
+  if err != nil {
+    return nil, err
+  }
+
+  var servers []string
+  for _, line := range strings.Split(cmdOut, "\n") {
+    if server := strings.TrimSpace(line); server != "" {
+      servers = append(servers, server)
+    }
+  }
+  return servers, nil
+}
+
+func GetHostAdapterIpAddressForSwitch(switchName string) (string, error) {
+
+  // the host adapter of the switch, which a private switch has not, is
+  // found by its device id
+  var script = `
+param([string]$switchName)
+$vmAdapter = Get-VMNetworkAdapter -ManagementOS -SwitchName $switchName -ErrorAction SilentlyContinue | Select-Object -First 1
+if ($vmAdapter -ne $null) {
+  $adapter = Get-NetAdapter | Where-Object { $_.DeviceID -eq $vmAdapter.DeviceId }
+  if ($adapter -ne $null) {
+    Get-NetIPAddress -InterfaceIndex $adapter.ifIndex -AddressFamily IPv4 -ErrorAction SilentlyContinue |
+      Where-Object { $_.AddressState -eq 'Preferred' } | Select-Object -First 1 -ExpandProperty IPAddress
+  }
+}
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, switchName)
+  var ip = strings.TrimSpace(cmdOut)
+  return ip, err
+}
+
 func DeleteVirtualSwitch(switchName string) error {
 
   var script = `
@@ -358,6 +992,66 @@ $vm.State -eq [Microsoft.HyperV.PowerShell.VMState]::Running
   return isRunning, err
 }
 
+func IsOff(vmName string) (bool, error) {
+
+  var script  = `
+param([string]$vmName)
+$vm = Get-VM -Name $vmName -ErrorAction SilentlyContinue
+$vm.State -eq [Microsoft.HyperV.PowerShell.VMState]::Off
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, vmName)
+  var isOff = strings.TrimSpace(cmdOut) == "True"
+  return isOff, err
+}
+
+func Uptime(vmName string) (uint64, error) {
+
+  var script  = `
+param([string]$vmName)
+$vm = Get-VM -Name $vmName -ErrorAction SilentlyContinue
+[uint64]$vm.Uptime.TotalSeconds
+`
+
+  var ps powershell.PowerShellCmd
+  cmdOut, err := ps.Output(script, vmName)
+  if err != nil {
+    return 0, err
+  }
+
+  uptime, err := strconv.ParseUint(strings.TrimSpace(cmdOut), 10, 64)
+  return uptime, err
+}
+
+func TypeScancodes(vmName string, scancodes []byte) error {
+
+  var codes []string
+  for _, code := range scancodes {
+    codes = append(codes, fmt.Sprintf("%02x", code))
+  }
+
+  // the keyboard of a VM is only reached through WMI; the VM is matched
+  // in PowerShell rather than in a WQL filter, which its name could break
+  var script = `
+param([string]$vmName,[string]$scancodes)
+$vm = Get-CimInstance -Namespace root\virtualization\v2 -ClassName Msvm_ComputerSystem -ErrorAction Stop | Where-Object { $_.ElementName -eq $vmName } | Select-Object -First 1
+if ($vm -eq $null) {
+  throw "Virtual machine '$vmName' not found."
+}
+$keyboard = Get-CimAssociatedInstance -InputObject $vm -ResultClassName Msvm_Keyboard -ErrorAction Stop | Select-Object -First 1
+[byte[]]$codes = $scancodes.Split(' ') | ForEach-Object { [Convert]::ToByte($_, 16) }
+$result = Invoke-CimMethod -InputObject $keyboard -MethodName TypeScancodes -Arguments @{ Scancodes = $codes } -ErrorAction Stop
+if ($result.ReturnValue -ne 0) {
+  throw "TypeScancodes failed with $($result.ReturnValue)."
+}
+`
+
+  var ps powershell.PowerShellCmd
+  err := ps.Run(script, vmName, strings.Join(codes, " "))
+  return err
+}
+
 func Start(vmName string) error {
 
   var script  = `
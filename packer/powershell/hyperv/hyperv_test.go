@@ -0,0 +1,677 @@
+package hyperv
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MSOpenTech/packer-hyperv/packer/powershell"
+)
+
+// testHost stands in for the PowerShell of a Hyper-V host: every script
+// prints the output given, in the form a Hyper-V host prints it, and the
+// parameters of the scripts are kept.
+type testHost struct {
+	stdout   string
+	stderr   string
+	exitCode int
+
+	params [][]string
+}
+
+func (h *testHost) Execute(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	h.params = append(h.params, params)
+	io.WriteString(stdout, h.stdout)
+	io.WriteString(stderr, h.stderr)
+	return h.exitCode, nil
+}
+
+// use makes the scripts of the test run on the host, and returns a
+// function restoring the default executor.
+func (h *testHost) use() func() {
+	powershell.DefaultExecutor = h
+	return func() { powershell.DefaultExecutor = nil }
+}
+
+// checkParams fails the test unless the one script run was given the
+// parameters expected.
+func (h *testHost) checkParams(t *testing.T, expected ...string) {
+	if len(h.params) != 1 {
+		t.Fatalf("bad scripts run: %d", len(h.params))
+	}
+	if !reflect.DeepEqual(h.params[0], expected) {
+		t.Fatalf("bad params: %q", h.params[0])
+	}
+}
+
+// psError is stderr as PowerShell prints an error stopping a script.
+func psError(cmdlet string, message string, category string) string {
+	return cmdlet + " : " + message + "\r\n" +
+		"At line:3 char:1\r\n" +
+		"+ " + cmdlet + " -Name $vmName\r\n" +
+		"+ " + strings.Repeat("~", len(cmdlet)+14) + "\r\n" +
+		"    + CategoryInfo          : " + category + "\r\n" +
+		"    + FullyQualifiedErrorId : OperationFailed\r\n"
+}
+
+func TestIsRunning(t *testing.T) {
+	host := &testHost{stdout: "True\r\n"}
+	defer host.use()()
+
+	running, err := IsRunning("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !running {
+		t.Fatal("should be running")
+	}
+	host.checkParams(t, "packer-test")
+}
+
+func TestIsRunning_notFound(t *testing.T) {
+	host := &testHost{
+		stderr:   psError("Get-VM", "Hyper-V was unable to find a virtual machine with name \"packer-test\".", "InvalidArgument: (packer-test:String) [Get-VM], VirtualizationException"),
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	running, err := IsRunning("packer-test")
+	if err == nil || !strings.Contains(err.Error(), "unable to find a virtual machine") {
+		t.Fatalf("bad error: %v", err)
+	}
+	if running {
+		t.Fatal("should not be running")
+	}
+}
+
+func TestIsOff(t *testing.T) {
+	host := &testHost{stdout: "False\r\n"}
+	defer host.use()()
+
+	off, err := IsOff("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if off {
+		t.Fatal("should not be off")
+	}
+}
+
+func TestUptime(t *testing.T) {
+	host := &testHost{stdout: "742\r\n"}
+	defer host.use()()
+
+	uptime, err := Uptime("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if uptime != 742 {
+		t.Fatalf("bad uptime: %d", uptime)
+	}
+}
+
+func TestUptime_noOutput(t *testing.T) {
+	host := &testHost{stdout: "\r\n"}
+	defer host.use()()
+
+	if _, err := Uptime("packer-test"); err == nil {
+		t.Fatal("should have error")
+	}
+}
+
+func TestCreateVirtualSwitch(t *testing.T) {
+	host := &testHost{stdout: "True\r\n"}
+	defer host.use()()
+
+	created, err := CreateVirtualSwitch("packer-test", "Internal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !created {
+		t.Fatal("should be created")
+	}
+	host.checkParams(t, "packer-test", "Internal")
+}
+
+func TestCreateVirtualSwitch_exists(t *testing.T) {
+	host := &testHost{stdout: "False\r\n"}
+	defer host.use()()
+
+	created, err := CreateVirtualSwitch("packer-test", "Internal")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if created {
+		t.Fatal("should not be created")
+	}
+}
+
+func TestCreateExternalVirtualSwitchOnNetAdapter(t *testing.T) {
+	host := &testHost{stdout: "True\r\n"}
+	defer host.use()()
+
+	created, err := CreateExternalVirtualSwitchOnNetAdapter("packer-test", "", "Intel(R) Ethernet Connection I217-LM")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !created {
+		t.Fatal("should be created")
+	}
+	host.checkParams(t, "packer-test", "", "Intel(R) Ethernet Connection I217-LM")
+}
+
+func TestCreateExternalVirtualSwitchOnNetAdapter_mismatch(t *testing.T) {
+	host := &testHost{
+		stderr: "The switch 'packer-test' exists with type Internal on '', expected an External switch on 'Intel(R) Ethernet Connection I217-LM'.\r\n" +
+			"At line:17 char:3\r\n" +
+			"+   throw \"The switch '$switchName' exists with type $($switch.SwitchType) ...\r\n" +
+			"+   ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~\r\n" +
+			"    + CategoryInfo          : OperationStopped: (:) [], RuntimeException\r\n",
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	created, err := CreateExternalVirtualSwitchOnNetAdapter("packer-test", "", "Intel(R) Ethernet Connection I217-LM")
+	if err == nil || !strings.Contains(err.Error(), "expected an External switch") {
+		t.Fatalf("bad error: %v", err)
+	}
+	if created {
+		t.Fatal("should not be created")
+	}
+}
+
+func TestGetVirtualSwitchType(t *testing.T) {
+	host := &testHost{stdout: "External\r\n"}
+	defer host.use()()
+
+	switchType, err := GetVirtualSwitchType("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if switchType != "External" {
+		t.Fatalf("bad type: %s", switchType)
+	}
+	host.checkParams(t, "packer-test")
+}
+
+func TestGetNetAdapterStatus(t *testing.T) {
+	host := &testHost{stdout: "Up\r\n"}
+	defer host.use()()
+
+	status, err := GetNetAdapterStatus("Ethernet", "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if status != "Up" {
+		t.Fatalf("bad status: %s", status)
+	}
+	host.checkParams(t, "Ethernet", "")
+}
+
+func TestCreateNetNat(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	err := CreateNetNat("packer-test_nat", "packer-test", "192.168.250.0/24", "192.168.250.1")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test_nat", "packer-test", "192.168.250.0/24", "192.168.250.1")
+}
+
+func TestCreateNetNat_error(t *testing.T) {
+	host := &testHost{
+		stderr:   psError("New-NetNat", "The parameter is incorrect.", "InvalidArgument: (MSFT_NetNat:root/StandardCimv2/MSFT_NetNat) [New-NetNat], CimException"),
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	err := CreateNetNat("packer-test_nat", "packer-test", "192.168.250.0/24", "192.168.250.1")
+	if err == nil || !strings.Contains(err.Error(), "The parameter is incorrect.") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestDeleteNetNat(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := DeleteNetNat("packer-test_nat", "192.168.250.1"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test_nat", "192.168.250.1")
+}
+
+func TestGetHostDnsServers(t *testing.T) {
+	host := &testHost{stdout: "10.0.0.53\r\n10.0.0.54\r\n\r\n"}
+	defer host.use()()
+
+	servers, err := GetHostDnsServers()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !reflect.DeepEqual(servers, []string{"10.0.0.53", "10.0.0.54"}) {
+		t.Fatalf("bad servers: %#v", servers)
+	}
+}
+
+func TestGetHostAdapterIpAddressForSwitch(t *testing.T) {
+	host := &testHost{stdout: "192.168.250.1\r\n"}
+	defer host.use()()
+
+	ip, err := GetHostAdapterIpAddressForSwitch("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ip != "192.168.250.1" {
+		t.Fatalf("bad address: %s", ip)
+	}
+	host.checkParams(t, "packer-test")
+}
+
+func TestTypeScancodes(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := TypeScancodes("packer-test's", []byte{0x1c, 0x9c}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// the name is a parameter of the script, never part of a WQL query
+	host.checkParams(t, "packer-test's", "1c 9c")
+}
+
+func TestTypeScancodes_error(t *testing.T) {
+	host := &testHost{
+		stderr:   "TypeScancodes failed with 32775.\r\nAt line:11 char:3\r\n    + CategoryInfo          : OperationStopped: (TypeScancodes failed with 32775.:String) [], RuntimeException\r\n",
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	err := TypeScancodes("packer-test", []byte{0x1c})
+	if err == nil || !strings.Contains(err.Error(), "TypeScancodes failed with 32775.") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestCreateVirtualMachine(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	err := CreateVirtualMachine("packer-test", `C:\Temp\packerhv123`, 1024*1024*1024, "packer-test", 2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", `C:\Temp\packerhv123`, "1073741824", "packer-test", "2")
+}
+
+func TestCreateVirtualHardDisk(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	err := CreateVirtualHardDisk(`C:\Temp\packerhv123\packer-test.vhdx`, "Fixed", 40*1024*1024*1024, 32*1024*1024, "")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, `C:\Temp\packerhv123\packer-test.vhdx`, "Fixed", "42949672960", "33554432", "")
+}
+
+func TestAddVirtualMachineHardDiskDrive(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	err := AddVirtualMachineHardDiskDrive("packer-test", `C:\Temp\packerhv123\packer-test-1.vhdx`, "SCSI")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", `C:\Temp\packerhv123\packer-test-1.vhdx`, "SCSI")
+}
+
+func TestImportVirtualMachine(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	err := ImportVirtualMachine(`C:\Temp\packerhv123\clone\base`, "packer-test", `C:\Temp\packerhv123`, 0, "packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, `C:\Temp\packerhv123\clone\base`, "packer-test", `C:\Temp\packerhv123`, "0", "packer-test")
+}
+
+func TestImportVirtualMachine_renameFails(t *testing.T) {
+	host := &testHost{
+		stderr:   psError("Rename-VM", "The operation cannot be performed while the object is in use.", "InvalidOperation: (:) [Rename-VM], VirtualizationException"),
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	err := ImportVirtualMachine(`C:\Temp\packerhv123\clone\base`, "packer-test", `C:\Temp\packerhv123`, 0, "packer-test")
+	if err == nil || !strings.Contains(err.Error(), "Rename-VM") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestGetVirtualMachineGeneration(t *testing.T) {
+	host := &testHost{stdout: "2\r\n"}
+	defer host.use()()
+
+	generation, err := GetVirtualMachineGeneration("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if generation != 2 {
+		t.Fatalf("bad generation: %d", generation)
+	}
+}
+
+func TestGetVirtualMachineProcessorCount(t *testing.T) {
+	host := &testHost{stdout: "2\r\n"}
+	defer host.use()()
+
+	count, err := GetVirtualMachineProcessorCount("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("bad count: %d", count)
+	}
+}
+
+func TestGetVirtualMachineMemory(t *testing.T) {
+	host := &testHost{stdout: "2147483648\r\n"}
+	defer host.use()()
+
+	memory, err := GetVirtualMachineMemory("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if memory != 2147483648 {
+		t.Fatalf("bad memory: %d", memory)
+	}
+}
+
+func TestGetHostMemoryCapacity(t *testing.T) {
+	host := &testHost{stdout: "68719476736\r\n"}
+	defer host.use()()
+
+	capacity, err := GetHostMemoryCapacity()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if capacity != 68719476736 {
+		t.Fatalf("bad capacity: %d", capacity)
+	}
+}
+
+func TestGetHostAvailableMemory(t *testing.T) {
+	host := &testHost{stdout: "6143\r\n"}
+	defer host.use()()
+
+	available, err := GetHostAvailableMemory()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if available != 6143 {
+		t.Fatalf("bad available memory: %v", available)
+	}
+}
+
+func TestGetHostAvailableMemory_error(t *testing.T) {
+	host := &testHost{
+		stderr:   psError("Get-WmiObject", "Access denied", "InvalidOperation: (:) [Get-WmiObject], ManagementException"),
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	if _, err := GetHostAvailableMemory(); err == nil || !strings.Contains(err.Error(), "Access denied") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestGetHostSupportedVersions(t *testing.T) {
+	host := &testHost{stdout: "5.0\r\n6.2\r\n7.0\r\n7.1\r\n8.0\r\n"}
+	defer host.use()()
+
+	versions, err := GetHostSupportedVersions()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{"5.0", "6.2", "7.0", "7.1", "8.0"}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("bad versions: %#v", versions)
+	}
+}
+
+func TestGetVirtualMachineHardDiskPaths(t *testing.T) {
+	host := &testHost{stdout: "C:\\Temp\\packerhv123\\packer-test.vhdx\r\nC:\\Temp\\packerhv123\\packer-test-1.vhdx\r\n"}
+	defer host.use()()
+
+	paths, err := GetVirtualMachineHardDiskPaths("packer-test")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	expected := []string{`C:\Temp\packerhv123\packer-test.vhdx`, `C:\Temp\packerhv123\packer-test-1.vhdx`}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("bad paths: %#v", paths)
+	}
+}
+
+func TestCompactVirtualHardDisk(t *testing.T) {
+	host := &testHost{stdout: "9395240960 4462739456\r\n"}
+	defer host.use()()
+
+	before, after, err := CompactVirtualHardDisk(`C:\Temp\packerhv123\packer-test.vhdx`)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if before != 9395240960 || after != 4462739456 {
+		t.Fatalf("bad sizes: %d %d", before, after)
+	}
+}
+
+func TestCompactVirtualHardDisk_inUse(t *testing.T) {
+	host := &testHost{
+		stderr:   psError("Mount-VHD", "The process cannot access the file because it is being used by another process.", "ResourceBusy: (:) [Mount-VHD], VirtualizationException"),
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	if _, _, err := CompactVirtualHardDisk(`C:\Temp\packerhv123\packer-test.vhdx`); err == nil || !strings.Contains(err.Error(), "being used by another process") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestSetVirtualMachineSecureBoot(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := SetVirtualMachineSecureBoot("packer-test", true, "MicrosoftUEFICertificateAuthority"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "On", "MicrosoftUEFICertificateAuthority")
+}
+
+func TestSetVirtualMachineProcessorCount(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := SetVirtualMachineProcessorCount("packer-test", 4); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "4")
+}
+
+func TestSetVirtualMachineDynamicMemory(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := SetVirtualMachineDynamicMemory("packer-test", true, 512*1024*1024, 4096*1024*1024, 20); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "true", "536870912", "4294967296", "20")
+}
+
+func TestSetVirtualMachineVirtualizationExtensions_error(t *testing.T) {
+	host := &testHost{
+		stderr:   psError("Set-VMProcessor", "Cannot enable nested virtualization on virtual machine 'packer-test' while dynamic memory is enabled.", "InvalidOperation: (:) [Set-VMProcessor], VirtualizationException"),
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	err := SetVirtualMachineVirtualizationExtensions("packer-test", true)
+	if err == nil || !strings.Contains(err.Error(), "dynamic memory") {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
+func TestSetVirtualMachineMacSpoofing(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := SetVirtualMachineMacSpoofing("packer-test", true); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "On")
+}
+
+func TestAddVirtualMachineNetworkAdapter(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := AddVirtualMachineNetworkAdapter("packer-test", "Network Adapter 2", "Internal Switch"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "Network Adapter 2", "Internal Switch")
+}
+
+func TestSetVirtualMachineNetworkAdapterVlanId(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := SetVirtualMachineNetworkAdapterVlanId("packer-test", "Network Adapter 2", "42"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "Network Adapter 2", "42")
+}
+
+func TestSetVirtualMachineNetworkAdapterMacAddress(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := SetVirtualMachineNetworkAdapterMacAddress("packer-test", "Network Adapter 2", "00155D010203"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "Network Adapter 2", "00155D010203")
+}
+
+func TestDisconnectVirtualMachineNetworkAdapter(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := DisconnectVirtualMachineNetworkAdapter("packer-test", "Network Adapter 2"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "Network Adapter 2")
+}
+
+func TestSetBootDvdDrive(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := SetBootDvdDrive("packer-test", 0, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "0", "1")
+}
+
+func TestStartVirtualMachine_error(t *testing.T) {
+	host := &testHost{
+		stderr:   psError("Start-VM", "'packer-test' failed to start.", "NotSpecified: (:) [Start-VM], VirtualizationException"),
+		exitCode: 1,
+	}
+	defer host.use()()
+
+	err := StartVirtualMachine("packer-test")
+	if err == nil {
+		t.Fatal("should have error")
+	}
+	if !strings.HasPrefix(err.Error(), "PowerShell exited with code 1: Start-VM : 'packer-test' failed to start.") {
+		t.Fatalf("bad error: %s", err)
+	}
+}
+
+func TestCreateDvdDrive(t *testing.T) {
+	host := &testHost{stdout: "1,1\r\n"}
+	defer host.use()()
+
+	controllerNumber, controllerLocation, err := CreateDvdDrive("packer-test", `C:\Windows\system32\vmguest.iso`)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if controllerNumber != 1 || controllerLocation != 1 {
+		t.Fatalf("bad controller: %d:%d", controllerNumber, controllerLocation)
+	}
+	host.checkParams(t, "packer-test", `C:\Windows\system32\vmguest.iso`)
+}
+
+func TestDeleteDvdDrive(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	if err := DeleteDvdDrive("packer-test", 1, 1); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	host.checkParams(t, "packer-test", "1", "1")
+}
+
+func TestGetExternalOnlineVirtualSwitch(t *testing.T) {
+	host := &testHost{stdout: "External Switch\r\n"}
+	defer host.use()()
+
+	switchName, err := GetExternalOnlineVirtualSwitch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if switchName != "External Switch" {
+		t.Fatalf("bad switch: %s", switchName)
+	}
+}
+
+func TestGetExternalOnlineVirtualSwitch_none(t *testing.T) {
+	host := &testHost{}
+	defer host.use()()
+
+	switchName, err := GetExternalOnlineVirtualSwitch()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if switchName != "" {
+		t.Fatalf("bad switch: %s", switchName)
+	}
+}
+
+func TestGetVirtualMachineNetworkAdapterAddress(t *testing.T) {
+	host := &testHost{stdout: "192.168.1.42\r\n"}
+	defer host.use()()
+
+	ip, err := GetVirtualMachineNetworkAdapterAddress("packer-test", "Network Adapter")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ip != "192.168.1.42" {
+		t.Fatalf("bad ip: %s", ip)
+	}
+	host.checkParams(t, "packer-test", "Network Adapter", "0")
+}
+
+func TestParseControllerProperties(t *testing.T) {
+	if _, _, err := parseControllerProperties("1"); err == nil {
+		t.Fatal("should error without a location")
+	}
+	if _, _, err := parseControllerProperties("a,1"); err == nil {
+		t.Fatal("should error on a bad number")
+	}
+}
@@ -5,15 +5,14 @@
 package powershell
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"io"
+	"io/ioutil"
 	"os"
-	"os/exec"
 	"strings"
 	"bytes"
-	"io/ioutil"
-	"strconv"
 )
 
 const (
@@ -24,6 +23,12 @@ const (
 type PowerShellCmd struct {
 	Stdout io.Writer
 	Stderr io.Writer
+	// The stdin of the script run by Execute, if any. The Executor must
+	// then be a StdinExecutor.
+	Stdin io.Reader
+	// The Executor that runs the scripts. DefaultExecutor is used if
+	// this is nil.
+	Executor Executor
 }
 
 func (ps *PowerShellCmd) Run(fileContents string, params ...string) error {
@@ -33,52 +38,39 @@ func (ps *PowerShellCmd) Run(fileContents string, params ...string) error {
 
 // Output runs the PowerShell command and returns its standard output. 
 func (ps *PowerShellCmd) Output(fileContents string, params ...string) (string, error) {
-	path, err := ps.getPowerShellPath();
-	if err != nil {
-		return "", nil
-	}
-
-	filename, err := saveScript(fileContents);
+	executor, err := ps.getExecutor()
 	if err != nil {
 		return "", err
 	}
 
-	debug := os.Getenv("PACKER_POWERSHELL_DEBUG") != ""
-	verbose := debug || os.Getenv("PACKER_POWERSHELL_VERBOSE") != ""
-
-	if !debug {
-		defer os.Remove(filename)
-	}
-	
-	args := createArgs(filename, params...)
-
-	if verbose {
-		log.Printf("Run: %s %s", path, args)
-	}
+	verbose := os.Getenv("PACKER_POWERSHELL_DEBUG") != "" || os.Getenv("PACKER_POWERSHELL_VERBOSE") != ""
 
 	var stdout, stderr bytes.Buffer
-	command := exec.Command(path, args...)
-	command.Stdout = &stdout
-	command.Stderr = &stderr
-
-	err = command.Run()
+	exitCode, err := executor.Execute(fileContents, params, &stdout, &stderr)
+	if err != nil {
+		return "", err
+	}
 
 	if ps.Stdout != nil {
-		stdout.WriteTo(ps.Stdout)
+		ps.Stdout.Write(stdout.Bytes())
 	}
 
 	if ps.Stderr != nil {
-		stderr.WriteTo(ps.Stderr)
+		ps.Stderr.Write(stderr.Bytes())
 	}
 
 	stderrString := strings.TrimSpace(stderr.String())
 
-	if _, ok := err.(*exec.ExitError); ok {
-		err = fmt.Errorf("PowerShell error: %s", stderrString)
-	}
-
-	if len(stderrString) > 0 {
-		err = fmt.Errorf("PowerShell error: %s", stderrString)
+	// a script fails by its exit code or by anything written to stderr
+	if exitCode != 0 || len(stderrString) > 0 {
+		message := "PowerShell error"
+		if exitCode != 0 {
+			message = fmt.Sprintf("PowerShell exited with code %d", exitCode)
+		}
+		if len(stderrString) > 0 {
+			message += ": " + stderrString
+		}
+		err = errors.New(message)
 	}
 
 	stdoutString := strings.TrimSpace(stdout.String())
@@ -96,69 +88,46 @@ func (ps *PowerShellCmd) Output(fileContents string, params ...string) (string,
 	return stdoutString, err;	
 }
 
-func (ps *PowerShellCmd) getPowerShellPath() (string, error) {
-	path, err := exec.LookPath("powershell")
+// Execute runs the PowerShell command, feeding it Stdin if set, writing
+// its output to Stdout and Stderr as it is produced, and returns its exit
+// code. Unlike Run and Output, anything written to stderr is not treated
+// as a failure.
+func (ps *PowerShellCmd) Execute(fileContents string, params ...string) (int, error) {
+	executor, err := ps.getExecutor()
 	if err != nil {
-		log.Fatal("Cannot find PowerShell in the path", err)
-		return "", err
+		return 0, err
 	}
 
-	return path, nil
-}
-
-func saveScript(fileContents string) (string, error) {
-	file, err := ioutil.TempFile(os.TempDir(), "ps")
-	if err != nil {
-		return "", err
-	}
-	
-	_, err = file.Write([]byte(fileContents))
-	if err != nil {
-		return "", err
+	stdout := ps.Stdout
+	if stdout == nil {
+		stdout = ioutil.Discard
 	}
 
-	err = file.Close()
-	if err != nil {
-		return "", err
+	stderr := ps.Stderr
+	if stderr == nil {
+		stderr = ioutil.Discard
 	}
 
-	newFilename := file.Name() + ".ps1"
-	err = os.Rename(file.Name(), newFilename)
-	if err != nil {
-		return "", err
+	if ps.Stdin == nil {
+		return executor.Execute(fileContents, params, stdout, stderr)
 	}
 
-	return newFilename, nil
-}
-
-func createArgs(filename string, params ...string) []string {
-	args := make([]string,len(params)+4)
-	args[0] = "-ExecutionPolicy"
-	args[1] = "Bypass"
-
-	args[2] = "-File"
-	args[3] = filename
-
-	for key, value := range params {
-		args[key+4] = value
-	}	
+	stdinExecutor, ok := executor.(StdinExecutor)
+	if !ok {
+		return 0, fmt.Errorf("The PowerShell executor %T cannot give a script a stdin", executor)
+	}
 
-	return args;
+	return stdinExecutor.ExecuteStdin(fileContents, params, ps.Stdin, stdout, stderr)
 }
 
-func GetHostAvailableMemory() float64 {
-
-	var script = "(Get-WmiObject Win32_OperatingSystem).FreePhysicalMemory / 1024"
-
-	var ps PowerShellCmd
-	output, _ := ps.Output(script)
-
-	freeMB, _ := strconv.ParseFloat(output, 64)
+func (ps *PowerShellCmd) getExecutor() (Executor, error) {
+	if ps.Executor != nil {
+		return ps.Executor, nil
+	}
 
-	return freeMB
+	return defaultExecutor()
 }
 
-
 func GetHostName(ip string) (string, error) {
 
 	var script = `
@@ -1,20 +1,27 @@
-
-
 package powershell
 
 import (
 	"bytes"
+	"io"
+	"strconv"
+	"strings"
 	"testing"
 )
 
-func TestOutputScriptBlock(t *testing.T) {
-
-	ps, err := powershell.Command()
+func testPowerShell(t *testing.T) *PowerShellCmd {
+	executor, err := defaultExecutor()
 	if err != nil {
-		t.Fatalf("should not have error: %s", err)
+		t.Skipf("skipping: %s", err)
 	}
 
-	trueOutput, err := powershell.OutputScriptBlock("$True")
+	return &PowerShellCmd{Executor: executor}
+}
+
+func TestOutputScriptBlock(t *testing.T) {
+
+	powershell := testPowerShell(t)
+
+	trueOutput, err := powershell.Output("$True")
 	if err != nil {
 		t.Fatalf("should not have error: %s", err)
 	}
@@ -23,7 +30,7 @@ func TestOutputScriptBlock(t *testing.T) {
 		t.Fatalf("output '%v' is not 'True'", trueOutput)
 	}
 
-	falseOutput, err := powershell.OutputScriptBlock("$False")
+	falseOutput, err := powershell.Output("$False")
 	if err != nil {
 		t.Fatalf("should not have error: %s", err)
 	}
@@ -34,39 +41,112 @@ func TestOutputScriptBlock(t *testing.T) {
 }
 
 func TestRunScriptBlock(t *testing.T) {
-	powershell, err := powershell.Command()
+	powershell := testPowerShell(t)
+
+	err := powershell.Run("$True")
 	if err != nil {
 		t.Fatalf("should not have error: %s", err)
 	}
-
-	err = powershell.RunScriptBlock("$True")
 }
 
 func TestVersion(t *testing.T) {
-	powershell, err := powershell.Command()
-	version, err := powershell.Version();
+	powershell := testPowerShell(t)
+
+	output, err := powershell.Output("$host.version.Major")
+	if err != nil {
+		t.Fatalf("should not have error: %s", err)
+	}
+
+	version, err := strconv.Atoi(output)
 	if err != nil {
 		t.Fatalf("should not have error: %s", err)
 	}
 
-	if (version != 4) {
-		t.Fatalf("expected version 4")
+	if version < 4 {
+		t.Fatalf("expected version 4 or higher")
 	}
 }
 
 func TestRunFile(t *testing.T) {
-	powershell, err := powershell.Command()
+	powershell := testPowerShell(t)
+
+	var blockBuffer bytes.Buffer
+	blockBuffer.WriteString("param([string]$a, [string]$b, [int]$x, [int]$y) $n = $x + $y; Write-Host $a, $b, $n")
+
+	err := powershell.Run(blockBuffer.String(), "a", "b", "5", "10")
+
 	if err != nil {
 		t.Fatalf("should not have error: %s", err)
 	}
 
-	var blockBuffer bytes.Buffer
-	blockBuffer.WriteString("param([string]$a, [string]$b, [int]$x, [int]$y) $n = $x + $y; Write-Host $a, $b, $n")
+}
+
+func TestOutput_exitCode(t *testing.T) {
+	ps := &PowerShellCmd{
+		Executor: executorFunc(func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+			io.WriteString(stdout, "partial\n")
+			return 1, nil
+		}),
+	}
+
+	output, err := ps.Output("exit 1")
+	if err == nil || err.Error() != "PowerShell exited with code 1" {
+		t.Fatalf("bad error: %v", err)
+	}
+
+	if output != "partial" {
+		t.Fatalf("bad output: %q", output)
+	}
+}
+
+func TestOutput_stderr(t *testing.T) {
+	ps := &PowerShellCmd{
+		Executor: executorFunc(func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+			io.WriteString(stderr, "Write-Error : failed\r\n")
+			return 0, nil
+		}),
+	}
+
+	_, err := ps.Output("Write-Error failed")
+	if err == nil || err.Error() != "PowerShell error: Write-Error : failed" {
+		t.Fatalf("bad error: %v", err)
+	}
+}
 
-	err = powershell.Run(blockBuffer.String(), "a", "b", "5", "10")
+func TestExecute_streams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	ps := &PowerShellCmd{
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Executor: executorFunc(func(script string, params []string, out io.Writer, err io.Writer) (int, error) {
+			if out != &stdout || err != &stderr {
+				t.Fatal("output should be written directly to the writers")
+			}
+			io.WriteString(err, "warning\n")
+			return 3, nil
+		}),
+	}
 
+	exitCode, err := ps.Execute("exit 3")
 	if err != nil {
 		t.Fatalf("should not have error: %s", err)
 	}
 
+	if exitCode != 3 || stderr.String() != "warning\n" {
+		t.Fatalf("bad: %d %q", exitCode, stderr.String())
+	}
+}
+
+func TestExecute_stdinNotSupported(t *testing.T) {
+	ps := &PowerShellCmd{
+		Stdin: strings.NewReader("input\n"),
+		Executor: executorFunc(func(script string, params []string, stdout io.Writer, stderr io.Writer) (int, error) {
+			t.Fatal("should not run the script")
+			return 0, nil
+		}),
+	}
+
+	if _, err := ps.Execute("$input"); err == nil {
+		t.Fatal("should have error")
+	}
 }
@@ -133,19 +133,11 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 
 	// check the remote connection is ready
 		{
-			var cmd packer.RemoteCmd
-			stdout := new(bytes.Buffer)
-			stderr := new(bytes.Buffer)
-
 			magicWord := "ready"
 
 			var blockBuffer bytes.Buffer
 			blockBuffer.WriteString("{ Write-Host '"+ magicWord +"' }")
 
-			cmd.Command = "-ScriptBlock " + blockBuffer.String()
-			cmd.Stdout = stdout
-			cmd.Stderr = stderr
-
 			count := 5
 			var duration time.Duration = 1
 			sleepTime := time.Minute * duration
@@ -153,10 +145,19 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 			ui.Say("Checking PS remoting is ready...")
 
 			for count > 0 {
+				var cmd packer.RemoteCmd
+				stdout := new(bytes.Buffer)
+				stderr := new(bytes.Buffer)
+
+				cmd.Command = "-ScriptBlock " + blockBuffer.String()
+				cmd.Stdout = stdout
+				cmd.Stderr = stderr
+
 				err = comm.Start(&cmd)
 				if err != nil {
 					return err
 				}
+				cmd.Wait()
 
 				stderrString := strings.TrimSpace(stderr.String())
 				stdoutString := strings.TrimSpace(stdout.String())
@@ -196,6 +197,10 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		cmd.Stderr = stderr
 
 		err = comm.Start(&cmd)
+		if err != nil {
+			return err
+		}
+		cmd.Wait()
 
 		stderrString := strings.TrimSpace(stderr.String())
 		stdoutString := strings.TrimSpace(stdout.String())
@@ -205,6 +210,8 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 
 		if len(stderrString) > 0 {
 			err = fmt.Errorf("Provision error: %s", stderrString)
+		} else if cmd.ExitStatus != 0 {
+			err = fmt.Errorf("Provision error: exit status %d", cmd.ExitStatus)
 		}
 
 		ui.Say(stdoutString)
@@ -220,6 +227,10 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 		cmd.Stderr = stderr
 
 		err = comm.Start(&cmd)
+		if err != nil {
+			return err
+		}
+		cmd.Wait()
 
 		stderrString := strings.TrimSpace(stderr.String())
 		stdoutString := strings.TrimSpace(stdout.String())
@@ -229,6 +240,8 @@ func (p *Provisioner) Provision(ui packer.Ui, comm packer.Communicator) error {
 
 		if len(stderrString) > 0 {
 			err = fmt.Errorf("Provision error: %s", stderrString)
+		} else if cmd.ExitStatus != 0 {
+			err = fmt.Errorf("Provision error: exit status %d", cmd.ExitStatus)
 		}
 
 		ui.Say(stdoutString)